@@ -49,6 +49,14 @@ type Batcher struct {
 
 	// remainLogs store the logs that split by barrier and haven't been consumed yet.
 	remainLogs []*oplog.GenericOplog
+
+	// the oplogs after stopPosition(unit: seconds) are dropped if it isn't zero.
+	// reachStop is set once any of them is fetched
+	stopPosition int64
+	reachStop    bool
+
+	// number of seek markers met since the syncer begins seeking
+	seekMarkers int
 }
 
 func NewBatcher(syncer *OplogSyncer, filterList filter.OplogFilterChain,
@@ -59,6 +67,7 @@ func NewBatcher(syncer *OplogSyncer, filterList filter.OplogFilterChain,
 		handler:          handler,
 		workerGroup:      workerGroup,
 		lastResponseTime: time.Now(),
+		stopPosition:     conf.Options.ContextStopPosition,
 	}
 }
 
@@ -84,9 +93,28 @@ func (batcher *Batcher) filter(log *oplog.PartialLog) bool {
 			log, utils.TimestampToLog(log.Timestamp), utils.TimestampToLog(batcher.syncer.fullSyncFinishPosition))
 		return false
 	}
+
+	// the oplogs synced again after backfill or recovery are applied as usual,
+	// the copied documents may be inconsistent with the DDL during the copy
+	if (moveChunkFilter.Filter(log) || ddlFilter.Filter(log)) && !isTransaction(log) &&
+		batcher.syncer.getReplayWindow().copied(log) {
+		LOG.Warn("ddl or move chunk oplog found[%v] on the copied namespace when oplog timestamp[%v] "+
+			"is less than the copy finish position, apply it again", log, utils.TimestampToLog(log.Timestamp))
+	}
 	return false
 }
 
+// isTransaction returns whether the command oplog carries the writes of
+// transaction, which are applied as the other writes
+func isTransaction(log *oplog.PartialLog) bool {
+	if log.Operation != "c" || len(log.Object) == 0 {
+		return false
+	}
+	// commitTransaction of prepared transaction since 4.2
+	name := log.Object[0].Name
+	return name == "applyOps" || name == "commitTransaction"
+}
+
 func (batcher *Batcher) dispatchBatch(nextBatch []*oplog.GenericOplog) (work bool) {
 	batchGroup := make([][]*oplog.GenericOplog, len(batcher.workerGroup))
 
@@ -112,6 +140,8 @@ func (batcher *Batcher) dispatchBatch(nextBatch []*oplog.GenericOplog) (work boo
  * return the last oplog, if the current batch is empty(first oplog in this batch is ddl),
  * just return the last oplog in the previous batch.
  * if just start, this is nil.
+ * return nil if a seek marker is met at first, the batches after marker are
+ * never merged.
  */
 func (batcher *Batcher) Next() []*oplog.GenericOplog {
 	// picked raw oplogs and batching in sequence
@@ -124,12 +154,21 @@ func (batcher *Batcher) Next() []*oplog.GenericOplog {
 		nextBatch = <-syncer.logsQueue[batcher.currentQueue()]
 		// move to next available logs queue
 		batcher.moveToNextQueue()
+		if nextBatch == nil {
+			batcher.seekMarkers++
+			return nil
+		}
 		for len(nextBatch) < conf.Options.AdaptiveBatchingMaxSize &&
 			len(syncer.logsQueue[batcher.currentQueue()]) > 0 {
 			// there has more pushed oplogs in next logs queue (read can't to be block)
 			// Hence, we fetch them by the way. and merge together
-			nextBatch = append(nextBatch, <-syncer.logsQueue[batcher.nextQueue]...)
+			batch := <-syncer.logsQueue[batcher.nextQueue]
 			batcher.moveToNextQueue()
+			if batch == nil {
+				batcher.seekMarkers++
+				break
+			}
+			nextBatch = append(nextBatch, batch...)
 		}
 	} else {
 		// remainLogs isn't empty
@@ -148,6 +187,15 @@ func (batcher *Batcher) filterAndBlockMoveChunk(nextBatch []*oplog.GenericOplog,
 	var filteredNextBatch []*oplog.GenericOplog
 	lastUnSyncTs := batcher.unsyncTs
 	for i, genericLog := range nextBatch {
+		// drop the oplogs after stop position, no more oplogs will be synced
+		if batcher.stopPosition != 0 && utils.ExtractTs32(genericLog.Parsed.Timestamp) > batcher.stopPosition {
+			LOG.Info("oplog syncer %v reach stop position[%v] with oplog[%v]", syncer.replset,
+				batcher.stopPosition, utils.TimestampToLog(genericLog.Parsed.Timestamp))
+			batcher.reachStop = true
+			batcher.remainLogs = nil
+			break
+		}
+
 		if genericLog.Parsed.Timestamp > batcher.unsyncTs {
 			lastUnSyncTs = batcher.unsyncTs
 			batcher.unsyncTs = genericLog.Parsed.Timestamp
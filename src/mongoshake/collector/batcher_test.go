@@ -482,3 +482,36 @@ func TestFilterPartialLog(t *testing.T) {
 		}), log, "should be equal")
 	}
 }
+
+func TestReplayWindow(t *testing.T) {
+	// test replayWindow
+
+	var nr int
+	{
+		fmt.Printf("TestReplayWindow case %d.\n", nr)
+		nr++
+
+		syncer := mockSyncer()
+		batcher := &Batcher{syncer: syncer}
+		drop := &oplog.PartialLog{Timestamp: 10, Operation: "c", Namespace: "db1.$cmd",
+			Object: bson.D{{"drop", "c1"}}}
+		assert.Equal(t, false, syncer.getReplayWindow().copied(drop), "should be equal")
+
+		// only db1 is copied
+		syncer.setReplayWindow(&replayWindow{finishTs: 20,
+			filterList: filter.DocFilterChain{filter.NewNamespaceFilter([]string{"db1"}, nil)}})
+		assert.Equal(t, true, syncer.getReplayWindow().copied(drop), "should be equal")
+		// ddl in the window doesn't stop the syncer
+		assert.Equal(t, false, batcher.filter(drop), "should be equal")
+
+		rename := &oplog.PartialLog{Timestamp: 10, Operation: "c", Namespace: "db2.$cmd",
+			Object: bson.D{{"renameCollection", "db2.c1"}, {"to", "db2.c2"}}}
+		assert.Equal(t, false, syncer.getReplayWindow().copied(rename), "should be equal")
+		drop.Timestamp = 30
+		assert.Equal(t, false, syncer.getReplayWindow().copied(drop), "should be equal")
+
+		// all namespaces are copied
+		syncer.setReplayWindow(&replayWindow{finishTs: 20})
+		assert.Equal(t, true, syncer.getReplayWindow().copied(rename), "should be equal")
+	}
+}
@@ -1,14 +1,16 @@
 package collector
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	nimo "github.com/gugemichael/nimo4go"
 	LOG "github.com/vinllen/log4go"
-	"github.com/vinllen/mgo"
 	"github.com/vinllen/mgo/bson"
 	"mongoshake/collector/configure"
+	"mongoshake/collector/oplogsyncer"
 	utils "mongoshake/common"
+	"mongoshake/executor"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -16,10 +18,15 @@ import (
 )
 
 const (
-	StorageTypeAPI = "api"
-	StorageTypeDB  = "database"
+	StorageTypeAPI  = utils.StorageTypeAPI
+	StorageTypeDB   = utils.StorageTypeDB
+	StorageTypeFile = utils.StorageTypeFile
 
 	CheckpointMoveChunkIntervalMS = 5000
+
+	CheckpointHistoryTime = "time"
+	// wait at most so long for setting the position of syncer
+	SetPositionTimeout = 30 * time.Second
 )
 
 type Persist interface {
@@ -37,11 +44,21 @@ type CheckpointManager struct {
 	db            string
 	table         string
 	startPosition int64
-	conn          *utils.MongoConn
+	storage       utils.CheckpointStorage
+
+	// replset -> flushed checkpoints ordered by time, at most
+	// checkpoint.history.size for each replset
+	history map[string][]*CheckpointHistory
 
 	persistList []Persist
 }
 
+// CheckpointHistory is the ackTs of replset flushed at Time(unix seconds)
+type CheckpointHistory struct {
+	AckTs bson.MongoTimestamp
+	Time  int64
+}
+
 func NewCheckpointManager(startPosition int64) *CheckpointManager {
 	manager := &CheckpointManager{
 		syncMap:       make(map[string]*OplogSyncer),
@@ -50,6 +67,7 @@ func NewCheckpointManager(startPosition int64) *CheckpointManager {
 		db:            utils.AppDatabase(),
 		table:         conf.Options.ContextStorageCollection,
 		startPosition: startPosition,
+		history:       make(map[string][]*CheckpointHistory),
 	}
 	manager.persistList = append(manager.persistList, manager)
 	return manager
@@ -121,81 +139,77 @@ func (manager *CheckpointManager) LoadAll() error {
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
 
-	conn := manager.conn
-	db := manager.db
 	// obtain checkpoint stage
-	var versionDoc map[string]interface{}
-	if err := manager.conn.Session.DB(manager.db).C(manager.table).
-		Find(bson.M{}).One(&versionDoc); err != nil && err != mgo.ErrNotFound {
-		manager.conn.Close()
-		manager.conn = nil
+	stage, err := utils.LoadCheckpointStage(manager.storage, manager.table)
+	if err != nil {
+		manager.closeStorage()
 		return LOG.Critical("CheckpointManager LoadAll versionDoc error. %v", err)
 	}
-	stage, ok := versionDoc[utils.CheckpointStage]
-	if ok {
-		switch stage {
-		case utils.StageOriginal:
-			// drop tmp table
-			for _, persist := range manager.persistList {
-				tablePrefix := "tmp_" + manager.table
-				for _, tmpTable := range persist.GetTableList(tablePrefix) {
-					if err := conn.Session.DB(db).C(tmpTable).DropCollection(); err != nil && err.Error() != "ns not found" {
-						manager.conn.Close()
-						manager.conn = nil
-						return LOG.Critical("CheckpointManager LoadAll drop collection %v failed. %v", tmpTable, err)
-					}
-				}
-			}
-		case utils.StageFlushed:
-			// drop original table
-			for _, persist := range manager.persistList {
-				for _, origTable := range persist.GetTableList(manager.table) {
-					if err := conn.Session.DB(db).C(origTable).DropCollection(); err != nil && err.Error() != "ns not found" {
-						manager.conn.Close()
-						manager.conn = nil
-						return LOG.Critical("CheckpointManager LoadAll drop collection %v failed. %v", origTable, err)
-					}
-				}
-			}
-			fallthrough
-		case utils.StageRename:
-			// rename tmp table to original table
-			for _, persist := range manager.persistList {
-				for _, origTable := range persist.GetTableList(manager.table) {
-					origNs := fmt.Sprintf("%v.%v", manager.db, origTable)
-					tmpNs := fmt.Sprintf("%v.tmp_%v", manager.db, origTable)
-					if err := conn.Session.DB("admin").
-						Run(bson.D{{"renameCollection", tmpNs}, {"to", origNs}}, nil); err != nil && err.Error() != "source namespace does not exist" {
-						manager.conn.Close()
-						manager.conn = nil
-						return LOG.Critical("CheckpointManager LoadAll rename collection %v to %v failed. %v", tmpNs, origNs, err)
-					}
-				}
-			}
-		default:
-			return LOG.Critical("CheckpointManager LoadAll no checkpoint")
+	if stage != "" {
+		if err := manager.recover(stage); err != nil {
+			manager.closeStorage()
+			return LOG.Critical("CheckpointManager LoadAll %v", err)
 		}
 	}
 	for _, persist := range manager.persistList {
 		if err := persist.Load(manager.table); err != nil {
-			manager.conn.Close()
-			manager.conn = nil
+			manager.closeStorage()
 			return LOG.Critical("CheckpointManager LoadAll persist load error %v", err)
 		}
 	}
-	if _, err := manager.conn.Session.DB(manager.db).C(manager.table).
-		Upsert(bson.M{}, bson.M{utils.CheckpointStage: utils.StageOriginal}); err != nil {
-		manager.conn.Close()
-		manager.conn = nil
+	if err := manager.setStage(utils.StageOriginal); err != nil {
+		manager.closeStorage()
 		return LOG.Critical("CheckpointManager LoadAll upsert versionDoc error. %v", err)
 	}
 	return nil
 }
 
+// recover finishes or rolls back the interrupted flush by stage
+func (manager *CheckpointManager) recover(stage string) error {
+	switch stage {
+	case utils.StageOriginal:
+		// drop tmp table
+		for _, persist := range manager.persistList {
+			for _, tmpTable := range persist.GetTableList("tmp_" + manager.table) {
+				if err := manager.storage.Drop(tmpTable); err != nil {
+					return fmt.Errorf("drop table %v failed. %v", tmpTable, err)
+				}
+			}
+		}
+	case utils.StageFlushed:
+		// drop original table
+		for _, persist := range manager.persistList {
+			for _, origTable := range persist.GetTableList(manager.table) {
+				if err := manager.storage.Drop(origTable); err != nil {
+					return fmt.Errorf("drop table %v failed. %v", origTable, err)
+				}
+			}
+		}
+		fallthrough
+	case utils.StageRename:
+		// rename tmp table to original table
+		for _, persist := range manager.persistList {
+			for _, origTable := range persist.GetTableList(manager.table) {
+				if err := manager.storage.Rename("tmp_"+origTable, origTable); err != nil {
+					return fmt.Errorf("rename table tmp_%v to %v failed. %v", origTable, origTable, err)
+				}
+			}
+		}
+	default:
+		return errors.New("no checkpoint")
+	}
+	return nil
+}
+
 func (manager *CheckpointManager) Load(tablePrefix string) error {
-	iter := manager.conn.Session.DB(manager.db).C(tablePrefix + "_oplog").Find(bson.M{}).Iter()
-	ckptDoc := make(map[string]interface{})
-	for iter.Next(ckptDoc) {
+	if err := manager.loadHistory(tablePrefix); err != nil {
+		return err
+	}
+	docs, err := manager.storage.Load(tablePrefix + "_oplog")
+	if err != nil {
+		return err
+	}
+	for _, ckptDoc := range docs {
 		replset, ok1 := ckptDoc[utils.CheckpointName].(string)
 		ackTs, ok2 := ckptDoc[utils.CheckpointAckTs].(bson.MongoTimestamp)
 		syncTs, ok3 := ckptDoc[utils.CheckpointSyncTs].(bson.MongoTimestamp)
@@ -211,13 +225,16 @@ func (manager *CheckpointManager) Load(tablePrefix string) error {
 				worker.unack = int64(ackTs)
 				worker.ack = int64(ackTs)
 			}
+			// change stream resumes after the token rather than ackTs
+			if reader, ok := syncer.reader.(*oplogsyncer.ChangeStreamReader); ok {
+				if token, ok := ckptDoc[utils.CheckpointResumeToken]; ok {
+					reader.SetResumeToken(token)
+				}
+			}
 			LOG.Info("CheckpointManager load checkpoint set replset[%v] checkpoint to exist ackTs[%v] syncTs[%v]",
 				replset, utils.TimestampToLog(ackTs), utils.TimestampToLog(syncTs))
 		}
 	}
-	if err := iter.Close(); err != nil {
-		LOG.Critical("CheckpointManager close iterator failed. %v", err)
-	}
 	for replset, syncer := range manager.syncMap {
 		// there is no checkpoint before or this is a new node
 		if syncer.batcher.syncTs == 0 {
@@ -232,6 +249,43 @@ func (manager *CheckpointManager) Load(tablePrefix string) error {
 				replset, utils.TimestampToLog(startTs))
 		}
 	}
+	if conf.Options.ReplayerExactlyOnce {
+		return manager.loadApplied()
+	}
+	return nil
+}
+
+// loadApplied moves the ack of each worker forward to the timestamp applied
+// in the target, so the syncer resumes from the target-side position. The
+// worker i writes the target conf.Options.TunnelAddress[i % len]
+func (manager *CheckpointManager) loadApplied() error {
+	appliedMap := make(map[uint32]bson.MongoTimestamp)
+	for i, url := range conf.Options.TunnelAddress {
+		conn, err := utils.NewMongoConn(url, utils.ConnectModePrimary, true)
+		if err != nil {
+			return fmt.Errorf("CheckpointManager connect to target %v failed. %v", url, err)
+		}
+		applied, err := executor.LoadAppliedTs(conn.Session)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("CheckpointManager load applied timestamp from target %v failed. %v", url, err)
+		}
+		for id, ts := range applied {
+			if int(id)%len(conf.Options.TunnelAddress) == i {
+				appliedMap[id] = ts
+			}
+		}
+	}
+	for replset, syncer := range manager.syncMap {
+		for _, worker := range syncer.batcher.workerGroup {
+			if ts, ok := appliedMap[worker.id]; ok && int64(ts) > worker.ack {
+				worker.unack = int64(ts)
+				worker.ack = int64(ts)
+				LOG.Info("CheckpointManager load checkpoint set replset[%v] worker[%v] checkpoint to applied %v",
+					replset, worker.id, utils.TimestampToLog(ts))
+			}
+		}
+	}
 	return nil
 }
 
@@ -242,75 +296,60 @@ func (manager *CheckpointManager) FlushAll() error {
 	manager.mutex.Lock()
 	defer manager.mutex.Unlock()
 
-	conn := manager.conn
-	db := manager.db
 	// Original Stage: drop tmp table and do checkpoint
-	if _, err := manager.conn.Session.DB(manager.db).C(manager.table).
-		Upsert(bson.M{}, bson.M{utils.CheckpointStage: utils.StageOriginal}); err != nil {
-		manager.conn.Close()
-		manager.conn = nil
+	if err := manager.setStage(utils.StageOriginal); err != nil {
+		manager.closeStorage()
 		return LOG.Critical("CheckpointManager FlushAll upsert versionDoc error. %v", err)
 	}
 	for _, persist := range manager.persistList {
 		tablePrefix := "tmp_" + manager.table
 		for _, tmpTable := range persist.GetTableList(tablePrefix) {
-			if err := conn.Session.DB(db).C(tmpTable).DropCollection(); err != nil && err.Error() != "ns not found" {
-				manager.conn.Close()
-				manager.conn = nil
-				return LOG.Critical("CheckpointManager FlushAll drop collection %v failed. %v", tmpTable, err)
+			if err := manager.storage.Drop(tmpTable); err != nil {
+				manager.closeStorage()
+				return LOG.Critical("CheckpointManager FlushAll drop table %v failed. %v", tmpTable, err)
 			}
 		}
 		if err := persist.Flush(tablePrefix); err != nil {
-			manager.conn.Close()
-			manager.conn = nil
+			manager.closeStorage()
 			return LOG.Critical("CheckpointManager FlushAll persist flush error %v", err)
 		}
 	}
 	// Flushed Stage: drop original table
-	if _, err := manager.conn.Session.DB(manager.db).C(manager.table).
-		Upsert(bson.M{}, bson.M{utils.CheckpointStage: utils.StageFlushed}); err != nil {
-		manager.conn.Close()
-		manager.conn = nil
+	if err := manager.setStage(utils.StageFlushed); err != nil {
+		manager.closeStorage()
 		return LOG.Critical("CheckpointManager FlushAll upsert versionDoc error. %v", err)
 	}
 	for _, persist := range manager.persistList {
 		for _, origTable := range persist.GetTableList(manager.table) {
-			if err := conn.Session.DB(db).C(origTable).DropCollection(); err != nil && err.Error() != "ns not found" {
-				manager.conn.Close()
-				manager.conn = nil
-				return LOG.Critical("CheckpointManager FlushAll drop collection %v failed. %v", origTable, err)
+			if err := manager.storage.Drop(origTable); err != nil {
+				manager.closeStorage()
+				return LOG.Critical("CheckpointManager FlushAll drop table %v failed. %v", origTable, err)
 			}
 		}
 	}
 	// Rename Stage: rename tmp table to original table
-	if _, err := manager.conn.Session.DB(manager.db).C(manager.table).
-		Upsert(bson.M{}, bson.M{utils.CheckpointStage: utils.StageRename}); err != nil {
-		manager.conn.Close()
-		manager.conn = nil
+	if err := manager.setStage(utils.StageRename); err != nil {
+		manager.closeStorage()
 		return LOG.Critical("CheckpointManager FlushAll upsert versionDoc error. %v", err)
 	}
 	for _, persist := range manager.persistList {
 		for _, origTable := range persist.GetTableList(manager.table) {
-			origNs := fmt.Sprintf("%v.%v", manager.db, origTable)
-			tmpNs := fmt.Sprintf("%v.tmp_%v", manager.db, origTable)
-			if err := conn.Session.DB("admin").
-				Run(bson.D{{"renameCollection", tmpNs}, {"to", origNs}}, nil); err != nil && err.Error() != "source namespace does not exist" {
-				manager.conn.Close()
-				manager.conn = nil
-				return LOG.Critical("CheckpointManager FlushAll rename collection %v to %v failed. %v", tmpNs, origNs, err)
+			if err := manager.storage.Rename("tmp_"+origTable, origTable); err != nil {
+				manager.closeStorage()
+				return LOG.Critical("CheckpointManager FlushAll rename table tmp_%v to %v failed. %v",
+					origTable, origTable, err)
 			}
 		}
 	}
-	if _, err := manager.conn.Session.DB(manager.db).C(manager.table).
-		Upsert(bson.M{}, bson.M{utils.CheckpointStage: utils.StageOriginal}); err != nil {
-		manager.conn.Close()
-		manager.conn = nil
+	if err := manager.setStage(utils.StageOriginal); err != nil {
+		manager.closeStorage()
 		return LOG.Critical("CheckpointManager FlushAll upsert versionDoc error. %v", err)
 	}
 	return nil
 }
 
 func (manager *CheckpointManager) Flush(tablePrefix string) error {
+	var buffer []interface{}
 	for replset, syncer := range manager.syncMap {
 		ackTs := manager.Get(replset)
 		syncTs := syncer.batcher.syncTs
@@ -329,36 +368,177 @@ func (manager *CheckpointManager) Flush(tablePrefix string) error {
 			utils.CheckpointAckTs:  ackTs,
 			utils.CheckpointSyncTs: syncTs,
 		}
-		if _, err := manager.conn.Session.DB(manager.db).C(tablePrefix+"_oplog").
-			Upsert(bson.M{utils.CheckpointName: replset}, ckptDoc); err != nil {
-			return fmt.Errorf("CheckpointManager upsert %v error. %v", ckptDoc, err)
+		if reader, ok := syncer.reader.(*oplogsyncer.ChangeStreamReader); ok {
+			if token := reader.ResumeToken(ackTs); token != nil {
+				ckptDoc[utils.CheckpointResumeToken] = token
+			}
 		}
+		buffer = append(buffer, ckptDoc)
+		manager.addHistory(replset, ackTs, time.Now().Unix())
 	}
-	return nil
+	if err := manager.storage.Save(tablePrefix+"_oplog", buffer); err != nil {
+		return fmt.Errorf("CheckpointManager save %v error. %v", buffer, err)
+	}
+	return manager.flushHistory(tablePrefix)
 }
 
 func (manager *CheckpointManager) GetTableList(tablePrefix string) []string {
-	return []string{tablePrefix + "_oplog"}
+	return []string{tablePrefix + "_oplog", tablePrefix + "_history"}
+}
+
+// addHistory records the ackTs if checkpoint.history.interval has passed
+// since the last record of replset. The oldest one is dropped if there are
+// more than checkpoint.history.size records
+func (manager *CheckpointManager) addHistory(replset string, ackTs bson.MongoTimestamp, now int64) {
+	if conf.Options.CheckpointHistorySize == 0 || ackTs == 0 {
+		return
+	}
+	history := manager.history[replset]
+	if n := len(history); n != 0 && (history[n-1].AckTs == ackTs ||
+		now-history[n-1].Time < conf.Options.CheckpointHistoryInterval) {
+		return
+	}
+	history = append(history, &CheckpointHistory{AckTs: ackTs, Time: now})
+	if len(history) > conf.Options.CheckpointHistorySize {
+		history = history[len(history)-conf.Options.CheckpointHistorySize:]
+	}
+	manager.history[replset] = history
+}
+
+func (manager *CheckpointManager) loadHistory(tablePrefix string) error {
+	docs, err := manager.storage.Load(tablePrefix + "_history")
+	if err != nil {
+		return err
+	}
+	manager.history = make(map[string][]*CheckpointHistory)
+	for _, ckptDoc := range docs {
+		replset, ok1 := ckptDoc[utils.CheckpointName].(string)
+		ackTs, ok2 := ckptDoc[utils.CheckpointAckTs].(bson.MongoTimestamp)
+		flushTime, ok3 := ckptDoc[CheckpointHistoryTime].(int64)
+		if !ok1 || !ok2 || !ok3 {
+			return fmt.Errorf("CheckpointManager load checkpoint history illegal record %v. ok1[%v] ok2[%v] ok3[%v]",
+				ckptDoc, ok1, ok2, ok3)
+		}
+		manager.history[replset] = append(manager.history[replset],
+			&CheckpointHistory{AckTs: ackTs, Time: flushTime})
+	}
+	for _, history := range manager.history {
+		sort.Slice(history, func(i, j int) bool {
+			return history[i].Time < history[j].Time
+		})
+	}
+	LOG.Info("CheckpointManager load checkpoint history of %v replsets", len(manager.history))
+	return nil
+}
+
+func (manager *CheckpointManager) flushHistory(tablePrefix string) error {
+	var buffer []interface{}
+	for replset, history := range manager.history {
+		for _, record := range history {
+			buffer = append(buffer, map[string]interface{}{
+				utils.CheckpointName:  replset,
+				utils.CheckpointAckTs: record.AckTs,
+				CheckpointHistoryTime: record.Time,
+			})
+		}
+	}
+	if err := manager.storage.Save(tablePrefix+"_history", buffer); err != nil {
+		return fmt.Errorf("CheckpointManager save history error. %v", err)
+	}
+	return nil
+}
+
+// setStage stores the stage of flush in the version table
+func (manager *CheckpointManager) setStage(stage string) error {
+	return manager.storage.Upsert(manager.table, map[string]interface{}{},
+		map[string]interface{}{utils.CheckpointStage: stage})
 }
 
 func (manager *CheckpointManager) ensureNetwork() bool {
 	// make connection if we don't already established
-	if manager.conn == nil {
-		if conn, err := utils.NewMongoConn(manager.url, utils.ConnectModePrimary, true); err == nil {
-			manager.conn = conn
+	if manager.storage == nil {
+		// set WriteMajority while checkpoint is writing to ConfigServer
+		if storage, err := utils.NewCheckpointStorage(conf.Options.IsShardCluster()); err == nil {
+			manager.storage = storage
 		} else {
 			LOG.Warn("CheckpointManager connect to %v failed. %v", manager.url, err)
-			manager.conn = nil
 			return false
 		}
 	}
-	// set WriteMajority while checkpoint is writing to ConfigServer
-	if conf.Options.IsShardCluster() {
-		manager.conn.Session.EnsureSafe(&mgo.Safe{WMode: utils.MajorityWriteConcern})
-	}
 	return true
 }
 
+func (manager *CheckpointManager) closeStorage() {
+	manager.storage.Close()
+	manager.storage = nil
+}
+
+func (manager *CheckpointManager) RestAPI() {
+	type History struct {
+		AckTs   string `json:"ack_ts"`
+		AckTime string `json:"ack_time"`
+		Time    string `json:"flush_time"`
+	}
+	type Position struct {
+		Replset string `json:"replset"`
+		// timestamp of mongodb, (unix seconds << 32) | increment
+		Ts int64 `json:"ts"`
+		// unix seconds, used if ts is zero
+		Unix int64 `json:"unix"`
+	}
+
+	utils.HttpApi.RegisterAPI("/checkpoint/history", nimo.HttpGet, func([]byte) interface{} {
+		manager.mutex.RLock()
+		defer manager.mutex.RUnlock()
+		result := make(map[string][]*History, len(manager.history))
+		for replset, history := range manager.history {
+			list := make([]*History, 0, len(history))
+			for _, record := range history {
+				list = append(list, &History{
+					AckTs:   utils.Int64ToString(int64(record.AckTs)),
+					AckTime: utils.TimestampToString(utils.ExtractTs32(record.AckTs)),
+					Time:    utils.TimestampToString(record.Time),
+				})
+			}
+			result[replset] = list
+		}
+		return result
+	})
+
+	// the oplogs after the position are synced again or skipped. it isn't
+	// supported by the tunnel which requires ack, since the receiver keeps
+	// its own position
+	utils.HttpApi.RegisterAPI("/checkpoint/position", nimo.HttpPost, func(body []byte) interface{} {
+		var position Position
+		if err := json.Unmarshal(body, &position); err != nil {
+			LOG.Info("CheckpointManager set position wrong format : %v", err)
+			return map[string]string{"position": "request json wrong format"}
+		}
+		syncer, ok := manager.syncMap[position.Replset]
+		if !ok {
+			return map[string]string{"position": fmt.Sprintf("replset %v is not exist", position.Replset)}
+		}
+		ts := position.Ts
+		if ts == 0 {
+			ts = position.Unix << 32
+		}
+		if ts <= 0 {
+			return map[string]string{"position": "ts or unix should be positive"}
+		}
+		for _, worker := range syncer.batcher.workerGroup {
+			if worker.writeController.tunnel.AckRequired() {
+				return map[string]string{"position": fmt.Sprintf("tunnel %v is not supported", conf.Options.Tunnel)}
+			}
+		}
+
+		LOG.Info("CheckpointManager set replset[%v] position to %v", position.Replset, utils.TimestampToLog(ts))
+		if err := syncer.SetPosition(bson.MongoTimestamp(ts), SetPositionTimeout); err != nil {
+			return map[string]string{"position": err.Error()}
+		}
+		return map[string]string{"position": "success"}
+	})
+}
+
 func calculateSyncerAckTs(sync *OplogSyncer) (v bson.MongoTimestamp, err error) {
 	// no need to lock and eventually consistence is acceptable
 	allAcked := true
@@ -5,6 +5,8 @@ import (
 	"testing"
 	"fmt"
 
+	conf "mongoshake/collector/configure"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -198,4 +200,47 @@ func TestCalculateWorkerLowestCheckpoint(t *testing.T) {
 		assert.Equal(t, "no candidates ack values found", err.Error(), "should be equal")
 		assert.Equal(t, bson.MongoTimestamp(0), checkpoint, "should be equal")
 	}
-}
\ No newline at end of file
+}
+
+func TestCheckpointHistory(t *testing.T) {
+	var nr int
+
+	conf.Options.CheckpointHistorySize = 3
+	conf.Options.CheckpointHistoryInterval = 60
+
+	// recorded once per interval and trimmed to size
+	{
+		fmt.Printf("TestCheckpointHistory case %d.\n", nr)
+		nr++
+
+		manager := NewCheckpointManager(0)
+		manager.addHistory("rs1", 0, 1000)
+		assert.Equal(t, 0, len(manager.history["rs1"]), "should be equal")
+
+		manager.addHistory("rs1", 10, 1000)
+		manager.addHistory("rs1", 20, 1030)
+		manager.addHistory("rs1", 20, 1100)
+		assert.Equal(t, 1, len(manager.history["rs1"]), "should be equal")
+
+		manager.addHistory("rs1", 30, 1100)
+		manager.addHistory("rs1", 40, 1200)
+		manager.addHistory("rs1", 50, 1300)
+		manager.addHistory("rs2", 60, 1300)
+		history := manager.history["rs1"]
+		assert.Equal(t, 3, len(history), "should be equal")
+		assert.Equal(t, bson.MongoTimestamp(30), history[0].AckTs, "should be equal")
+		assert.Equal(t, int64(1300), history[2].Time, "should be equal")
+		assert.Equal(t, 1, len(manager.history["rs2"]), "should be equal")
+	}
+
+	// disabled
+	{
+		fmt.Printf("TestCheckpointHistory case %d.\n", nr)
+		nr++
+
+		conf.Options.CheckpointHistorySize = 0
+		manager := NewCheckpointManager(0)
+		manager.addHistory("rs1", 10, 1000)
+		assert.Equal(t, 0, len(manager.history), "should be equal")
+	}
+}
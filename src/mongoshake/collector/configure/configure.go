@@ -15,6 +15,8 @@ type Configuration struct {
 	OplogGIDS                []string `config:"oplog.gids"`
 	ShardKey                 string   `config:"shard_key"`
 	SyncerReaderBufferTime   uint     `config:"syncer.reader.buffer_time"`
+	SyncerReaderFetchMethod  string   `config:"syncer.reader.fetch_method"`
+	SyncerReaderStreamDB     string   `config:"syncer.reader.change_stream.database"`
 	WorkerNum                int      `config:"worker"`
 	WorkerOplogCompressor    string   `config:"worker.oplog_compressor"`
 	WorkerBatchQueueSize     uint64   `config:"worker.batch_queue_size"`
@@ -22,20 +24,40 @@ type Configuration struct {
 	FetcherBufferCapacity    int      `config:"fetcher.buffer_capacity"`
 	Tunnel                   string   `config:"tunnel"`
 	TunnelAddress            []string `config:"tunnel.address"`
+	TunnelKafkaPartitionBy   string   `config:"tunnel.kafka.partition_by"`
+	TunnelMessage            string   `config:"tunnel.message"`
+	TunnelKafkaAsync         bool     `config:"tunnel.kafka.async"`
+	TunnelFileSegmentSize    int64    `config:"tunnel.file.segment_size"`
+	TunnelFileSegmentTime    int64    `config:"tunnel.file.segment_interval"`
 	MasterQuorum             bool     `config:"master_quorum"`
 	ContextStorage           string   `config:"context.storage"`
 	ContextStorageUrl        string   `config:"context.storage.url"`
 	ContextStorageDB         string   `config:"context.storage.db"`
 	ContextStorageCollection string   `config:"context.storage.collection"`
 	ContextStartPosition     int64    `config:"context.start_position" type:"date"`
+	ContextStopPosition      int64    `config:"context.stop_position" type:"date"`
 	FilterNamespaceBlack     []string `config:"filter.namespace.black"`
 	FilterNamespaceWhite     []string `config:"filter.namespace.white"`
 	FilterPassSpecialDb      []string `config:"filter.pass.special.db"`
 	SyncMode                 string   `config:"sync_mode"`
 	TransformNamespace       []string `config:"transform.namespace"`
+	TransformField           []string `config:"transform.field"`
+	TransformFieldHashSalt   string   `config:"transform.field.hash_salt"`
 	DBRef                    bool     `config:"dbref"`
 	MoveChunkEnable          bool     `config:"movechunk.enable"`
 	MoveChunkInterval        int64    `config:"movechunk.interval"`
+	ShutdownTimeout          int64    `config:"shutdown.timeout"`
+
+	CheckpointHistorySize     int   `config:"checkpoint.history.size"`
+	CheckpointHistoryInterval int64 `config:"checkpoint.history.interval"`
+
+	SyncerOplogWindowWarnPercent int  `config:"syncer.oplog_window.warn_percent"`
+	SyncerOplogWindowRecovery    bool `config:"syncer.oplog_window.recovery"`
+
+	HealthMaxLag         int64 `config:"health.max_lag"`
+	HealthMinOplogWindow int64 `config:"health.min_oplog_window"`
+
+	FilterNamespaceBackfill bool `config:"filter.namespace.backfill"`
 
 	ReplayerDMLOnly                   bool   `config:"replayer.dml_only"`
 	ReplayerExecutor                  int    `config:"replayer.executor"`
@@ -44,12 +66,27 @@ type Configuration struct {
 	ReplayerCollisionEnable           bool   `config:"replayer.collision_detection"`
 	ReplayerConflictWriteTo           string `config:"replayer.conflict_write_to"`
 	ReplayerDurable                   bool   `config:"replayer.durable"`
+	ReplayerExactlyOnce               bool   `config:"replayer.exactly_once"`
+
+	ReplayerConflictPolicy          string   `config:"replayer.conflict_policy"`
+	ReplayerConflictPolicyNamespace []string `config:"replayer.conflict_policy.namespace"`
+
+	ReplayerDeadLetter      string `config:"replayer.dead_letter"`
+	ReplayerDeadLetterUrl   string `config:"replayer.dead_letter.url"`
+	ReplayerDeadLetterRetry int    `config:"replayer.dead_letter.retry"`
+
+	ReplayerLoopPrevention bool `config:"replayer.loop_prevention"`
+	FilterLoopPrevention   bool `config:"filter.loop_prevention"`
 
-	ReplayerCollectionDrop     bool `config:"replayer.collection_drop"`
-	ReplayerCollectionParallel int  `config:"replayer.collection_parallel"`
-	ReplayerDocumentParallel   int  `config:"replayer.document_parallel"`
-	ReplayerDocumentBatchSize  int  `config:"replayer.document_batch_size"`
-	FilterOrphanDocument       bool `config:"filter.orphan_document"`
+	ReplayerCollectionDrop           bool   `config:"replayer.collection_drop"`
+	ReplayerCollectionParallel       int    `config:"replayer.collection_parallel"`
+	ReplayerDocumentParallel         int    `config:"replayer.document_parallel"`
+	ReplayerDocumentBatchSize        int    `config:"replayer.document_batch_size"`
+	ReplayerDocumentResume           bool   `config:"replayer.document_resume"`
+	ReplayerCollectionSplitThreshold int64  `config:"replayer.collection_split_threshold"`
+	ReplayerCollectionSplitParallel  int    `config:"replayer.collection_split_parallel"`
+	ReplayerIndexStrategy            string `config:"replayer.index_strategy"`
+	FilterOrphanDocument             bool   `config:"filter.orphan_document"`
 
 	/*---------------------------------------------------------*/
 	// inner variables
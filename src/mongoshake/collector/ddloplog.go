@@ -138,12 +138,11 @@ func (manager *DDLManager) UnBlockDDL(replset string, log *oplog.PartialLog) {
 func (manager *DDLManager) Load(tablePrefix string) error {
 	manager.ddlLock.Lock()
 	defer manager.ddlLock.Unlock()
-	conn := manager.ckptManager.conn
-	db := manager.ckptManager.db
-
-	iter := conn.Session.DB(db).C(tablePrefix + "_ddl").Find(bson.M{}).Iter()
-	ckptDoc := make(map[string]interface{})
-	for iter.Next(ckptDoc) {
+	docs, err := manager.ckptManager.storage.Load(tablePrefix + "_ddl")
+	if err != nil {
+		return err
+	}
+	for _, ckptDoc := range docs {
 		namespace, ok1 := ckptDoc[CheckpointKeyNs].(string)
 		object, ok2 := ckptDoc[CheckpointKeyObject].(string)
 		blockLogDoc, ok3 := ckptDoc[CheckpointBlocklog].(map[string]interface{})
@@ -177,13 +176,7 @@ func (manager *DDLManager) Load(tablePrefix string) error {
 func (manager *DDLManager) Flush(tablePrefix string) error {
 	manager.ddlLock.Lock()
 	defer manager.ddlLock.Unlock()
-	conn := manager.ckptManager.conn
-	db := manager.ckptManager.db
-
 	table := tablePrefix + "_ddl"
-	if err := conn.Session.DB(db).C(table).DropCollection(); err != nil && err.Error() != "ns not found" {
-		return LOG.Critical("DDLManager flush checkpoint drop collection %v failed. %v", table, err)
-	}
 	var buffer []interface{}
 	for ddlKey, ddlValue := range manager.ddlMap {
 		blockLog, err := utils.Struct2Map(ddlValue.blockLog, "bson")
@@ -198,10 +191,8 @@ func (manager *DDLManager) Flush(tablePrefix string) error {
 		}
 		buffer = append(buffer, ckptDoc)
 	}
-	if len(buffer) > 0 {
-		if err := conn.Session.DB(db).C(table).Insert(buffer...); err != nil {
-			return LOG.Critical("DDLManager flush checkpoint ddlMap buffer %v insert failed. %v", buffer, err)
-		}
+	if err := manager.ckptManager.storage.Save(table, buffer); err != nil {
+		return LOG.Critical("DDLManager flush checkpoint ddlMap buffer %v save failed. %v", buffer, err)
 	}
 	LOG.Info("DDLManager flush checkpoint ddlMap size[%v]", len(manager.ddlMap))
 	return nil
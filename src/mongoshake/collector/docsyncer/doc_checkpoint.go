@@ -2,8 +2,10 @@ package docsyncer
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
 	LOG "github.com/vinllen/log4go"
-	"github.com/vinllen/mgo"
 	"github.com/vinllen/mgo/bson"
 	"mongoshake/collector/configure"
 	utils "mongoshake/common"
@@ -11,43 +13,36 @@ import (
 
 func LoadCheckpoint() (map[string]bson.MongoTimestamp, error) {
 	url := conf.Options.ContextStorageUrl
-	db := utils.AppDatabase()
 	table := conf.Options.ContextStorageCollection
-	conn, err := utils.NewMongoConn(url, utils.ConnectModePrimary, true)
+	storage, err := utils.NewCheckpointStorage(true)
 	if err != nil {
 		return nil, fmt.Errorf("LoadCheckpoint connect to %v failed. %v", url, err)
 	}
-	defer conn.Close()
+	defer storage.Close()
 	ckptMap := make(map[string]bson.MongoTimestamp)
 
-	var versionDoc map[string]interface{}
-	if err := conn.Session.DB(db).C(table).
-		Find(bson.M{}).One(&versionDoc); err != nil && err != mgo.ErrNotFound {
+	stage, err := utils.LoadCheckpointStage(storage, table)
+	if err != nil {
 		return nil, LOG.Critical("LoadCheckpoint versionDoc error. %v", err)
 	}
 	oplogTable := table + "_oplog"
-	stage, ok := versionDoc[utils.CheckpointStage]
-	if ok {
-		switch stage {
-		case utils.StageFlushed:
-			oplogTable = "tmp_" + oplogTable
-		case utils.StageRename:
-			// rename tmp table to original table
-			colNames, err := conn.Session.DB(db).CollectionNames()
-			if err != nil {
-				return nil, LOG.Critical("LoadCheckpoint obtain collection names error. %v", err)
-			}
-			for _, col := range colNames {
-				if col == "tmp_"+oplogTable {
-					oplogTable = "tmp_" + oplogTable
-				}
-			}
+	var docs []map[string]interface{}
+	switch stage {
+	case utils.StageFlushed:
+		docs, err = storage.Load("tmp_" + oplogTable)
+	case utils.StageRename:
+		// the tmp table is left if it isn't renamed to original table
+		if docs, err = storage.Load("tmp_" + oplogTable); err == nil && len(docs) == 0 {
+			docs, err = storage.Load(oplogTable)
 		}
+	default:
+		docs, err = storage.Load(oplogTable)
+	}
+	if err != nil {
+		return nil, LOG.Critical("LoadCheckpoint load checkpoint error. %v", err)
 	}
 
-	iter := conn.Session.DB(db).C(oplogTable).Find(bson.M{}).Iter()
-	ckptDoc := make(map[string]interface{})
-	for iter.Next(ckptDoc) {
+	for _, ckptDoc := range docs {
 		replset, ok1 := ckptDoc[utils.CheckpointName].(string)
 		ackTs, ok2 := ckptDoc[utils.CheckpointAckTs].(bson.MongoTimestamp)
 		if !ok1 || !ok2 {
@@ -58,38 +53,261 @@ func LoadCheckpoint() (map[string]bson.MongoTimestamp, error) {
 			LOG.Info("LoadCheckpoint load replset[%v] ackTs[%v]", replset, utils.TimestampToLog(ackTs))
 		}
 	}
-	if err := iter.Close(); err != nil {
-		LOG.Critical("LoadCheckpoint close iterator failed. %v", err)
-	}
 	return ckptMap, nil
 }
 
 func FlushCheckpoint(ckptMap map[string]bson.MongoTimestamp) error {
 	url := conf.Options.ContextStorageUrl
-	db := utils.AppDatabase()
 	table := conf.Options.ContextStorageCollection
 	oplogTable := table + "_oplog"
-	conn, err := utils.NewMongoConn(url, utils.ConnectModePrimary, true)
+	storage, err := utils.NewCheckpointStorage(true)
 	if err != nil {
 		return fmt.Errorf("FlushCheckpoint connect to %v failed. %v", url, err)
 	}
-	conn.Session.EnsureSafe(&mgo.Safe{WMode: utils.MajorityWriteConcern})
-	defer conn.Close()
+	defer storage.Close()
 
-	if _, err := conn.Session.DB(db).C(table).
-		Upsert(bson.M{}, bson.M{utils.CheckpointStage: utils.StageOriginal}); err != nil {
+	if err := storage.Save(table, []interface{}{
+		map[string]interface{}{utils.CheckpointStage: utils.StageOriginal},
+	}); err != nil {
 		return LOG.Critical("FlushCheckpoint upsert versionDoc error. %v", err)
 	}
+	buffer := make([]interface{}, 0, len(ckptMap))
 	for replset, ackTs := range ckptMap {
 		ckptDoc := map[string]interface{}{
 			utils.CheckpointName:   replset,
 			utils.CheckpointAckTs:  ackTs,
 			utils.CheckpointSyncTs: ackTs,
 		}
-		if _, err := conn.Session.DB(db).C(oplogTable).
-			Upsert(bson.M{utils.CheckpointName: replset}, ckptDoc); err != nil {
-			return fmt.Errorf("FlushCheckpoint upsert %v error. %v", ckptDoc, err)
+		buffer = append(buffer, ckptDoc)
+	}
+	if err := storage.Save(oplogTable, buffer); err != nil {
+		return fmt.Errorf("FlushCheckpoint save %v error. %v", buffer, err)
+	}
+	return nil
+}
+
+const (
+	// flush the position of one namespace at most once per interval
+	DocCheckpointInterval = 3 * time.Second
+)
+
+// DocProgress is the position of document replication of one _id range
+// [MinId, MaxId) of a namespace, the bound is open if it is empty. A namespace
+// has more than one range if it is split. The record with empty ns only stores
+// the oplog timestamp when full sync began.
+type DocProgress struct {
+	Replset string              `bson:"name"`
+	Ns      string              `bson:"ns"`
+	Part    int                 `bson:"part"`
+	MinId   bson.Raw            `bson:"minId,omitempty"`
+	MaxId   bson.Raw            `bson:"maxId,omitempty"`
+	LastId  bson.Raw            `bson:"lastId,omitempty"`
+	Done    bool                `bson:"done"`
+	BeginTs bson.MongoTimestamp `bson:"beginTs,omitempty"`
+}
+
+// DocCheckpoint persists the per namespace progress of document replication
+// into table "${context.storage.collection}_doc" of the checkpoint storage,
+// so a restarted full sync only copies what remains.
+type DocCheckpoint struct {
+	storage utils.CheckpointStorage
+	table   string
+
+	mutex sync.Mutex
+	// replset -> oplog timestamp when full sync began
+	beginTs map[string]bson.MongoTimestamp
+	// replset -> ns -> part -> progress
+	progress map[string]map[string]map[int]*DocProgress
+}
+
+func NewDocCheckpoint() (*DocCheckpoint, error) {
+	url := conf.Options.ContextStorageUrl
+	storage, err := utils.NewCheckpointStorage(true)
+	if err != nil {
+		return nil, fmt.Errorf("NewDocCheckpoint connect to %v failed. %v", url, err)
+	}
+
+	ckpt := &DocCheckpoint{
+		storage:  storage,
+		table:    conf.Options.ContextStorageCollection + "_doc",
+		beginTs:  make(map[string]bson.MongoTimestamp),
+		progress: make(map[string]map[string]map[int]*DocProgress),
+	}
+	if err := ckpt.load(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return ckpt, nil
+}
+
+func (ckpt *DocCheckpoint) load() error {
+	docs, err := ckpt.storage.Load(ckpt.table)
+	if err != nil {
+		return LOG.Critical("DocCheckpoint load from %v failed. %v", ckpt.table, err)
+	}
+	for _, doc := range docs {
+		record := new(DocProgress)
+		// convert to struct by bson since the bounds are kept as bson.Raw
+		if data, err := bson.Marshal(doc); err != nil {
+			return LOG.Critical("DocCheckpoint load illegal record %v. %v", doc, err)
+		} else if err := bson.Unmarshal(data, record); err != nil {
+			return LOG.Critical("DocCheckpoint load illegal record %v. %v", doc, err)
+		}
+		if record.Ns == "" {
+			ckpt.beginTs[record.Replset] = record.BeginTs
+			LOG.Info("DocCheckpoint load replset[%v] beginTs[%v]", record.Replset,
+				utils.TimestampToLog(record.BeginTs))
+		} else {
+			ckpt.set(record)
+			LOG.Info("DocCheckpoint load replset[%v] ns[%v] part[%v] done[%v]", record.Replset,
+				record.Ns, record.Part, record.Done)
+		}
+	}
+	return nil
+}
+
+func (ckpt *DocCheckpoint) set(record *DocProgress) {
+	if _, ok := ckpt.progress[record.Replset]; !ok {
+		ckpt.progress[record.Replset] = make(map[string]map[int]*DocProgress)
+	}
+	if _, ok := ckpt.progress[record.Replset][record.Ns]; !ok {
+		ckpt.progress[record.Replset][record.Ns] = make(map[int]*DocProgress)
+	}
+	ckpt.progress[record.Replset][record.Ns][record.Part] = record
+}
+
+// BeginTs returns the oplog timestamp of each replset when the interrupted
+// full sync began. empty if there is nothing to resume
+func (ckpt *DocCheckpoint) BeginTs() map[string]bson.MongoTimestamp {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	beginTs := make(map[string]bson.MongoTimestamp, len(ckpt.beginTs))
+	for replset, ts := range ckpt.beginTs {
+		beginTs[replset] = ts
+	}
+	return beginTs
+}
+
+// SetBeginTs must be called before any namespace progress is stored, so that
+// the oplog replication after a resumed full sync starts from the right place
+func (ckpt *DocCheckpoint) SetBeginTs(beginTs map[string]bson.MongoTimestamp) error {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	for replset, ts := range beginTs {
+		record := &DocProgress{Replset: replset, BeginTs: ts}
+		if err := ckpt.upsert(record); err != nil {
+			return err
+		}
+		ckpt.beginTs[replset] = ts
+	}
+	return nil
+}
+
+// Namespaces returns all the namespaces which have progress in any replset
+func (ckpt *DocCheckpoint) Namespaces() map[string]bool {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	nsSet := make(map[string]bool)
+	for _, nsMap := range ckpt.progress {
+		for ns := range nsMap {
+			nsSet[ns] = true
 		}
 	}
+	return nsSet
+}
+
+// Partitions returns the progress of all ranges of the namespace ordered by
+// part, or nil if the namespace hasn't been synced before
+func (ckpt *DocCheckpoint) Partitions(replset string, ns utils.NS) []*DocProgress {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	partMap, ok := ckpt.progress[replset][ns.Str()]
+	if !ok {
+		return nil
+	}
+	partitions := make([]*DocProgress, len(partMap))
+	for part, record := range partMap {
+		if part < 0 || part >= len(partMap) {
+			LOG.Warn("DocCheckpoint replset[%v] ns[%v] has illegal part[%v], sync it from scratch",
+				replset, ns, part)
+			return nil
+		}
+		copied := *record
+		partitions[part] = &copied
+	}
+	return partitions
+}
+
+// SetPartitions stores the ranges of the namespace before any of them is synced
+func (ckpt *DocCheckpoint) SetPartitions(partitions []*DocProgress) error {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	for _, partition := range partitions {
+		record := *partition
+		if err := ckpt.upsert(&record); err != nil {
+			return err
+		}
+		ckpt.set(&record)
+	}
 	return nil
 }
+
+// Update records that all documents of the range with _id not greater than
+// lastId are written
+func (ckpt *DocCheckpoint) Update(replset string, ns utils.NS, part int, lastId bson.Raw) error {
+	return ckpt.flush(replset, ns, part, func(record *DocProgress) {
+		record.LastId = lastId
+	})
+}
+
+// Finish marks the range as fully synced
+func (ckpt *DocCheckpoint) Finish(replset string, ns utils.NS, part int) error {
+	return ckpt.flush(replset, ns, part, func(record *DocProgress) {
+		record.Done = true
+	})
+}
+
+func (ckpt *DocCheckpoint) flush(replset string, ns utils.NS, part int, modify func(record *DocProgress)) error {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	// keep the bounds of the range
+	record := &DocProgress{Replset: replset, Ns: ns.Str(), Part: part}
+	if old, ok := ckpt.progress[replset][ns.Str()][part]; ok {
+		copied := *old
+		record = &copied
+	}
+	modify(record)
+	if err := ckpt.upsert(record); err != nil {
+		return err
+	}
+	ckpt.set(record)
+	return nil
+}
+
+// upsert saves the given record only, which is found by replset, namespace
+// and partition
+func (ckpt *DocCheckpoint) upsert(record *DocProgress) error {
+	selector := map[string]interface{}{"name": record.Replset, "ns": record.Ns, "part": record.Part}
+	if err := ckpt.storage.Upsert(ckpt.table, selector, record); err != nil {
+		return fmt.Errorf("DocCheckpoint upsert replset[%v] ns[%v] part[%v] error. %v",
+			record.Replset, record.Ns, record.Part, err)
+	}
+	return nil
+}
+
+// Clear removes all progress. it's called when document replication finished
+// or the progress is useless
+func (ckpt *DocCheckpoint) Clear() error {
+	ckpt.mutex.Lock()
+	defer ckpt.mutex.Unlock()
+	if err := ckpt.storage.Drop(ckpt.table); err != nil {
+		return LOG.Critical("DocCheckpoint drop %v failed. %v", ckpt.table, err)
+	}
+	ckpt.beginTs = make(map[string]bson.MongoTimestamp)
+	ckpt.progress = make(map[string]map[string]map[int]*DocProgress)
+	return nil
+}
+
+func (ckpt *DocCheckpoint) Close() {
+	ckpt.storage.Close()
+}
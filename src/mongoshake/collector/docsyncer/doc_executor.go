@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"mongoshake/collector/configure"
 	"mongoshake/common"
 	"mongoshake/oplog"
 
+	LOG "github.com/vinllen/log4go"
 	"github.com/vinllen/mgo"
 	"github.com/vinllen/mgo/bson"
 )
@@ -32,7 +34,38 @@ type CollectionExecutor struct {
 
 	conn *utils.MongoConn
 
-	docBatch chan []*bson.Raw
+	docBatch chan *documentBatch
+
+	// checkpoint of document replication, nil if disabled
+	ckpt    *DocCheckpoint
+	replset string
+	srcNs   utils.NS
+	// documents may already exist in dest mongodb if resumed
+	resumed bool
+	// documents existing in dest mongodb are replaced
+	overwrite bool
+
+	// part -> ack state, batches of each part are acked independently
+	ackMutex sync.Mutex
+	acks     map[int]*partitionAck
+}
+
+type documentBatch struct {
+	part int
+	seq  int64
+	docs []*bson.Raw
+	// _id of the last scanned document of this batch, including filtered ones
+	lastId *bson.Raw
+}
+
+type partitionAck struct {
+	// sequence of the next batch
+	seq int64
+	// all batches before ackSeq have been written
+	ackSeq    int64
+	ackLastId *bson.Raw
+	acked     map[int64]*bson.Raw
+	lastFlush time.Time
 }
 
 func GenerateCollExecutorId() int {
@@ -44,9 +77,20 @@ func NewCollectionExecutor(id int, mongoUrl string, ns utils.NS) *CollectionExec
 		id:       id,
 		mongoUrl: mongoUrl,
 		ns:       ns,
+		acks:     make(map[int]*partitionAck),
 	}
 }
 
+// EnableCheckpoint makes the executor store the _id of the last contiguously
+// written document of srcNs
+func (colExecutor *CollectionExecutor) EnableCheckpoint(ckpt *DocCheckpoint, replset string,
+	srcNs utils.NS, resumed bool) {
+	colExecutor.ckpt = ckpt
+	colExecutor.replset = replset
+	colExecutor.srcNs = srcNs
+	colExecutor.resumed = resumed
+}
+
 func (colExecutor *CollectionExecutor) Start() error {
 	var err error
 	if colExecutor.conn, err = utils.NewMongoConn(colExecutor.mongoUrl, utils.ConnectModePrimary, true); err != nil {
@@ -54,7 +98,7 @@ func (colExecutor *CollectionExecutor) Start() error {
 	}
 
 	parallel := conf.Options.ReplayerDocumentParallel
-	colExecutor.docBatch = make(chan []*bson.Raw, parallel)
+	colExecutor.docBatch = make(chan *documentBatch, parallel)
 
 	executors := make([]*DocExecutor, parallel)
 	for i := 0; i != len(executors); i++ {
@@ -66,14 +110,61 @@ func (colExecutor *CollectionExecutor) Start() error {
 	return nil
 }
 
-func (colExecutor *CollectionExecutor) Sync(docs []*bson.Raw) {
+// Sync dispatches a batch read from the given part of the collection. it's
+// safe to call Sync concurrently on different parts. lastId is the _id of the
+// last scanned document which is only used by checkpoint
+func (colExecutor *CollectionExecutor) Sync(docs []*bson.Raw, part int, lastId *bson.Raw) {
 	count := uint64(len(docs))
 	if count == 0 {
 		return
 	}
 
+	colExecutor.ackMutex.Lock()
+	partAck, ok := colExecutor.acks[part]
+	if !ok {
+		partAck = &partitionAck{acked: make(map[int64]*bson.Raw), lastFlush: time.Now()}
+		colExecutor.acks[part] = partAck
+	}
+	seq := partAck.seq
+	partAck.seq++
+	colExecutor.ackMutex.Unlock()
+
 	colExecutor.wg.Add(1)
-	colExecutor.docBatch <- docs
+	colExecutor.docBatch <- &documentBatch{part: part, seq: seq, docs: docs, lastId: lastId}
+}
+
+// ack is called when the batch is written. batches are written concurrently,
+// so only the _id of the last contiguous one of each part is checkpointed
+func (colExecutor *CollectionExecutor) ack(batch *documentBatch) {
+	if colExecutor.ckpt == nil {
+		return
+	}
+
+	colExecutor.ackMutex.Lock()
+	defer colExecutor.ackMutex.Unlock()
+	partAck := colExecutor.acks[batch.part]
+	partAck.acked[batch.seq] = batch.lastId
+	for {
+		lastId, ok := partAck.acked[partAck.ackSeq]
+		if !ok {
+			break
+		}
+		delete(partAck.acked, partAck.ackSeq)
+		partAck.ackSeq++
+		if lastId != nil {
+			partAck.ackLastId = lastId
+		}
+	}
+
+	if partAck.ackLastId != nil && time.Since(partAck.lastFlush) >= DocCheckpointInterval {
+		if err := colExecutor.ckpt.Update(colExecutor.replset, colExecutor.srcNs, batch.part,
+			*partAck.ackLastId); err != nil {
+			LOG.Warn("document syncer %v flush checkpoint of ns %v part %v failed. %v",
+				colExecutor.replset, colExecutor.srcNs, batch.part, err)
+			return
+		}
+		partAck.lastFlush = time.Now()
+	}
 }
 
 func (colExecutor *CollectionExecutor) Wait() error {
@@ -115,14 +206,16 @@ func NewDocExecutor(id int, colExecutor *CollectionExecutor, session *mgo.Sessio
 func (exec *DocExecutor) start() {
 	defer exec.session.Close()
 	for {
-		docs, ok := <-exec.colExecutor.docBatch
+		batch, ok := <-exec.colExecutor.docBatch
 		if !ok {
 			break
 		}
 
 		if exec.error == nil {
-			if err := exec.doSync(docs); err != nil {
+			if err := exec.doSync(batch.docs); err != nil {
 				exec.error = err
+			} else {
+				exec.colExecutor.ack(batch)
 			}
 		}
 		exec.colExecutor.wg.Done()
@@ -141,7 +234,21 @@ func (exec *DocExecutor) doSync(docs []*bson.Raw) error {
 		docList = append(docList, doc)
 	}
 
-	if err := exec.session.DB(ns.Database).C(ns.Collection).Insert(docList...); err != nil {
+	collection := exec.session.DB(ns.Database).C(ns.Collection)
+	err := collection.Insert(docList...)
+	if err != nil && exec.colExecutor.resumed && mgo.IsDup(err) {
+		// documents after the checkpoint may have been written before restart,
+		// the newer version will be replayed by oplog
+		bulk := collection.Bulk()
+		bulk.Unordered()
+		bulk.Insert(docList...)
+		if _, err = bulk.Run(); err != nil && mgo.IsDup(err) {
+			err = nil
+		}
+	} else if err != nil && exec.colExecutor.overwrite && mgo.IsDup(err) {
+		err = exec.replace(collection, docs)
+	}
+	if err != nil {
 		printLog := new(oplog.PartialLog)
 		bson.Unmarshal(docs[0].Data, printLog)
 		return fmt.Errorf("insert docs with length[%v] into ns %v of dest mongo failed[%v]. first doc: %v",
@@ -150,3 +257,20 @@ func (exec *DocExecutor) doSync(docs []*bson.Raw) error {
 
 	return nil
 }
+
+// replace upserts the documents by _id
+func (exec *DocExecutor) replace(collection *mgo.Collection, docs []*bson.Raw) error {
+	bulk := collection.Bulk()
+	bulk.Unordered()
+	for _, doc := range docs {
+		var id struct {
+			Id interface{} `bson:"_id"`
+		}
+		if err := bson.Unmarshal(doc.Data, &id); err != nil {
+			return err
+		}
+		bulk.Upsert(bson.M{"_id": id.Id}, doc)
+	}
+	_, err := bulk.Run()
+	return err
+}
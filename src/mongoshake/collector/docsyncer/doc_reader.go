@@ -16,7 +16,7 @@ import (
 func GetAllNamespace(sources []*utils.MongoSource) (map[utils.NS]bool, error) {
 	nsSet := make(map[utils.NS]bool)
 	for _, src := range sources {
-		nsList, err := getDbNamespace(src.URL)
+		nsList, err := getDbNamespace(src.URL, filter.NewDocFilterList())
 		if err != nil {
 			return nil, err
 		}
@@ -27,7 +27,33 @@ func GetAllNamespace(sources []*utils.MongoSource) (map[utils.NS]bool, error) {
 	return nsSet, nil
 }
 
-func getDbNamespace(url string) (nsList []utils.NS, err error) {
+// GetAllIndexes returns the indexes of all namespaces need to sync
+func GetAllIndexes(sources []*utils.MongoSource) (map[utils.NS][]mgo.Index, error) {
+	indexMap := make(map[utils.NS][]mgo.Index)
+	for _, src := range sources {
+		nsList, err := getDbNamespace(src.URL, filter.NewDocFilterList())
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := utils.NewMongoConn(src.URL, conf.Options.MongoConnectMode, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nsList {
+			indexes, err := conn.Session.DB(ns.Database).C(ns.Collection).Indexes()
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("get indexes of ns %v from mongodb url=%s error. %v", ns, src.URL, err)
+			}
+			indexMap[ns] = indexes
+		}
+		conn.Close()
+	}
+	return indexMap, nil
+}
+
+func getDbNamespace(url string, filterList filter.DocFilterChain) (nsList []utils.NS, err error) {
 	var conn *utils.MongoConn
 	if conn, err = utils.NewMongoConn(url, utils.ConnectModeSecondaryPreferred, true); conn == nil || err != nil {
 		return nil, err
@@ -40,8 +66,6 @@ func getDbNamespace(url string) (nsList []utils.NS, err error) {
 		return nil, err
 	}
 
-	filterList := filter.NewDocFilterList()
-
 	nsList = make([]utils.NS, 0, 128)
 	for _, db := range dbNames {
 		colNames, err := conn.Session.DB(db).CollectionNames()
@@ -76,6 +100,13 @@ type DocumentReader struct {
 
 	// query statement and current max cursor
 	query bson.M
+	// scan in _id order so that the position can be checkpointed
+	sortById bool
+	// _id range [minId, maxId) when the collection is split, and the
+	// position to resume. nil means unbounded
+	minId  *bson.Raw
+	maxId  *bson.Raw
+	lastId *bson.Raw
 }
 
 // NewDocumentReader creates reader with mongodb url
@@ -83,6 +114,47 @@ func NewDocumentReader(src string, ns utils.NS) *DocumentReader {
 	return &DocumentReader{src: src, ns: ns, query: bson.M{}}
 }
 
+// EnableResume makes the reader scan documents in _id order, and skip those
+// with _id not greater than lastId if it is given. Note that the range query
+// only matches _id of the same BSON type as lastId, so the namespace with _id
+// of different types shouldn't be resumed by lastId.
+func (reader *DocumentReader) EnableResume(lastId *bson.Raw) {
+	reader.sortById = true
+	if lastId != nil && lastId.Kind != 0 {
+		reader.lastId = lastId
+	}
+	reader.buildQuery()
+}
+
+// SetRange limits the reader to _id range [minId, maxId), an empty bound is open
+func (reader *DocumentReader) SetRange(minId, maxId *bson.Raw) {
+	if minId != nil && minId.Kind != 0 {
+		reader.minId = minId
+	}
+	if maxId != nil && maxId.Kind != 0 {
+		reader.maxId = maxId
+	}
+	reader.buildQuery()
+}
+
+func (reader *DocumentReader) buildQuery() {
+	condition := bson.M{}
+	if reader.lastId != nil {
+		condition["$gt"] = *reader.lastId
+	} else if reader.minId != nil {
+		condition["$gte"] = *reader.minId
+	}
+	if reader.maxId != nil {
+		condition["$lt"] = *reader.maxId
+	}
+
+	if len(condition) == 0 {
+		reader.query = bson.M{}
+	} else {
+		reader.query = bson.M{"_id": condition}
+	}
+}
+
 // NextDoc returns an document by raw bytes which is []byte
 func (reader *DocumentReader) NextDoc() (doc *bson.Raw, err error) {
 	if err := reader.ensureNetwork(); err != nil {
@@ -104,15 +176,14 @@ func (reader *DocumentReader) NextDoc() (doc *bson.Raw, err error) {
 }
 
 func (reader *DocumentReader) GetIndexes() ([]mgo.Index, error) {
+	if err := reader.ensureConnection(); err != nil {
+		return nil, err
+	}
 	return reader.conn.Session.DB(reader.ns.Database).C(reader.ns.Collection).Indexes()
 }
 
-// ensureNetwork establish the mongodb connection at first
-// if current connection is not ready or disconnected
-func (reader *DocumentReader) ensureNetwork() (err error) {
-	if reader.docIterator != nil {
-		return nil
-	}
+// ensureConnection reconnects if current connection is not ready or disconnected
+func (reader *DocumentReader) ensureConnection() (err error) {
 	if reader.conn == nil || (reader.conn != nil && !reader.conn.IsGood()) {
 		if reader.conn != nil {
 			reader.conn.Close()
@@ -122,13 +193,28 @@ func (reader *DocumentReader) ensureNetwork() (err error) {
 			return err
 		}
 	}
+	return nil
+}
+
+// ensureNetwork establish the mongodb connection at first
+// if current connection is not ready or disconnected
+func (reader *DocumentReader) ensureNetwork() (err error) {
+	if reader.docIterator != nil {
+		return nil
+	}
+	if err = reader.ensureConnection(); err != nil {
+		return err
+	}
 
 	// rebuild syncerGroup condition statement with current checkpoint timestamp
 	reader.conn.Session.SetBatch(8192)
 	reader.conn.Session.SetPrefetch(0.2)
 	reader.conn.Session.SetCursorTimeout(0)
-	reader.docIterator = reader.conn.Session.DB(reader.ns.Database).C(reader.ns.Collection).
-		Find(reader.query).Iter()
+	query := reader.conn.Session.DB(reader.ns.Database).C(reader.ns.Collection).Find(reader.query)
+	if reader.sortById {
+		query = query.Sort("_id")
+	}
+	reader.docIterator = query.Iter()
 	return nil
 }
 
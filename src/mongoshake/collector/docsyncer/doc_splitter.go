@@ -0,0 +1,167 @@
+package docsyncer
+
+import (
+	"bytes"
+	"fmt"
+
+	"mongoshake/common"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// number of sampled _id for each partition when splitVector is unavailable
+	SampleCountPerPartition = 10
+)
+
+// SplitCollection splits the namespace into at most parts _id ranges if its
+// size is larger than threshold bytes. The returned bounds are in ascending
+// order, and nil means the collection should be synced as a whole.
+func SplitCollection(conn *utils.MongoConn, ns utils.NS, threshold int64, parts int) ([]bson.Raw, error) {
+	if threshold <= 0 || parts <= 1 {
+		return nil, nil
+	}
+
+	var stats struct {
+		Size  int64 `bson:"size"`
+		Count int64 `bson:"count"`
+	}
+	if err := conn.Session.DB(ns.Database).Run(bson.D{{"collStats", ns.Collection}}, &stats); err != nil {
+		return nil, fmt.Errorf("get stats of ns %v failed. %v", ns, err)
+	}
+	if stats.Size < threshold || stats.Count < int64(parts) {
+		return nil, nil
+	}
+
+	// range query only matches the _id of the same type as the bound
+	if same, err := isSameIdType(conn, ns); err != nil {
+		return nil, err
+	} else if !same {
+		LOG.Info("ns %v has _id of different types, it will not be split", ns)
+		return nil, nil
+	}
+
+	bounds, err := splitVector(conn, ns, stats.Size/int64(parts))
+	if err != nil {
+		LOG.Warn("run splitVector on ns %v failed, use sampled bounds instead. %v", ns, err)
+		if bounds, err = sampleBounds(conn, ns, parts); err != nil {
+			return nil, err
+		}
+	}
+	return selectBounds(bounds, parts), nil
+}
+
+func isSameIdType(conn *utils.MongoConn, ns utils.NS) (bool, error) {
+	var first, last struct {
+		Id bson.Raw `bson:"_id"`
+	}
+	collection := conn.Session.DB(ns.Database).C(ns.Collection)
+	if err := collection.Find(bson.M{}).Select(bson.M{"_id": 1}).Sort("_id").One(&first); err != nil {
+		return false, fmt.Errorf("get the smallest _id of ns %v failed. %v", ns, err)
+	}
+	if err := collection.Find(bson.M{}).Select(bson.M{"_id": 1}).Sort("-_id").One(&last); err != nil {
+		return false, fmt.Errorf("get the largest _id of ns %v failed. %v", ns, err)
+	}
+	return typeBracket(first.Id.Kind) == typeBracket(last.Id.Kind), nil
+}
+
+// typeBracket merges the kinds which are compared as the same type
+func typeBracket(kind byte) byte {
+	switch kind {
+	case 0x01, 0x10, 0x12, 0x13:
+		// double, int32, int64 and decimal128 are all numbers
+		return 0x01
+	case 0x0E:
+		// symbol is compared as string
+		return 0x02
+	default:
+		return kind
+	}
+}
+
+func splitVector(conn *utils.MongoConn, ns utils.NS, chunkSize int64) ([]bson.Raw, error) {
+	var result struct {
+		SplitKeys []struct {
+			Id bson.Raw `bson:"_id"`
+		} `bson:"splitKeys"`
+	}
+	if err := conn.Session.DB(ns.Database).Run(bson.D{
+		{"splitVector", ns.Str()},
+		{"keyPattern", bson.M{"_id": 1}},
+		{"maxChunkSizeBytes", chunkSize},
+	}, &result); err != nil {
+		return nil, err
+	}
+
+	bounds := make([]bson.Raw, 0, len(result.SplitKeys))
+	for _, key := range result.SplitKeys {
+		bounds = append(bounds, key.Id)
+	}
+	return bounds, nil
+}
+
+func sampleBounds(conn *utils.MongoConn, ns utils.NS, parts int) ([]bson.Raw, error) {
+	var samples []struct {
+		Id bson.Raw `bson:"_id"`
+	}
+	pipeline := []bson.M{
+		{"$sample": bson.M{"size": parts * SampleCountPerPartition}},
+		{"$project": bson.M{"_id": 1}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	if err := conn.Session.DB(ns.Database).C(ns.Collection).Pipe(pipeline).AllowDiskUse().
+		All(&samples); err != nil {
+		return nil, fmt.Errorf("sample _id of ns %v failed. %v", ns, err)
+	}
+
+	bounds := make([]bson.Raw, 0, len(samples))
+	for _, sample := range samples {
+		bounds = append(bounds, sample.Id)
+	}
+	return bounds, nil
+}
+
+// selectBounds picks at most parts-1 evenly distributed and distinct bounds
+func selectBounds(bounds []bson.Raw, parts int) []bson.Raw {
+	distinct := make([]bson.Raw, 0, len(bounds))
+	for _, bound := range bounds {
+		if len(distinct) > 0 && sameRaw(distinct[len(distinct)-1], bound) {
+			continue
+		}
+		distinct = append(distinct, bound)
+	}
+	if len(distinct) == 0 {
+		return nil
+	}
+	if len(distinct) < parts {
+		return distinct
+	}
+
+	selected := make([]bson.Raw, 0, parts-1)
+	for i := 1; i < parts; i++ {
+		selected = append(selected, distinct[i*len(distinct)/parts])
+	}
+	return selected
+}
+
+func sameRaw(a, b bson.Raw) bool {
+	return a.Kind == b.Kind && bytes.Equal(a.Data, b.Data)
+}
+
+// NewPartitions builds the ranges split by the bounds. a single range without
+// bounds is returned if bounds is empty
+func NewPartitions(replset string, ns utils.NS, bounds []bson.Raw) []*DocProgress {
+	partitions := make([]*DocProgress, 0, len(bounds)+1)
+	for i := 0; i <= len(bounds); i++ {
+		partition := &DocProgress{Replset: replset, Ns: ns.Str(), Part: i}
+		if i > 0 {
+			partition.MinId = bounds[i-1]
+		}
+		if i < len(bounds) {
+			partition.MaxId = bounds[i]
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
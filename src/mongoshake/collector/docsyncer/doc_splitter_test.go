@@ -0,0 +1,89 @@
+package docsyncer
+
+import (
+	"fmt"
+	"testing"
+
+	"mongoshake/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinllen/mgo/bson"
+)
+
+func rawInt(v byte) bson.Raw {
+	return bson.Raw{Kind: 0x10, Data: []byte{v, 0, 0, 0}}
+}
+
+func TestSelectBounds(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestSelectBounds case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, 0, len(selectBounds(nil, 4)), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSelectBounds case %d.\n", nr)
+		nr++
+
+		// duplicated bounds are removed
+		bounds := []bson.Raw{rawInt(1), rawInt(1), rawInt(2)}
+		selected := selectBounds(bounds, 4)
+		assert.Equal(t, []bson.Raw{rawInt(1), rawInt(2)}, selected, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSelectBounds case %d.\n", nr)
+		nr++
+
+		bounds := make([]bson.Raw, 0)
+		for i := 0; i < 40; i++ {
+			bounds = append(bounds, rawInt(byte(i)))
+		}
+		selected := selectBounds(bounds, 4)
+		assert.Equal(t, []bson.Raw{rawInt(10), rawInt(20), rawInt(30)}, selected, "should be equal")
+	}
+}
+
+func TestNewPartitions(t *testing.T) {
+	var nr int
+	ns := utils.NS{Database: "db", Collection: "c"}
+	{
+		fmt.Printf("TestNewPartitions case %d.\n", nr)
+		nr++
+
+		partitions := NewPartitions("rs", ns, nil)
+		assert.Equal(t, 1, len(partitions), "should be equal")
+		assert.Equal(t, byte(0), partitions[0].MinId.Kind, "should be equal")
+		assert.Equal(t, byte(0), partitions[0].MaxId.Kind, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestNewPartitions case %d.\n", nr)
+		nr++
+
+		partitions := NewPartitions("rs", ns, []bson.Raw{rawInt(10), rawInt(20)})
+		assert.Equal(t, 3, len(partitions), "should be equal")
+		assert.Equal(t, byte(0), partitions[0].MinId.Kind, "should be equal")
+		assert.Equal(t, rawInt(10), partitions[0].MaxId, "should be equal")
+		assert.Equal(t, rawInt(10), partitions[1].MinId, "should be equal")
+		assert.Equal(t, rawInt(20), partitions[1].MaxId, "should be equal")
+		assert.Equal(t, rawInt(20), partitions[2].MinId, "should be equal")
+		assert.Equal(t, byte(0), partitions[2].MaxId.Kind, "should be equal")
+		assert.Equal(t, 2, partitions[2].Part, "should be equal")
+		assert.Equal(t, "db.c", partitions[2].Ns, "should be equal")
+	}
+}
+
+func TestTypeBracket(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestTypeBracket case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, typeBracket(0x01), typeBracket(0x12), "should be equal")
+		assert.Equal(t, typeBracket(0x10), typeBracket(0x13), "should be equal")
+		assert.NotEqual(t, typeBracket(0x07), typeBracket(0x02), "should be not equal")
+	}
+}
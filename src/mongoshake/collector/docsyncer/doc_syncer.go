@@ -20,6 +20,14 @@ import (
 
 const (
 	MAX_BUFFER_BYTE_SIZE = 16 * 1024 * 1024
+
+	// create indexes before copying documents, any failure stops the full sync
+	IndexStrategyBefore = "before"
+	// create indexes in foreground after all documents are copied
+	IndexStrategyAfter = "after"
+	// create indexes in background after all documents are copied, the incr
+	// sync begins without waiting for them
+	IndexStrategyBackgroundAfter = "background-after"
 )
 
 func IsShardingToSharding(fromIsSharding bool, toConn *utils.MongoConn) bool {
@@ -40,11 +48,17 @@ func IsShardingToSharding(fromIsSharding bool, toConn *utils.MongoConn) bool {
 	}
 }
 
+// StartDropDestCollection drops or checks the dest collections. namespaces in
+// nsResumeSet are synced partially before, so they are kept as they are.
 func StartDropDestCollection(nsSet map[utils.NS]bool, toConn *utils.MongoConn,
-	nsTrans *transform.NamespaceTransform) (map[string]bool, error) {
+	nsTrans *transform.NamespaceTransform, nsResumeSet map[string]bool) (map[string]bool, error) {
 	nsExistedSet := make(map[string]bool)
 	for ns := range nsSet {
 		toNS := utils.NewNS(nsTrans.Transform(ns.Str()))
+		if _, ok := nsResumeSet[ns.Str()]; ok {
+			LOG.Info("ns %v will be resumed from the checkpoint, skip dropping %v of dest mongodb", ns, toNS)
+			continue
+		}
 		if !conf.Options.ReplayerCollectionDrop {
 			colNames, err := toConn.Session.DB(toNS.Database).CollectionNames()
 			if err != nil {
@@ -134,6 +148,13 @@ func StartNamespaceSpecSyncForSharding(csUrl string, toConn *utils.MongoConn,
 				continue
 			}
 			toNs := nsTrans.Transform(colSpecDoc.Ns)
+			var toColSpecDoc colSpec
+			err = toConn.Session.DB("config").C("collections").
+				Find(bson.D{{"_id", toNs}}).One(&toColSpecDoc)
+			if err == nil && !toColSpecDoc.Dropped {
+				LOG.Info("ns %v of dest mongodb is already sharded", toNs)
+				continue
+			}
 			err = toConn.Session.DB("admin").Run(bson.D{{"shardCollection", toNs},
 				{"key", colSpecDoc.Key}, {"unique", colSpecDoc.Unique}}, nil)
 			if err != nil {
@@ -150,8 +171,10 @@ func StartNamespaceSpecSyncForSharding(csUrl string, toConn *utils.MongoConn,
 	return nil
 }
 
+// StartIndexSync creates indexes on dest mongodb according to the strategy. The
+// failures are only logged unless the strategy is IndexStrategyBefore.
 func StartIndexSync(indexMap map[utils.NS][]mgo.Index, toUrl string,
-	nsExistedSet map[string]bool, nsTrans *transform.NamespaceTransform) (syncError error) {
+	nsExistedSet map[string]bool, nsTrans *transform.NamespaceTransform, strategy string) (syncError error) {
 	type IndexNS struct {
 		ns        utils.NS
 		indexList []mgo.Index
@@ -190,6 +213,7 @@ func StartIndexSync(indexMap map[utils.NS][]mgo.Index, toUrl string,
 	}
 	defer conn.Close()
 
+	var failCount int32
 	if indexNeedSync > 0 {
 		var wg sync.WaitGroup
 		wg.Add(indexNeedSync)
@@ -207,9 +231,10 @@ func StartIndexSync(indexMap map[utils.NS][]mgo.Index, toUrl string,
 					toNS := utils.NewNS(nsTrans.Transform(ns.Str()))
 
 					for _, index := range indexNs.indexList {
-						index.Background = false
-						if err = session.DB(toNS.Database).C(toNS.Collection).EnsureIndex(index); err != nil {
-							LOG.Warn("Create indexes for ns %v of dest mongodb failed. %v", ns, err)
+						index.Background = strategy == IndexStrategyBackgroundAfter
+						if err := session.DB(toNS.Database).C(toNS.Collection).EnsureIndex(index); err != nil {
+							LOG.Warn("Create index %v for ns %v of dest mongodb failed. %v", index.Name, toNS, err)
+							atomic.AddInt32(&failCount, 1)
 						}
 					}
 					LOG.Info("Create indexes for ns %v of dest mongodb finish", toNS)
@@ -222,6 +247,10 @@ func StartIndexSync(indexMap map[utils.NS][]mgo.Index, toUrl string,
 	}
 
 	close(namespaces)
+	if failCount > 0 && strategy == IndexStrategyBefore {
+		return LOG.Critical("document syncer sync index failed, %v indexes can't be created on dest mongodb",
+			failCount)
+	}
 	LOG.Info("document syncer sync index finish")
 	return syncError
 }
@@ -238,9 +267,18 @@ type DBSyncer struct {
 	startTime time.Time
 	// namespace transform
 	nsTrans *transform.NamespaceTransform
+	// field transform, nil if no rules
+	fieldTrans *transform.FieldTransform
 	// filter orphan duplicate record
 	orphanFilter *filter.OrphanFilter
 
+	// per namespace progress, nil if resume is disabled
+	docCkpt *DocCheckpoint
+	// replace the documents existing in dest mongodb
+	overwrite bool
+	// the namespaces to sync, filter.NewDocFilterList() if nil
+	filterList filter.DocFilterChain
+
 	mutex sync.Mutex
 
 	replMetric *utils.ReplicationMetric
@@ -251,7 +289,9 @@ func NewDBSyncer(
 	fromMongoUrl string,
 	toMongoUrl string,
 	nsTrans *transform.NamespaceTransform,
-	orphanFilter *filter.OrphanFilter) *DBSyncer {
+	fieldTrans *transform.FieldTransform,
+	orphanFilter *filter.OrphanFilter,
+	docCkpt *DocCheckpoint) *DBSyncer {
 
 	syncer := &DBSyncer{
 		replset:      replset,
@@ -259,17 +299,34 @@ func NewDBSyncer(
 		ToMongoUrl:   toMongoUrl,
 		indexMap:     make(map[utils.NS][]mgo.Index),
 		nsTrans:      nsTrans,
+		fieldTrans:   fieldTrans,
 		orphanFilter: orphanFilter,
+		docCkpt:      docCkpt,
 	}
 
 	return syncer
 }
 
+// EnableOverwrite makes the syncer replace the stale documents in dest
+// mongodb instead of failing on duplicate key
+func (syncer *DBSyncer) EnableOverwrite() {
+	syncer.overwrite = true
+}
+
+// SetFilter makes the syncer copy the namespaces passing the filters only
+func (syncer *DBSyncer) SetFilter(filterList filter.DocFilterChain) {
+	syncer.filterList = filterList
+}
+
 func (syncer *DBSyncer) Start() (syncError error) {
 	syncer.startTime = time.Now()
 	var wg sync.WaitGroup
 
-	nsList, err := getDbNamespace(syncer.FromMongoUrl)
+	filterList := syncer.filterList
+	if filterList == nil {
+		filterList = filter.NewDocFilterList()
+	}
+	nsList, err := getDbNamespace(syncer.FromMongoUrl, filterList)
 	if err != nil {
 		return err
 	}
@@ -328,33 +385,189 @@ func (syncer *DBSyncer) Start() (syncError error) {
 func (syncer *DBSyncer) collectionSync(collExecutorId int, ns utils.NS,
 	toNS utils.NS) error {
 	reader := NewDocumentReader(syncer.FromMongoUrl, ns)
+	defer reader.Close()
+
+	partitions, resumed, err := syncer.preparePartitions(reader, ns)
+	if err != nil {
+		return err
+	}
+
+	var partDoneCount int32 = 0
+	for _, partition := range partitions {
+		if partition.Done {
+			partDoneCount++
+		}
+	}
+	if int(partDoneCount) == len(partitions) {
+		LOG.Info("document syncer %v ns %v is already synced before", syncer.replset, ns)
+		return syncer.collectIndexes(reader, ns)
+	}
 
 	colExecutor := NewCollectionExecutor(collExecutorId, syncer.ToMongoUrl, toNS)
+	colExecutor.overwrite = syncer.overwrite
+	if syncer.docCkpt != nil {
+		colExecutor.EnableCheckpoint(syncer.docCkpt, syncer.replset, ns, resumed)
+	}
 	if err := colExecutor.Start(); err != nil {
 		return err
 	}
 
+	// all parts feed the same collection executor
+	var wg sync.WaitGroup
+	partErrors := make(chan error, len(partitions))
+	for _, partition := range partitions {
+		if partition.Done {
+			continue
+		}
+		wg.Add(1)
+		partition := partition
+		nimo.GoRoutine(func() {
+			defer wg.Done()
+			count, err := syncer.partitionSync(colExecutor, ns, partition)
+			if err != nil {
+				partErrors <- err
+				return
+			}
+			if len(partitions) > 1 {
+				done := atomic.AddInt32(&partDoneCount, 1)
+				LOG.Info("document syncer %v ns %v part %v read %v documents. ns progress %v/%v parts",
+					syncer.replset, ns, partition.Part, count, done, len(partitions))
+			}
+		})
+	}
+	wg.Wait()
+	close(partErrors)
+
+	if err := colExecutor.Wait(); err != nil {
+		return err
+	}
+	// the first error of parts
+	if err := <-partErrors; err != nil {
+		return err
+	}
+
+	if syncer.docCkpt != nil {
+		for _, partition := range partitions {
+			if partition.Done {
+				continue
+			}
+			if err := syncer.docCkpt.Finish(syncer.replset, ns, partition.Part); err != nil {
+				LOG.Warn("document syncer %v flush checkpoint of ns %v part %v failed. %v",
+					syncer.replset, ns, partition.Part, err)
+			}
+		}
+	}
+
+	return syncer.collectIndexes(reader, ns)
+}
+
+// preparePartitions returns the _id ranges of the namespace, and whether they
+// are resumed from the checkpoint
+func (syncer *DBSyncer) preparePartitions(reader *DocumentReader, ns utils.NS) ([]*DocProgress, bool, error) {
+	if syncer.docCkpt != nil {
+		if partitions := syncer.docCkpt.Partitions(syncer.replset, ns); partitions != nil {
+			LOG.Info("document syncer %v resume ns %v with %v parts from the checkpoint",
+				syncer.replset, ns, len(partitions))
+			if err := syncer.checkResumeIdType(reader, ns, partitions); err != nil {
+				return nil, false, err
+			}
+			return partitions, true, nil
+		}
+	}
+
+	if err := reader.ensureConnection(); err != nil {
+		return nil, false, errors.New(fmt.Sprintf("Connect to ns %v of src mongodb failed. %v", ns, err))
+	}
+	threshold := conf.Options.ReplayerCollectionSplitThreshold * 1024 * 1024
+	bounds, err := SplitCollection(reader.conn, ns, threshold, conf.Options.ReplayerCollectionSplitParallel)
+	if err != nil {
+		LOG.Warn("document syncer %v split ns %v failed, sync it as a whole. %v", syncer.replset, ns, err)
+		bounds = nil
+	}
+
+	partitions := NewPartitions(syncer.replset, ns, bounds)
+	if len(partitions) > 1 {
+		LOG.Info("document syncer %v split ns %v into %v parts", syncer.replset, ns, len(partitions))
+	}
+	if syncer.docCkpt != nil {
+		if err := syncer.docCkpt.SetPartitions(partitions); err != nil {
+			return nil, false, err
+		}
+	}
+	return partitions, false, nil
+}
+
+// checkResumeIdType makes the namespace which isn't split copied from the
+// beginning if its _id are of different types, since the range query after
+// the last _id only matches the _id of the same type
+func (syncer *DBSyncer) checkResumeIdType(reader *DocumentReader, ns utils.NS, partitions []*DocProgress) error {
+	if len(partitions) != 1 {
+		// the split namespace has _id of the same type
+		return nil
+	}
+	partition := partitions[0]
+	if partition.Done || partition.LastId.Kind == 0 || partition.MinId.Kind != 0 || partition.MaxId.Kind != 0 {
+		return nil
+	}
+
+	if err := reader.ensureConnection(); err != nil {
+		return errors.New(fmt.Sprintf("Connect to ns %v of src mongodb failed. %v", ns, err))
+	}
+	if same, err := isSameIdType(reader.conn, ns); err != nil {
+		LOG.Warn("document syncer %v check _id type of ns %v failed, copy it from the beginning. %v",
+			syncer.replset, ns, err)
+	} else if same {
+		return nil
+	} else {
+		LOG.Warn("document syncer %v ns %v has _id of different types, copy it from the beginning",
+			syncer.replset, ns)
+	}
+	// the documents written before are skipped as duplicated
+	partition.LastId = bson.Raw{}
+	return syncer.docCkpt.SetPartitions(partitions)
+}
+
+// partitionSync reads the _id range of the namespace and dispatches the
+// documents to colExecutor. it returns the number of documents read
+func (syncer *DBSyncer) partitionSync(colExecutor *CollectionExecutor, ns utils.NS,
+	partition *DocProgress) (int64, error) {
+	reader := NewDocumentReader(syncer.FromMongoUrl, ns)
+	defer reader.Close()
+
+	reader.SetRange(&partition.MinId, &partition.MaxId)
+	if syncer.docCkpt != nil {
+		var lastId *bson.Raw
+		if partition.LastId.Kind != 0 {
+			lastId = &partition.LastId
+			LOG.Info("document syncer %v resume ns %v part %v from the checkpoint",
+				syncer.replset, ns, partition.Part)
+		}
+		reader.EnableResume(lastId)
+	}
+
 	bufferSize := conf.Options.ReplayerDocumentBatchSize
 	buffer := make([]*bson.Raw, 0, bufferSize)
 	bufferByteSize := 0
+	// the last document read into buffer, including the filtered ones
+	var lastDoc *bson.Raw
+	var count int64
 
 	for {
 		var doc *bson.Raw
 		var err error
 		if doc, err = reader.NextDoc(); err != nil {
-			return errors.New(fmt.Sprintf("Get next document from ns %v of src mongodb failed. %v", ns, err))
+			return count, errors.New(fmt.Sprintf("Get next document from ns %v of src mongodb failed. %v", ns, err))
 		} else if doc == nil {
-			colExecutor.Sync(buffer)
-			if err := colExecutor.Wait(); err != nil {
-				return err
-			}
+			colExecutor.Sync(buffer, partition.Part, syncer.getDocId(lastDoc))
 			break
 		}
 		if bufferByteSize+len(doc.Data) > MAX_BUFFER_BYTE_SIZE || len(buffer) >= bufferSize {
-			colExecutor.Sync(buffer)
+			colExecutor.Sync(buffer, partition.Part, syncer.getDocId(lastDoc))
 			buffer = make([]*bson.Raw, 0, bufferSize)
 			bufferByteSize = 0
 		}
+		lastDoc = doc
+		count++
 
 		// filter orphan document of chunk
 		if conf.Options.FilterOrphanDocument && syncer.orphanFilter.Filter(doc, ns.Str()) {
@@ -366,10 +579,18 @@ func (syncer *DBSyncer) collectionSync(collExecutorId int, ns utils.NS,
 			doc = transform.TransformDBRef(doc, ns.Database, syncer.nsTrans)
 		}
 
+		// transform fields by the rules of source namespace
+		if syncer.fieldTrans != nil {
+			doc = syncer.fieldTrans.TransformRawDoc(ns.Str(), doc)
+		}
+
 		buffer = append(buffer, doc)
 		bufferByteSize += len(doc.Data)
 	}
+	return count, nil
+}
 
+func (syncer *DBSyncer) collectIndexes(reader *DocumentReader, ns utils.NS) error {
 	if indexes, err := reader.GetIndexes(); err != nil {
 		return errors.New(fmt.Sprintf("Get indexes from ns %v of src mongodb failed. %v", ns, err))
 	} else {
@@ -377,11 +598,24 @@ func (syncer *DBSyncer) collectionSync(collExecutorId int, ns utils.NS,
 		defer syncer.mutex.Unlock()
 		syncer.indexMap[ns] = indexes
 	}
-
-	reader.Close()
 	return nil
 }
 
+// getDocId returns nil if checkpoint is disabled
+func (syncer *DBSyncer) getDocId(doc *bson.Raw) *bson.Raw {
+	if syncer.docCkpt == nil || doc == nil {
+		return nil
+	}
+	var idDoc struct {
+		Id bson.Raw `bson:"_id"`
+	}
+	if err := doc.Unmarshal(&idDoc); err != nil {
+		LOG.Warn("document syncer %v get _id of document failed. %v", syncer.replset, err)
+		return nil
+	}
+	return &idDoc.Id
+}
+
 func (syncer *DBSyncer) GetIndexMap() map[utils.NS][]mgo.Index {
 	return syncer.indexMap
 }
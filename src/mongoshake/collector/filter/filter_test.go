@@ -248,3 +248,35 @@ func TestAutologousFilter(t *testing.T) {
 		assert.Equal(t, false, filter.Filter(log), "should be equal")
 	}
 }
+
+func TestLoopFilter(t *testing.T) {
+	// test LoopFilter
+
+	var nr int
+	{
+		fmt.Printf("TestLoopFilter case %d.\n", nr)
+		nr++
+
+		filter := new(LoopFilter)
+		marked := append(append([]byte{}, utils.LoopMarker...), 1, 2, 3, 4, 5, 6, 7, 8)
+		unmarked := []byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+
+		log := &oplog.PartialLog{}
+		assert.Equal(t, false, filter.Filter(log), "should be equal")
+
+		log = &oplog.PartialLog{
+			Lsid: bson.M{"id": bson.Binary{Kind: 0x04, Data: unmarked}},
+		}
+		assert.Equal(t, false, filter.Filter(log), "should be equal")
+
+		log = &oplog.PartialLog{
+			Lsid: bson.M{"id": bson.Binary{Kind: 0x04, Data: marked}},
+		}
+		assert.Equal(t, true, filter.Filter(log), "should be equal")
+
+		log = &oplog.PartialLog{
+			Lsid: bson.D{{"id", bson.Binary{Kind: 0x04, Data: marked}}, {"uid", bson.Binary{Data: unmarked}}},
+		}
+		assert.Equal(t, true, filter.Filter(log), "should be equal")
+	}
+}
@@ -12,7 +12,7 @@ import (
 	"github.com/vinllen/mgo/bson"
 )
 
-// OplogFilter: AutologousFilter, NamespaceFilter, GidFilter, NoopFilter, DDLFilter
+// OplogFilter: AutologousFilter, NamespaceFilter, GidFilter, NoopFilter, DDLFilter, LoopFilter
 type OplogFilter interface {
 	Filter(log *oplog.PartialLog) bool
 }
@@ -113,6 +113,15 @@ func (filter *MigrateFilter) Filter(log *oplog.PartialLog) bool {
 	return log.FromMigrate
 }
 
+// LoopFilter drops the oplogs written by the collector of reverse direction
+// in bidirectional replication, whose session ids are marked
+type LoopFilter struct {
+}
+
+func (filter *LoopFilter) Filter(log *oplog.PartialLog) bool {
+	return utils.HasLoopMarker(log.Lsid)
+}
+
 // because regexp use the default perl engine which is not support inverse match, so
 // use two rules to match
 type NamespaceFilter struct {
@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+
+	"github.com/gugemichael/nimo4go"
+)
+
+const (
+	HealthPath = "/health"
+
+	// stages of replication shown in HealthPath
+	HealthStageStartup  = "startup"
+	HealthStageFullSync = "full sync"
+	HealthStageIncrSync = "incr sync"
+)
+
+type ReplsetHealth struct {
+	*utils.Lag
+	Problems []string `json:"problems,omitempty"`
+}
+
+type Health struct {
+	Healthy  bool                      `json:"healthy"`
+	Stage    string                    `json:"stage"`
+	Replsets map[string]*ReplsetHealth `json:"replsets"`
+}
+
+// HealthAPI serves HealthPath since startup. The restful api of http_profile
+// answers the health in json, and HealthPath of http.DefaultServeMux, which
+// is listened by system_profile, answers 503 as well if unhealthy for the
+// probe of load balancer. Only the syncers of incr sync are checked, the
+// stage is shown so full sync isn't taken as healthy incr sync
+func (coordinator *ReplicationCoordinator) HealthAPI() {
+	coordinator.setStage(HealthStageStartup)
+
+	utils.HttpApi.RegisterAPI(HealthPath, nimo.HttpGet, func([]byte) interface{} {
+		return coordinator.health()
+	})
+	http.HandleFunc(HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		health := coordinator.health()
+		data, _ := json.Marshal(health)
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+	})
+}
+
+func (coordinator *ReplicationCoordinator) health() *Health {
+	health := &Health{Healthy: true, Stage: coordinator.getStage(), Replsets: make(map[string]*ReplsetHealth)}
+	// syncerGroup is complete once incr sync begins
+	if health.Stage != HealthStageIncrSync {
+		return health
+	}
+	for _, syncer := range coordinator.syncerGroup {
+		replset := &ReplsetHealth{Lag: syncer.replMetric.Lag()}
+		replset.Problems = checkLag(replset.Lag)
+		if len(replset.Problems) != 0 {
+			health.Healthy = false
+		}
+		health.Replsets[syncer.replset] = replset
+	}
+	return health
+}
+
+func (coordinator *ReplicationCoordinator) setStage(stage string) {
+	coordinator.stage.Store(stage)
+}
+
+func (coordinator *ReplicationCoordinator) getStage() string {
+	if stage, ok := coordinator.stage.Load().(string); ok {
+		return stage
+	}
+	return HealthStageStartup
+}
+
+// checkLag returns the thresholds crossed by lag
+func checkLag(lag *utils.Lag) []string {
+	var problems []string
+	if conf.Options.HealthMaxLag > 0 && lag.Apply >= 0 && lag.Apply > conf.Options.HealthMaxLag {
+		problems = append(problems, fmt.Sprintf("apply lag %vs exceeds health.max_lag %vs",
+			lag.Apply, conf.Options.HealthMaxLag))
+	}
+	if conf.Options.HealthMinOplogWindow > 0 && lag.OplogWindow >= 0 &&
+		lag.OplogWindow < conf.Options.HealthMinOplogWindow {
+		problems = append(problems, fmt.Sprintf("oplog window %vs is less than health.min_oplog_window %vs",
+			lag.OplogWindow, conf.Options.HealthMinOplogWindow))
+	}
+	if lag.Exhausting {
+		problems = append(problems, fmt.Sprintf("oplog window %vs is less than %v%% of oplog span %vs",
+			lag.OplogWindow, conf.Options.SyncerOplogWindowWarnPercent, lag.OplogSpan))
+	}
+	return problems
+}
@@ -0,0 +1,437 @@
+// +build darwin linux windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"mongoshake/collector"
+	"mongoshake/collector/configure"
+	"mongoshake/collector/filter"
+	"mongoshake/collector/oplogsyncer"
+	"mongoshake/common"
+	"mongoshake/executor"
+	"mongoshake/tunnel/kafka"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	CheckPass = "PASS"
+	CheckWarn = "WARN"
+	CheckFail = "FAIL"
+
+	// a rough speed of full sync to estimate its duration
+	CheckFullSyncBytesPerSecond = 50 * 1024 * 1024
+	checkDialTimeout            = 10 * time.Second
+)
+
+var (
+	// any of them is enough for the source, or the target of direct tunnel
+	checkSourceRoles = []string{"root", "__system", "backup", "readAnyDatabase", "readWriteAnyDatabase"}
+	checkTargetRoles = []string{"root", "__system", "readWriteAnyDatabase"}
+)
+
+type checkItem struct {
+	level  string
+	name   string
+	detail string
+}
+
+// checkReport collects the result of each check item
+type checkReport struct {
+	items []*checkItem
+}
+
+func (report *checkReport) add(level, name, format string, args ...interface{}) {
+	report.items = append(report.items, &checkItem{level: level, name: name, detail: fmt.Sprintf(format, args...)})
+}
+
+func (report *checkReport) failed() bool {
+	for _, item := range report.items {
+		if item.level == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *checkReport) print() {
+	count := map[string]int{}
+	for _, item := range report.items {
+		fmt.Printf("[%s] %s: %s\n", item.level, item.name, item.detail)
+		count[item.level]++
+	}
+	fmt.Printf("%d pass, %d warn, %d fail\n", count[CheckPass], count[CheckWarn], count[CheckFail])
+}
+
+// checkPreflight verifies the configuration and the connectivity of source, config
+// server, checkpoint storage and tunnel without replicating anything. It
+// returns false if any item fails
+func checkPreflight() bool {
+	report := new(checkReport)
+	defer report.print()
+
+	if err := sanitizeOptions(); err != nil {
+		report.add(CheckFail, "configuration", "%v", err)
+		return false
+	}
+	report.add(CheckPass, "configuration", "sync_mode[%v] tunnel[%v]", conf.Options.SyncMode, conf.Options.Tunnel)
+
+	// keep the logs of driver out of the report
+	if err := utils.InitialLogger(conf.Options.LogDirectory, conf.Options.LogFileName, conf.Options.LogLevel,
+		conf.Options.LogBuffer, false); err != nil {
+		report.add(CheckFail, "log", "initial log.dir[%v] log.name[%v] failed. %v", conf.Options.LogDirectory,
+			conf.Options.LogFileName, err)
+		return false
+	}
+
+	replsets, namespaces := checkSources(report)
+	checkConfigServer(report, replsets)
+	checkFilter(report, namespaces)
+	checkCheckpointStorage(report)
+	checkTunnel(report)
+	return !report.failed()
+}
+
+// checkSources returns the replica set names and the namespaces of sources
+func checkSources(report *checkReport) ([]string, []string) {
+	var replsets, namespaces []string
+	seen := make(map[string]bool)
+	for i, rawurl := range conf.Options.MongoUrls {
+		url, _ := utils.ParseMongoUrl(rawurl)
+		name := fmt.Sprintf("source[%d]", i)
+		conn, err := utils.NewMongoConn(url, conf.Options.MongoConnectMode, true)
+		if err != nil || !conn.IsGood() {
+			report.add(CheckFail, name, "connect %v failed. %v", url, err)
+			if conn != nil {
+				conn.Close()
+			}
+			continue
+		}
+
+		version, err := utils.GetDBVersion(conn.Session)
+		if err != nil {
+			report.add(CheckWarn, name, "get version failed. %v", err)
+		} else {
+			report.add(CheckPass, name, "connected, version %v", version)
+		}
+		if rs, err := conn.AcquireReplicaSetName(); err != nil {
+			report.add(CheckWarn, name, "get replica set name failed. %v", err)
+		} else if seen[rs] {
+			report.add(CheckFail, name, "duplicate replica set name %v", rs)
+		} else {
+			seen[rs] = true
+			replsets = append(replsets, rs)
+		}
+		checkRoles(report, name, conn, checkSourceRoles)
+
+		list, err := listNamespaces(conn)
+		if err != nil {
+			report.add(CheckFail, name, "list namespaces failed. %v", err)
+		}
+		namespaces = append(namespaces, list...)
+
+		if conf.Options.SyncMode != collector.SYNCMODE_DOCUMENT {
+			if conf.Options.SyncerReaderFetchMethod == oplogsyncer.FetchMethodChangeStream {
+				if ok, _ := utils.GetAndCompareVersion(conn.Session, "4.0.0"); !ok {
+					report.add(CheckFail, name, "change stream needs MongoDB 4.0+")
+				}
+			} else {
+				checkOplog(report, name, conn)
+			}
+		}
+		conn.Close()
+	}
+	return replsets, namespaces
+}
+
+// checkOplog verifies the permission of local database, and estimates
+// whether the oplog window is enough for full sync
+func checkOplog(report *checkReport, name string, conn *utils.MongoConn) {
+	if !conn.HasOplogNs() {
+		report.add(CheckFail, name, "no local.oplog.rs or no read permission of local database")
+		return
+	}
+	oldest, err := utils.GetOldestTimestampBySession(conn.Session)
+	var newest bson.MongoTimestamp
+	if err == nil {
+		newest, err = utils.GetNewestTimestampBySession(conn.Session)
+	}
+	if err != nil {
+		report.add(CheckFail, name, "read local.oplog.rs failed. %v", err)
+		return
+	}
+	window := utils.ExtractTs32(newest) - utils.ExtractTs32(oldest)
+
+	var stats struct {
+		MaxSize int64 `bson:"maxSize"`
+	}
+	if err := conn.Session.DB(utils.LocalDB).Run(bson.D{{"collStats", utils.OplogNS}}, &stats); err != nil {
+		report.add(CheckWarn, name, "get oplog size failed. %v", err)
+	}
+	dataSize, err := sumDataSize(conn)
+	if err != nil {
+		report.add(CheckWarn, name, "get data size failed. %v", err)
+	}
+	detail := fmt.Sprintf("oplog window %vs, oplog size %vMB, data size %vMB", window, stats.MaxSize>>20,
+		dataSize>>20)
+
+	// the oplogs since full sync begins must be kept until it finishes
+	if estimated := dataSize / CheckFullSyncBytesPerSecond; conf.Options.SyncMode == collector.SYNCMODE_ALL &&
+		window < estimated {
+		report.add(CheckWarn, name, "%s, less than the estimated full sync time %vs", detail, estimated)
+	} else {
+		report.add(CheckPass, name, "%s", detail)
+	}
+}
+
+// checkRoles warns if the user has none of the roles. Nothing is checked
+// if authentication is disabled
+func checkRoles(report *checkReport, name string, conn *utils.MongoConn, roles []string) {
+	var status struct {
+		AuthInfo struct {
+			Users []interface{} `bson:"authenticatedUsers"`
+			Roles []struct {
+				Role string `bson:"role"`
+			} `bson:"authenticatedUserRoles"`
+		} `bson:"authInfo"`
+	}
+	if err := conn.Session.DB("admin").Run(bson.M{"connectionStatus": 1}, &status); err != nil {
+		report.add(CheckWarn, name, "get roles failed. %v", err)
+		return
+	}
+	if len(status.AuthInfo.Users) == 0 {
+		return
+	}
+	var granted []string
+	for _, role := range status.AuthInfo.Roles {
+		for _, wanted := range roles {
+			if role.Role == wanted {
+				report.add(CheckPass, name, "role %v", role.Role)
+				return
+			}
+		}
+		granted = append(granted, role.Role)
+	}
+	report.add(CheckWarn, name, "roles %v may be insufficient, any of %v is recommended", granted, roles)
+}
+
+func listNamespaces(conn *utils.MongoConn) ([]string, error) {
+	dbNames, err := conn.Session.DatabaseNames()
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, db := range dbNames {
+		colNames, err := conn.Session.DB(db).CollectionNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range colNames {
+			if !strings.HasPrefix(col, "system.") {
+				namespaces = append(namespaces, db+"."+col)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// sumDataSize returns the bytes of all databases except admin, local and config
+func sumDataSize(conn *utils.MongoConn) (int64, error) {
+	dbNames, err := conn.Session.DatabaseNames()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, db := range dbNames {
+		if db == "admin" || db == utils.LocalDB || db == utils.ConfigDB {
+			continue
+		}
+		var stats struct {
+			DataSize float64 `bson:"dataSize"`
+		}
+		if err := conn.Session.DB(db).Run(bson.M{"dbStats": 1}, &stats); err != nil {
+			return 0, err
+		}
+		total += int64(stats.DataSize)
+	}
+	return total, nil
+}
+
+// checkConfigServer verifies that the shards of config server are the sources,
+// and the balancer is stopped for full sync
+func checkConfigServer(report *checkReport, replsets []string) {
+	name := "mongo_cs_url"
+	if conf.Options.MongoCsUrl == "" {
+		return
+	}
+	conn, err := utils.NewMongoConn(conf.Options.MongoCsUrl, utils.ConnectModePrimary, true)
+	if err != nil || !conn.IsGood() {
+		report.add(CheckFail, name, "connect %v failed. %v", conf.Options.MongoCsUrl, err)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	defer conn.Close()
+
+	var shards []struct {
+		Host string `bson:"host"`
+	}
+	if err := conn.Session.DB(utils.ConfigDB).C(utils.ShardCol).Find(bson.M{}).All(&shards); err != nil {
+		report.add(CheckFail, name, "read shards failed. %v", err)
+		return
+	}
+	shardSet := make(map[string]bool)
+	for _, shard := range shards {
+		shardSet[strings.Split(shard.Host, "/")[0]] = true
+	}
+	for _, replset := range replsets {
+		if !shardSet[replset] {
+			report.add(CheckFail, name, "replica set %v of mongo_urls isn't a shard of it", replset)
+			return
+		}
+	}
+	report.add(CheckPass, name, "%d shards", len(shards))
+
+	if conf.Options.SyncMode != collector.SYNCMODE_OPLOG {
+		if running, err := utils.GetBalancerStatusByUrl(conf.Options.MongoCsUrl); err != nil {
+			report.add(CheckWarn, name, "get balancer status failed. %v", err)
+		} else if running {
+			report.add(CheckFail, name, "balancer should be stopped for document replication")
+		}
+	}
+}
+
+// checkFilter warns if any namespace of filter matches nothing in source
+func checkFilter(report *checkReport, namespaces []string) {
+	name := "filter"
+	if len(conf.Options.FilterNamespaceWhite) == 0 && len(conf.Options.FilterNamespaceBlack) == 0 {
+		return
+	}
+	match := func(rule, ns string) bool {
+		return ns == rule || strings.HasPrefix(ns, rule+".")
+	}
+	for _, rule := range append(conf.Options.FilterNamespaceWhite, conf.Options.FilterNamespaceBlack...) {
+		found := false
+		for _, ns := range namespaces {
+			if match(rule, ns) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report.add(CheckWarn, name, "%v matches no namespace of source", rule)
+		}
+	}
+
+	filterList := filter.NewDocFilterList()
+	var passed int
+	for _, ns := range namespaces {
+		if !filterList.IterateFilter(ns) {
+			passed++
+		}
+	}
+	if passed == 0 {
+		report.add(CheckWarn, name, "all the %d namespaces of source are filtered", len(namespaces))
+	} else {
+		report.add(CheckPass, name, "%d of %d namespaces of source are synced", passed, len(namespaces))
+	}
+}
+
+func checkCheckpointStorage(report *checkReport) {
+	name := "checkpoint storage"
+	if conf.Options.SyncMode == collector.SYNCMODE_DOCUMENT && !conf.Options.ReplayerDocumentResume {
+		return
+	}
+	storage, err := utils.NewCheckpointStorage(false)
+	if err != nil {
+		report.add(CheckFail, name, "create %v storage failed. %v", conf.Options.ContextStorage, err)
+		return
+	}
+	defer storage.Close()
+	docs, err := storage.Load(conf.Options.ContextStorageCollection + "_oplog")
+	if err != nil {
+		report.add(CheckFail, name, "load checkpoint failed. %v", err)
+		return
+	}
+	report.add(CheckPass, name, "%v storage, %d checkpoints found", conf.Options.ContextStorage, len(docs))
+}
+
+func checkTunnel(report *checkReport) {
+	name := "tunnel"
+	switch conf.Options.Tunnel {
+	case "direct":
+		for i, address := range conf.Options.TunnelAddress {
+			checkTarget(report, fmt.Sprintf("target[%d]", i), address)
+		}
+	case "rpc", "tcp":
+		checkDial(report, name, conf.Options.TunnelAddress[0])
+	case "kafka":
+		brokers, err := kafka.Brokers(conf.Options.TunnelAddress[0])
+		if err != nil {
+			report.add(CheckFail, name, "illegal kafka address %v. %v", conf.Options.TunnelAddress[0], err)
+			return
+		}
+		for _, broker := range brokers {
+			checkDial(report, name, broker)
+		}
+	case "file":
+		info, err := os.Stat(conf.Options.TunnelAddress[0])
+		if os.IsNotExist(err) {
+			report.add(CheckWarn, name, "folder %v doesn't exist and will be created", conf.Options.TunnelAddress[0])
+		} else if err != nil || !info.IsDir() {
+			report.add(CheckFail, name, "%v isn't a folder. %v", conf.Options.TunnelAddress[0], err)
+		} else {
+			report.add(CheckPass, name, "folder %v", conf.Options.TunnelAddress[0])
+		}
+	default:
+		report.add(CheckPass, name, "%v", conf.Options.Tunnel)
+	}
+}
+
+func checkDial(report *checkReport, name, address string) {
+	conn, err := net.DialTimeout("tcp", address, checkDialTimeout)
+	if err != nil {
+		report.add(CheckFail, name, "connect %v failed. %v", address, err)
+		return
+	}
+	conn.Close()
+	report.add(CheckPass, name, "connected %v", address)
+}
+
+func checkTarget(report *checkReport, name, address string) {
+	conn, err := utils.NewMongoConn(address, utils.ConnectModePrimary, true)
+	if err != nil || !conn.IsGood() {
+		report.add(CheckFail, name, "connect %v failed. %v", address, err)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	defer conn.Close()
+
+	version, err := utils.GetDBVersion(conn.Session)
+	if err != nil {
+		report.add(CheckWarn, name, "get version failed. %v", err)
+	} else {
+		report.add(CheckPass, name, "connected, version %v", version)
+	}
+	checkRoles(report, name, conn, checkTargetRoles)
+	if conf.Options.ReplayerExactlyOnce {
+		if ok, _ := utils.GetAndCompareVersion(conn.Session, executor.TransactionVersion); !ok {
+			report.add(CheckFail, name, "replayer.exactly_once needs MongoDB %v+", executor.TransactionVersion)
+		}
+	}
+	if conf.Options.ReplayerLoopPrevention {
+		if ok, _ := utils.GetAndCompareVersion(conn.Session, executor.RetryableWriteVersion); !ok {
+			report.add(CheckFail, name, "replayer.loop_prevention needs MongoDB %v+",
+				executor.RetryableWriteVersion)
+		}
+	}
+}
@@ -7,19 +7,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/gugemichael/nimo4go"
 	LOG "github.com/vinllen/log4go"
 	"github.com/vinllen/mgo/bson"
 	"mongoshake/collector"
 	"mongoshake/collector/configure"
+	"mongoshake/collector/docsyncer"
+	"mongoshake/collector/oplogsyncer"
 	"mongoshake/common"
 	"mongoshake/executor"
 	"mongoshake/modules"
 	"mongoshake/oplog"
 	"mongoshake/quorum"
+	"mongoshake/tunnel"
 )
 
 type Exit struct{ Code int }
@@ -34,6 +39,7 @@ func main() {
 	configuration := flag.String("conf", "", "configure file absolute path")
 	verbose := flag.Bool("verbose", false, "show logs on console")
 	version := flag.Bool("version", false, "show version")
+	check := flag.Bool("check", false, "check the configuration and connectivity, then exit")
 	flag.Parse()
 
 	if *configuration == "" || *version == true {
@@ -52,6 +58,13 @@ func main() {
 		crash(fmt.Sprintf("Configure file %s parse failed. %v", *configuration, err), -2)
 	}
 
+	if *check {
+		if !checkPreflight() {
+			crash("Check failed", -9)
+		}
+		panic(Exit{0})
+	}
+
 	// verify collector options and revise
 	if err = sanitizeOptions(); err != nil {
 		crash(fmt.Sprintf("Conf.Options check failed: %s", err.Error()), -4)
@@ -64,6 +77,7 @@ func main() {
 
 	conf.Options.Version = utils.BRANCH
 
+	utils.InitPrometheus()
 	nimo.Profiling(conf.Options.SystemProfile)
 	signalProfile, _ := strconv.Atoi(utils.SIGNALPROFILE)
 	signalStack, _ := strconv.Atoi(utils.SIGNALSTACK)
@@ -78,11 +92,11 @@ func main() {
 
 	// get exclusive process lock and write pid
 	if utils.WritePidById(conf.Options.LogDirectory, conf.Options.CollectorId) {
-		startup()
+		startup(*configuration)
 	}
 }
 
-func startup() {
+func startup(configuration string) {
 	// leader election at the beginning
 	selectLeader()
 
@@ -92,10 +106,22 @@ func startup() {
 	utils.HttpApi.RegisterAPI("/conf", nimo.HttpGet, func([]byte) interface{} {
 		return &conf.Options
 	})
+	utils.PrometheusRestAPI()
 
 	coordinator := &collector.ReplicationCoordinator{
 		Sources: make([]*utils.MongoSource, len(conf.Options.MongoUrls)),
 	}
+	coordinator.HealthAPI()
+
+	// the http api is listened before replication, so the health is shown
+	// in full sync
+	listened := make(chan error, 1)
+	go func() {
+		err := utils.HttpApi.Listen()
+		LOG.Critical("Coordinator http api listen failed. %v", err)
+		listened <- err
+	}()
+
 	// start mongodb replication
 	if err := coordinator.Run(); err != nil {
 		// initial or connection established failed
@@ -103,10 +129,94 @@ func startup() {
 	}
 
 	// if the sync mode is "document", mongoshake should exit here.
-	if conf.Options.SyncMode != collector.SYNCMODE_DOCUMENT {
-		if err := utils.HttpApi.Listen(); err != nil {
-			LOG.Critical("Coordinator http api listen failed. %v", err)
+	if conf.Options.SyncMode == collector.SYNCMODE_DOCUMENT {
+		return
+	}
+
+	// the incr sync is drained on SIGTERM or SIGINT
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	// the filters and transforms are reloaded from the configure file on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			reload(coordinator, configuration)
 		}
+	}()
+
+	// exit after all syncers reach the stop position
+	if conf.Options.ContextStopPosition != 0 {
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- coordinator.WaitStopPosition()
+		}()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				crash(fmt.Sprintf("Flush checkpoint at stop position failed: %v", err), -7)
+			}
+			LOG.Info("Collector reach stop position[%v] and exit", conf.Options.ContextStopPosition)
+		case sig := <-signals:
+			shutdown(coordinator, sig)
+		}
+		return
+	}
+
+	select {
+	case <-listened:
+		// the failure is logged by the listener
+	case sig := <-signals:
+		shutdown(coordinator, sig)
+	}
+}
+
+// shutdown drains the incr sync, flushes the checkpoint and releases the
+// master in shutdown.timeout, the process exits with 0 if it succeeds
+func shutdown(coordinator *collector.ReplicationCoordinator, sig os.Signal) {
+	LOG.Info("Collector receive signal %v, shutdown begin", sig)
+	err := coordinator.Shutdown(time.Duration(conf.Options.ShutdownTimeout) * time.Second)
+	if conf.Options.MasterQuorum && conf.Options.ContextStorage == collector.StorageTypeDB {
+		if err := quorum.ReleaseMaster(conf.Options.ContextStorageUrl, utils.AppDatabase()); err != nil {
+			LOG.Warn("Release the master failed. %v", err)
+		}
+	}
+	if err != nil {
+		crash(fmt.Sprintf("Collector shutdown failed: %v", err), -8)
+	}
+	LOG.Info("Collector shutdown successfully")
+}
+
+// reload replaces the filters and transforms by the ones in configure file
+func reload(coordinator *collector.ReplicationCoordinator, configuration string) {
+	LOG.Info("Collector reload from configure file %s", configuration)
+	file, err := os.Open(configuration)
+	if err != nil {
+		LOG.Error("Configure file open failed. %v", err)
+		return
+	}
+	defer file.Close()
+
+	var options conf.Configuration
+	configure := nimo.NewConfigLoader(file)
+	configure.SetDateFormat(utils.GolangSecurityTime)
+	if err := configure.Load(&options); err != nil {
+		LOG.Error("Configure file %s parse failed. %v", configuration, err)
+		return
+	}
+	// the empty rules in configure file clear the current ones
+	rules := &collector.ReloadRules{
+		FilterNamespaceWhite: append([]string{}, options.FilterNamespaceWhite...),
+		FilterNamespaceBlack: append([]string{}, options.FilterNamespaceBlack...),
+		Backfill:             options.FilterNamespaceBackfill,
+	}
+	// transform.namespace is applied by receiver with the other tunnels
+	if conf.Options.Tunnel == "direct" {
+		rules.TransformNamespace = append([]string{}, options.TransformNamespace...)
+	}
+	if err := coordinator.Reload(rules); err != nil {
+		LOG.Error("Collector reload failed. %v", err)
 	}
 }
 
@@ -155,7 +265,7 @@ func sanitizeOptions() error {
 			return errors.New("config server url should not be configured when transfer from mongo replica set")
 		}
 	}
-	if conf.Options.ContextStorageUrl == "" {
+	if conf.Options.ContextStorageUrl == "" && conf.Options.ContextStorage == collector.StorageTypeDB {
 		if len(conf.Options.MongoUrls) == 1 {
 			conf.Options.ContextStorageUrl = conf.Options.MongoUrls[0]
 		} else if len(conf.Options.MongoUrls) > 1 {
@@ -190,6 +300,21 @@ func sanitizeOptions() error {
 	} else if conf.Options.CheckpointInterval  == 0 {
 		conf.Options.CheckpointInterval = 5000 // set default to 5 seconds
 	}
+	if conf.Options.SyncerOplogWindowWarnPercent < 0 || conf.Options.SyncerOplogWindowWarnPercent > 100 {
+		return errors.New("syncer.oplog_window.warn_percent should be in [0, 100]")
+	}
+	if conf.Options.HealthMaxLag < 0 || conf.Options.HealthMinOplogWindow < 0 {
+		return errors.New("health.max_lag and health.min_oplog_window should be >= 0")
+	}
+	if conf.Options.ShutdownTimeout <= 0 {
+		conf.Options.ShutdownTimeout = 60 // set default to 1 minute
+	}
+	if conf.Options.CheckpointHistorySize < 0 {
+		return errors.New("checkpoint history size is negative")
+	}
+	if conf.Options.CheckpointHistoryInterval <= 0 {
+		conf.Options.CheckpointHistoryInterval = 60 // set default to 1 minute
+	}
 	if conf.Options.ShardKey != oplog.ShardByNamespace &&
 		conf.Options.ShardKey != oplog.ShardByID &&
 		conf.Options.ShardKey != oplog.ShardAutomatic {
@@ -207,9 +332,13 @@ func sanitizeOptions() error {
 	if conf.Options.ContextStorage == "" || conf.Options.ContextStorageDB == "" ||
 		conf.Options.ContextStorageCollection == "" ||
 		(conf.Options.ContextStorage != collector.StorageTypeAPI &&
-			conf.Options.ContextStorage != collector.StorageTypeDB) {
+			conf.Options.ContextStorage != collector.StorageTypeDB &&
+			conf.Options.ContextStorage != collector.StorageTypeFile) {
 		return errors.New("context storage type or address is invalid")
 	}
+	if conf.Options.ContextStorageUrl == "" {
+		return errors.New("context storage url should be configured when storage type is api or file")
+	}
 	if conf.Options.WorkerOplogCompressor != module.CompressionNone &&
 		conf.Options.WorkerOplogCompressor != module.CompressionGzip &&
 		conf.Options.WorkerOplogCompressor != module.CompressionZlib &&
@@ -236,6 +365,37 @@ func sanitizeOptions() error {
 	if conf.Options.SyncMode == "" {
 		conf.Options.SyncMode = "oplog" // default
 	}
+	if conf.Options.TunnelKafkaPartitionBy == "" {
+		conf.Options.TunnelKafkaPartitionBy = tunnel.KafkaPartitionByNone // default
+	}
+	if conf.Options.TunnelKafkaPartitionBy != tunnel.KafkaPartitionByNone &&
+		conf.Options.TunnelKafkaPartitionBy != oplog.ShardByID &&
+		conf.Options.TunnelKafkaPartitionBy != oplog.ShardByNamespace {
+		return fmt.Errorf("unknown tunnel.kafka.partition_by[%v]", conf.Options.TunnelKafkaPartitionBy)
+	}
+	if conf.Options.TunnelMessage == "" {
+		conf.Options.TunnelMessage = tunnel.MessageRaw // default
+	}
+	if conf.Options.TunnelMessage != tunnel.MessageRaw &&
+		conf.Options.TunnelMessage != tunnel.MessageBson &&
+		conf.Options.TunnelMessage != tunnel.MessageJson {
+		return fmt.Errorf("unknown tunnel.message[%v]", conf.Options.TunnelMessage)
+	}
+	if conf.Options.TunnelMessage != tunnel.MessageRaw {
+		if conf.Options.Tunnel != "kafka" {
+			return errors.New("tunnel.message should be raw when tunnel type isn't kafka")
+		}
+		if conf.Options.WorkerOplogCompressor != module.CompressionNone {
+			return errors.New("worker.oplog_compressor should be none when tunnel.message isn't raw")
+		}
+	}
+
+	if conf.Options.TunnelFileSegmentSize <= 0 {
+		conf.Options.TunnelFileSegmentSize = 1024 // default 1GB
+	}
+	if conf.Options.TunnelFileSegmentTime <= 0 {
+		conf.Options.TunnelFileSegmentTime = 3600 // default 1 hour
+	}
 
 	// judge the replayer configuration when tunnel type is "direct"
 	if conf.Options.Tunnel == "direct" {
@@ -251,8 +411,52 @@ func sanitizeOptions() error {
 			conf.Options.ReplayerConflictWriteTo != executor.NoDumpConflict {
 			return errors.New("collision write strategy is neither db nor sdk nor none")
 		}
+		conf.Options.ReplayerConflictPolicy = executor.DefaultConflictPolicy()
+		if resolver, err := executor.NewConflictResolver(conf.Options.ReplayerConflictPolicy,
+			conf.Options.ReplayerConflictPolicyNamespace, nil); err != nil {
+			return err
+		} else if conf.Options.ReplayerExactlyOnce {
+			if err := resolver.CheckInTransaction(); err != nil {
+				return err
+			}
+		}
+		if conf.Options.ReplayerDeadLetter == "" {
+			conf.Options.ReplayerDeadLetter = executor.DeadLetterNone
+		}
+		switch conf.Options.ReplayerDeadLetter {
+		case executor.DeadLetterNone:
+		case utils.StorageTypeDB:
+			if conf.Options.ReplayerDeadLetterUrl == "" {
+				conf.Options.ReplayerDeadLetterUrl = conf.Options.TunnelAddress[0]
+			}
+		case utils.StorageTypeFile:
+			if conf.Options.ReplayerDeadLetterUrl == "" {
+				return errors.New("replayer.dead_letter.url should be a folder when replayer.dead_letter is file")
+			}
+		default:
+			return fmt.Errorf("unknown replayer.dead_letter[%v]", conf.Options.ReplayerDeadLetter)
+		}
+		if conf.Options.ReplayerDeadLetterRetry < 0 {
+			return errors.New("replayer.dead_letter.retry should be >= 0")
+		}
+		if conf.Options.ReplayerExactlyOnce && conf.Options.ReplayerExecutor != 1 {
+			// the applied timestamp is kept for each worker
+			return errors.New("replayer.exactly_once requires replayer.executor = 1")
+		}
 		conf.Options.ReplayerCollisionEnable = conf.Options.ReplayerExecutor != 1
 	} else {
+		if conf.Options.ReplayerExactlyOnce {
+			return errors.New("replayer.exactly_once only support direct tunnel type")
+		}
+		if conf.Options.ReplayerDeadLetter != "" && conf.Options.ReplayerDeadLetter != executor.DeadLetterNone {
+			return errors.New("replayer.dead_letter only support direct tunnel type")
+		}
+		if conf.Options.ReplayerLoopPrevention {
+			return errors.New("replayer.loop_prevention only support direct tunnel type")
+		}
+		if conf.Options.SyncerOplogWindowRecovery {
+			return errors.New("syncer.oplog_window.recovery only support direct tunnel type")
+		}
 		if conf.Options.SyncMode != "oplog" {
 			return errors.New("document replication only support direct tunnel type")
 		}
@@ -262,6 +466,45 @@ func sanitizeOptions() error {
 		return fmt.Errorf("unknown sync_mode[%v]", conf.Options.SyncMode)
 	}
 
+	if conf.Options.ReplayerIndexStrategy == "" {
+		conf.Options.ReplayerIndexStrategy = docsyncer.IndexStrategyAfter // default
+	}
+	if conf.Options.ReplayerIndexStrategy != docsyncer.IndexStrategyBefore &&
+		conf.Options.ReplayerIndexStrategy != docsyncer.IndexStrategyAfter &&
+		conf.Options.ReplayerIndexStrategy != docsyncer.IndexStrategyBackgroundAfter {
+		return fmt.Errorf("unknown replayer.index_strategy[%v]", conf.Options.ReplayerIndexStrategy)
+	}
+
+	if conf.Options.SyncerReaderFetchMethod == "" {
+		conf.Options.SyncerReaderFetchMethod = oplogsyncer.FetchMethodOplog // default
+	}
+	if conf.Options.SyncerReaderFetchMethod != oplogsyncer.FetchMethodOplog &&
+		conf.Options.SyncerReaderFetchMethod != oplogsyncer.FetchMethodChangeStream {
+		return fmt.Errorf("unknown syncer.reader.fetch_method[%v]", conf.Options.SyncerReaderFetchMethod)
+	}
+	if conf.Options.SyncerReaderFetchMethod == oplogsyncer.FetchMethodChangeStream {
+		if conf.Options.SyncMode != collector.SYNCMODE_OPLOG {
+			return errors.New("sync_mode should be oplog when syncer.reader.fetch_method is change_stream")
+		}
+		if len(conf.Options.MongoUrls) != 1 {
+			return errors.New("mongo_urls should be the address of replica set or mongos when " +
+				"syncer.reader.fetch_method is change_stream")
+		}
+		if conf.Options.SyncerOplogWindowRecovery {
+			return errors.New("syncer.oplog_window.recovery is not supported when syncer.reader.fetch_method " +
+				"is change_stream")
+		}
+	}
+
+	if conf.Options.ContextStopPosition != 0 {
+		if conf.Options.SyncMode == collector.SYNCMODE_DOCUMENT {
+			return errors.New("context.stop_position is useless when sync_mode is document")
+		}
+		if conf.Options.ContextStopPosition <= conf.Options.ContextStartPosition {
+			return errors.New("context.stop_position should be later than context.start_position")
+		}
+	}
+
 	if conf.Options.MongoConnectMode != utils.ConnectModePrimary &&
 		conf.Options.MongoConnectMode != utils.ConnectModeSecondaryPreferred &&
 		conf.Options.MongoConnectMode != utils.ConnectModeStandalone {
@@ -18,7 +18,6 @@ const (
 	MoveChunkKeyName             = "key"
 	MoveChunkInsertMap           = "insertMap"
 	MoveChunkDeleteItem          = "deleteItem"
-	MoveChunkBufferSize          = 1000
 	MoveChunkUnResponseThreshold = 30 // s
 )
 
@@ -277,12 +276,13 @@ func (manager *MoveChunkManager) BarrierOplog(replset string, partialLog *oplog.
 func (manager *MoveChunkManager) Load(tablePrefix string) error {
 	manager.moveChunkLock.Lock()
 	defer manager.moveChunkLock.Unlock()
-	conn := manager.ckptManager.conn
-	db := manager.ckptManager.db
+	storage := manager.ckptManager.storage
 
-	iter := conn.Session.DB(db).C(tablePrefix + "_mvck_syncer").Find(bson.M{}).Iter()
-	ckptDoc := make(map[string]interface{})
-	for iter.Next(ckptDoc) {
+	docs, err := storage.Load(tablePrefix + "_mvck_syncer")
+	if err != nil {
+		return err
+	}
+	for _, ckptDoc := range docs {
 		replset, ok1 := ckptDoc[utils.CheckpointName].(string)
 		barrierKey, ok2 := ckptDoc[MoveChunkBarrierKey].(map[string]interface{})
 		if !ok1 || !ok2 {
@@ -302,11 +302,10 @@ func (manager *MoveChunkManager) Load(tablePrefix string) error {
 				replset, syncInfo.barrierKey, syncInfo.barrierChan)
 		}
 	}
-	if err := iter.Close(); err != nil {
-		LOG.Critical("MoveChunkManager close iterator failed. %v", err)
+	if docs, err = storage.Load(tablePrefix + "_mvck_map"); err != nil {
+		return err
 	}
-	iter = conn.Session.DB(db).C(tablePrefix + "_mvck_map").Find(bson.M{}).Iter()
-	for iter.Next(ckptDoc) {
+	for _, ckptDoc := range docs {
 		key := MoveChunkKey{}
 		value := MoveChunkValue{insertMap: make(map[string]bson.MongoTimestamp),
 			barrierMap: make(map[string]chan interface{})}
@@ -328,9 +327,6 @@ func (manager *MoveChunkManager) Load(tablePrefix string) error {
 			manager.moveChunkMap[key] = &value
 		}
 	}
-	if err := iter.Close(); err != nil {
-		LOG.Critical("MoveChunkManager close iterator failed. %v", err)
-	}
 	for replset, syncInfo := range manager.syncInfoMap {
 		if syncInfo.barrierChan != nil {
 			value := manager.moveChunkMap[syncInfo.barrierKey]
@@ -344,10 +340,10 @@ func (manager *MoveChunkManager) Load(tablePrefix string) error {
 func (manager *MoveChunkManager) Flush(tablePrefix string) error {
 	manager.moveChunkLock.Lock()
 	defer manager.moveChunkLock.Unlock()
-	conn := manager.ckptManager.conn
-	db := manager.ckptManager.db
+	storage := manager.ckptManager.storage
 
 	checkpointBegin := time.Now()
+	syncerBuffer := make([]interface{}, 0, len(manager.syncInfoMap))
 	for replset, syncInfo := range manager.syncInfoMap {
 		syncInfo.mutex.Lock()
 		var barrierKey map[string]interface{}
@@ -363,18 +359,14 @@ func (manager *MoveChunkManager) Flush(tablePrefix string) error {
 			utils.CheckpointName: replset,
 			MoveChunkBarrierKey:  barrierKey,
 		}
-		if _, err = conn.Session.DB(db).C(tablePrefix+"_mvck_syncer").
-			Upsert(bson.M{utils.CheckpointName: replset}, ckptDoc); err != nil {
-			syncInfo.mutex.Unlock()
-			return fmt.Errorf("MoveChunkManager flush checkpoint syncer %v upsert failed. %v", ckptDoc, err)
-		}
+		syncerBuffer = append(syncerBuffer, ckptDoc)
 		syncInfo.mutex.Unlock()
 	}
-	table := tablePrefix + "_mvck_map"
-	if err := conn.Session.DB(db).C(table).DropCollection(); err != nil && err.Error() != "ns not found" {
-		return LOG.Critical("MoveChunkManager flush checkpoint drop collection %v failed. %v", table, err)
+	if err := storage.Save(tablePrefix+"_mvck_syncer", syncerBuffer); err != nil {
+		return fmt.Errorf("MoveChunkManager flush checkpoint syncer %v save failed. %v", syncerBuffer, err)
 	}
-	buffer := make([]interface{}, 0, MoveChunkBufferSize)
+	table := tablePrefix + "_mvck_map"
+	buffer := make([]interface{}, 0, len(manager.moveChunkMap))
 	for key, value := range manager.moveChunkMap {
 		keyItem, err1 := utils.Struct2Map(&key, "bson")
 		var deleteItem map[string]interface{}
@@ -391,19 +383,11 @@ func (manager *MoveChunkManager) Flush(tablePrefix string) error {
 			MoveChunkInsertMap:  value.insertMap,
 			MoveChunkDeleteItem: deleteItem,
 		}
-		if len(buffer) >= MoveChunkBufferSize {
-			// 1000 * byte size of ckptDoc < 16MB
-			if err := conn.Session.DB(db).C(table).Insert(buffer...); err != nil {
-				return LOG.Critical("MoveChunkManager flush checkpoint moveChunkMap buffer %v insert failed. %v", buffer, err)
-			}
-			buffer = make([]interface{}, 0, MoveChunkBufferSize)
-		}
 		buffer = append(buffer, ckptDoc)
 	}
-	if len(buffer) > 0 {
-		if err := conn.Session.DB(db).C(table).Insert(buffer...); err != nil {
-			return LOG.Critical("MoveChunkManager flush checkpoint moveChunkMap buffer %v insert failed. %v", buffer, err)
-		}
+	// the storage inserts the documents in batches of utils.StorageBatchSize
+	if err := storage.Save(table, buffer); err != nil {
+		return LOG.Critical("MoveChunkManager flush checkpoint moveChunkMap buffer %v save failed. %v", buffer, err)
 	}
 	LOG.Info("MoveChunkManager flush checkpoint moveChunkMap size[%v] cost %vs",
 		len(manager.moveChunkMap), time.Now().Sub(checkpointBegin).Seconds())
@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"time"
+
+	"mongoshake/collector/configure"
+	"mongoshake/collector/docsyncer"
+	"mongoshake/collector/filter"
+	"mongoshake/collector/transform"
+	"mongoshake/common"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+// checkOplogWindow predicts the exhaustion of oplog window. The oldest oplog
+// of source moves forward as fast as the newest one, so the oplogs after
+// checkpoint are lost once the checkpoint lag reaches the oplog span. A
+// warning is raised if the remaining window is less than
+// syncer.oplog_window.warn_percent of the span. prev is the lag of last sample
+func (sync *OplogSyncer) checkOplogWindow(prev, lag *utils.Lag) {
+	percent := int64(conf.Options.SyncerOplogWindowWarnPercent)
+	if percent == 0 || lag.OplogWindow < 0 || lag.OplogSpan <= 0 {
+		sync.replMetric.SetOplogExhausting(false)
+		return
+	}
+	exhausting := lag.OplogWindow*100 < lag.OplogSpan*percent
+	sync.replMetric.SetOplogExhausting(exhausting)
+	if !exhausting {
+		return
+	}
+
+	// the window shrinks as fast as the checkpoint lag grows
+	eta := "unknown"
+	if prev != nil && prev.Checkpoint >= 0 && lag.Checkpoint > prev.Checkpoint {
+		eta = utils.TimestampToString(time.Now().Unix() +
+			lag.OplogWindow*LagSampleInterval/(lag.Checkpoint-prev.Checkpoint))
+	}
+	LOG.Warn("Syncer[%s] oplog window of source is going to be exhausted. window[%vs] span[%vs] "+
+		"checkpoint lag[%vs] estimated exhaustion time[%v]", sync.replset, lag.OplogWindow, lag.OplogSpan,
+		lag.Checkpoint, eta)
+}
+
+// recoverOplogWindow is called by poll when the oplogs after checkpoint are
+// lost. It copies the documents of the replset again, and then resumes the
+// oplog replication after the position where the copy begins
+func (sync *OplogSyncer) recoverOplogWindow() {
+	LOG.Warn("Syncer[%s] oplog window is exhausted, recover by document sync of the replset", sync.replset)
+	sync.replMetric.ReplStatus.Update(utils.FetchBad)
+	for {
+		err := sync.resyncDocument()
+		if err == nil {
+			break
+		}
+		LOG.Error("Syncer[%s] recover oplog window failed, retry later. %v", sync.replset, err)
+		utils.YieldInMs(DurationTime)
+	}
+	sync.replMetric.AddOplogRecovery(1)
+	sync.replMetric.ReplStatus.Clear(utils.FetchBad)
+	LOG.Info("Syncer[%s] oplog window is recovered", sync.replset)
+}
+
+func (sync *OplogSyncer) resyncDocument() error {
+	// drop the oplogs in pipeline and wait for the dispatched ones, so no
+	// stale oplog is applied over the copied documents. The checkpoint
+	// stays lost until the copy finishes
+	sync.waitSeek(sync.reader.GetQueryTimestamp())
+
+	beginTs, err := utils.GetNewestTimestampByUrl(sync.mongoUrl)
+	if err != nil {
+		return err
+	}
+	if err := sync.coordinator.resyncDocument(sync.replset, sync.mongoUrl, nil); err != nil {
+		return err
+	}
+	finishTs, err := utils.GetNewestTimestampByUrl(sync.mongoUrl)
+	if err != nil {
+		return err
+	}
+	LOG.Info("Syncer[%s] document sync for recovery done, incr sync begins at %v", sync.replset,
+		utils.TimestampToLog(beginTs))
+
+	// the oplogs before finishTs may be applied already, all namespaces are
+	// copied
+	sync.setReplayWindow(&replayWindow{finishTs: finishTs})
+	sync.waitSeek(beginTs)
+	return nil
+}
+
+// waitSeek is called by poll, and blocks until the position is set
+func (sync *OplogSyncer) waitSeek(ts bson.MongoTimestamp) {
+	req := &positionRequest{ts: ts, done: make(chan struct{})}
+	sync.seek(req)
+	<-req.done
+}
+
+// resyncDocument copies the documents of replset to target again, only the
+// namespaces passing filterList are copied if it isn't nil. The collections
+// are dropped by replayer.collection_drop if the source is a replica set,
+// otherwise the stale documents are replaced, while the ones deleted from
+// source during the lost oplogs are left in target
+func (coordinator *ReplicationCoordinator) resyncDocument(replset, url string,
+	filterList filter.DocFilterChain) error {
+	var orphanFilter *filter.OrphanFilter
+	if conf.Options.FilterOrphanDocument {
+		shardingChunkMap, err := utils.GetChunkMapByUrl(conf.Options.MongoCsUrl)
+		if err != nil {
+			return err
+		}
+		dbChunkMap, ok := shardingChunkMap[replset]
+		if !ok {
+			LOG.Warn("document syncer %v has no chunk map", replset)
+			dbChunkMap = make(utils.DBChunkMap)
+		}
+		orphanFilter = filter.NewOrphanFilter(replset, dbChunkMap)
+	}
+
+	toUrl := conf.Options.TunnelAddress[0]
+	trans := transform.NewNamespaceTransform(conf.Options.TransformNamespace)
+	var fieldTrans *transform.FieldTransform
+	if len(conf.Options.TransformField) > 0 {
+		fieldTrans = transform.NewFieldTransform(conf.Options.TransformField, conf.Options.TransformFieldHashSalt)
+	}
+
+	nsExistedSet := make(map[string]bool)
+	if !conf.Options.IsShardCluster() {
+		// the collections hold the documents of this replset only
+		nsSet, err := docsyncer.GetAllNamespace([]*utils.MongoSource{{URL: url, Replset: replset}})
+		if err != nil {
+			return err
+		}
+		for ns := range nsSet {
+			if filterList != nil && filterList.IterateFilter(ns.Str()) {
+				delete(nsSet, ns)
+			}
+		}
+		toConn, err := utils.NewMongoConn(toUrl, utils.ConnectModePrimary, true)
+		if err != nil {
+			return err
+		}
+		nsExistedSet, err = docsyncer.StartDropDestCollection(nsSet, toConn, trans, nil)
+		toConn.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	dbSyncer := docsyncer.NewDBSyncer(replset, url, toUrl, trans, fieldTrans, orphanFilter, nil)
+	dbSyncer.EnableOverwrite()
+	dbSyncer.SetFilter(filterList)
+	LOG.Info("document syncer %v begin replication for url=%v again", replset, url)
+	if err := dbSyncer.Start(); err != nil {
+		return err
+	}
+	return docsyncer.StartIndexSync(dbSyncer.GetIndexMap(), toUrl, nsExistedSet, trans,
+		conf.Options.ReplayerIndexStrategy)
+}
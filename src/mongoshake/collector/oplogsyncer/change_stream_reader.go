@@ -0,0 +1,428 @@
+package oplogsyncer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	FetchMethodOplog        = "oplog"
+	FetchMethodChangeStream = "change_stream"
+
+	AdminDB = "admin"
+
+	changeStreamBatchSize = 8192
+	// aggregate with "aggregate: 1" is a collection-less command
+	changeStreamCollection = "$cmd.aggregate"
+)
+
+// change event types. see https://docs.mongodb.com/manual/reference/change-events/
+const (
+	eventInsert       = "insert"
+	eventUpdate       = "update"
+	eventReplace      = "replace"
+	eventDelete       = "delete"
+	eventDrop         = "drop"
+	eventRename       = "rename"
+	eventDropDatabase = "dropDatabase"
+	eventInvalidate   = "invalidate"
+)
+
+type changeNamespace struct {
+	DB   string `bson:"db"`
+	Coll string `bson:"coll"`
+}
+
+type changeEvent struct {
+	Id                interface{}         `bson:"_id"`
+	OperationType     string              `bson:"operationType"`
+	ClusterTime       bson.MongoTimestamp `bson:"clusterTime"`
+	Ns                changeNamespace     `bson:"ns"`
+	To                changeNamespace     `bson:"to"`
+	DocumentKey       bson.D              `bson:"documentKey"`
+	FullDocument      bson.D              `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.D   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+	// session id of transaction or retryable write
+	Lsid interface{} `bson:"lsid"`
+}
+
+type changeCursor struct {
+	Cursor struct {
+		Id         int64      `bson:"id"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// resume token of the last event at ts
+type resumePoint struct {
+	ts    bson.MongoTimestamp
+	token interface{}
+}
+
+// ChangeStreamReader opens a $changeStream on the whole cluster or a
+// database instead of tailing local.oplog.rs. The change events are
+// translated into oplogs, so the following pipeline is unchanged
+type ChangeStreamReader struct {
+	// source mongo address url
+	src     string
+	replset string
+	// watch the whole cluster if empty
+	database string
+
+	conn     *utils.MongoConn
+	cursorId int64
+	// fetched events not consumed yet
+	batch []bson.Raw
+
+	// start at queryTs if resumeToken is nil
+	queryTs     bson.MongoTimestamp
+	resumeToken interface{}
+	// resumeToken is of an invalidate event, which can only be started after
+	invalidated bool
+
+	// resume points of oplogs not checkpointed yet, ordered by ts
+	pointsLock sync.Mutex
+	points     []resumePoint
+
+	// oplog channel
+	oplogChan    chan *retOplog
+	seekChan     chan *seekRequest
+	fetcherExist bool
+	fetcherLock  sync.Mutex
+}
+
+// NewChangeStreamReader creates reader with mongodb url
+func NewChangeStreamReader(src, replset, database string) *ChangeStreamReader {
+	return &ChangeStreamReader{
+		src:       src,
+		replset:   replset,
+		database:  database,
+		oplogChan: make(chan *retOplog, oplogChanSize),
+		seekChan:  make(chan *seekRequest),
+	}
+}
+
+func (reader *ChangeStreamReader) SetQueryTimestampOnEmpty(ts bson.MongoTimestamp) {
+	if reader.queryTs == 0 {
+		reader.UpdateQueryTimestamp(ts)
+	}
+}
+
+func (reader *ChangeStreamReader) UpdateQueryTimestamp(ts bson.MongoTimestamp) {
+	reader.queryTs = ts
+}
+
+func (reader *ChangeStreamReader) GetQueryTimestamp() bson.MongoTimestamp {
+	return reader.queryTs
+}
+
+func (reader *ChangeStreamReader) Seek(ts bson.MongoTimestamp) {
+	reader.fetcherLock.Lock()
+	if !reader.fetcherExist {
+		reader.seek(&seekRequest{ts: ts, done: make(chan struct{})})
+		reader.fetcherLock.Unlock()
+		return
+	}
+	reader.fetcherLock.Unlock()
+
+	req := &seekRequest{ts: ts, done: make(chan struct{})}
+	reader.seekChan <- req
+	<-req.done
+}
+
+// seek is called by fetcher, the change stream is reopened at ts since the
+// resume token is cleared
+func (reader *ChangeStreamReader) seek(req *seekRequest) {
+	reader.releaseCursor()
+	reader.queryTs = req.ts
+	reader.resumeToken = nil
+	reader.invalidated = false
+	reader.pointsLock.Lock()
+	reader.points = nil
+	reader.pointsLock.Unlock()
+	LOG.Info("change stream replset %v seek to %v", reader.replset, utils.TimestampToLog(req.ts))
+	close(req.done)
+}
+
+// send passes the fetched oplog to Next unless a seek is requested, in which
+// case the oplog is dropped
+func (reader *ChangeStreamReader) send(ret *retOplog) {
+	select {
+	case reader.oplogChan <- ret:
+	case req := <-reader.seekChan:
+		reader.seek(req)
+	}
+}
+
+// SetResumeToken sets the resume token loaded from checkpoint, which takes
+// precedence over the query timestamp
+func (reader *ChangeStreamReader) SetResumeToken(token interface{}) {
+	reader.resumeToken = token
+	reader.invalidated = false
+}
+
+// ResumeToken returns the token to resume after the oplogs not later than
+// ts, the older tokens are dropped. nil is returned if no oplog is fetched
+func (reader *ChangeStreamReader) ResumeToken(ts bson.MongoTimestamp) interface{} {
+	reader.pointsLock.Lock()
+	defer reader.pointsLock.Unlock()
+
+	i := 0
+	for i < len(reader.points) && reader.points[i].ts <= ts {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+	reader.points = reader.points[i-1:]
+	return reader.points[0].token
+}
+
+func (reader *ChangeStreamReader) addResumePoint(ts bson.MongoTimestamp, token interface{}) {
+	reader.pointsLock.Lock()
+	defer reader.pointsLock.Unlock()
+
+	// events of one transaction share the same cluster time, keep the last one
+	if n := len(reader.points); n != 0 && reader.points[n-1].ts == ts {
+		reader.points[n-1].token = token
+		return
+	}
+	reader.points = append(reader.points, resumePoint{ts: ts, token: token})
+}
+
+// Next returns an oplog by raw bytes which is []byte
+func (reader *ChangeStreamReader) Next() (*bson.Raw, error) {
+	select {
+	case ret := <-reader.oplogChan:
+		return ret.log, ret.err
+	case <-time.After(time.Second * time.Duration(conf.Options.SyncerReaderBufferTime)):
+		return nil, TimeoutError
+	}
+}
+
+// start fetcher if not exist
+func (reader *ChangeStreamReader) StartFetcher() {
+	if reader.fetcherExist == true {
+		return
+	}
+
+	reader.fetcherLock.Lock()
+	if reader.fetcherExist == false { // double check
+		reader.fetcherExist = true
+		go reader.fetcher()
+	}
+	reader.fetcherLock.Unlock()
+}
+
+// fetch change events, translate them into oplogs and put into channel
+func (reader *ChangeStreamReader) fetcher() {
+	for {
+		select {
+		case req := <-reader.seekChan:
+			reader.seek(req)
+		default:
+		}
+
+		if err := reader.ensureNetwork(); err != nil {
+			reader.send(&retOplog{nil, err})
+			continue
+		}
+
+		if len(reader.batch) == 0 {
+			if err := reader.getMore(); err != nil {
+				reader.releaseCursor()
+				reader.send(&retOplog{nil, fmt.Errorf("get next change event failed. release cursor, %v", err)})
+				continue
+			}
+			if len(reader.batch) == 0 {
+				// await timeout
+				reader.send(&retOplog{nil, TimeoutError})
+				continue
+			}
+		}
+
+		raw := reader.batch[0]
+		reader.batch = reader.batch[1:]
+		event := new(changeEvent)
+		if err := raw.Unmarshal(event); err != nil {
+			LOG.Crashf("change stream replset %v unmarshal event failed: %v", reader.replset, err)
+		}
+		if event.OperationType == eventInvalidate {
+			// the cursor is closed after invalidate, open a new one after it
+			reader.releaseCursor()
+			reader.resumeToken = event.Id
+			reader.invalidated = true
+			reader.send(&retOplog{nil, fmt.Errorf("change stream replset %v is invalidated at %v, reopen it",
+				reader.replset, utils.TimestampToLog(event.ClusterTime))})
+			continue
+		}
+
+		// the stream starts at queryTs inclusively, but the oplogs at queryTs
+		// have been synced
+		if reader.resumeToken == nil && event.ClusterTime <= reader.queryTs {
+			continue
+		}
+		reader.resumeToken = event.Id
+		reader.invalidated = false
+
+		log, err := translateEvent(event)
+		if err != nil {
+			LOG.Crashf("change stream replset %v translate event[%v] failed: %v", reader.replset, event, err)
+		}
+		if log == nil {
+			// no corresponding oplog
+			continue
+		}
+		reader.addResumePoint(event.ClusterTime, event.Id)
+		reader.send(&retOplog{log, nil})
+	}
+}
+
+// ensureNetwork opens the change stream if current cursor is not ready
+func (reader *ChangeStreamReader) ensureNetwork() (err error) {
+	if reader.cursorId != 0 {
+		return nil
+	}
+	if reader.conn == nil || (reader.conn != nil && !reader.conn.IsGood()) {
+		if reader.conn != nil {
+			reader.conn.Close()
+		}
+		// reconnect
+		if reader.conn, err = utils.NewMongoConn(reader.src, conf.Options.MongoConnectMode, true); reader.conn == nil || err != nil {
+			err = fmt.Errorf("reconnect mongo instance [%s] error. %s", reader.src, err)
+			return err
+		}
+	}
+
+	stage := bson.D{}
+	db := reader.database
+	if db == "" {
+		db = AdminDB
+		stage = append(stage, bson.DocElem{Name: "allChangesForCluster", Value: true})
+	}
+	if reader.resumeToken != nil && reader.invalidated {
+		// resumeAfter an invalidate event fails, startAfter needs 4.2 or later
+		stage = append(stage, bson.DocElem{Name: "startAfter", Value: reader.resumeToken})
+	} else if reader.resumeToken != nil {
+		stage = append(stage, bson.DocElem{Name: "resumeAfter", Value: reader.resumeToken})
+	} else if utils.ExtractTs32(reader.queryTs) > 1 {
+		stage = append(stage, bson.DocElem{Name: "startAtOperationTime", Value: reader.queryTs})
+	} else {
+		// Timestamp(1, 0) means all oplogs, but the change stream can
+		// only start from now
+		LOG.Warn("change stream replset %v has no start position, start from now", reader.replset)
+	}
+
+	cmd := bson.D{
+		{"aggregate", 1},
+		{"pipeline", []bson.D{{{"$changeStream", stage}}}},
+		{"cursor", bson.M{"batchSize": changeStreamBatchSize}},
+	}
+	result := new(changeCursor)
+	if err = reader.conn.Session.DB(db).Run(cmd, result); err != nil {
+		return fmt.Errorf("open change stream on replset %v failed. %v", reader.replset, err)
+	}
+	LOG.Info("change stream replset %v open with %v", reader.replset, stage)
+
+	reader.cursorId = result.Cursor.Id
+	reader.batch = result.Cursor.FirstBatch
+	return nil
+}
+
+func (reader *ChangeStreamReader) getMore() error {
+	db := reader.database
+	if db == "" {
+		db = AdminDB
+	}
+	cmd := bson.D{
+		{"getMore", reader.cursorId},
+		{"collection", changeStreamCollection},
+		{"batchSize", changeStreamBatchSize},
+		{"maxTimeMS", tailTimeout * 1000},
+	}
+	result := new(changeCursor)
+	if err := reader.conn.Session.DB(db).Run(cmd, result); err != nil {
+		return err
+	}
+	reader.batch = result.Cursor.NextBatch
+	return nil
+}
+
+func (reader *ChangeStreamReader) releaseCursor() {
+	if reader.cursorId != 0 && reader.conn != nil {
+		db := reader.database
+		if db == "" {
+			db = AdminDB
+		}
+		reader.conn.Session.DB(db).Run(bson.D{
+			{"killCursors", changeStreamCollection},
+			{"cursors", []int64{reader.cursorId}},
+		}, nil)
+	}
+	reader.cursorId = 0
+	reader.batch = nil
+}
+
+// translateEvent converts the change event into the oplog format of
+// local.oplog.rs. nil is returned if there is no corresponding oplog
+func translateEvent(event *changeEvent) (*bson.Raw, error) {
+	ns := fmt.Sprintf("%s.%s", event.Ns.DB, event.Ns.Coll)
+	cmdNs := fmt.Sprintf("%s.$cmd", event.Ns.DB)
+
+	log := bson.D{{"ts", event.ClusterTime}}
+	switch event.OperationType {
+	case eventInsert:
+		log = append(log, bson.D{{"op", "i"}, {"ns", ns}, {"o", event.FullDocument}}...)
+	case eventUpdate:
+		update := bson.D{}
+		if len(event.UpdateDescription.UpdatedFields) != 0 {
+			update = append(update, bson.DocElem{Name: "$set", Value: event.UpdateDescription.UpdatedFields})
+		}
+		if len(event.UpdateDescription.RemovedFields) != 0 {
+			unset := bson.D{}
+			for _, field := range event.UpdateDescription.RemovedFields {
+				unset = append(unset, bson.DocElem{Name: field, Value: 1})
+			}
+			update = append(update, bson.DocElem{Name: "$unset", Value: unset})
+		}
+		if len(update) == 0 {
+			return nil, nil
+		}
+		log = append(log, bson.D{{"op", "u"}, {"ns", ns}, {"o", update}, {"o2", event.DocumentKey}}...)
+	case eventReplace:
+		log = append(log, bson.D{{"op", "u"}, {"ns", ns}, {"o", event.FullDocument}, {"o2", event.DocumentKey}}...)
+	case eventDelete:
+		log = append(log, bson.D{{"op", "d"}, {"ns", ns}, {"o", event.DocumentKey}}...)
+	case eventDrop:
+		log = append(log, bson.D{{"op", "c"}, {"ns", cmdNs}, {"o", bson.D{{"drop", event.Ns.Coll}}}}...)
+	case eventRename:
+		log = append(log, bson.D{{"op", "c"}, {"ns", cmdNs}, {"o", bson.D{{"renameCollection", ns},
+			{"to", fmt.Sprintf("%s.%s", event.To.DB, event.To.Coll)}}}}...)
+	case eventDropDatabase:
+		log = append(log, bson.D{{"op", "c"}, {"ns", cmdNs}, {"o", bson.D{{"dropDatabase", 1}}}}...)
+	default:
+		LOG.Warn("change event type %v is not supported, ignore it. %v", event.OperationType, event)
+		return nil, nil
+	}
+
+	if event.Lsid != nil {
+		log = append(log, bson.DocElem{Name: "lsid", Value: event.Lsid})
+	}
+
+	data, err := bson.Marshal(log)
+	if err != nil {
+		return nil, err
+	}
+	return &bson.Raw{Kind: 0x03, Data: data}, nil
+}
@@ -0,0 +1,112 @@
+package oplogsyncer
+
+import (
+	"fmt"
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinllen/mgo/bson"
+)
+
+func translateToLog(t *testing.T, event *changeEvent) *oplog.PartialLog {
+	raw, err := translateEvent(event)
+	assert.Equal(t, nil, err, "should be equal")
+	if raw == nil {
+		return nil
+	}
+	log := new(oplog.PartialLog)
+	assert.Equal(t, nil, bson.Unmarshal(raw.Data, log), "should be equal")
+	return log
+}
+
+func TestTranslateEvent(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestTranslateEvent case %d.\n", nr)
+		nr++
+
+		event := &changeEvent{
+			OperationType: eventInsert,
+			ClusterTime:   bson.MongoTimestamp(10),
+			Ns:            changeNamespace{DB: "a", Coll: "b"},
+			FullDocument:  bson.D{{"_id", 1}, {"x", 1}},
+		}
+		log := translateToLog(t, event)
+		assert.Equal(t, bson.MongoTimestamp(10), log.Timestamp, "should be equal")
+		assert.Equal(t, "i", log.Operation, "should be equal")
+		assert.Equal(t, "a.b", log.Namespace, "should be equal")
+		assert.Equal(t, bson.D{{"_id", 1}, {"x", 1}}, log.Object, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestTranslateEvent case %d.\n", nr)
+		nr++
+
+		event := &changeEvent{
+			OperationType: eventUpdate,
+			Ns:            changeNamespace{DB: "a", Coll: "b"},
+			DocumentKey:   bson.D{{"_id", 1}},
+		}
+		event.UpdateDescription.UpdatedFields = bson.D{{"x", 2}}
+		event.UpdateDescription.RemovedFields = []string{"y"}
+		log := translateToLog(t, event)
+		assert.Equal(t, "u", log.Operation, "should be equal")
+		assert.Equal(t, bson.D{{"$set", bson.D{{"x", 2}}}, {"$unset", bson.D{{"y", 1}}}}, log.Object,
+			"should be equal")
+		assert.Equal(t, bson.M{"_id": 1}, log.Query, "should be equal")
+
+		// nothing changed
+		event.UpdateDescription.UpdatedFields = nil
+		event.UpdateDescription.RemovedFields = nil
+		assert.Equal(t, (*oplog.PartialLog)(nil), translateToLog(t, event), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestTranslateEvent case %d.\n", nr)
+		nr++
+
+		event := &changeEvent{
+			OperationType: eventDelete,
+			Ns:            changeNamespace{DB: "a", Coll: "b"},
+			DocumentKey:   bson.D{{"_id", 1}},
+		}
+		log := translateToLog(t, event)
+		assert.Equal(t, "d", log.Operation, "should be equal")
+		assert.Equal(t, bson.D{{"_id", 1}}, log.Object, "should be equal")
+
+		event = &changeEvent{
+			OperationType: eventRename,
+			Ns:            changeNamespace{DB: "a", Coll: "b"},
+			To:            changeNamespace{DB: "a", Coll: "c"},
+		}
+		log = translateToLog(t, event)
+		assert.Equal(t, "c", log.Operation, "should be equal")
+		assert.Equal(t, "a.$cmd", log.Namespace, "should be equal")
+		assert.Equal(t, bson.D{{"renameCollection", "a.b"}, {"to", "a.c"}}, log.Object, "should be equal")
+	}
+}
+
+func TestResumeToken(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestResumeToken case %d.\n", nr)
+		nr++
+
+		reader := NewChangeStreamReader("", "", "")
+		assert.Equal(t, nil, reader.ResumeToken(10), "should be equal")
+
+		reader.addResumePoint(10, "t1")
+		reader.addResumePoint(20, "t2")
+		// same cluster time in transaction
+		reader.addResumePoint(20, "t3")
+		reader.addResumePoint(30, "t4")
+
+		assert.Equal(t, nil, reader.ResumeToken(5), "should be equal")
+		assert.Equal(t, "t3", reader.ResumeToken(25), "should be equal")
+		assert.Equal(t, "t3", reader.ResumeToken(20), "should be equal")
+		assert.Equal(t, "t4", reader.ResumeToken(40), "should be equal")
+		assert.Equal(t, 1, len(reader.points), "should be equal")
+	}
+}
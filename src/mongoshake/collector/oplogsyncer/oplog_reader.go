@@ -43,6 +43,26 @@ type retOplog struct {
 	err error     // error detail message
 }
 
+// seekRequest asks the fetcher to restart after ts. done is closed once the
+// fetched oplogs are dropped
+type seekRequest struct {
+	ts   bson.MongoTimestamp
+	done chan struct{}
+}
+
+// Reader fetches the oplogs from source mongodb in the format of
+// local.oplog.rs
+type Reader interface {
+	SetQueryTimestampOnEmpty(ts bson.MongoTimestamp)
+	UpdateQueryTimestamp(ts bson.MongoTimestamp)
+	GetQueryTimestamp() bson.MongoTimestamp
+	// Seek drops the oplogs fetched but not returned by Next, and fetches
+	// the oplogs after ts. It must not be called concurrently with Next
+	Seek(ts bson.MongoTimestamp)
+	StartFetcher()
+	Next() (*bson.Raw, error)
+}
+
 // OplogReader represents stream reader from mongodb that specified
 // by an url. And with query options. user can iterate oplogs.
 type OplogReader struct {
@@ -58,6 +78,7 @@ type OplogReader struct {
 
 	// oplog channel
 	oplogChan    chan *retOplog
+	seekChan     chan *seekRequest
 	fetcherExist bool
 	fetcherLock  sync.Mutex
 
@@ -71,6 +92,7 @@ func NewOplogReader(src, replset string) *OplogReader {
 		replset:   replset,
 		query:     bson.M{},
 		oplogChan: make(chan *retOplog, oplogChanSize),
+		seekChan:  make(chan *seekRequest),
 		firstRead: true,
 	}
 }
@@ -91,6 +113,38 @@ func (reader *OplogReader) GetQueryTimestamp() bson.MongoTimestamp {
 	return reader.query[QueryTs].(bson.M)[QueryOpGT].(bson.MongoTimestamp)
 }
 
+func (reader *OplogReader) Seek(ts bson.MongoTimestamp) {
+	reader.fetcherLock.Lock()
+	if !reader.fetcherExist {
+		reader.UpdateQueryTimestamp(ts)
+		reader.fetcherLock.Unlock()
+		return
+	}
+	reader.fetcherLock.Unlock()
+
+	req := &seekRequest{ts: ts, done: make(chan struct{})}
+	reader.seekChan <- req
+	<-req.done
+}
+
+// seek is called by fetcher, the iterator is rebuilt at next fetch
+func (reader *OplogReader) seek(req *seekRequest) {
+	reader.releaseIterator()
+	reader.UpdateQueryTimestamp(req.ts)
+	LOG.Info("oplog reader replset %v seek to %v", reader.replset, utils.TimestampToLog(req.ts))
+	close(req.done)
+}
+
+// send passes the fetched oplog to Next unless a seek is requested, in which
+// case the oplog is dropped
+func (reader *OplogReader) send(ret *retOplog) {
+	select {
+	case reader.oplogChan <- ret:
+	case req := <-reader.seekChan:
+		reader.seek(req)
+	}
+}
+
 // Next returns an oplog by raw bytes which is []byte
 func (reader *OplogReader) Next() (*bson.Raw, error) {
 	return reader.get()
@@ -137,8 +191,14 @@ func (reader *OplogReader) StartFetcher() {
 func (reader *OplogReader) fetcher() {
 	var log *bson.Raw
 	for {
+		select {
+		case req := <-reader.seekChan:
+			reader.seek(req)
+		default:
+		}
+
 		if err := reader.ensureNetwork(); err != nil {
-			reader.oplogChan <- &retOplog{nil, err}
+			reader.send(&retOplog{nil, err})
 			continue
 		}
 
@@ -148,17 +208,22 @@ func (reader *OplogReader) fetcher() {
 				// some internal error. need rebuild the oplogsIterator
 				reader.releaseIterator()
 				if reader.isCollectionCappedError(err) { // print it
-					LOG.Crashf("oplog sync replset %v collection oplog.rs capped may happen: %v", reader.replset, err)
+					if !conf.Options.SyncerOplogWindowRecovery {
+						LOG.Crashf("oplog sync replset %v collection oplog.rs capped may happen: %v", reader.replset, err)
+					}
+					// the syncer recovers by document sync
+					LOG.Error("oplog sync replset %v collection oplog.rs capped may happen: %v", reader.replset, err)
+					reader.send(&retOplog{nil, CollectionCappedError})
 				} else {
-					reader.oplogChan <- &retOplog{nil, fmt.Errorf("get next oplog failed. release oplogsIterator, %s", err.Error())}
+					reader.send(&retOplog{nil, fmt.Errorf("get next oplog failed. release oplogsIterator, %s", err.Error())})
 				}
 			} else {
 				// query timeout
-				reader.oplogChan <- &retOplog{nil, TimeoutError}
+				reader.send(&retOplog{nil, TimeoutError})
 			}
 			continue
 		}
-		reader.oplogChan <- &retOplog{log, nil}
+		reader.send(&retOplog{log, nil})
 	}
 }
 
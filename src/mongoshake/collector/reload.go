@@ -0,0 +1,305 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mongoshake/collector/configure"
+	"mongoshake/collector/filter"
+	"mongoshake/collector/transform"
+	"mongoshake/common"
+
+	"github.com/gugemichael/nimo4go"
+	LOG "github.com/vinllen/log4go"
+)
+
+const (
+	ReloadTimeout = 60 * time.Second
+)
+
+// ReloadRules replaces the namespace filters and transforms at runtime. The
+// rules are kept if nil, and cleared if empty
+type ReloadRules struct {
+	FilterNamespaceWhite []string `json:"filter.namespace.white"`
+	FilterNamespaceBlack []string `json:"filter.namespace.black"`
+	TransformNamespace   []string `json:"transform.namespace"`
+	// copy the documents of the namespaces which are filtered before and
+	// pass the new filters
+	Backfill bool `json:"backfill"`
+}
+
+// reloadRequest is handled by batcher between two batches, done is closed
+// once the rules are replaced
+type reloadRequest struct {
+	filterWhite []string
+	filterBlack []string
+	// the namespace transform of direct tunnel is replaced if set
+	transform bool
+	nsTrans   *transform.NamespaceTransform
+	done      chan struct{}
+}
+
+// namespaceTransformer is implemented by the tunnel which transforms the
+// namespaces of oplogs
+type namespaceTransformer interface {
+	SetNamespaceTransform(trans *transform.NamespaceTransform)
+}
+
+// backfillFilter drops the namespaces passing the filters before reload
+type backfillFilter struct {
+	before filter.DocFilterChain
+}
+
+func (backfill *backfillFilter) FilterNs(namespace string) bool {
+	return !backfill.before.IterateFilter(namespace)
+}
+
+// Reload validates the rules, and replaces the rules of all syncers. The
+// options are updated only if all syncers are reloaded, otherwise the previous
+// rules are restored. The namespaces newly passing the filters are copied in
+// background if backfill is set, and the oplogs since the copy begins are
+// synced again after it
+func (coordinator *ReplicationCoordinator) Reload(rules *ReloadRules) error {
+	if !atomic.CompareAndSwapInt32(&coordinator.reloading, 0, 1) {
+		return errors.New("the previous reload or backfill is in progress")
+	}
+	// the flag is cleared by backfill or rollback if either of them begins
+	var running bool
+	defer func() {
+		if !running {
+			atomic.StoreInt32(&coordinator.reloading, 0)
+		}
+	}()
+
+	white, black := conf.Options.FilterNamespaceWhite, conf.Options.FilterNamespaceBlack
+	if rules.FilterNamespaceWhite != nil {
+		white = rules.FilterNamespaceWhite
+	}
+	if rules.FilterNamespaceBlack != nil {
+		black = rules.FilterNamespaceBlack
+	}
+	if len(white) != 0 && len(black) != 0 {
+		return errors.New("at most one of black lists and white lists option can be given")
+	}
+	if rules.TransformNamespace != nil {
+		if conf.Options.Tunnel != "direct" {
+			return fmt.Errorf("transform.namespace isn't applied by collector with tunnel %v", conf.Options.Tunnel)
+		}
+		if err := transform.ValidateNamespaceTransform(rules.TransformNamespace); err != nil {
+			return err
+		}
+	}
+	if rules.Backfill {
+		if conf.Options.Tunnel != "direct" {
+			return fmt.Errorf("backfill isn't supported with tunnel %v", conf.Options.Tunnel)
+		}
+		if conf.Options.ReplayerExactlyOnce {
+			// the oplogs synced again are skipped by the applied timestamp
+			return errors.New("backfill isn't supported with replayer.exactly_once")
+		}
+	}
+
+	// no namespace passes the filters newly if they aren't changed
+	backfill := rules.Backfill && (strings.Join(white, ";") != strings.Join(conf.Options.FilterNamespaceWhite, ";") ||
+		strings.Join(black, ";") != strings.Join(conf.Options.FilterNamespaceBlack, ";"))
+	var nsTrans *transform.NamespaceTransform
+	if len(rules.TransformNamespace) > 0 {
+		nsTrans = transform.NewNamespaceTransform(rules.TransformNamespace)
+	}
+
+	if err := coordinator.reloadSyncers(white, black, rules.TransformNamespace != nil, nsTrans); err != nil {
+		running = true
+		go coordinator.rollback(rules.TransformNamespace != nil)
+		return err
+	}
+
+	// the filters before reload are built by the options
+	before := filter.NewDocFilterList()
+	conf.Options.FilterNamespaceWhite, conf.Options.FilterNamespaceBlack = white, black
+	if rules.TransformNamespace != nil {
+		conf.Options.TransformNamespace = rules.TransformNamespace
+	}
+	LOG.Info("Collector reload filter.namespace.white%v filter.namespace.black%v transform.namespace%v",
+		white, black, conf.Options.TransformNamespace)
+
+	if !backfill {
+		return nil
+	}
+	running = true
+	go coordinator.backfill(append(filter.NewDocFilterList(), &backfillFilter{before: before}))
+	return nil
+}
+
+// reloadSyncers sends the rules to all syncers, and returns the first error
+func (coordinator *ReplicationCoordinator) reloadSyncers(white, black []string, trans bool,
+	nsTrans *transform.NamespaceTransform) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(coordinator.syncerGroup))
+	for _, syncer := range coordinator.syncerGroup {
+		wg.Add(1)
+		syncer := syncer
+		go func() {
+			defer wg.Done()
+			errs <- syncer.Reload(&reloadRequest{
+				filterWhite: white,
+				filterBlack: black,
+				transform:   trans,
+				nsTrans:     nsTrans,
+				done:        make(chan struct{}),
+			}, ReloadTimeout)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback restores the rules in options to all syncers after a failed
+// reload. The request of the failed reload may be still pending in syncer, so
+// the rollback waits for it to be handled first
+func (coordinator *ReplicationCoordinator) rollback(trans bool) {
+	var nsTrans *transform.NamespaceTransform
+	if trans && len(conf.Options.TransformNamespace) > 0 {
+		nsTrans = transform.NewNamespaceTransform(conf.Options.TransformNamespace)
+	}
+	var wg sync.WaitGroup
+	for _, syncer := range coordinator.syncerGroup {
+		wg.Add(1)
+		syncer := syncer
+		go func() {
+			defer wg.Done()
+			req := &reloadRequest{
+				filterWhite: conf.Options.FilterNamespaceWhite,
+				filterBlack: conf.Options.FilterNamespaceBlack,
+				transform:   trans,
+				nsTrans:     nsTrans,
+				done:        make(chan struct{}),
+			}
+			syncer.reloadChan <- req
+			<-req.done
+		}()
+	}
+	wg.Wait()
+	atomic.StoreInt32(&coordinator.reloading, 0)
+	LOG.Info("Collector reload rollback done")
+}
+
+func (coordinator *ReplicationCoordinator) backfill(filterList filter.DocFilterChain) {
+	var wg sync.WaitGroup
+	for _, syncer := range coordinator.syncerGroup {
+		wg.Add(1)
+		syncer := syncer
+		go func() {
+			defer wg.Done()
+			for {
+				err := syncer.backfill(filterList)
+				if err == nil {
+					break
+				}
+				LOG.Error("Syncer[%s] backfill failed, retry later. %v", syncer.replset, err)
+				utils.YieldInMs(DurationTime)
+			}
+		}()
+	}
+	wg.Wait()
+	atomic.StoreInt32(&coordinator.reloading, 0)
+	LOG.Info("Collector backfill done")
+}
+
+func (coordinator *ReplicationCoordinator) ReloadAPI() {
+	utils.HttpApi.RegisterAPI("/reload", nimo.HttpPost, func(body []byte) interface{} {
+		var rules ReloadRules
+		if err := json.Unmarshal(body, &rules); err != nil {
+			LOG.Info("Collector reload wrong format : %v", err)
+			return map[string]string{"reload": "request json wrong format"}
+		}
+		if err := coordinator.Reload(&rules); err != nil {
+			return map[string]string{"reload": err.Error()}
+		}
+		return map[string]string{"reload": "success"}
+	})
+}
+
+// Reload replaces the rules once the batcher finishes the current batch. It
+// returns once the rules are replaced or timeout, the request is still
+// handled after timeout
+func (sync *OplogSyncer) Reload(req *reloadRequest, timeout time.Duration) error {
+	select {
+	case sync.reloadChan <- req:
+	default:
+		return fmt.Errorf("oplog syncer %v is busy reloading", sync.replset)
+	}
+	select {
+	case <-req.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("oplog syncer %v reload timeout, it's reloaded once the batcher resumes", sync.replset)
+	}
+}
+
+// reload is called by batcher. The oplogs dispatched before are applied with
+// the previous rules
+func (sync *OplogSyncer) reload(req *reloadRequest) {
+	sync.batcher.WaitAllAck()
+	sync.batcher.filterList = replaceNamespaceFilter(sync.batcher.filterList, req.filterWhite, req.filterBlack)
+	if req.transform {
+		for _, worker := range sync.batcher.workerGroup {
+			if transformer, ok := worker.writeController.tunnel.(namespaceTransformer); ok {
+				transformer.SetNamespaceTransform(req.nsTrans)
+			}
+		}
+	}
+	close(req.done)
+	LOG.Info("oplog syncer %v reload done", sync.replset)
+}
+
+// backfill copies the namespaces passing filterList, and then syncs the
+// oplogs since the copy begins again, so the stale documents copied are
+// overwritten
+func (sync *OplogSyncer) backfill(filterList filter.DocFilterChain) error {
+	beginTs, err := utils.GetNewestTimestampByUrl(sync.mongoUrl)
+	if err != nil {
+		return err
+	}
+	if err := sync.coordinator.resyncDocument(sync.replset, sync.mongoUrl, filterList); err != nil {
+		return err
+	}
+	finishTs, err := utils.GetNewestTimestampByUrl(sync.mongoUrl)
+	if err != nil {
+		return err
+	}
+	LOG.Info("Syncer[%s] document sync for backfill done, incr sync begins at %v again", sync.replset,
+		utils.TimestampToLog(beginTs))
+
+	// only the oplogs of the namespaces copied may be applied before
+	sync.setReplayWindow(&replayWindow{finishTs: finishTs, filterList: filterList})
+	req := &positionRequest{ts: beginTs, done: make(chan struct{})}
+	sync.positionChan <- req
+	<-req.done
+	return nil
+}
+
+// replaceNamespaceFilter returns the chain with the namespace filter of the
+// new rules
+func replaceNamespaceFilter(chain filter.OplogFilterChain, white, black []string) filter.OplogFilterChain {
+	replaced := make(filter.OplogFilterChain, 0, len(chain)+1)
+	for _, oplogFilter := range chain {
+		if _, ok := oplogFilter.(*filter.NamespaceFilter); !ok {
+			replaced = append(replaced, oplogFilter)
+		}
+	}
+	if len(white) != 0 || len(black) != 0 {
+		replaced = append(replaced, filter.NewNamespaceFilter(white, black))
+	}
+	return replaced
+}
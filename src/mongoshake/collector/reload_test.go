@@ -0,0 +1,37 @@
+package collector
+
+import (
+	"fmt"
+	"testing"
+
+	"mongoshake/collector/filter"
+	"mongoshake/oplog"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceNamespaceFilter(t *testing.T) {
+	var nr int
+	chain := filter.OplogFilterChain{filter.NewAutologousFilter(), filter.NewNamespaceFilter([]string{"a"}, nil)}
+	{
+		fmt.Printf("TestReplaceNamespaceFilter case %d.\n", nr)
+		nr++
+		replaced := replaceNamespaceFilter(chain, []string{"b"}, nil)
+		assert.Equal(t, 2, len(replaced), "should be equal")
+		assert.Equal(t, true, replaced.IterateFilter(&oplog.PartialLog{Namespace: "a.c", Operation: "i"}),
+			"should be equal")
+		assert.Equal(t, false, replaced.IterateFilter(&oplog.PartialLog{Namespace: "b.c", Operation: "i"}),
+			"should be equal")
+		// the previous chain is kept
+		assert.Equal(t, false, chain.IterateFilter(&oplog.PartialLog{Namespace: "a.c", Operation: "i"}),
+			"should be equal")
+	}
+	{
+		fmt.Printf("TestReplaceNamespaceFilter case %d.\n", nr)
+		nr++
+		replaced := replaceNamespaceFilter(chain, nil, nil)
+		assert.Equal(t, 1, len(replaced), "should be equal")
+		assert.Equal(t, false, replaced.IterateFilter(&oplog.PartialLog{Namespace: "a.c", Operation: "i"}),
+			"should be equal")
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"github.com/vinllen/mgo/bson"
 	"mongoshake/collector/filter"
+	"mongoshake/collector/oplogsyncer"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"mongoshake/collector/configure"
 	"mongoshake/collector/docsyncer"
 	"mongoshake/collector/transform"
 	"mongoshake/common"
+	"mongoshake/executor"
 	"mongoshake/oplog"
 
 	"github.com/gugemichael/nimo4go"
@@ -35,8 +39,21 @@ type ReplicationCoordinator struct {
 	// syncerGroup and workerGroup number is 1:N in ReplicaSet.
 	// 1:1 while replicated in shard cluster
 	syncerGroup []*OplogSyncer
+	ckptManager *CheckpointManager
+	// replset of the syncer which reaches the stop position
+	stopNotifier chan string
 
 	rateController *nimo.SimpleRateController
+
+	// the queue of failed oplogs of direct tunnel, nil if retried forever
+	deadLetter executor.DeadLetterQueue
+
+	// set to 1 while reloading the rules or backfilling
+	reloading int32
+
+	// stage of replication, one of HealthStageStartup, HealthStageFullSync
+	// and HealthStageIncrSync
+	stage atomic.Value
 }
 
 func (coordinator *ReplicationCoordinator) Run() error {
@@ -67,7 +84,9 @@ func (coordinator *ReplicationCoordinator) Run() error {
 
 	switch syncMode {
 	case SYNCMODE_ALL:
-		if err := coordinator.startDocumentReplication(); err != nil {
+		// the full sync may be resumed from an interrupted one, so incr sync
+		// begins at the position where the first run started
+		if fullBeginTs, err = coordinator.startDocumentReplication(fullBeginTs); err != nil {
 			return err
 		}
 
@@ -94,12 +113,13 @@ func (coordinator *ReplicationCoordinator) Run() error {
 			return err
 		}
 	case SYNCMODE_DOCUMENT:
-		if err := coordinator.startDocumentReplication(); err != nil {
+		if _, err := coordinator.startDocumentReplication(0); err != nil {
 			return err
 		}
 	case SYNCMODE_OPLOG:
 		beginTs32 := conf.Options.ContextStartPosition
-		if beginTs32 != 0 {
+		// change stream reports the lost oplogs itself when opening
+		if beginTs32 != 0 && conf.Options.SyncerReaderFetchMethod != oplogsyncer.FetchMethodChangeStream {
 			// get current oldest timestamp
 			_, _, _, bigOldTs, _, err := utils.GetAllTimestamp(coordinator.Sources)
 			if err != nil {
@@ -110,7 +130,7 @@ func (coordinator *ReplicationCoordinator) Run() error {
 				return LOG.Critical("incr sync beginTs[%v] is less than current bigOldTs[%v], this error means user's "+
 					"oplog collection size is too small or full sync continues too long", beginTs32, utils.ExtractTs32(bigOldTs))
 			}
-		} else {
+		} else if beginTs32 == 0 {
 			// we can't insert Timestamp(0, 0) that will be treat as Now(), so we use Timestamp(1, 0)
 			beginTs32 = 1
 		}
@@ -132,12 +152,14 @@ func (coordinator *ReplicationCoordinator) sanitizeMongoDB() error {
 
 	// try to connect ContextStorageUrl
 	storageUrl := conf.Options.ContextStorageUrl
-	if conn, err = utils.NewMongoConn(storageUrl, utils.ConnectModePrimary, true); conn == nil || !conn.IsGood() || err != nil {
-		LOG.Critical("Connect storageUrl[%v] error[%v]. Please add primary node into 'mongo_urls' "+
-			"if 'context.storage.url' is empty", storageUrl, err)
-		return err
+	if conf.Options.ContextStorage == StorageTypeDB {
+		if conn, err = utils.NewMongoConn(storageUrl, utils.ConnectModePrimary, true); conn == nil || !conn.IsGood() || err != nil {
+			LOG.Critical("Connect storageUrl[%v] error[%v]. Please add primary node into 'mongo_urls' "+
+				"if 'context.storage.url' is empty", storageUrl, err)
+			return err
+		}
+		conn.Close()
 	}
-	conn.Close()
 
 	csUrl := conf.Options.MongoCsUrl
 	if csUrl != "" {
@@ -162,7 +184,8 @@ func (coordinator *ReplicationCoordinator) sanitizeMongoDB() error {
 		}
 
 		// a conventional ReplicaSet should have local.oplog.rs collection
-		if conf.Options.SyncMode != SYNCMODE_DOCUMENT && !conn.HasOplogNs() {
+		if conf.Options.SyncMode != SYNCMODE_DOCUMENT &&
+			conf.Options.SyncerReaderFetchMethod != oplogsyncer.FetchMethodChangeStream && !conn.HasOplogNs() {
 			conn.Close()
 			return LOG.Critical("no oplog ns in mongo. See https://github.com/alibaba/MongoShake/wiki/FAQ#q-how-to-solve-the-oplog-tailer-initialize-failed-no-oplog-ns-in-mongo-error")
 		}
@@ -250,19 +273,23 @@ func (coordinator *ReplicationCoordinator) selectSyncMode(syncMode string) (stri
 	}
 }
 
-func (coordinator *ReplicationCoordinator) startDocumentReplication() error {
+// startDocumentReplication returns the position where the incr sync should begin,
+// which is fullBeginTs unless an interrupted full sync is resumed
+func (coordinator *ReplicationCoordinator) startDocumentReplication(fullBeginTs int64) (int64, error) {
+	coordinator.setStage(HealthStageFullSync)
+
 	shardingChunkMap := make(utils.ShardingChunkMap)
 	fromIsSharding := len(coordinator.Sources) > 1
 	if fromIsSharding {
 		ok, _ := utils.GetBalancerStatusByUrl(conf.Options.MongoCsUrl)
 		if ok {
 			LOG.Critical("source mongodb sharding need to stop balancer when document replication occur")
-			return errors.New("source mongodb sharding need to stop balancer when document replication occur")
+			return 0, errors.New("source mongodb sharding need to stop balancer when document replication occur")
 		}
 		if conf.Options.FilterOrphanDocument {
 			var err error
 			if shardingChunkMap, err = utils.GetChunkMapByUrl(conf.Options.MongoCsUrl); err != nil {
-				return err
+				return 0, err
 			}
 		}
 	}
@@ -270,7 +297,15 @@ func (coordinator *ReplicationCoordinator) startDocumentReplication() error {
 	// get all namespace need to sync
 	nsSet, err := docsyncer.GetAllNamespace(coordinator.Sources)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	var docCkpt *docsyncer.DocCheckpoint
+	if conf.Options.ReplayerDocumentResume {
+		if docCkpt, err = docsyncer.NewDocCheckpoint(); err != nil {
+			return 0, err
+		}
+		defer docCkpt.Close()
 	}
 
 	ckptMap := make(map[string]bson.MongoTimestamp)
@@ -278,30 +313,69 @@ func (coordinator *ReplicationCoordinator) startDocumentReplication() error {
 	if conf.Options.SyncMode != SYNCMODE_DOCUMENT {
 		tsMap, _, _, _, _, err := utils.GetAllTimestamp(coordinator.Sources)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		for replset, tsNode := range tsMap {
 			ckptMap[replset] = tsNode.Newest
 		}
+
+		if docCkpt != nil {
+			if beginTsMap, ok := resumableBeginTs(tsMap, docCkpt.BeginTs()); ok {
+				LOG.Info("document syncer resume from the checkpoint, incr sync will begin at %v", beginTsMap)
+				ckptMap = beginTsMap
+				fullBeginTs = smallestTs(beginTsMap)
+			} else {
+				if len(docCkpt.Namespaces()) != 0 {
+					LOG.Warn("document syncer checkpoint is dropped because the oplog after it is lost")
+				}
+				if err := docCkpt.Clear(); err != nil {
+					return 0, err
+				}
+				if err := docCkpt.SetBeginTs(ckptMap); err != nil {
+					return 0, err
+				}
+			}
+		}
 	}
 
 	toUrl := conf.Options.TunnelAddress[0]
 	var toConn *utils.MongoConn
 	if toConn, err = utils.NewMongoConn(toUrl, utils.ConnectModePrimary, true); err != nil {
-		return err
+		return 0, err
 	}
 	defer toConn.Close()
 
 	trans := transform.NewNamespaceTransform(conf.Options.TransformNamespace)
+	var fieldTrans *transform.FieldTransform
+	if len(conf.Options.TransformField) > 0 {
+		fieldTrans = transform.NewFieldTransform(conf.Options.TransformField, conf.Options.TransformFieldHashSalt)
+	}
+
+	nsResumeSet := make(map[string]bool)
+	if docCkpt != nil {
+		nsResumeSet = docCkpt.Namespaces()
+	}
 
 	shardingSync := docsyncer.IsShardingToSharding(fromIsSharding, toConn)
-	nsExistedSet, err := docsyncer.StartDropDestCollection(nsSet, toConn, trans)
+	nsExistedSet, err := docsyncer.StartDropDestCollection(nsSet, toConn, trans, nsResumeSet)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if shardingSync {
 		if err := docsyncer.StartNamespaceSpecSyncForSharding(conf.Options.MongoCsUrl, toConn, nsExistedSet, trans); err != nil {
-			return err
+			return 0, err
+		}
+	}
+
+	// create indexes before copying documents so that the failures come out up front
+	indexStrategy := conf.Options.ReplayerIndexStrategy
+	if indexStrategy == docsyncer.IndexStrategyBefore {
+		indexMap, err := docsyncer.GetAllIndexes(coordinator.Sources)
+		if err != nil {
+			return 0, err
+		}
+		if err := docsyncer.StartIndexSync(indexMap, toUrl, nsExistedSet, trans, indexStrategy); err != nil {
+			return 0, err
 		}
 	}
 
@@ -322,7 +396,7 @@ func (coordinator *ReplicationCoordinator) startDocumentReplication() error {
 			orphanFilter = filter.NewOrphanFilter(src.Replset, dbChunkMap)
 		}
 
-		dbSyncer := docsyncer.NewDBSyncer(src.Replset, src.URL, toUrl, trans, orphanFilter)
+		dbSyncer := docsyncer.NewDBSyncer(src.Replset, src.URL, toUrl, trans, fieldTrans, orphanFilter, docCkpt)
 		LOG.Info("document syncer %v begin replication for url=%v", src.Replset, src.URL)
 		wg.Add(1)
 		nimo.GoRoutine(func() {
@@ -340,11 +414,21 @@ func (coordinator *ReplicationCoordinator) startDocumentReplication() error {
 	}
 	wg.Wait()
 	if replError != nil {
-		return replError
+		return 0, replError
 	}
 
-	if err := docsyncer.StartIndexSync(indexMap, toUrl, nsExistedSet, trans); err != nil {
-		return err
+	switch {
+	case indexStrategy == docsyncer.IndexStrategyBefore:
+	case indexStrategy == docsyncer.IndexStrategyBackgroundAfter && conf.Options.SyncMode != SYNCMODE_DOCUMENT:
+		// the failures are only logged, so nothing is waited for. the document
+		// mode waits since the collector exits once the full sync is done
+		nimo.GoRoutine(func() {
+			docsyncer.StartIndexSync(indexMap, toUrl, nsExistedSet, trans, indexStrategy)
+		})
+	default:
+		if err := docsyncer.StartIndexSync(indexMap, toUrl, nsExistedSet, trans, indexStrategy); err != nil {
+			return 0, err
+		}
 	}
 
 	// checkpoint after document syncer
@@ -352,11 +436,43 @@ func (coordinator *ReplicationCoordinator) startDocumentReplication() error {
 		LOG.Info("try to set checkpoint with map[%v]", ckptMap)
 		if err := docsyncer.FlushCheckpoint(ckptMap); err != nil {
 			LOG.Error("document syncer flush checkpoint failed. %v", err)
-			return err
+			return 0, err
+		}
+	}
+	// progress of namespaces is useless once the document replication is done
+	if docCkpt != nil {
+		if err := docCkpt.Clear(); err != nil {
+			return 0, err
 		}
 	}
 	LOG.Info("document syncer sync end")
-	return nil
+	return fullBeginTs, nil
+}
+
+// resumableBeginTs returns the begin timestamp of an interrupted full sync if
+// the oplog after it still exists in every replset
+func resumableBeginTs(tsMap map[string]utils.TimestampNode,
+	beginTsMap map[string]bson.MongoTimestamp) (map[string]bson.MongoTimestamp, bool) {
+	if len(beginTsMap) == 0 {
+		return nil, false
+	}
+	for replset, tsNode := range tsMap {
+		beginTs, ok := beginTsMap[replset]
+		if !ok || tsNode.Oldest >= beginTs {
+			return nil, false
+		}
+	}
+	return beginTsMap, true
+}
+
+func smallestTs(tsMap map[string]bson.MongoTimestamp) int64 {
+	var smallest bson.MongoTimestamp
+	for _, ts := range tsMap {
+		if smallest == 0 || ts < smallest {
+			smallest = ts
+		}
+	}
+	return utils.TimestampToInt64(smallest)
 }
 
 func (coordinator *ReplicationCoordinator) startOplogReplication(oplogStartPosition, fullSyncFinishPosition int64) error {
@@ -366,6 +482,8 @@ func (coordinator *ReplicationCoordinator) startOplogReplication(oplogStartPosit
 	ckptManager := NewCheckpointManager(oplogStartPosition)
 	mvckManager := NewMoveChunkManager(ckptManager)
 	ddlManager := NewDDLManager(ckptManager)
+	coordinator.ckptManager = ckptManager
+	coordinator.stopNotifier = make(chan string, len(coordinator.Sources))
 
 	// prepare all syncer. only one syncer while source is ReplicaSet
 	// otherwise one syncer connects to one shard
@@ -384,6 +502,15 @@ func (coordinator *ReplicationCoordinator) startOplogReplication(oplogStartPosit
 		coordinator.syncerGroup = append(coordinator.syncerGroup, syncer)
 	}
 
+	if conf.Options.Tunnel == "direct" && conf.Options.ReplayerDeadLetter != executor.DeadLetterNone {
+		queue, err := executor.NewDeadLetterQueue()
+		if err != nil {
+			return LOG.Critical("create dead letter queue %v failed. %v", conf.Options.ReplayerDeadLetter, err)
+		}
+		coordinator.deadLetter = queue
+		executor.DeadLetterRestAPI(queue, conf.Options.TunnelAddress)
+	}
+
 	// prepare worker routine and bind it to syncer
 	for i := 0; i != conf.Options.WorkerNum; i++ {
 		syncer := coordinator.syncerGroup[i%len(coordinator.syncerGroup)]
@@ -405,6 +532,9 @@ func (coordinator *ReplicationCoordinator) startOplogReplication(oplogStartPosit
 		return err
 	}
 	ckptManager.start()
+	ckptManager.RestAPI()
+	coordinator.ReloadAPI()
+	coordinator.setStage(HealthStageIncrSync)
 	if conf.Options.MoveChunkEnable {
 		mvckManager.start()
 	}
@@ -418,6 +548,44 @@ func (coordinator *ReplicationCoordinator) startOplogReplication(oplogStartPosit
 	return nil
 }
 
+// WaitStopPosition blocks until all syncers reach the stop position, and then
+// flushes the checkpoint
+func (coordinator *ReplicationCoordinator) WaitStopPosition() error {
+	for range coordinator.syncerGroup {
+		replset := <-coordinator.stopNotifier
+		LOG.Info("oplog syncer %v stopped at position[%v]", replset, conf.Options.ContextStopPosition)
+	}
+	return coordinator.ckptManager.FlushAll()
+}
+
+// Shutdown stops fetching oplogs, waits for the fetched ones to be applied and
+// then flushes the checkpoint. error is returned if it isn't done in timeout
+func (coordinator *ReplicationCoordinator) Shutdown(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		// drain at the same time, the DDL of sharding is blocked until all
+		// the syncers meet it
+		var wg sync.WaitGroup
+		for _, syncer := range coordinator.syncerGroup {
+			wg.Add(1)
+			syncer := syncer
+			go func() {
+				defer wg.Done()
+				syncer.Drain()
+			}()
+		}
+		wg.Wait()
+		done <- coordinator.ckptManager.FlushAll()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("oplogs are not drained in %v", timeout)
+	}
+}
+
 func DDLSupportForSharding() bool {
 	return !conf.Options.ReplayerDMLOnly && conf.Options.MongoCsUrl != ""
 }
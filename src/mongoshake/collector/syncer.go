@@ -3,6 +3,9 @@ package collector
 import (
 	"fmt"
 	"mongoshake/collector/oplogsyncer"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"mongoshake/collector/configure"
@@ -30,6 +33,7 @@ const (
 	DurationTime        = 6000 // unit: ms.
 	DDLCheckpointGap    = 5    // unit: seconds.
 	FilterCheckpointGap = 180  // unit: seconds. no checkpoint update, flush checkpoint mandatory
+	LagSampleInterval   = 10   // unit: seconds.
 
 	ShardingWorkerId = 0
 )
@@ -47,6 +51,8 @@ type OplogSyncer struct {
 	coordinator *ReplicationCoordinator
 	// source mongodb replica set name
 	replset string
+	// source mongodb url
+	mongoUrl string
 	// full sync finish position, used to check DDL between full sync and incr sync
 	fullSyncFinishPosition int64
 
@@ -66,13 +72,101 @@ type OplogSyncer struct {
 	nextQueuePosition uint64
 
 	// source mongo oplog reader
-	reader *oplogsyncer.OplogReader
+	reader oplogsyncer.Reader
 	// journal log that records all oplogs
 	journal *utils.Journal
 	// oplogs dispatcher
 	batcher *Batcher
 
 	replMetric *utils.ReplicationMetric
+
+	// set to 1 when the stop position is reached or draining, no more oplogs
+	// are fetched
+	stopped int32
+
+	// position requests from rest api, handled by poll
+	positionChan chan *positionRequest
+	// the request in progress. batcher drops the oplogs until it meets the
+	// seek markers of all logs queues. protected by batchLock
+	seeking   *positionRequest
+	batchLock sync.Mutex
+
+	// drain requests from shutdown, handled by poll
+	drainChan chan chan struct{}
+	// closed by batcher once it meets the drain markers of all logs queues
+	// and the oplogs before are acked. protected by batchLock
+	draining chan struct{}
+
+	// reload requests of filters and transforms, handled by batcher
+	reloadChan chan *reloadRequest
+
+	// *replayWindow of the oplogs synced again after backfill, set before
+	// seek and read by batcher
+	replayWindow atomic.Value
+}
+
+// positionRequest sets the position of syncer, done is closed once the
+// oplogs after ts are going to be dispatched
+type positionRequest struct {
+	ts   bson.MongoTimestamp
+	done chan struct{}
+}
+
+// replayWindow covers the oplogs not later than finishTs, which are synced
+// again after the documents are copied while the syncer is running. Unlike
+// the oplogs before fullSyncFinishPosition, DDL in it doesn't stop the syncer,
+// since the DDL before the copy has been applied once, and it's tolerated by
+// the executor to be applied again
+type replayWindow struct {
+	finishTs bson.MongoTimestamp
+	// the namespaces filtered aren't copied, all are copied if nil
+	filterList filter.DocFilterChain
+}
+
+// copied returns whether the oplog is in the window and on the namespaces
+// copied
+func (window *replayWindow) copied(log *oplog.PartialLog) bool {
+	if window == nil || log.Timestamp > window.finishTs {
+		return false
+	}
+	return window.filterList == nil || !window.filterList.IterateFilter(commandNamespace(log))
+}
+
+// commandNamespace returns the namespace operated by the oplog, which is the
+// database for the commands on database
+func commandNamespace(log *oplog.PartialLog) string {
+	db := strings.SplitN(log.Namespace, ".", 2)[0]
+	if log.Operation != "c" {
+		if strings.HasSuffix(log.Namespace, "system.indexes") {
+			if ns, ok := oplog.GetKey(log.Object, "ns").(string); ok {
+				return ns
+			}
+		}
+		return log.Namespace
+	}
+	operation, found := oplog.ExtraCommandName(log.Object)
+	if !found {
+		return db
+	}
+	switch value := oplog.GetKey(log.Object, operation).(type) {
+	case string:
+		if operation == "renameCollection" {
+			return value
+		}
+		return fmt.Sprintf("%s.%s", db, value)
+	default:
+		// such as dropDatabase and applyOps
+		return db
+	}
+}
+
+func (sync *OplogSyncer) setReplayWindow(window *replayWindow) {
+	sync.replayWindow.Store(window)
+}
+
+func (sync *OplogSyncer) getReplayWindow() *replayWindow {
+	window, _ := sync.replayWindow.Load().(*replayWindow)
+	return window
 }
 
 /*
@@ -94,13 +188,22 @@ func NewOplogSyncer(
 	syncer := &OplogSyncer{
 		coordinator:            coordinator,
 		replset:                replset,
+		mongoUrl:               mongoUrl,
 		fullSyncFinishPosition: fullSyncFinishPosition,
 		journal: utils.NewJournal(utils.JournalFileName(
 			fmt.Sprintf("%s.%s", conf.Options.CollectorId, replset))),
-		reader:      oplogsyncer.NewOplogReader(mongoUrl, replset),
-		ckptManager: ckptManager,
-		mvckManager: mvckManager,
-		ddlManager:  ddlManager,
+		ckptManager:  ckptManager,
+		mvckManager:  mvckManager,
+		ddlManager:   ddlManager,
+		positionChan: make(chan *positionRequest, 1),
+		drainChan:    make(chan chan struct{}, 1),
+		reloadChan:   make(chan *reloadRequest, 1),
+	}
+
+	if conf.Options.SyncerReaderFetchMethod == oplogsyncer.FetchMethodChangeStream {
+		syncer.reader = oplogsyncer.NewChangeStreamReader(mongoUrl, replset, conf.Options.SyncerReaderStreamDB)
+	} else {
+		syncer.reader = oplogsyncer.NewOplogReader(mongoUrl, replset)
 	}
 
 	// concurrent level hasher
@@ -113,6 +216,10 @@ func NewOplogSyncer(
 
 	filterList := filter.OplogFilterChain{filter.NewAutologousFilter(), filter.NewGidFilter(gids)}
 
+	// the oplogs synced from the peer in bidirectional replication
+	if conf.Options.FilterLoopPrevention {
+		filterList = append(filterList, new(filter.LoopFilter))
+	}
 	// DDL filter
 	if conf.Options.ReplayerDMLOnly {
 		filterList = append(filterList, new(filter.DDLFilter))
@@ -136,6 +243,7 @@ func (sync *OplogSyncer) init() {
 		utils.METRIC_TUNNEL_TRAFFIC|utils.METRIC_LSN_CKPT|utils.METRIC_SUCCESS|
 		utils.METRIC_TPS|utils.METRIC_RETRANSIMISSION)
 	sync.replMetric.ReplStatus.Update(utils.WorkGood)
+	utils.RegisterPrometheus(sync.replMetric.WritePrometheus)
 
 	sync.RestAPI()
 }
@@ -160,6 +268,8 @@ func (sync *OplogSyncer) start() {
 	sync.startDeserializer()
 	// start batcher: pull oplog from logs queue and then batch together before adding into worker.
 	sync.startBatcher()
+	// sample the newest and oldest timestamp of source for lag
+	go sync.sampleSource()
 
 	// forever fetching oplog from mongodb into oplog_reader
 	for {
@@ -170,6 +280,38 @@ func (sync *OplogSyncer) start() {
 	}
 }
 
+// sampleSource samples the newest and oldest oplog timestamp of source
+// every LagSampleInterval seconds, and checks the oplog window
+func (sync *OplogSyncer) sampleSource() {
+	var conn *utils.MongoConn
+	var lag *utils.Lag
+	for range time.NewTicker(LagSampleInterval * time.Second).C {
+		if conn == nil {
+			var err error
+			if conn, err = utils.NewMongoConn(sync.mongoUrl, utils.ConnectModeSecondaryPreferred, true); err != nil {
+				LOG.Warn("Syncer[%s] connect source for sampling lag failed. %v", sync.replset, err)
+				conn = nil
+				continue
+			}
+		}
+		newest, err := utils.GetNewestTimestampBySession(conn.Session)
+		var oldest bson.MongoTimestamp
+		if err == nil {
+			oldest, err = utils.GetOldestTimestampBySession(conn.Session)
+		}
+		if err != nil {
+			LOG.Warn("Syncer[%s] sample oplog timestamp of source failed. %v", sync.replset, err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		sync.replMetric.SetSourceTs(int64(newest), int64(oldest))
+		prev := lag
+		lag = sync.replMetric.Lag()
+		sync.checkOplogWindow(prev, lag)
+	}
+}
+
 // fetch all oplog from logs queue, batched together and then send to different workers.
 func (sync *OplogSyncer) startBatcher() {
 	var batcher = sync.batcher
@@ -180,6 +322,25 @@ func (sync *OplogSyncer) startBatcher() {
 		// of oplogs in batch is limited by AdaptiveBatchingMaxSize
 		nextBatch := batcher.Next()
 
+		sync.batchLock.Lock()
+		if sync.seeking != nil {
+			// drop the oplogs fetched before seek
+			barrier = false
+			batcher.remainLogs = nil
+			if batcher.seekMarkers == len(sync.logsQueue) {
+				sync.finishSeek()
+			}
+			sync.batchLock.Unlock()
+			return
+		}
+
+		// the rules are replaced between two batches
+		select {
+		case req := <-sync.reloadChan:
+			sync.reload(req)
+		default:
+		}
+
 		// avoid to do checkpoint when syncer update ackTs or syncTs
 		sync.ckptManager.mutex.RLock()
 		filteredNextBatch, nextBarrier, flushCheckpoint, lastOplog := batcher.filterAndBlockMoveChunk(nextBatch, barrier)
@@ -239,9 +400,142 @@ func (sync *OplogSyncer) startBatcher() {
 		// update syncTs of batcher
 		sync.batcher.syncTs = sync.batcher.unsyncTs
 		sync.ckptManager.mutex.RUnlock()
+		if sync.draining != nil && batcher.seekMarkers == len(sync.logsQueue) && len(batcher.remainLogs) == 0 {
+			sync.finishDrain()
+		}
+		sync.batchLock.Unlock()
+
+		if batcher.reachStop {
+			sync.stop()
+		}
 	})
 }
 
+// SetPosition makes the syncer fetch and dispatch the oplogs after ts, which
+// may be earlier or later than current position. It returns once the
+// position is set or timeout, the request is still handled after timeout
+func (sync *OplogSyncer) SetPosition(ts bson.MongoTimestamp, timeout time.Duration) error {
+	req := &positionRequest{ts: ts, done: make(chan struct{})}
+	select {
+	case sync.positionChan <- req:
+	default:
+		return fmt.Errorf("oplog syncer %v is busy setting position", sync.replset)
+	}
+	select {
+	case <-req.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("oplog syncer %v set position timeout, it's set once the syncer is polling", sync.replset)
+	}
+}
+
+// seek is called by poll. It pauses the batcher, drops the oplogs fetched
+// and sends a seek marker to every pending queue. The batcher resumes when
+// it meets all the markers
+func (sync *OplogSyncer) seek(req *positionRequest) {
+	LOG.Info("oplog syncer %v seek to %v", sync.replset, utils.TimestampToLog(req.ts))
+	// the oplogs dispatched after this are dropped
+	sync.batchLock.Lock()
+	sync.seeking = req
+	sync.batchLock.Unlock()
+
+	sync.buffer = make([]*bson.Raw, 0, conf.Options.FetcherBufferCapacity)
+	sync.reader.Seek(req.ts)
+	sync.sendMarkers()
+}
+
+// sendMarkers sends a marker to every pending queue
+func (sync *OplogSyncer) sendMarkers() {
+	for range sync.pendingQueue {
+		selected := int(sync.nextQueuePosition % uint64(len(sync.pendingQueue)))
+		sync.pendingQueue[selected] <- nil
+		sync.nextQueuePosition++
+	}
+}
+
+// finishSeek is called by batcher holding batchLock when all the seek
+// markers are met
+func (sync *OplogSyncer) finishSeek() {
+	req := sync.seeking
+	// the oplogs dispatched before seek are applied
+	sync.batcher.WaitAllAck()
+	for _, worker := range sync.batcher.workerGroup {
+		worker.resetAck(int64(req.ts))
+	}
+
+	sync.ckptManager.mutex.RLock()
+	sync.batcher.syncTs = req.ts
+	sync.batcher.unsyncTs = req.ts
+	sync.ckptManager.mutex.RUnlock()
+
+	sync.batcher.seekMarkers = 0
+	sync.seeking = nil
+	close(req.done)
+	LOG.Info("oplog syncer %v set position to %v", sync.replset, utils.TimestampToLog(req.ts))
+	// persist the new position
+	sync.ckptManager.FlushChan <- true
+}
+
+// Drain stops fetching oplogs, and blocks until the fetched ones are
+// dispatched and acked
+func (sync *OplogSyncer) Drain() {
+	if !quorum.IsMaster() {
+		// no oplogs are fetched by poll
+		sync.batcher.WaitAllAck()
+		return
+	}
+	done := make(chan struct{})
+	sync.drainChan <- done
+	<-done
+}
+
+// startDrain is called by poll. It stops fetching oplogs, dispatches the
+// buffered ones and sends a drain marker to every pending queue. The batcher
+// finishes draining when it meets all the markers
+func (sync *OplogSyncer) startDrain(done chan struct{}) {
+	LOG.Info("oplog syncer %v drain begin", sync.replset)
+	if !atomic.CompareAndSwapInt32(&sync.stopped, 0, 1) {
+		// the stop position is reached, the batcher is blocked after all
+		// the oplogs before it are acked
+		sync.batcher.WaitAllAck()
+		close(done)
+		return
+	}
+	// the markers of seek in progress can't be told from the drain ones
+	for {
+		sync.batchLock.Lock()
+		if sync.seeking == nil {
+			sync.draining = done
+			sync.batchLock.Unlock()
+			break
+		}
+		sync.batchLock.Unlock()
+		utils.DelayFor(100)
+	}
+	sync.transfer(nil)
+	sync.sendMarkers()
+}
+
+// finishDrain is called by batcher holding batchLock when all the drain
+// markers are met
+func (sync *OplogSyncer) finishDrain() {
+	sync.batcher.WaitAllAck()
+	sync.batcher.seekMarkers = 0
+	close(sync.draining)
+	sync.draining = nil
+	LOG.Info("oplog syncer %v drain done", sync.replset)
+}
+
+// stop fetching oplogs after the stop position, and notify the coordinator
+// once all dispatched oplogs are acked. The batcher is blocked forever
+func (sync *OplogSyncer) stop() {
+	atomic.StoreInt32(&sync.stopped, 1)
+	sync.batcher.WaitAllAck()
+	LOG.Info("oplog syncer %v all oplogs before stop position are acked", sync.replset)
+	sync.coordinator.stopNotifier <- sync.replset
+	select {}
+}
+
 func (sync *OplogSyncer) waitAllAck(flushCheckpoint bool) {
 	beginTs := time.Now()
 	if flushCheckpoint {
@@ -279,6 +573,11 @@ func (sync *OplogSyncer) startDeserializer() {
 func (sync *OplogSyncer) deserializer(index int) {
 	for {
 		batchRawLogs := <-sync.pendingQueue[index]
+		if batchRawLogs == nil {
+			// seek marker
+			sync.logsQueue[index] <- nil
+			continue
+		}
 		nimo.AssertTrue(len(batchRawLogs) != 0, "pending queue batch logs has zero length")
 		var deserializeLogs = make([]*oplog.GenericOplog, 0, len(batchRawLogs))
 
@@ -311,6 +610,20 @@ func (sync *OplogSyncer) poll() {
 	rc := sync.coordinator.rateController
 
 	for quorum.IsMaster() {
+		select {
+		case req := <-sync.positionChan:
+			sync.seek(req)
+		case done := <-sync.drainChan:
+			sync.startDrain(done)
+		default:
+		}
+
+		// no more oplogs are needed after the stop position
+		if atomic.LoadInt32(&sync.stopped) == 1 {
+			utils.DelayFor(100)
+			continue
+		}
+
 		// SimpleRateController is too simple. the TPS flow may represent
 		// low -> high -> low.... and centralize to point time in somewhere
 		// However. not smooth is make sense in stream processing. This was
@@ -346,6 +659,8 @@ func (sync *OplogSyncer) next() bool {
 		sync.replMetric.SetOplogMax(payload)
 		sync.replMetric.SetOplogAvg(payload)
 		sync.replMetric.ReplStatus.Clear(utils.FetchBad)
+	} else if err == oplogsyncer.CollectionCappedError && conf.Options.SyncerOplogWindowRecovery {
+		sync.recoverOplogWindow()
 	} else if err != nil && err != oplogsyncer.TimeoutError {
 		LOG.Error("oplog syncer internal error: %v", err)
 		// error is nil indicate that only timeout incur syncer.next()
@@ -409,6 +724,13 @@ func (sync *OplogSyncer) RestAPI() {
 		LsnAck      *MongoTime `json:"lsn_ack"`
 		LsnCkpt     *MongoTime `json:"lsn_ckpt"`
 		Now         *Time      `json:"now"`
+
+		// resolved conflicts of each policy
+		Conflicts map[string]uint64 `json:"conflicts"`
+		// oplogs put into the dead letter queue
+		DeadLetters uint64 `json:"dead_letters"`
+		// seconds behind the newest oplog of source
+		Lag *utils.Lag `json:"lag"`
 	}
 
 	utils.HttpApi.RegisterAPI("/repl", nimo.HttpGet, func([]byte) interface{} {
@@ -420,6 +742,9 @@ func (sync *OplogSyncer) RestAPI() {
 			LogsRepl:    sync.replMetric.Apply(),
 			LogsSuccess: sync.replMetric.Success(),
 			Tps:         sync.replMetric.Tps(),
+			Conflicts:   sync.replMetric.Conflicts(),
+			DeadLetters: atomic.LoadUint64(&sync.replMetric.DeadLetters),
+			Lag:         sync.replMetric.Lag(),
 			Lsn: &MongoTime{TimestampMongo: utils.Int64ToString(sync.replMetric.LSN),
 				Time: Time{TimestampUnix: utils.ExtractTs32(sync.replMetric.LSN),
 					TimestampTime: utils.TimestampToString(utils.ExtractTs32(sync.replMetric.LSN))}},
@@ -0,0 +1,397 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	FieldDrop   = "drop"
+	FieldRename = "rename"
+	FieldHash   = "hash"
+	FieldMask   = "mask"
+	FieldSet    = "set"
+
+	maskChar = "*"
+)
+
+// FieldRule transforms a field of the documents in namespace. The field is
+// a dotted path of embedded documents, the arrays are not traversed
+type FieldRule struct {
+	// "db" matches all the collections in db
+	namespace string
+	path      []string
+	op        string
+	// new path of rename
+	renamed []string
+	// number of trailing characters left by mask
+	keep int
+	// constant of set
+	value string
+}
+
+type FieldTransform struct {
+	rules []*FieldRule
+	salt  string
+}
+
+// NewFieldTransform parses the rules in format "namespace:op:field[:argument]":
+//
+//	db.coll:drop:field
+//	db.coll:rename:field:newName
+//	db.coll:hash:field
+//	db.coll:mask:field[:keep]
+//	db.coll:set:field:constant
+func NewFieldTransform(transRule []string, salt string) *FieldTransform {
+	rules := make([]*FieldRule, 0, len(transRule))
+	for _, rule := range transRule {
+		items := strings.SplitN(rule, ":", 4)
+		if len(items) < 3 || items[0] == "" || items[2] == "" {
+			LOG.Crashf("transform field rule %v is illegal", rule)
+		}
+
+		fieldRule := &FieldRule{namespace: items[0], op: items[1], path: strings.Split(items[2], ".")}
+		// _id is the key to replay update and delete
+		if fieldRule.path[0] == "_id" {
+			LOG.Crashf("transform field rule %v is illegal, _id can't be transformed", rule)
+		}
+		switch fieldRule.op {
+		case FieldDrop, FieldHash:
+			if len(items) != 3 {
+				LOG.Crashf("transform field rule %v is illegal", rule)
+			}
+		case FieldRename:
+			if len(items) != 4 || items[3] == "" || strings.Contains(items[3], ".") {
+				LOG.Crashf("transform field rule %v is illegal, rename needs a new field name", rule)
+			}
+			fieldRule.renamed = append(append([]string{}, fieldRule.path[:len(fieldRule.path)-1]...), items[3])
+		case FieldMask:
+			if len(items) == 4 {
+				keep, err := strconv.Atoi(items[3])
+				if err != nil || keep < 0 {
+					LOG.Crashf("transform field rule %v is illegal, mask needs a non-negative number", rule)
+				}
+				fieldRule.keep = keep
+			}
+		case FieldSet:
+			if len(items) != 4 {
+				LOG.Crashf("transform field rule %v is illegal, set needs a constant", rule)
+			}
+			fieldRule.value = items[3]
+		default:
+			LOG.Crashf("transform field rule %v is illegal, unknown operation %v", rule, fieldRule.op)
+		}
+		rules = append(rules, fieldRule)
+	}
+	return &FieldTransform{rules: rules, salt: salt}
+}
+
+func (transform *FieldTransform) match(namespace string) []*FieldRule {
+	var rules []*FieldRule
+	for _, rule := range transform.rules {
+		if rule.namespace == namespace || strings.HasPrefix(namespace, rule.namespace+".") {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// TransformDoc applies the rules of namespace to the whole document, which
+// is inserted or replaced
+func (transform *FieldTransform) TransformDoc(namespace string, doc bson.D) bson.D {
+	for _, rule := range transform.match(namespace) {
+		doc = transform.applyDoc(rule, doc, rule.path)
+	}
+	return doc
+}
+
+func (transform *FieldTransform) TransformRawDoc(namespace string, doc *bson.Raw) *bson.Raw {
+	rules := transform.match(namespace)
+	if len(rules) == 0 {
+		return doc
+	}
+
+	var docD bson.D
+	if err := bson.Unmarshal(doc.Data, &docD); err != nil {
+		LOG.Warn("TransformRawDoc unmarshal bson %v from ns[%v] failed. %v", doc.Data, namespace, err)
+		return doc
+	}
+	for _, rule := range rules {
+		docD = transform.applyDoc(rule, docD, rule.path)
+	}
+
+	if v, err := bson.Marshal(docD); err != nil {
+		LOG.Warn("TransformRawDoc marshal bson %v from ns[%v] failed. %v", docD, namespace, err)
+	} else {
+		doc.Data = v
+	}
+	return doc
+}
+
+// TransformUpdate applies the rules of namespace to the object of update
+// oplog. The paths in $set and $unset, or the fields in diff of $v:2 since
+// 5.0, are rewritten, dropped or kept according to the rules. nil is
+// returned if nothing is left to update
+func (transform *FieldTransform) TransformUpdate(namespace string, update bson.D) bson.D {
+	rules := transform.match(namespace)
+	if len(rules) == 0 {
+		return update
+	}
+	if len(update) == 0 || !strings.HasPrefix(update[0].Name, "$") {
+		// replacement
+		return transform.TransformDoc(namespace, update)
+	}
+
+	result := make(bson.D, 0, len(update))
+	modified := false
+	for _, ele := range update {
+		if ele.Name == "$set" || ele.Name == "$unset" {
+			modifier, ok := ele.Value.(bson.D)
+			if !ok {
+				LOG.Warn("TransformUpdate meets illegal %v of ns[%v]: %v", ele.Name, namespace, ele.Value)
+				result = append(result, ele)
+				continue
+			}
+			for _, rule := range rules {
+				modifier = transform.applyModifier(rule, modifier, ele.Name == "$unset")
+			}
+			if len(modifier) == 0 {
+				continue
+			}
+			ele.Value = modifier
+		} else if ele.Name == "diff" {
+			diff, ok := ele.Value.(bson.D)
+			if !ok {
+				LOG.Warn("TransformUpdate meets illegal %v of ns[%v]: %v", ele.Name, namespace, ele.Value)
+				result = append(result, ele)
+				continue
+			}
+			for _, rule := range rules {
+				diff = transform.applyDiff(rule, diff, rule.path)
+			}
+			if len(diff) == 0 {
+				continue
+			}
+			ele.Value = diff
+		}
+		if ele.Name != "$v" {
+			modified = true
+		}
+		result = append(result, ele)
+	}
+	if !modified {
+		return nil
+	}
+	return result
+}
+
+func (transform *FieldTransform) applyDoc(rule *FieldRule, doc bson.D, path []string) bson.D {
+	index := indexOf(doc, path[0])
+	if len(path) > 1 {
+		if index < 0 {
+			if rule.op != FieldSet {
+				return doc
+			}
+			doc = append(doc, bson.DocElem{Name: path[0], Value: bson.D{}})
+			index = len(doc) - 1
+		}
+		if sub, ok := doc[index].Value.(bson.D); ok {
+			doc[index].Value = transform.applyDoc(rule, sub, path[1:])
+		}
+		return doc
+	}
+
+	switch {
+	case index < 0:
+		if rule.op == FieldSet {
+			doc = append(doc, bson.DocElem{Name: path[0], Value: rule.value})
+		}
+	case rule.op == FieldDrop:
+		doc = append(doc[:index], doc[index+1:]...)
+	case rule.op == FieldRename:
+		doc[index].Name = rule.renamed[len(rule.renamed)-1]
+	default:
+		doc[index].Value = transform.transformValue(rule, doc[index].Value)
+	}
+	return doc
+}
+
+// applyModifier rewrites the fields of $set or $unset, which are keyed by
+// dotted path:
+//
+//	field of rule: the value is transformed, or the path is dropped or renamed.
+//	parent of field: the rule is applied to the embedded document in $set.
+//	child of field: the path is renamed, otherwise the change is dropped since
+//	                the field is replaced by the rule
+func (transform *FieldTransform) applyModifier(rule *FieldRule, modifier bson.D, unset bool) bson.D {
+	result := make(bson.D, 0, len(modifier))
+	for _, ele := range modifier {
+		path := strings.Split(ele.Name, ".")
+		switch {
+		case len(path) == len(rule.path) && hasPrefix(path, rule.path):
+			switch rule.op {
+			case FieldDrop:
+				continue
+			case FieldRename:
+				ele.Name = strings.Join(rule.renamed, ".")
+			case FieldSet:
+				// the constant is kept
+				if unset {
+					continue
+				}
+				ele.Value = rule.value
+			default:
+				if !unset {
+					ele.Value = transform.transformValue(rule, ele.Value)
+				}
+			}
+		case hasPrefix(rule.path, path):
+			if sub, ok := ele.Value.(bson.D); ok && !unset {
+				ele.Value = transform.applyDoc(rule, sub, rule.path[len(path):])
+			}
+		case hasPrefix(path, rule.path):
+			if rule.op != FieldRename {
+				continue
+			}
+			ele.Name = strings.Join(append(append([]string{}, rule.renamed...), path[len(rule.path):]...), ".")
+		}
+		result = append(result, ele)
+	}
+	return result
+}
+
+// applyDiff rewrites the diff of update in format $v:2, which is keyed by the
+// field name of each level:
+//
+//	{u: {field: value}, i: {field: value}, d: {field: false}, s<field>: {diff of field}}
+//
+// "u" and "i" are handled as $set, "d" as $unset. The diff of the field of
+// rule is dropped unless renamed, since the field is replaced by the rule.
+// The diff of array marked by "a" isn't traversed
+func (transform *FieldTransform) applyDiff(rule *FieldRule, diff bson.D, path []string) bson.D {
+	if indexOf(diff, "a") >= 0 {
+		return diff
+	}
+
+	result := make(bson.D, 0, len(diff))
+	for _, ele := range diff {
+		switch ele.Name {
+		case "u", "i", "d":
+			if section, ok := ele.Value.(bson.D); ok {
+				section = transform.applyDiffSection(rule, section, path, ele.Name == "d")
+				if len(section) == 0 {
+					continue
+				}
+				ele.Value = section
+			}
+		case "s" + path[0]:
+			if len(path) == 1 {
+				if rule.op != FieldRename {
+					continue
+				}
+				ele.Name = "s" + rule.renamed[len(rule.renamed)-1]
+			} else if sub, ok := ele.Value.(bson.D); ok {
+				sub = transform.applyDiff(rule, sub, path[1:])
+				if len(sub) == 0 {
+					continue
+				}
+				ele.Value = sub
+			}
+		}
+		result = append(result, ele)
+	}
+	return result
+}
+
+func (transform *FieldTransform) applyDiffSection(rule *FieldRule, section bson.D, path []string,
+	deleted bool) bson.D {
+	result := make(bson.D, 0, len(section))
+	for _, ele := range section {
+		if ele.Name == path[0] {
+			if len(path) > 1 {
+				if sub, ok := ele.Value.(bson.D); ok && !deleted {
+					ele.Value = transform.applyDoc(rule, sub, path[1:])
+				}
+			} else {
+				switch rule.op {
+				case FieldDrop:
+					continue
+				case FieldRename:
+					ele.Name = rule.renamed[len(rule.renamed)-1]
+				case FieldSet:
+					// the constant is kept
+					if deleted {
+						continue
+					}
+					ele.Value = rule.value
+				default:
+					if !deleted {
+						ele.Value = transform.transformValue(rule, ele.Value)
+					}
+				}
+			}
+		}
+		result = append(result, ele)
+	}
+	return result
+}
+
+func (transform *FieldTransform) transformValue(rule *FieldRule, value interface{}) interface{} {
+	switch rule.op {
+	case FieldHash:
+		var data []byte
+		if s, ok := value.(string); ok {
+			data = []byte(s)
+		} else if raw, err := bson.Marshal(bson.D{{"v", value}}); err == nil {
+			data = raw
+		} else {
+			data = []byte(fmt.Sprint(value))
+		}
+		sum := sha256.Sum256(append([]byte(transform.salt), data...))
+		return hex.EncodeToString(sum[:])
+	case FieldMask:
+		s, ok := value.(string)
+		if !ok {
+			s = fmt.Sprint(value)
+		}
+		// the short one is masked entirely
+		n := utf8.RuneCountInString(s)
+		if n <= rule.keep {
+			return strings.Repeat(maskChar, n)
+		}
+		runes := []rune(s)
+		return strings.Repeat(maskChar, n-rule.keep) + string(runes[n-rule.keep:])
+	case FieldSet:
+		return rule.value
+	}
+	return value
+}
+
+func indexOf(doc bson.D, name string) int {
+	for i, ele := range doc {
+		if ele.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasPrefix returns whether prefix is a proper or equal prefix of path
+func hasPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
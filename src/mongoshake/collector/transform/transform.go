@@ -14,6 +14,10 @@ type NamespaceTransform struct {
 }
 
 func (transform *NamespaceTransform) Transform(namespace string) string {
+	// nil if only the fields are transformed
+	if transform == nil {
+		return namespace
+	}
 	for _, rule_pair := range transform.ruleList {
 		re := regexp.MustCompile(rule_pair[0])
 		params := re.FindStringSubmatch(namespace)
@@ -27,10 +31,9 @@ func (transform *NamespaceTransform) Transform(namespace string) string {
 func NewNamespaceTransform(transRule []string) *NamespaceTransform {
 	ruleList := make([][2]string, 0)
 	for _, rule := range transRule {
-		rulePair := strings.SplitN(rule, ":", 2)
-		if len(rulePair) != 2 ||
-			len(strings.SplitN(rulePair[0], ".", 2)) != len(strings.SplitN(rulePair[1], ".", 2)) {
-			LOG.Crashf("transform rule %v is illegal", rule)
+		rulePair, err := splitRule(rule)
+		if err != nil {
+			LOG.Crashf("%v", err)
 		}
 		fromRule := strings.Replace(rulePair[0], ".", "\\.", -1)
 		fromPattern := fmt.Sprintf("^%s$|^%s(\\..*)$", fromRule, fromRule)
@@ -39,6 +42,27 @@ func NewNamespaceTransform(transRule []string) *NamespaceTransform {
 	return &NamespaceTransform{ruleList: ruleList}
 }
 
+// ValidateNamespaceTransform returns the error of the first illegal rule
+func ValidateNamespaceTransform(transRule []string) error {
+	for _, rule := range transRule {
+		if _, err := splitRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitRule splits the rule into the namespaces of source and dest, which
+// must be both db or both db.collection
+func splitRule(rule string) ([]string, error) {
+	rulePair := strings.SplitN(rule, ":", 2)
+	if len(rulePair) != 2 ||
+		len(strings.SplitN(rulePair[0], ".", 2)) != len(strings.SplitN(rulePair[1], ".", 2)) {
+		return nil, fmt.Errorf("transform rule %v is illegal", rule)
+	}
+	return rulePair, nil
+}
+
 type DBTransform struct {
 	ruleMap map[string][]string
 }
@@ -53,10 +77,9 @@ func (transform *DBTransform) Transform(db string) []string {
 func NewDBTransform(transRule []string) *DBTransform {
 	ruleMap := make(map[string][]string)
 	for _, rule := range transRule {
-		rulePair := strings.SplitN(rule, ":", 2)
-		if len(rulePair) != 2 ||
-			len(strings.SplitN(rulePair[0], ".", 2)) != len(strings.SplitN(rulePair[1], ".", 2)) {
-			LOG.Crashf("transform rule %v is illegal", rule)
+		rulePair, err := splitRule(rule)
+		if err != nil {
+			LOG.Crashf("%v", err)
 		}
 		fromDB := strings.SplitN(rulePair[0], ".", 2)[0]
 		toDB := strings.SplitN(rulePair[1], ".", 2)[0]
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/vinllen/mgo/bson"
 )
 
 func TestTransform(t *testing.T) {
@@ -44,4 +45,91 @@ func TestTransform(t *testing.T) {
 		assert.Equal(t, []string{"toDB1", "toDB2"}, trans.Transform("fromDB1"), "should be equal")
 		assert.Equal(t, []string{"fromDB2"}, trans.Transform("fromDB2"), "should be equal")
 	}
+	{
+		fmt.Printf("TestTransform case %d.\n", nr)
+		nr++
+		assert.Nil(t, ValidateNamespaceTransform([]string{"fromDB1:toDB1", "fromDB2.fromCol2:toDB2.toCol2"}))
+		assert.NotNil(t, ValidateNamespaceTransform([]string{"fromDB1:toDB1", "fromDB2.fromCol2:toDB2"}))
+		assert.NotNil(t, ValidateNamespaceTransform([]string{"fromDB1"}))
+	}
+}
+
+func TestFieldTransform(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestFieldTransform case %d.\n", nr)
+		nr++
+		transRule := []string{"db.coll:drop:a.b", "db:rename:c:d", "db.coll:mask:e:2", "db.coll:set:f.g:cn",
+			"db2:hash:e"}
+		trans := NewFieldTransform(transRule, "salt")
+		doc := bson.D{{"_id", 1}, {"a", bson.D{{"b", 1}, {"x", 1}}}, {"c", 1}, {"e", "12345"}}
+		assert.Equal(t, bson.D{{"_id", 1}, {"a", bson.D{{"x", 1}}}, {"d", 1}, {"e", "***45"}, {"f", bson.D{{"g", "cn"}}}},
+			trans.TransformDoc("db.coll", doc), "should be equal")
+		assert.Equal(t, bson.D{{"_id", 1}, {"d", 1}}, trans.TransformDoc("db.coll2", bson.D{{"_id", 1}, {"c", 1}}),
+			"should be equal")
+		assert.Equal(t, bson.D{{"_id", 1}, {"c", 1}}, trans.TransformDoc("db3.coll", bson.D{{"_id", 1}, {"c", 1}}),
+			"should be equal")
+
+		hash := trans.TransformDoc("db2.coll", bson.D{{"e", "12345"}})
+		assert.Equal(t, 64, len(hash[0].Value.(string)), "should be equal")
+		assert.Equal(t, hash, trans.TransformDoc("db2.coll", bson.D{{"e", "12345"}}), "should be equal")
+		assert.NotEqual(t, hash, NewFieldTransform(transRule, "").TransformDoc("db2.coll", bson.D{{"e", "12345"}}),
+			"should be not equal")
+	}
+	{
+		fmt.Printf("TestFieldTransform case %d.\n", nr)
+		nr++
+		transRule := []string{"db.coll:drop:a.b", "db:rename:c:d", "db.coll:mask:e", "db.coll:set:f:cn"}
+		trans := NewFieldTransform(transRule, "")
+
+		// $set
+		update := bson.D{{"$v", 1}, {"$set", bson.D{{"a.b", 1}, {"a", bson.D{{"b", 1}, {"x", 1}}}, {"c.y", 1},
+			{"e", "123"}, {"e.z", 1}, {"f", "us"}}}}
+		assert.Equal(t, bson.D{{"$v", 1}, {"$set", bson.D{{"a", bson.D{{"x", 1}}}, {"d.y", 1}, {"e", "***"},
+			{"f", "cn"}}}}, trans.TransformUpdate("db.coll", update), "should be equal")
+
+		// $unset
+		update = bson.D{{"$unset", bson.D{{"a.b", 1}, {"a", 1}, {"c", 1}, {"e", 1}, {"f", 1}}}}
+		assert.Equal(t, bson.D{{"$unset", bson.D{{"a", 1}, {"d", 1}, {"e", 1}}}},
+			trans.TransformUpdate("db.coll", update), "should be equal")
+
+		// nothing left
+		update = bson.D{{"$v", 1}, {"$set", bson.D{{"a.b", 1}}}, {"$unset", bson.D{{"f", 1}}}}
+		assert.Equal(t, bson.D(nil), trans.TransformUpdate("db.coll", update), "should be equal")
+
+		// replacement
+		update = bson.D{{"_id", 1}, {"c", 1}}
+		assert.Equal(t, bson.D{{"_id", 1}, {"d", 1}, {"f", "cn"}}, trans.TransformUpdate("db.coll", update),
+			"should be equal")
+	}
+	{
+		fmt.Printf("TestFieldTransform case %d.\n", nr)
+		nr++
+		transRule := []string{"db.coll:drop:a.b", "db:rename:c:d", "db.coll:mask:e", "db.coll:set:f:cn"}
+		trans := NewFieldTransform(transRule, "")
+
+		// diff of $v:2
+		update := bson.D{{"$v", 2}, {"diff", bson.D{
+			{"u", bson.D{{"a", bson.D{{"b", 1}, {"x", 1}}}, {"e", "123"}, {"f", "us"}}},
+			{"i", bson.D{{"c", 1}}},
+			{"d", bson.D{{"f", false}, {"g", false}}},
+			{"sa", bson.D{{"u", bson.D{{"b", 2}, {"x", 2}}}, {"d", bson.D{{"b", false}}}}},
+			{"sc", bson.D{{"i", bson.D{{"y", 1}}}}},
+			{"se", bson.D{{"i", bson.D{{"z", 1}}}}},
+			{"sh", bson.D{{"a", true}, {"u0", 1}}},
+		}}}
+		assert.Equal(t, bson.D{{"$v", 2}, {"diff", bson.D{
+			{"u", bson.D{{"a", bson.D{{"x", 1}}}, {"e", "***"}, {"f", "cn"}}},
+			{"i", bson.D{{"d", 1}}},
+			{"d", bson.D{{"g", false}}},
+			{"sa", bson.D{{"u", bson.D{{"x", 2}}}}},
+			{"sd", bson.D{{"i", bson.D{{"y", 1}}}}},
+			{"sh", bson.D{{"a", true}, {"u0", 1}}},
+		}}}, trans.TransformUpdate("db.coll", update), "should be equal")
+
+		// nothing left
+		update = bson.D{{"$v", 2}, {"diff", bson.D{{"d", bson.D{{"f", false}}},
+			{"sa", bson.D{{"u", bson.D{{"b", 2}}}}}}}}
+		assert.Equal(t, bson.D(nil), trans.TransformUpdate("db.coll", update), "should be equal")
+	}
 }
@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"fmt"
 	"sort"
 	"sync/atomic"
 
@@ -46,6 +47,9 @@ type Worker struct {
 
 	// event listener
 	eventListener *TransferEventListener
+
+	// position set by syncer, handled in worker routine
+	resetChan chan int64
 }
 
 type TransferEventListener struct {
@@ -59,11 +63,13 @@ func NewWorker(coordinator *ReplicationCoordinator, syncer *OplogSyncer, id uint
 		syncer:      syncer,
 		id:          id,
 		queue:       make(chan []*oplog.GenericOplog, conf.Options.WorkerBatchQueueSize),
+		resetChan:   make(chan int64),
 	}
 }
 
 func (worker *Worker) init() bool {
 	worker.RestAPI()
+	utils.RegisterPrometheus(worker.writePrometheus)
 	worker.writeController = NewWriteController(worker)
 	return worker.writeController != nil
 }
@@ -122,6 +128,13 @@ func (worker *Worker) startWorker() {
 
 	var batch []*oplog.GenericOplog
 	for {
+		select {
+		case ts := <-worker.resetChan:
+			worker.reset(ts)
+			continue
+		default:
+		}
+
 		switch {
 		case worker.shouldDelay():
 			// we guess there were lots of oplogs have been pended in jobs queue.
@@ -217,6 +230,20 @@ func (worker *Worker) transfer(batch []*oplog.GenericOplog) {
 	}
 }
 
+// resetAck sets the ack offset to ts after all the oplogs are acked. It
+// blocks until the worker routine handles it
+func (worker *Worker) resetAck(ts int64) {
+	worker.resetChan <- ts
+}
+
+func (worker *Worker) reset(ts int64) {
+	worker.listUnACK = nil
+	worker.writeController.LatestLsnAck = ts
+	atomic.StoreInt64(&worker.unack, ts)
+	atomic.StoreInt64(&worker.ack, ts)
+	LOG.Info("Collector-worker-%d reset ack to %v", worker.id, utils.TimestampToLog(ts))
+}
+
 func (worker *Worker) probe() {
 	if replyAcked := worker.writeController.Send([]*oplog.GenericOplog{}, tunnel.MsgProbe); replyAcked > 0 {
 		// only change ack offset on reply is OK
@@ -264,3 +291,14 @@ func (worker *Worker) RestAPI() {
 		}
 	})
 }
+
+// writePrometheus writes the depth of job queue and the unack buffer
+func (worker *Worker) writePrometheus(writer *utils.PrometheusWriter) {
+	labels := []string{"replset", worker.syncer.replset, "worker", fmt.Sprint(worker.id)}
+	writer.Add("mongoshake_worker_queue_depth", utils.PrometheusGauge, "Batches queued in worker.",
+		float64(len(worker.queue)), labels...)
+	writer.Add("mongoshake_worker_unack_buffer", utils.PrometheusGauge, "Oplogs sent but not acked by tunnel.",
+		float64(len(worker.listUnACK)), labels...)
+	writer.Add("mongoshake_worker_ack_seconds", utils.PrometheusGauge, "Timestamp of the last acked oplog.",
+		float64(utils.ExtractTs32(atomic.LoadInt64(&worker.ack))), labels...)
+}
@@ -1,6 +1,8 @@
 package collector
 
 import (
+	"time"
+
 	"mongoshake/collector/configure"
 	"mongoshake/common"
 	"mongoshake/modules"
@@ -55,7 +57,18 @@ func NewWriteController(worker *Worker) *WriteController {
 	}
 
 	// create t by options
-	factory := tunnel.WriterFactory{Name: conf.Options.Tunnel}
+	factory := tunnel.WriterFactory{
+		Name:                conf.Options.Tunnel,
+		KafkaPartitionBy:    conf.Options.TunnelKafkaPartitionBy,
+		KafkaMessage:        conf.Options.TunnelMessage,
+		KafkaAsync:          conf.Options.TunnelKafkaAsync,
+		FileSegmentSize:     conf.Options.TunnelFileSegmentSize * 1024 * 1024,
+		FileSegmentInterval: time.Duration(conf.Options.TunnelFileSegmentTime) * time.Second,
+		ExactlyOnce:         conf.Options.ReplayerExactlyOnce,
+		LoopPrevention:      conf.Options.ReplayerLoopPrevention,
+		ReplMetric:          worker.syncer.replMetric,
+		DeadLetter:          worker.coordinator.deadLetter,
+	}
 	if writeController.tunnel = factory.Create(conf.Options.TunnelAddress, worker.id); writeController.tunnel != nil {
 		if writeController.tunnel.Prepare() {
 			return writeController
@@ -92,6 +105,7 @@ func (controller *WriteController) Send(logs []*oplog.GenericOplog, tag uint32)
 			Tag:     tag,
 			Shard:   controller.worker.id,
 			RawLogs: oplog.LogEntryEncode(logs),
+			Replset: controller.worker.syncer.replset,
 		},
 		ParsedLogs: oplog.LogParsed(logs),
 	}
@@ -0,0 +1,383 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	conf "mongoshake/collector/configure"
+
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	StorageTypeAPI  = "api"
+	StorageTypeDB   = "database"
+	StorageTypeFile = "file"
+
+	// documents inserted at once, 1000 * byte size of checkpoint < 16MB
+	StorageBatchSize = 1000
+	// the key of documents in file and http body
+	storageDocsKey = "docs"
+
+	storageHttpTimeout = 10 * time.Second
+)
+
+// CheckpointStorage persists the tables of checkpoint. A table is a list of
+// documents which is written as a whole, or one document at a time. The
+// documents are loaded as map[string]interface{}, so are the embedded
+// documents.
+type CheckpointStorage interface {
+	// Load returns all the documents of table, empty if it doesn't exist
+	Load(table string) ([]map[string]interface{}, error)
+	// Save replaces the documents of table atomically
+	Save(table string, docs []interface{}) error
+	// Upsert replaces the first document whose fields equal to selector, or
+	// inserts doc if there is none. The other documents are kept
+	Upsert(table string, selector map[string]interface{}, doc interface{}) error
+	// Drop removes table, nothing happens if it doesn't exist
+	Drop(table string) error
+	// Rename replaces table "to" with "from", nothing happens if "from"
+	// doesn't exist
+	Rename(from, to string) error
+	Close()
+}
+
+// NewCheckpointStorage creates the storage by context.storage. The writes of
+// database storage are acknowledged by the majority if majority is true
+func NewCheckpointStorage(majority bool) (CheckpointStorage, error) {
+	url := conf.Options.ContextStorageUrl
+	db := AppDatabase()
+	switch conf.Options.ContextStorage {
+	case StorageTypeDB:
+		return NewMongoStorage(url, db, majority)
+	case StorageTypeFile:
+		return NewFileStorage(filepath.Join(url, db))
+	case StorageTypeAPI:
+		return NewHttpStorage(strings.TrimRight(url, "/") + "/" + db), nil
+	}
+	return nil, fmt.Errorf("unknown context storage %v", conf.Options.ContextStorage)
+}
+
+// LoadCheckpointStage returns the stage of flush in the version table of
+// checkpoint, empty if not exists
+func LoadCheckpointStage(storage CheckpointStorage, table string) (string, error) {
+	docs, err := storage.Load(table)
+	if err != nil || len(docs) == 0 {
+		return "", err
+	}
+	stage, _ := docs[0][CheckpointStage].(string)
+	return stage, nil
+}
+
+// MongoStorage stores each table in a collection of db
+type MongoStorage struct {
+	conn *MongoConn
+	db   string
+}
+
+func NewMongoStorage(url, db string, majority bool) (*MongoStorage, error) {
+	conn, err := NewMongoConn(url, ConnectModePrimary, true)
+	if err != nil {
+		return nil, err
+	}
+	if majority {
+		conn.Session.EnsureSafe(&mgo.Safe{WMode: MajorityWriteConcern})
+	}
+	return &MongoStorage{conn: conn, db: db}, nil
+}
+
+func (storage *MongoStorage) Load(table string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	iter := storage.conn.Session.DB(storage.db).C(table).Find(bson.M{}).Iter()
+	doc := make(map[string]interface{})
+	for iter.Next(doc) {
+		docs = append(docs, doc)
+		doc = make(map[string]interface{})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("load %v.%v failed. %v", storage.db, table, err)
+	}
+	return docs, nil
+}
+
+// Save inserts the documents into a temporary collection, then renames it
+// to table with dropTarget. The collection is dropped if docs is empty
+func (storage *MongoStorage) Save(table string, docs []interface{}) error {
+	if len(docs) == 0 {
+		return storage.Drop(table)
+	}
+	tmpTable := "tmp_save_" + table
+	if err := storage.Drop(tmpTable); err != nil {
+		return err
+	}
+	coll := storage.conn.Session.DB(storage.db).C(tmpTable)
+	for len(docs) > 0 {
+		n := len(docs)
+		if n > StorageBatchSize {
+			n = StorageBatchSize
+		}
+		if err := coll.Insert(docs[:n]...); err != nil {
+			return fmt.Errorf("insert %v.%v failed. %v", storage.db, tmpTable, err)
+		}
+		docs = docs[n:]
+	}
+	if err := storage.Rename(tmpTable, table); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (storage *MongoStorage) Upsert(table string, selector map[string]interface{}, doc interface{}) error {
+	if _, err := storage.conn.Session.DB(storage.db).C(table).Upsert(bson.M(selector), doc); err != nil {
+		return fmt.Errorf("upsert %v.%v failed. %v", storage.db, table, err)
+	}
+	return nil
+}
+
+func (storage *MongoStorage) Drop(table string) error {
+	if err := storage.conn.Session.DB(storage.db).C(table).DropCollection(); err != nil &&
+		err.Error() != "ns not found" {
+		return fmt.Errorf("drop %v.%v failed. %v", storage.db, table, err)
+	}
+	return nil
+}
+
+func (storage *MongoStorage) Rename(from, to string) error {
+	fromNs := fmt.Sprintf("%v.%v", storage.db, from)
+	toNs := fmt.Sprintf("%v.%v", storage.db, to)
+	if err := storage.conn.Session.DB("admin").Run(bson.D{{"renameCollection", fromNs}, {"to", toNs},
+		{"dropTarget", true}}, nil); err != nil && err.Error() != "source namespace does not exist" {
+		return fmt.Errorf("rename %v to %v failed. %v", fromNs, toNs, err)
+	}
+	return nil
+}
+
+func (storage *MongoStorage) Close() {
+	storage.conn.Close()
+}
+
+// FileStorage stores each table in a bson file of folder
+type FileStorage struct {
+	folder string
+}
+
+func NewFileStorage(folder string) (*FileStorage, error) {
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &FileStorage{folder: folder}, nil
+}
+
+func (storage *FileStorage) path(table string) string {
+	return filepath.Join(storage.folder, table)
+}
+
+func (storage *FileStorage) Load(table string) ([]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(storage.path(table))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeStorageDocs(data)
+}
+
+// Save writes a temporary file and renames it, so the table is either the
+// old or the new one after crash
+func (storage *FileStorage) Save(table string, docs []interface{}) error {
+	data, err := encodeStorageDocs(docs)
+	if err != nil {
+		return err
+	}
+	path := storage.path(table)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Upsert rewrites the whole file, which is cheap for the local file
+func (storage *FileStorage) Upsert(table string, selector map[string]interface{}, doc interface{}) error {
+	docs, err := storage.Load(table)
+	if err != nil {
+		return err
+	}
+	return storage.Save(table, upsertStorageDocs(docs, selector, doc))
+}
+
+func (storage *FileStorage) Drop(table string) error {
+	if err := os.Remove(storage.path(table)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (storage *FileStorage) Rename(from, to string) error {
+	if err := os.Rename(storage.path(from), storage.path(to)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (storage *FileStorage) Close() {}
+
+// HttpStorage stores each table as a bson value of key-value service:
+//
+//	GET    {url}/{table}  200 with the value, 404 if not exists
+//	PUT    {url}/{table}  replace the value by request body
+//	DELETE {url}/{table}  remove the value
+type HttpStorage struct {
+	url    string
+	client *http.Client
+}
+
+func NewHttpStorage(url string) *HttpStorage {
+	return &HttpStorage{url: url, client: &http.Client{Timeout: storageHttpTimeout}}
+}
+
+func (storage *HttpStorage) request(method, table string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, storage.url+"/"+table, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := storage.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, resp.StatusCode, fmt.Errorf("%v %v/%v failed. status %v", method, storage.url, table,
+			resp.StatusCode)
+	}
+	return data, resp.StatusCode, nil
+}
+
+func (storage *HttpStorage) Load(table string) ([]map[string]interface{}, error) {
+	data, status, err := storage.request(http.MethodGet, table, nil)
+	if err != nil {
+		return nil, err
+	} else if status == http.StatusNotFound {
+		return nil, nil
+	}
+	return decodeStorageDocs(data)
+}
+
+func (storage *HttpStorage) Save(table string, docs []interface{}) error {
+	data, err := encodeStorageDocs(docs)
+	if err != nil {
+		return err
+	}
+	_, _, err = storage.request(http.MethodPut, table, data)
+	return err
+}
+
+// Upsert replaces the whole value, since the key-value service has no
+// partial update
+func (storage *HttpStorage) Upsert(table string, selector map[string]interface{}, doc interface{}) error {
+	docs, err := storage.Load(table)
+	if err != nil {
+		return err
+	}
+	return storage.Save(table, upsertStorageDocs(docs, selector, doc))
+}
+
+func (storage *HttpStorage) Drop(table string) error {
+	_, _, err := storage.request(http.MethodDelete, table, nil)
+	return err
+}
+
+func (storage *HttpStorage) Rename(from, to string) error {
+	data, status, err := storage.request(http.MethodGet, from, nil)
+	if err != nil || status == http.StatusNotFound {
+		return err
+	}
+	// an interrupted rename is redone from the beginning since "from" is
+	// deleted at last
+	if _, _, err := storage.request(http.MethodPut, to, data); err != nil {
+		return err
+	}
+	return storage.Drop(from)
+}
+
+func (storage *HttpStorage) Close() {}
+
+func encodeStorageDocs(docs []interface{}) ([]byte, error) {
+	if docs == nil {
+		docs = []interface{}{}
+	}
+	return bson.Marshal(bson.M{storageDocsKey: docs})
+}
+
+func decodeStorageDocs(data []byte) ([]map[string]interface{}, error) {
+	var value map[string]interface{}
+	if err := bson.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	list, ok := value[storageDocsKey].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("illegal checkpoint value %v", value)
+	}
+	docs := make([]map[string]interface{}, 0, len(list))
+	for _, doc := range list {
+		if m, ok := doc.(map[string]interface{}); ok {
+			docs = append(docs, m)
+		} else {
+			return nil, fmt.Errorf("illegal checkpoint document %v", doc)
+		}
+	}
+	return docs, nil
+}
+
+// upsertStorageDocs returns the documents with the first one matching
+// selector replaced by doc, or doc appended if there is none. The values are
+// compared by the string form, since the numbers are loaded as other types
+func upsertStorageDocs(docs []map[string]interface{}, selector map[string]interface{},
+	doc interface{}) []interface{} {
+	upserted := make([]interface{}, 0, len(docs)+1)
+	replaced := false
+	for _, old := range docs {
+		if !replaced && matchStorageDoc(old, selector) {
+			upserted = append(upserted, doc)
+			replaced = true
+		} else {
+			upserted = append(upserted, old)
+		}
+	}
+	if !replaced {
+		upserted = append(upserted, doc)
+	}
+	return upserted
+}
+
+func matchStorageDoc(doc, selector map[string]interface{}) bool {
+	for key, value := range selector {
+		if found, ok := doc[key]; !ok || fmt.Sprint(found) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinllen/mgo/bson"
+)
+
+func testCheckpointStorage(t *testing.T, storage CheckpointStorage) {
+	docs, err := storage.Load("ckpt_oplog")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, 0, len(docs), "should be equal")
+
+	ckptDoc := map[string]interface{}{
+		CheckpointName:  "rs1",
+		CheckpointAckTs: bson.MongoTimestamp(100),
+		"dbMap":         map[string]interface{}{"rs2": bson.MongoTimestamp(200)},
+	}
+	assert.Equal(t, nil, storage.Save("tmp_ckpt_oplog", []interface{}{ckptDoc}), "should be equal")
+	assert.Equal(t, nil, storage.Rename("tmp_ckpt_oplog", "ckpt_oplog"), "should be equal")
+	// renaming a missing table is ignored
+	assert.Equal(t, nil, storage.Rename("tmp_ckpt_oplog", "ckpt_oplog"), "should be equal")
+
+	docs, err = storage.Load("ckpt_oplog")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, []map[string]interface{}{ckptDoc}, docs, "should be equal")
+	docs, err = storage.Load("tmp_ckpt_oplog")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, 0, len(docs), "should be equal")
+
+	assert.Equal(t, nil, storage.Save("ckpt", []interface{}{
+		map[string]interface{}{CheckpointStage: StageFlushed},
+	}), "should be equal")
+	stage, err := LoadCheckpointStage(storage, "ckpt")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, StageFlushed, stage, "should be equal")
+	assert.Equal(t, nil, storage.Upsert("ckpt", map[string]interface{}{},
+		map[string]interface{}{CheckpointStage: StageRename}), "should be equal")
+	stage, err = LoadCheckpointStage(storage, "ckpt")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, StageRename, stage, "should be equal")
+
+	// upsert inserts the missing document and replaces the matched one only
+	part0 := map[string]interface{}{"ns": "a.b", "part": 0, "lastId": "x"}
+	part1 := map[string]interface{}{"ns": "a.b", "part": 1, "lastId": "y"}
+	assert.Equal(t, nil, storage.Upsert("ckpt_doc", map[string]interface{}{"ns": "a.b", "part": 0}, part0), "should be equal")
+	assert.Equal(t, nil, storage.Upsert("ckpt_doc", map[string]interface{}{"ns": "a.b", "part": 1}, part1), "should be equal")
+	part1 = map[string]interface{}{"ns": "a.b", "part": 1, "lastId": "z"}
+	assert.Equal(t, nil, storage.Upsert("ckpt_doc", map[string]interface{}{"ns": "a.b", "part": 1}, part1), "should be equal")
+	docs, err = storage.Load("ckpt_doc")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, 2, len(docs), "should be equal")
+	assert.Equal(t, "x", docs[0]["lastId"], "should be equal")
+	assert.Equal(t, "z", docs[1]["lastId"], "should be equal")
+
+	assert.Equal(t, nil, storage.Drop("ckpt_oplog"), "should be equal")
+	assert.Equal(t, nil, storage.Drop("ckpt_oplog"), "should be equal")
+	docs, err = storage.Load("ckpt_oplog")
+	assert.Equal(t, nil, err, "should be equal")
+	assert.Equal(t, 0, len(docs), "should be equal")
+}
+
+func TestCheckpointStorage(t *testing.T) {
+	var nr int
+
+	// file
+	{
+		fmt.Printf("TestCheckpointStorage case %d.\n", nr)
+		nr++
+
+		dir, err := ioutil.TempDir("", "ckpt")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.RemoveAll(dir)
+
+		storage, err := NewFileStorage(dir)
+		assert.Equal(t, nil, err, "should be equal")
+		testCheckpointStorage(t, storage)
+	}
+
+	// http key-value
+	{
+		fmt.Printf("TestCheckpointStorage case %d.\n", nr)
+		nr++
+
+		var mutex sync.Mutex
+		values := make(map[string][]byte)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch r.Method {
+			case http.MethodGet:
+				if value, ok := values[r.URL.Path]; ok {
+					w.Write(value)
+				} else {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			case http.MethodPut:
+				values[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+			case http.MethodDelete:
+				delete(values, r.URL.Path)
+			}
+		}))
+		defer server.Close()
+
+		testCheckpointStorage(t, NewHttpStorage(server.URL+"/mongoshake"))
+	}
+}
@@ -35,6 +35,8 @@ const (
 	CheckpointName   = "name"
 	CheckpointAckTs  = "ackTs"
 	CheckpointSyncTs = "syncTs"
+	// resume token of change stream
+	CheckpointResumeToken = "resumeToken"
 )
 
 // Build info
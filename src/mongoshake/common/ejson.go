@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+// MarshalExtJSON encodes the value decoded by bson into canonical MongoDB
+// Extended JSON v2, so the type of each value is kept, e.g., int32 is
+// {"$numberInt":"1"}. The order of bson.D is kept while bson.M is sorted by key.
+func MarshalExtJSON(value interface{}) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := writeExtJSON(buffer, value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeExtJSON(buffer *bytes.Buffer, value interface{}) error {
+	// types which can't be matched by type switch
+	switch value {
+	case bson.MinKey:
+		buffer.WriteString(`{"$minKey":1}`)
+		return nil
+	case bson.MaxKey:
+		buffer.WriteString(`{"$maxKey":1}`)
+		return nil
+	case bson.Undefined:
+		buffer.WriteString(`{"$undefined":true}`)
+		return nil
+	}
+
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteString("null")
+	case bool:
+		buffer.WriteString(strconv.FormatBool(v))
+	case string:
+		writeJSONString(buffer, v)
+	case int:
+		// int32 is decoded as int
+		fmt.Fprintf(buffer, `{"$numberInt":"%d"}`, v)
+	case int32:
+		fmt.Fprintf(buffer, `{"$numberInt":"%d"}`, v)
+	case int64:
+		fmt.Fprintf(buffer, `{"$numberLong":"%d"}`, v)
+	case float64:
+		fmt.Fprintf(buffer, `{"$numberDouble":"%s"}`, formatExtJSONDouble(v))
+	case bson.Decimal128:
+		fmt.Fprintf(buffer, `{"$numberDecimal":"%s"}`, v.String())
+	case bson.ObjectId:
+		fmt.Fprintf(buffer, `{"$oid":"%s"}`, v.Hex())
+	case time.Time:
+		ms := v.Unix()*1000 + int64(v.Nanosecond()/1e6)
+		fmt.Fprintf(buffer, `{"$date":{"$numberLong":"%d"}}`, ms)
+	case bson.MongoTimestamp:
+		fmt.Fprintf(buffer, `{"$timestamp":{"t":%d,"i":%d}}`, uint64(v)>>32, uint32(v))
+	case []byte:
+		writeExtJSONBinary(buffer, 0x00, v)
+	case bson.Binary:
+		writeExtJSONBinary(buffer, v.Kind, v.Data)
+	case bson.RegEx:
+		options := []byte(v.Options)
+		sort.Slice(options, func(i, j int) bool { return options[i] < options[j] })
+		buffer.WriteString(`{"$regularExpression":{"pattern":`)
+		writeJSONString(buffer, v.Pattern)
+		buffer.WriteString(`,"options":`)
+		writeJSONString(buffer, string(options))
+		buffer.WriteString("}}")
+	case bson.JavaScript:
+		buffer.WriteString(`{"$code":`)
+		writeJSONString(buffer, v.Code)
+		if v.Scope != nil {
+			buffer.WriteString(`,"$scope":`)
+			if err := writeExtJSON(buffer, v.Scope); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("}")
+	case bson.Symbol:
+		buffer.WriteString(`{"$symbol":`)
+		writeJSONString(buffer, string(v))
+		buffer.WriteString("}")
+	case bson.DBPointer:
+		buffer.WriteString(`{"$dbPointer":{"$ref":`)
+		writeJSONString(buffer, v.Namespace)
+		fmt.Fprintf(buffer, `,"$id":{"$oid":"%s"}}}`, v.Id.Hex())
+	case bson.D:
+		buffer.WriteString("{")
+		for i, elem := range v {
+			if i != 0 {
+				buffer.WriteString(",")
+			}
+			writeJSONString(buffer, elem.Name)
+			buffer.WriteString(":")
+			if err := writeExtJSON(buffer, elem.Value); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("}")
+	case bson.M:
+		return writeExtJSONMap(buffer, v)
+	case map[string]interface{}:
+		return writeExtJSONMap(buffer, v)
+	case []interface{}:
+		buffer.WriteString("[")
+		for i, elem := range v {
+			if i != 0 {
+				buffer.WriteString(",")
+			}
+			if err := writeExtJSON(buffer, elem); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("]")
+	default:
+		return fmt.Errorf("MarshalExtJSON unsupported type[%T] value[%v]", value, value)
+	}
+	return nil
+}
+
+func writeExtJSONMap(buffer *bytes.Buffer, m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buffer.WriteString("{")
+	for i, key := range keys {
+		if i != 0 {
+			buffer.WriteString(",")
+		}
+		writeJSONString(buffer, key)
+		buffer.WriteString(":")
+		if err := writeExtJSON(buffer, m[key]); err != nil {
+			return err
+		}
+	}
+	buffer.WriteString("}")
+	return nil
+}
+
+func writeExtJSONBinary(buffer *bytes.Buffer, kind byte, data []byte) {
+	fmt.Fprintf(buffer, `{"$binary":{"base64":"%s","subType":"%02x"}}`,
+		base64.StdEncoding.EncodeToString(data), kind)
+}
+
+func writeJSONString(buffer *bytes.Buffer, s string) {
+	// json.Marshal of string never fails
+	encoded, _ := json.Marshal(s)
+	buffer.Write(encoded)
+}
+
+// formatExtJSONDouble keeps the decimal point of integral values, e.g., 1.0
+func formatExtJSONDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	s := strconv.FormatFloat(f, 'G', -1, 64)
+	if !strings.ContainsAny(s, ".E") {
+		s += ".0"
+	}
+	return s
+}
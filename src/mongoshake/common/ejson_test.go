@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestMarshalExtJSON(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestMarshalExtJSON case %d.\n", nr)
+		nr++
+
+		out, err := MarshalExtJSON(bson.D{
+			{"b", 1},
+			{"a", int64(2)},
+			{"c", 1.0},
+			{"d", "x\"y"},
+			{"e", nil},
+			{"f", true},
+		})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, `{"b":{"$numberInt":"1"},"a":{"$numberLong":"2"},"c":{"$numberDouble":"1.0"},`+
+			`"d":"x\"y","e":null,"f":true}`, string(out), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMarshalExtJSON case %d.\n", nr)
+		nr++
+
+		out, err := MarshalExtJSON(bson.M{"z": []interface{}{1.5, math.Inf(-1)}, "a": bson.MongoTimestamp(5<<32 | 3)})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, `{"a":{"$timestamp":{"t":5,"i":3}},"z":[{"$numberDouble":"1.5"},{"$numberDouble":"-Infinity"}]}`,
+			string(out), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMarshalExtJSON case %d.\n", nr)
+		nr++
+
+		out, err := MarshalExtJSON(bson.D{
+			{"t", time.Unix(1, 5e6)},
+			{"b", bson.Binary{Kind: 0x04, Data: []byte{1, 2}}},
+			{"r", bson.RegEx{Pattern: "^a", Options: "mi"}},
+			{"min", bson.MinKey},
+			{"u", bson.Undefined},
+		})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, `{"t":{"$date":{"$numberLong":"1005"}},"b":{"$binary":{"base64":"AQI=","subType":"04"}},`+
+			`"r":{"$regularExpression":{"pattern":"^a","options":"im"}},"min":{"$minKey":1},"u":{"$undefined":true}}`,
+			string(out), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMarshalExtJSON case %d.\n", nr)
+		nr++
+
+		_, err := MarshalExtJSON(bson.D{{"x", struct{}{}}})
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"bytes"
+
+	"github.com/vinllen/mgo/bson"
+)
+
+// LoopMarker prefixes the session id of the writes of direct tunnel if
+// replayer.loop_prevention is enabled, so their oplogs are recognized by the
+// collector of the reverse direction in bidirectional replication
+var LoopMarker = []byte("mongoshk")
+
+// HasLoopMarker returns whether the session id of oplog, which is
+// {id: UUID, uid: ...}, is prefixed by LoopMarker
+func HasLoopMarker(lsid interface{}) bool {
+	var id interface{}
+	switch x := lsid.(type) {
+	case bson.M:
+		id = x["id"]
+	case map[string]interface{}:
+		id = x["id"]
+	case bson.D:
+		id = x.Map()["id"]
+	}
+	binary, ok := id.(bson.Binary)
+	return ok && bytes.HasPrefix(binary.Data, LoopMarker)
+}
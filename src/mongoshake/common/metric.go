@@ -52,14 +52,22 @@ type ReplicationMetric struct {
 	CheckpointTimes uint64
 	Retransmission  uint64
 	TunnelTraffic   uint64
+	DeadLetters     uint64
+	OplogRecoveries uint64
 	LSN             int64
 	LSNAck          int64
 	LSNCheckpoint   int64
+	SourceNewest    int64
+	SourceOldest    int64
+	// 1 if the oplog window of source is going to be exhausted
+	OplogExhausting int32
 
 	OplogMaxSize int64
 	OplogAvgSize int64
 
 	TableOperations *TableOps
+	// resolved conflicts of each policy
+	ConflictOperations *TableOps
 
 	// replication status
 	ReplStatus ReplicationStatus
@@ -87,6 +95,7 @@ const (
 
 func (metric *ReplicationMetric) init() {
 	metric.TableOperations = NewTableOps()
+	metric.ConflictOperations = NewTableOps()
 }
 
 func (metric *ReplicationMetric) resetEverySecond(items []*MetricDelta) {
@@ -204,6 +213,14 @@ func (metric *ReplicationMetric) AddFilter(incr uint64) {
 	atomic.AddUint64(&metric.OplogFilter.Value, incr)
 }
 
+func (metric *ReplicationMetric) AddDeadLetter(incr uint64) {
+	atomic.AddUint64(&metric.DeadLetters, incr)
+}
+
+func (metric *ReplicationMetric) AddOplogRecovery(incr uint64) {
+	atomic.AddUint64(&metric.OplogRecoveries, incr)
+}
+
 func (metric *ReplicationMetric) AddApply(incr uint64) {
 	atomic.AddUint64(&metric.OplogApply.Value, incr)
 }
@@ -238,6 +255,67 @@ func (metric *ReplicationMetric) SetLSNACK(ack int64) {
 	forwardCas(&metric.LSNAck, ack)
 }
 
+// SetSourceTs records the newest and oldest oplog timestamp of source
+func (metric *ReplicationMetric) SetSourceTs(newest, oldest int64) {
+	atomic.StoreInt64(&metric.SourceNewest, newest)
+	atomic.StoreInt64(&metric.SourceOldest, oldest)
+}
+
+func (metric *ReplicationMetric) SetOplogExhausting(exhausting bool) {
+	var v int32
+	if exhausting {
+		v = 1
+	}
+	atomic.StoreInt32(&metric.OplogExhausting, v)
+}
+
+// Lag is the seconds behind the newest oplog of source, -1 if unknown
+type Lag struct {
+	Fetch      int64 `json:"fetch"`
+	Apply      int64 `json:"apply"`
+	Checkpoint int64 `json:"checkpoint"`
+	// seconds from the oldest oplog of source to the checkpoint, the oplogs
+	// after checkpoint are lost if it falls to zero. -1 if unknown
+	OplogWindow int64 `json:"oplog_window"`
+	// seconds from the oldest to the newest oplog of source, -1 if unknown
+	OplogSpan int64 `json:"oplog_span"`
+	// the oplog window is less than syncer.oplog_window.warn_percent of span
+	Exhausting bool `json:"exhausting"`
+	// unix seconds of the newest oplog of source, 0 if not sampled yet
+	SourceNewest int64 `json:"source_newest"`
+}
+
+func (metric *ReplicationMetric) Lag() *Lag {
+	newest := ExtractTs32(atomic.LoadInt64(&metric.SourceNewest))
+	oldest := ExtractTs32(atomic.LoadInt64(&metric.SourceOldest))
+	checkpoint := ExtractTs32(atomic.LoadInt64(&metric.LSNCheckpoint))
+	behind := func(ts int64) int64 {
+		if newest == 0 || ts == 0 {
+			return -1
+		}
+		if ts >= newest {
+			return 0
+		}
+		return newest - ts
+	}
+	lag := &Lag{
+		Fetch:        behind(ExtractTs32(atomic.LoadInt64(&metric.LSN))),
+		Apply:        behind(ExtractTs32(atomic.LoadInt64(&metric.LSNAck))),
+		Checkpoint:   behind(checkpoint),
+		OplogWindow:  -1,
+		OplogSpan:    -1,
+		SourceNewest: newest,
+		Exhausting:   atomic.LoadInt32(&metric.OplogExhausting) == 1,
+	}
+	if oldest != 0 && checkpoint != 0 {
+		lag.OplogWindow = checkpoint - oldest
+	}
+	if oldest != 0 && newest != 0 {
+		lag.OplogSpan = newest - oldest
+	}
+	return lag
+}
+
 func (metric *ReplicationMetric) AddTableOps(table string, n uint64) {
 	metric.TableOperations.Incr(table, n)
 }
@@ -246,6 +324,14 @@ func (metric *ReplicationMetric) TableOps() map[string]uint64 {
 	return metric.TableOperations.MakeCopy()
 }
 
+func (metric *ReplicationMetric) AddConflict(policy string, n uint64) {
+	metric.ConflictOperations.Incr(policy, n)
+}
+
+func (metric *ReplicationMetric) Conflicts() map[string]uint64 {
+	return metric.ConflictOperations.MakeCopy()
+}
+
 func forwardCas(v *int64, new int64) {
 	var current int64
 	for current = atomic.LoadInt64(v); new > current; {
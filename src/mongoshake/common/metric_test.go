@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationMetricLag(t *testing.T) {
+	// test Lag
+
+	var nr int
+	{
+		fmt.Printf("TestReplicationMetricLag case %d.\n", nr)
+		nr++
+
+		metric := &ReplicationMetric{}
+		assert.Equal(t, &Lag{Fetch: -1, Apply: -1, Checkpoint: -1, OplogWindow: -1, OplogSpan: -1},
+			metric.Lag(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReplicationMetricLag case %d.\n", nr)
+		nr++
+
+		metric := &ReplicationMetric{LSN: 100 << 32, LSNAck: 90 << 32, LSNCheckpoint: 60 << 32}
+		metric.SetSourceTs(110<<32, 20<<32)
+		assert.Equal(t, &Lag{Fetch: 10, Apply: 20, Checkpoint: 50, OplogWindow: 40, OplogSpan: 90,
+			SourceNewest: 110}, metric.Lag(), "should be equal")
+
+		// the fetched oplog is newer than the sampled one
+		metric.LSN = 120 << 32
+		assert.Equal(t, int64(0), metric.Lag().Fetch, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReplicationMetricLag case %d.\n", nr)
+		nr++
+
+		// nothing is acked or checkpointed yet
+		metric := &ReplicationMetric{LSN: 100 << 32}
+		metric.SetSourceTs(110<<32, 20<<32)
+		assert.Equal(t, &Lag{Fetch: 10, Apply: -1, Checkpoint: -1, OplogWindow: -1, OplogSpan: 90,
+			SourceNewest: 110}, metric.Lag(), "should be equal")
+	}
+}
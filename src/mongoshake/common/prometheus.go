@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gugemichael/nimo4go"
+)
+
+const (
+	PrometheusPath = "/metrics"
+
+	PrometheusCounter = "counter"
+	PrometheusGauge   = "gauge"
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var prometheusSources struct {
+	sync.Mutex
+	list []func(writer *PrometheusWriter)
+}
+
+// InitPrometheus serves the metrics of the registered sources in prometheus
+// text format on PrometheusPath of http.DefaultServeMux, which is listened
+// by system_profile
+func InitPrometheus() {
+	http.HandleFunc(PrometheusPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		w.Write(scrapePrometheus().Bytes())
+	})
+}
+
+// PrometheusRestAPI serves the metrics on PrometheusPath of HttpApi as well,
+// which is listened since startup. The restful api answers json only, so the
+// samples are keyed by the metric name with labels
+func PrometheusRestAPI() {
+	HttpApi.RegisterAPI(PrometheusPath, nimo.HttpGet, func([]byte) interface{} {
+		return scrapePrometheus().Samples()
+	})
+}
+
+func scrapePrometheus() *PrometheusWriter {
+	writer := NewPrometheusWriter()
+	prometheusSources.Lock()
+	defer prometheusSources.Unlock()
+	for _, source := range prometheusSources.list {
+		source(writer)
+	}
+	return writer
+}
+
+// RegisterPrometheus adds the source which writes its metrics on each scrape
+func RegisterPrometheus(source func(writer *PrometheusWriter)) {
+	prometheusSources.Lock()
+	defer prometheusSources.Unlock()
+	prometheusSources.list = append(prometheusSources.list, source)
+}
+
+type prometheusSample struct {
+	// metric name with labels
+	key   string
+	value float64
+}
+
+type prometheusFamily struct {
+	help    string
+	kind    string
+	samples []prometheusSample
+}
+
+// PrometheusWriter groups the samples by metric name, since the samples of
+// a metric must be together in the text format
+type PrometheusWriter struct {
+	families map[string]*prometheusFamily
+}
+
+func NewPrometheusWriter() *PrometheusWriter {
+	return &PrometheusWriter{families: make(map[string]*prometheusFamily)}
+}
+
+// Add writes a sample of metric, labels are pairs of name and value
+func (writer *PrometheusWriter) Add(name, kind, help string, value float64, labels ...string) {
+	family, ok := writer.families[name]
+	if !ok {
+		family = &prometheusFamily{help: help, kind: kind}
+		writer.families[name] = family
+	}
+	sample := name
+	if len(labels) != 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+		}
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	family.samples = append(family.samples, prometheusSample{key: sample, value: value})
+}
+
+// Bytes returns the text format, the metrics are sorted by name
+func (writer *PrometheusWriter) Bytes() []byte {
+	names := make([]string, 0, len(writer.families))
+	for name := range writer.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := new(bytes.Buffer)
+	for _, name := range names {
+		family := writer.families[name]
+		fmt.Fprintf(buffer, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", name, family.kind)
+		for _, sample := range family.samples {
+			buffer.WriteString(sample.key + " " + strconv.FormatFloat(sample.value, 'f', -1, 64))
+			buffer.WriteByte('\n')
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Samples returns the value of each sample keyed by the metric name with
+// labels, e.g. mongoshake_oplog_get_total{replset="rs1"}
+func (writer *PrometheusWriter) Samples() map[string]float64 {
+	samples := make(map[string]float64)
+	for _, family := range writer.families {
+		for _, sample := range family.samples {
+			samples[sample.key] = sample.value
+		}
+	}
+	return samples
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// WritePrometheus writes the counters of metric labeled by the replset
+func (metric *ReplicationMetric) WritePrometheus(writer *PrometheusWriter) {
+	replset := []string{"replset", metric.NAME}
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"mongoshake_oplog_get_total", "Oplogs fetched from source.", atomic.LoadUint64(&metric.OplogGet.Value)},
+		{"mongoshake_oplog_filter_total", "Oplogs dropped by filters.", atomic.LoadUint64(&metric.OplogFilter.Value)},
+		{"mongoshake_oplog_consume_total", "Oplogs consumed by workers.",
+			atomic.LoadUint64(&metric.OplogConsume.Value)},
+		{"mongoshake_oplog_apply_total", "Oplogs written to tunnel.", atomic.LoadUint64(&metric.OplogApply.Value)},
+		{"mongoshake_oplog_success_total", "Oplogs acked by tunnel.", atomic.LoadUint64(&metric.OplogSuccess.Value)},
+		{"mongoshake_oplog_fail_total", "Failed writes to tunnel.", atomic.LoadUint64(&metric.OplogFail.Value)},
+		{"mongoshake_tunnel_traffic_bytes_total", "Bytes sent to tunnel.", atomic.LoadUint64(&metric.TunnelTraffic)},
+		{"mongoshake_checkpoint_total", "Checkpoints persisted.", atomic.LoadUint64(&metric.CheckpointTimes)},
+		{"mongoshake_retransmission_total", "Retransmissions required by tunnel.",
+			atomic.LoadUint64(&metric.Retransmission)},
+		{"mongoshake_dead_letter_total", "Oplogs put into the dead letter queue.",
+			atomic.LoadUint64(&metric.DeadLetters)},
+		{"mongoshake_oplog_recovery_total", "Document syncs rerun after the oplog window is exhausted.",
+			atomic.LoadUint64(&metric.OplogRecoveries)},
+	}
+	for _, counter := range counters {
+		writer.Add(counter.name, PrometheusCounter, counter.help, float64(counter.value), replset...)
+	}
+
+	// the unix seconds of mongodb timestamps
+	lsns := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"mongoshake_lsn_seconds", "Timestamp of the last fetched oplog.", atomic.LoadInt64(&metric.LSN)},
+		{"mongoshake_lsn_ack_seconds", "Timestamp of the last acked oplog.", atomic.LoadInt64(&metric.LSNAck)},
+		{"mongoshake_lsn_checkpoint_seconds", "Timestamp of the checkpoint.",
+			atomic.LoadInt64(&metric.LSNCheckpoint)},
+	}
+	for _, lsn := range lsns {
+		writer.Add(lsn.name, PrometheusGauge, lsn.help, float64(ExtractTs32(lsn.value)), replset...)
+	}
+
+	lag := metric.Lag()
+	for _, stage := range []struct {
+		name  string
+		value int64
+	}{{"fetch", lag.Fetch}, {"apply", lag.Apply}, {"checkpoint", lag.Checkpoint}} {
+		if stage.value < 0 {
+			continue
+		}
+		writer.Add("mongoshake_lag_seconds", PrometheusGauge, "Seconds behind the newest oplog of source.",
+			float64(stage.value), "replset", metric.NAME, "stage", stage.name)
+	}
+	if lag.OplogWindow >= 0 {
+		writer.Add("mongoshake_oplog_window_seconds", PrometheusGauge,
+			"Seconds from the oldest oplog of source to the checkpoint.", float64(lag.OplogWindow), replset...)
+	}
+	if lag.OplogSpan >= 0 {
+		writer.Add("mongoshake_oplog_span_seconds", PrometheusGauge,
+			"Seconds from the oldest to the newest oplog of source.", float64(lag.OplogSpan), replset...)
+	}
+	var exhausting float64
+	if lag.Exhausting {
+		exhausting = 1
+	}
+	writer.Add("mongoshake_oplog_exhausting", PrometheusGauge,
+		"1 if the oplog window of source is going to be exhausted.", exhausting, replset...)
+
+	for policy, n := range metric.Conflicts() {
+		writer.Add("mongoshake_conflict_total", PrometheusCounter, "Conflicts resolved by policy.", float64(n),
+			"replset", metric.NAME, "policy", policy)
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusWriter(t *testing.T) {
+	// test PrometheusWriter
+
+	var nr int
+	{
+		fmt.Printf("TestPrometheusWriter case %d.\n", nr)
+		nr++
+
+		writer := NewPrometheusWriter()
+		writer.Add("mongoshake_b", PrometheusGauge, "b help.", 1.5, "replset", "rs1")
+		writer.Add("mongoshake_a", PrometheusCounter, "a help.", 1<<40)
+		writer.Add("mongoshake_b", PrometheusGauge, "b help.", 2, "replset", `rs"2`, "worker", "3")
+		assert.Equal(t, "# HELP mongoshake_a a help.\n"+
+			"# TYPE mongoshake_a counter\n"+
+			"mongoshake_a 1099511627776\n"+
+			"# HELP mongoshake_b b help.\n"+
+			"# TYPE mongoshake_b gauge\n"+
+			"mongoshake_b{replset=\"rs1\"} 1.5\n"+
+			"mongoshake_b{replset=\"rs\\\"2\",worker=\"3\"} 2\n", string(writer.Bytes()), "should be equal")
+		assert.Equal(t, map[string]float64{
+			"mongoshake_a":                                   1 << 40,
+			"mongoshake_b{replset=\"rs1\"}":                  1.5,
+			"mongoshake_b{replset=\"rs\\\"2\",worker=\"3\"}": 2,
+		}, writer.Samples(), "should be equal")
+	}
+}
@@ -0,0 +1,261 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// the document of source replaces the one in target
+	ConflictSourceWins = "source_wins"
+	// the document in target is kept
+	ConflictTargetWins = "target_wins"
+	// the document with the larger value of field wins, "last_writer_wins:field"
+	ConflictLastWriterWins = "last_writer_wins"
+	// the document in target is kept, the oplog is written to dead letter
+	ConflictDeadLetter = "dead_letter"
+
+	// the collection of dead letter in utils.APPConflictDatabase()
+	ConflictDeadLetterCollection = "dead_letter"
+)
+
+// DefaultConflictPolicy is compatible with replayer.executor.insert_on_dup_update
+// if replayer.conflict_policy is not set
+func DefaultConflictPolicy() string {
+	if conf.Options.ReplayerConflictPolicy != "" {
+		return conf.Options.ReplayerConflictPolicy
+	} else if conf.Options.ReplayerExecutorInsertOnDupUpdate {
+		return ConflictSourceWins
+	}
+	return ConflictTargetWins
+}
+
+type ConflictPolicy struct {
+	Name string
+	// the document timestamp field of last_writer_wins
+	Field string
+}
+
+func (policy *ConflictPolicy) String() string {
+	if policy.Field != "" {
+		return policy.Name + ":" + policy.Field
+	}
+	return policy.Name
+}
+
+// ParseConflictPolicy parses the policy like "source_wins" or
+// "last_writer_wins:updated_at"
+func ParseConflictPolicy(value string) (*ConflictPolicy, error) {
+	parts := strings.SplitN(value, ":", 2)
+	policy := &ConflictPolicy{Name: parts[0]}
+	switch policy.Name {
+	case ConflictSourceWins, ConflictTargetWins, ConflictDeadLetter:
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("conflict policy %v has no field", policy.Name)
+		}
+	case ConflictLastWriterWins:
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("conflict policy %v needs a field, like %v:updated_at",
+				policy.Name, policy.Name)
+		}
+		policy.Field = parts[1]
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %v", value)
+	}
+	return policy, nil
+}
+
+// ConflictResolver resolves the duplicated writes by the policy of namespace
+// and counts them in the metric
+type ConflictResolver struct {
+	defaultPolicy *ConflictPolicy
+	// namespace("db" or "db.collection") -> policy
+	policies map[string]*ConflictPolicy
+	// nil if not counted
+	metric *utils.ReplicationMetric
+	// the letters of dead_letter policy are put into the queue, or written
+	// to the target if it's nil
+	replayerId uint32
+	deadLetter DeadLetterQueue
+}
+
+// NewConflictResolver creates the resolver with the default policy and the
+// policies of namespaces like "db.collection:policy"
+func NewConflictResolver(defaultPolicy string, namespaces []string,
+	metric *utils.ReplicationMetric) (*ConflictResolver, error) {
+	policy, err := ParseConflictPolicy(defaultPolicy)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &ConflictResolver{
+		defaultPolicy: policy,
+		policies:      make(map[string]*ConflictPolicy),
+		metric:        metric,
+	}
+	for _, value := range namespaces {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("illegal namespace conflict policy %v", value)
+		}
+		if resolver.policies[parts[0]], err = ParseConflictPolicy(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// CheckInTransaction returns error if any policy can't be resolved in the
+// transaction of exactly once mode, which needs to read the target first
+func (resolver *ConflictResolver) CheckInTransaction() error {
+	policies := []*ConflictPolicy{resolver.defaultPolicy}
+	for _, policy := range resolver.policies {
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		if policy.Name != ConflictSourceWins && policy.Name != ConflictTargetWins {
+			return fmt.Errorf("conflict policy %v isn't supported with replayer.exactly_once", policy)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the policy of collection first, then the one of database
+func (resolver *ConflictResolver) Lookup(ns string) *ConflictPolicy {
+	if policy, ok := resolver.policies[ns]; ok {
+		return policy
+	}
+	if policy, ok := resolver.policies[strings.SplitN(ns, ".", 2)[0]]; ok {
+		return policy
+	}
+	return resolver.defaultPolicy
+}
+
+// lastWriterWins replaces the document in target if the field of source is
+// not less than the target. The replacement is conditional on the field of
+// target unchanged
+func (resolver *ConflictResolver) lastWriterWins(collection *mgo.Collection, field string,
+	log *oplog.PartialLog, found bson.D) {
+	sourceValue, sourceOk := lookupField(log.Object, field)
+	targetValue, targetOk := lookupField(found, field)
+	if !sourceOk {
+		return
+	}
+	id := oplog.GetKey(log.Object, "")
+	selector := bson.M{"_id": id, field: bson.M{"$exists": false}}
+	if targetOk {
+		if cmp, ok := compareValues(sourceValue, targetValue); !ok {
+			LOG.Warn("Conflict of %v _id[%v] field[%v] can't compare %v with %v, the target wins",
+				collection.FullName, id, field, sourceValue, targetValue)
+			return
+		} else if cmp < 0 {
+			return
+		}
+		selector = bson.M{"_id": id, field: targetValue}
+	}
+	if err := collection.Update(selector, log.Object); err != nil && !utils.IsNotFound(err) {
+		LOG.Warn("Conflict of %v _id[%v] replace by last writer failed. %v", collection.FullName, id, err)
+	}
+}
+
+// writeDeadLetter records the oplog and the document in target
+func (resolver *ConflictResolver) writeDeadLetter(collection *mgo.Collection, log *oplog.PartialLog,
+	found bson.D) {
+	letter := NewDeadLetter(resolver.replayerId, log, "conflict", found)
+	var err error
+	if resolver.deadLetter != nil {
+		err = resolver.deadLetter.Put(letter)
+	} else {
+		err = collection.Database.Session.DB(utils.APPConflictDatabase()).C(ConflictDeadLetterCollection).
+			Insert(letter)
+	}
+	if err != nil {
+		LOG.Warn("Conflict of %v write dead letter %v failed. %v", collection.FullName, letter.Oplog, err)
+	}
+}
+
+func lookupField(doc bson.D, field string) (interface{}, bool) {
+	for _, ele := range doc {
+		if ele.Name == field {
+			return ele.Value, true
+		}
+	}
+	return nil, false
+}
+
+// compareValues compares the values of the same kind: time, timestamp,
+// number and string. false is returned if they are not comparable
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			if x.Before(y) {
+				return -1, true
+			} else if x.After(y) {
+				return 1, true
+			}
+			return 0, true
+		}
+	case bson.MongoTimestamp:
+		if y, ok := b.(bson.MongoTimestamp); ok {
+			return compareInt(int64(x), int64(y)), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	default:
+		// int64 may lose precision in float64
+		if x, ok := a.(int64); ok {
+			if y, ok := b.(int64); ok {
+				return compareInt(x, y), true
+			}
+		}
+		x1, ok1 := toFloat(a)
+		y1, ok2 := toFloat(b)
+		if ok1 && ok2 {
+			return compareFloat(x1, y1), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+func compareInt(x, y int64) int {
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(x, y float64) int {
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
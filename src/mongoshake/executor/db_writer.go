@@ -17,8 +17,7 @@ import (
 
 type BasicWriter interface {
 	// insert operation
-	doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord,
-		dupUpdate bool) error
+	doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord) error
 
 	// update when insert duplicated
 	doUpdateOnInsert(database, collection string, metadata bson.M,
@@ -44,23 +43,24 @@ type BasicWriter interface {
 	doCommand(database string, metadata bson.M, oplogs []*OplogRecord) error
 }
 
-func NewDbWriter(session *mgo.Session, metadata bson.M, bulkInsert bool) BasicWriter {
+func NewDbWriter(session *mgo.Session, metadata bson.M, bulkInsert bool, conflict *ConflictResolver) BasicWriter {
 	if !bulkInsert { // bulk insertion disable
-		return &SingleWriter{session: session}
+		return &SingleWriter{session: session, conflict: conflict}
 	} else if _, ok := metadata["g"]; ok { // has gid
-		return &CommandWriter{session: session}
+		return &CommandWriter{session: session, conflict: conflict}
 	}
-	return &BulkWriter{session: session} // bulk insertion enable
+	return &BulkWriter{session: session, conflict: conflict} // bulk insertion enable
 }
 
 // use run_command to execute command
 type CommandWriter struct {
 	// mongo connection
 	session *mgo.Session
+	// resolve the duplicated writes
+	conflict *ConflictResolver
 }
 
-func (cw *CommandWriter) doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord,
-	dupUpdate bool) error {
+func (cw *CommandWriter) doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord) error {
 	var inserts []bson.D
 	for _, log := range oplogs {
 		newObject := log.original.partialLog.Object
@@ -82,11 +82,10 @@ func (cw *CommandWriter) doInsert(database, collection string, metadata bson.M,
 	}
 
 	if mgo.IsDup(err) {
-		HandleDuplicated(dbHandle.C(collection), oplogs, OpInsert)
-		// update on duplicated key occur
-		if dupUpdate {
+		// update on duplicated key occur if the source wins
+		if updates := cw.conflict.HandleDuplicated(dbHandle.C(collection), oplogs, OpInsert); len(updates) != 0 {
 			LOG.Info("Duplicated document found. reinsert or update to [%s] [%s]", database, collection)
-			return cw.doUpdateOnInsert(database, collection, metadata, oplogs, conf.Options.ReplayerExecutorUpsert)
+			return cw.doUpdateOnInsert(database, collection, metadata, updates, conf.Options.ReplayerExecutorUpsert)
 		}
 		return nil
 	}
@@ -163,7 +162,7 @@ func (cw *CommandWriter) doUpdate(database, collection string, metadata bson.M,
 
 	// ignore dup error
 	if mgo.IsDup(err) {
-		HandleDuplicated(dbHandle.C(collection), oplogs, OpUpdate)
+		cw.conflict.HandleDuplicated(dbHandle.C(collection), oplogs, OpUpdate)
 		return nil
 	}
 	return err
@@ -247,10 +246,11 @@ func (cw *CommandWriter) applyOps(database string, metadata bson.M, oplogs []*op
 type BulkWriter struct {
 	// mongo connection
 	session *mgo.Session
+	// resolve the duplicated writes
+	conflict *ConflictResolver
 }
 
-func (bw *BulkWriter) doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord,
-	dupUpdate bool) error {
+func (bw *BulkWriter) doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord) error {
 	var inserts []interface{}
 	for _, log := range oplogs {
 		newObject := log.original.partialLog.Object
@@ -265,11 +265,11 @@ func (bw *BulkWriter) doInsert(database, collection string, metadata bson.M, opl
 
 	if _, err := bulk.Run(); err != nil {
 		if mgo.IsDup(err) {
-			HandleDuplicated(bw.session.DB(database).C(collection), oplogs, OpInsert)
-			// update on duplicated key occur
-			if dupUpdate {
+			// update on duplicated key occur if the source wins
+			updates := bw.conflict.HandleDuplicated(bw.session.DB(database).C(collection), oplogs, OpInsert)
+			if len(updates) != 0 {
 				LOG.Info("Duplicated document found. reinsert or update to [%s] [%s]", database, collection)
-				return bw.doUpdateOnInsert(database, collection, metadata, oplogs, conf.Options.ReplayerExecutorUpsert)
+				return bw.doUpdateOnInsert(database, collection, metadata, updates, conf.Options.ReplayerExecutorUpsert)
 			}
 			return nil
 		}
@@ -334,7 +334,7 @@ func (bw *BulkWriter) doUpdate(database, collection string, metadata bson.M,
 
 	if _, err := bulk.Run(); err != nil {
 		if mgo.IsDup(err) {
-			HandleDuplicated(bw.session.DB(database).C(collection), oplogs, OpUpdate)
+			bw.conflict.HandleDuplicated(bw.session.DB(database).C(collection), oplogs, OpUpdate)
 			return nil
 		}
 		return fmt.Errorf("doUpdate run upsert/update[%v] failed[%v]", upsert, err)
@@ -394,10 +394,11 @@ func (bw *BulkWriter) doCommand(database string, metadata bson.M, oplogs []*Oplo
 type SingleWriter struct {
 	// mongo connection
 	session *mgo.Session
+	// resolve the duplicated writes
+	conflict *ConflictResolver
 }
 
-func (sw *SingleWriter) doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord,
-	dupUpdate bool) error {
+func (sw *SingleWriter) doInsert(database, collection string, metadata bson.M, oplogs []*OplogRecord) error {
 	collectionHandle := sw.session.DB(database).C(collection)
 	var upserts []*OplogRecord
 	var errMsgs []string
@@ -420,11 +421,10 @@ func (sw *SingleWriter) doInsert(database, collection string, metadata bson.M, o
 	}
 
 	if len(upserts) != 0 {
-		HandleDuplicated(collectionHandle, upserts, OpInsert)
-		// update on duplicated key occur
-		if dupUpdate {
+		// update on duplicated key occur if the source wins
+		if updates := sw.conflict.HandleDuplicated(collectionHandle, upserts, OpInsert); len(updates) != 0 {
 			LOG.Info("Duplicated document found. reinsert or update to [%s] [%s]", database, collection)
-			return sw.doUpdateOnInsert(database, collection, metadata, upserts, conf.Options.ReplayerExecutorUpsert)
+			return sw.doUpdateOnInsert(database, collection, metadata, updates, conf.Options.ReplayerExecutorUpsert)
 		}
 		return nil
 	}
@@ -490,7 +490,7 @@ func (sw *SingleWriter) doUpdate(database, collection string, metadata bson.M,
 			_, err := collectionHandle.Upsert(log.original.partialLog.Query, newObject)
 			if err != nil {
 				if mgo.IsDup(err) {
-					HandleDuplicated(collectionHandle, oplogs, OpUpdate)
+					sw.conflict.HandleDuplicated(collectionHandle, []*OplogRecord{log}, OpUpdate)
 					continue
 				}
 				errMsg := fmt.Sprintf("doUpdate[upsert] old-data[%v] with new-data[%v] failed[%v]",
@@ -511,7 +511,7 @@ func (sw *SingleWriter) doUpdate(database, collection string, metadata bson.M,
 				if utils.IsNotFound(err) {
 					LOG.Warn("doUpdate[update] data[%v] not found", log.original.partialLog.Query)
 				} else if mgo.IsDup(err) {
-					HandleDuplicated(collectionHandle, oplogs, OpUpdate)
+					sw.conflict.HandleDuplicated(collectionHandle, []*OplogRecord{log}, OpUpdate)
 				} else {
 					errMsg := fmt.Sprintf("doUpdate[update] old-data[%v] with new-data[%v] failed[%v]",
 						log.original.partialLog.Query, newObject, err)
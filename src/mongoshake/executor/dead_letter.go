@@ -0,0 +1,402 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/oplog"
+
+	"github.com/gugemichael/nimo4go"
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// the failed oplogs are retried forever
+	DeadLetterNone = "none"
+
+	// the backoff between the retries of failed oplogs doubles up to it
+	deadLetterMaxBackoff = 32 * time.Second
+	// the max letters returned by rest api
+	deadLetterListLimit = 1000
+	// the suffix of letter in file queue
+	deadLetterFileSuffix = ".bson"
+)
+
+// DeadLetter is an oplog which can't be replayed, with the error. The
+// oplog is stored after namespace and field transform
+type DeadLetter struct {
+	Id         bson.ObjectId `bson:"_id"`
+	ReplayerId uint32        `bson:"replayerId"`
+	Namespace  string        `bson:"ns"`
+	Error      string        `bson:"error"`
+	Time       time.Time     `bson:"time"`
+	// the whole oplog dumped by PartialLog.Dump
+	Oplog bson.D `bson:"oplog"`
+	// the document in target if the letter is written by conflict policy
+	Target bson.D `bson:"target,omitempty"`
+}
+
+func NewDeadLetter(replayerId uint32, log *oplog.PartialLog, reason string, target bson.D) *DeadLetter {
+	return &DeadLetter{
+		Id:         bson.NewObjectId(),
+		ReplayerId: replayerId,
+		Namespace:  log.Namespace,
+		Error:      reason,
+		Time:       time.Now(),
+		Oplog:      log.Dump(nil),
+		Target:     target,
+	}
+}
+
+// PartialLog decodes the oplog of letter
+func (letter *DeadLetter) PartialLog() (*oplog.PartialLog, error) {
+	data, err := bson.Marshal(letter.Oplog)
+	if err != nil {
+		return nil, err
+	}
+	log := new(oplog.PartialLog)
+	if err := bson.Unmarshal(data, log); err != nil {
+		return nil, fmt.Errorf("decode oplog of dead letter %v failed. %v", letter.Id.Hex(), err)
+	}
+	return log, nil
+}
+
+// DeadLetterQueue stores the dead letters until they are re-driven. It's
+// shared by all the executors
+type DeadLetterQueue interface {
+	Put(letter *DeadLetter) error
+	// List returns at most limit letters in the order of writing
+	List(limit int) ([]*DeadLetter, error)
+	// Get returns nil if the letter doesn't exist
+	Get(id bson.ObjectId) (*DeadLetter, error)
+	// Remove does nothing if the letter doesn't exist
+	Remove(id bson.ObjectId) error
+	Close()
+}
+
+// NewDeadLetterQueue creates the queue by replayer.dead_letter
+func NewDeadLetterQueue() (DeadLetterQueue, error) {
+	url := conf.Options.ReplayerDeadLetterUrl
+	switch conf.Options.ReplayerDeadLetter {
+	case utils.StorageTypeDB:
+		return NewMongoDeadLetterQueue(url)
+	case utils.StorageTypeFile:
+		return NewFileDeadLetterQueue(url)
+	}
+	return nil, fmt.Errorf("unknown replayer.dead_letter %v", conf.Options.ReplayerDeadLetter)
+}
+
+// MongoDeadLetterQueue stores the letters in the collection
+// ConflictDeadLetterCollection of utils.APPConflictDatabase()
+type MongoDeadLetterQueue struct {
+	conn *utils.MongoConn
+}
+
+func NewMongoDeadLetterQueue(url string) (*MongoDeadLetterQueue, error) {
+	conn, err := utils.NewMongoConn(url, utils.ConnectModePrimary, true)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoDeadLetterQueue{conn: conn}, nil
+}
+
+func (queue *MongoDeadLetterQueue) Put(letter *DeadLetter) error {
+	return queue.conn.Session.DB(utils.APPConflictDatabase()).C(ConflictDeadLetterCollection).Insert(letter)
+}
+
+func (queue *MongoDeadLetterQueue) List(limit int) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	err := queue.conn.Session.DB(utils.APPConflictDatabase()).C(ConflictDeadLetterCollection).
+		Find(bson.M{}).Sort("_id").Limit(limit).All(&letters)
+	return letters, err
+}
+
+func (queue *MongoDeadLetterQueue) Get(id bson.ObjectId) (*DeadLetter, error) {
+	letter := new(DeadLetter)
+	err := queue.conn.Session.DB(utils.APPConflictDatabase()).C(ConflictDeadLetterCollection).FindId(id).One(letter)
+	if utils.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+func (queue *MongoDeadLetterQueue) Remove(id bson.ObjectId) error {
+	err := queue.conn.Session.DB(utils.APPConflictDatabase()).C(ConflictDeadLetterCollection).RemoveId(id)
+	if err != nil && !utils.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (queue *MongoDeadLetterQueue) Close() {
+	queue.conn.Close()
+}
+
+// FileDeadLetterQueue stores each letter in a bson file of folder, named by
+// the id of letter
+type FileDeadLetterQueue struct {
+	folder string
+}
+
+func NewFileDeadLetterQueue(folder string) (*FileDeadLetterQueue, error) {
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterQueue{folder: folder}, nil
+}
+
+func (queue *FileDeadLetterQueue) path(id bson.ObjectId) string {
+	return filepath.Join(queue.folder, id.Hex()+deadLetterFileSuffix)
+}
+
+// Put writes a temporary file and renames it, so the letter is never partly
+// written
+func (queue *FileDeadLetterQueue) Put(letter *DeadLetter) error {
+	data, err := bson.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	path := queue.path(letter.Id)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (queue *FileDeadLetterQueue) List(limit int) ([]*DeadLetter, error) {
+	files, err := ioutil.ReadDir(queue.folder)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), deadLetterFileSuffix) {
+			names = append(names, file.Name())
+		}
+	}
+	// the hex of object id begins with the time
+	sort.Strings(names)
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+	letters := make([]*DeadLetter, 0, len(names))
+	for _, name := range names {
+		hex := strings.TrimSuffix(name, deadLetterFileSuffix)
+		if !bson.IsObjectIdHex(hex) {
+			continue
+		}
+		letter, err := queue.Get(bson.ObjectIdHex(hex))
+		if err != nil {
+			return nil, err
+		} else if letter != nil {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, nil
+}
+
+func (queue *FileDeadLetterQueue) Get(id bson.ObjectId) (*DeadLetter, error) {
+	data, err := ioutil.ReadFile(queue.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	letter := new(DeadLetter)
+	if err := bson.Unmarshal(data, letter); err != nil {
+		return nil, fmt.Errorf("decode dead letter %v failed. %v", id.Hex(), err)
+	}
+	return letter, nil
+}
+
+func (queue *FileDeadLetterQueue) Remove(id bson.ObjectId) error {
+	if err := os.Remove(queue.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (queue *FileDeadLetterQueue) Close() {}
+
+// syncWithRetry retries the oplogs with backoff until they are written. If
+// the dead letter queue is set and the oplogs still fail after
+// replayer.dead_letter.retry times, they are written one by one and the
+// failed ones are put into the queue, so the replication goes on
+func (exec *Executor) syncWithRetry(logs []*OplogRecord) {
+	backoff := time.Second
+	for retry := 1; ; retry++ {
+		err := exec.doSync(logs)
+		if err == nil {
+			return
+		}
+		queue := exec.batchExecutor.DeadLetter
+		if queue != nil && retry > conf.Options.ReplayerDeadLetterRetry && exec.isolate(logs, queue) {
+			return
+		}
+		LOG.Warn("Replayer-%d executor-%d retry %d failed, retry again after %v. %v",
+			exec.batchExecutor.ReplayerId, exec.id, retry, backoff, err)
+		time.Sleep(backoff)
+		if backoff < deadLetterMaxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// isolate writes the oplogs one by one, and puts the failed ones into the
+// queue. false is returned if the target isn't reachable, since the oplogs
+// aren't poisonous then
+func (exec *Executor) isolate(logs []*OplogRecord, queue DeadLetterQueue) bool {
+	for _, log := range logs {
+		if !exec.reachable() {
+			return false
+		}
+		err := exec.doSync([]*OplogRecord{log})
+		if err == nil {
+			continue
+		}
+		if !exec.reachable() {
+			return false
+		}
+		partialLog := log.original.partialLog
+		letter := NewDeadLetter(exec.batchExecutor.ReplayerId, partialLog, err.Error(), nil)
+		if err := queue.Put(letter); err != nil {
+			LOG.Critical("Replayer-%d executor-%d put dead letter of oplog %v failed. %v",
+				exec.batchExecutor.ReplayerId, exec.id, partialLog.Dump(nil), err)
+			return false
+		}
+		LOG.Critical("Replayer-%d executor-%d oplog %v is put into dead letter %v. %v",
+			exec.batchExecutor.ReplayerId, exec.id, partialLog.Dump(nil), letter.Id.Hex(), err)
+		if exec.batchExecutor.ReplMetric != nil {
+			exec.batchExecutor.ReplMetric.AddDeadLetter(1)
+		}
+	}
+	return true
+}
+
+func (exec *Executor) reachable() bool {
+	return exec.ensureConnection() && exec.session.Ping() == nil
+}
+
+// DeadLetterRestAPI registers the api to list and re-drive the letters.
+// The letters are re-driven to the target of their replayers in
+// addresses, and removed if written successfully. The conflicts are
+// resolved by the policy again
+func DeadLetterRestAPI(queue DeadLetterQueue, addresses []string) {
+	type Letter struct {
+		Id         string          `json:"id"`
+		ReplayerId uint32          `json:"replayer_id"`
+		Namespace  string          `json:"ns"`
+		Error      string          `json:"error"`
+		Time       string          `json:"time"`
+		Oplog      json.RawMessage `json:"oplog"`
+		Target     json.RawMessage `json:"target,omitempty"`
+	}
+	type Redrive struct {
+		// all the letters if empty
+		Ids []string `json:"ids"`
+	}
+
+	utils.HttpApi.RegisterAPI("/deadletter", nimo.HttpGet, func([]byte) interface{} {
+		letters, err := queue.List(deadLetterListLimit)
+		if err != nil {
+			return map[string]string{"deadletter": err.Error()}
+		}
+		result := make([]*Letter, 0, len(letters))
+		for _, letter := range letters {
+			item := &Letter{
+				Id:         letter.Id.Hex(),
+				ReplayerId: letter.ReplayerId,
+				Namespace:  letter.Namespace,
+				Error:      letter.Error,
+				Time:       letter.Time.Format(utils.TimeFormat),
+			}
+			item.Oplog, _ = utils.MarshalExtJSON(letter.Oplog)
+			if letter.Target != nil {
+				item.Target, _ = utils.MarshalExtJSON(letter.Target)
+			}
+			result = append(result, item)
+		}
+		return result
+	})
+
+	utils.HttpApi.RegisterAPI("/deadletter/redrive", nimo.HttpPost, func(body []byte) interface{} {
+		var redrive Redrive
+		if err := json.Unmarshal(body, &redrive); err != nil {
+			LOG.Info("Dead letter redrive wrong format : %v", err)
+			return map[string]string{"redrive": "request json wrong format"}
+		}
+		var letters []*DeadLetter
+		if len(redrive.Ids) == 0 {
+			var err error
+			if letters, err = queue.List(deadLetterListLimit); err != nil {
+				return map[string]string{"redrive": err.Error()}
+			}
+		}
+		for _, id := range redrive.Ids {
+			if !bson.IsObjectIdHex(id) {
+				return map[string]string{"redrive": fmt.Sprintf("illegal id %v", id)}
+			}
+			letter, err := queue.Get(bson.ObjectIdHex(id))
+			if err != nil {
+				return map[string]string{"redrive": err.Error()}
+			} else if letter == nil {
+				return map[string]string{"redrive": fmt.Sprintf("dead letter %v is not exist", id)}
+			}
+			letters = append(letters, letter)
+		}
+		result := make(map[string]string, len(letters))
+		for _, letter := range letters {
+			if err := redriveDeadLetter(queue, letter, addresses); err != nil {
+				result[letter.Id.Hex()] = err.Error()
+			} else {
+				result[letter.Id.Hex()] = "success"
+			}
+		}
+		return result
+	})
+}
+
+// redriveDeadLetter writes the letter once by a standalone executor, the
+// letter is removed if successful
+func redriveDeadLetter(queue DeadLetterQueue, letter *DeadLetter, addresses []string) error {
+	log, err := letter.PartialLog()
+	if err != nil {
+		return err
+	}
+	conflict, err := NewConflictResolver(DefaultConflictPolicy(), conf.Options.ReplayerConflictPolicyNamespace, nil)
+	if err != nil {
+		return err
+	}
+	url := addresses[letter.ReplayerId%uint32(len(addresses))]
+	// the oplog is transformed already
+	batchExecutor := &BatchGroupExecutor{ReplayerId: letter.ReplayerId, MongoUrl: url, conflict: conflict}
+	conflict.replayerId, conflict.deadLetter = letter.ReplayerId, queue
+	exec := &Executor{
+		id:            GenerateExecutorId(),
+		batchExecutor: batchExecutor,
+		MongoUrl:      url,
+		namespaces:    make(map[string]bool),
+	}
+	defer func() {
+		if exec.session != nil {
+			exec.dropConnection()
+		}
+	}()
+	if err := exec.doSync([]*OplogRecord{{original: &PartialLogWithCallbak{partialLog: log}}}); err != nil {
+		return err
+	}
+	LOG.Info("Dead letter %v of replayer-%d is re-driven", letter.Id.Hex(), letter.ReplayerId)
+	return queue.Remove(letter.Id)
+}
@@ -1,6 +1,8 @@
 package executor
 
 import (
+	"reflect"
+
 	"mongoshake/collector/configure"
 	"mongoshake/common"
 	"mongoshake/oplog"
@@ -10,9 +12,23 @@ import (
 	"github.com/vinllen/mgo/bson"
 )
 
-func HandleDuplicated(collection *mgo.Collection, records []*OplogRecord, op int8) {
+// HandleDuplicated resolves the records failed by duplicated key, and returns
+// the inserts that the source wins, which should be written as update
+func (resolver *ConflictResolver) HandleDuplicated(collection *mgo.Collection, records []*OplogRecord,
+	op int8) []*OplogRecord {
+	policy := resolver.Lookup(collection.FullName)
+	var sourceWins []*OplogRecord
 	for _, record := range records {
 		log := record.original.partialLog
+		var found bson.D
+		if op == OpInsert {
+			// the unordered insert may be partly successful
+			id := oplog.GetKey(log.Object, "")
+			if err := collection.FindId(id).One(&found); err == nil && reflect.DeepEqual(found, log.Object) {
+				continue
+			}
+		}
+
 		switch conf.Options.ReplayerConflictWriteTo {
 		case DumpConflictToDB:
 			// general process : write record to specific database
@@ -25,7 +41,26 @@ func HandleDuplicated(collection *mgo.Collection, records []*OplogRecord, op int
 		if utils.SentinelOptions.DuplicatedDump {
 			SnapshotDiffer{op: op, log: log}.dump(collection)
 		}
+
+		if resolver.metric != nil {
+			resolver.metric.AddConflict(policy.Name, 1)
+		}
+		switch policy.Name {
+		case ConflictSourceWins:
+			// the update can't be resolved, the target wins
+			if op == OpInsert {
+				sourceWins = append(sourceWins, record)
+			}
+		case ConflictLastWriterWins:
+			if op == OpInsert && found != nil {
+				resolver.lastWriterWins(collection, policy.Field, log, found)
+			}
+		case ConflictDeadLetter:
+			resolver.writeDeadLetter(collection, log, found)
+		case ConflictTargetWins:
+		}
 	}
+	return sourceWins
 }
 
 type SnapshotDiffer struct {
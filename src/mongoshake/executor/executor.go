@@ -5,7 +5,6 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"mongoshake/collector/configure"
 	"mongoshake/collector/transform"
@@ -51,6 +50,19 @@ type BatchGroupExecutor struct {
 	MongoUrl string
 	// tranform namespace
 	NsTrans *transform.NamespaceTransform
+	// transform fields of document
+	FieldTrans *transform.FieldTransform
+	// write concern of the executors, default is used if nil
+	Safe *mgo.Safe
+	// write the oplogs with the applied timestamp in transaction, the
+	// applied oplogs are skipped after restart
+	ExactlyOnce bool
+	// metric of the syncer, nil if not counted
+	ReplMetric *utils.ReplicationMetric
+	// the oplogs failed after retries are put into it, retried forever if nil
+	DeadLetter DeadLetterQueue
+	// resolve the duplicated writes by conflict policy
+	conflict *ConflictResolver
 }
 
 func (batchExecutor *BatchGroupExecutor) Start() {
@@ -62,6 +74,17 @@ func (batchExecutor *BatchGroupExecutor) Start() {
 	if len(conf.Options.TransformNamespace) > 0 {
 		batchExecutor.NsTrans = transform.NewNamespaceTransform(conf.Options.TransformNamespace)
 	}
+	if len(conf.Options.TransformField) > 0 {
+		batchExecutor.FieldTrans = transform.NewFieldTransform(conf.Options.TransformField,
+			conf.Options.TransformFieldHashSalt)
+	}
+	conflict, err := NewConflictResolver(DefaultConflictPolicy(),
+		conf.Options.ReplayerConflictPolicyNamespace, batchExecutor.ReplMetric)
+	if err != nil {
+		LOG.Crashf("replayer conflict policy is illegal. %v", err)
+	}
+	conflict.replayerId, conflict.deadLetter = batchExecutor.ReplayerId, batchExecutor.DeadLetter
+	batchExecutor.conflict = conflict
 	executors := make([]*Executor, parallel)
 	for i := 0; i != len(executors); i++ {
 		executors[i] = NewExecutor(GenerateExecutorId(), batchExecutor, batchExecutor.MongoUrl)
@@ -180,6 +203,13 @@ type Executor struct {
 
 	// bulk insert or single insert
 	bulkInsert bool
+
+	// transaction and the timestamp of the last applied oplog if
+	// ExactlyOnce is set. the session of txn marks the writes if
+	// replayer.loop_prevention is enabled
+	txn        *transaction
+	appliedTs  bson.MongoTimestamp
+	namespaces map[string]bool
 }
 
 func GenerateExecutorId() int {
@@ -193,15 +223,16 @@ func NewExecutor(id int, batchExecutor *BatchGroupExecutor, MongoUrl string) *Ex
 		journal:       utils.NewJournal(utils.JournalFileName(fmt.Sprintf("direct.%03d", id))),
 		MongoUrl:      MongoUrl,
 		batchBlock:    make(chan []*OplogRecord, 1),
+		namespaces:    make(map[string]bool),
 	}
 }
 
 func (exec *Executor) start() {
 	for toBeExecuted := range exec.batchBlock {
 		nimo.AssertTrue(len(toBeExecuted) != 0, "the size of being executed batch oplogRecords could not be zero")
-		for exec.doSync(toBeExecuted) != nil {
-			time.Sleep(time.Second)
-		}
+		// transform once, since the oplogs are changed in place
+		transformLogs(toBeExecuted, exec.batchExecutor.NsTrans, exec.batchExecutor.FieldTrans, conf.Options.DBRef)
+		exec.syncWithRetry(toBeExecuted)
 		// acknowledge all oplogRecords have been successfully executed
 		exec.finisher.Add(-len(toBeExecuted))
 
@@ -215,13 +246,11 @@ func (exec *Executor) start() {
 func (exec *Executor) doSync(logs []*OplogRecord) error {
 	count := len(logs)
 
-	transLogs := transformLogs(logs, exec.batchExecutor.NsTrans, conf.Options.DBRef)
-
 	// split batched oplogRecords into (ns, op) groups. individual group
 	// can be accomplished in single MongoDB request. groups
 	// in this executor will be sequential
 	oplogGroups := LogsGroupCombiner{maxGroupNr: OplogsMaxGroupNum,
-		maxGroupSize: OplogsMaxGroupSize}.mergeToGroups(transLogs)
+		maxGroupSize: OplogsMaxGroupSize}.mergeToGroups(logs)
 	for _, group := range oplogGroups {
 		if err := exec.execute(group); err != nil {
 			return err
@@ -233,16 +262,18 @@ func (exec *Executor) doSync(logs []*OplogRecord) error {
 	return nil
 }
 
-// if no need to transform namespace, return original logs
+// if no need to transform namespace or field, return original logs
 // for no command log, transform namespace in DBRef by conf.Options.TransformDBRef
+// and fields of insert and update by the rules of source namespace
 // for command log, need transform namespace/collection in object of oplog
-func transformLogs(logs []*OplogRecord, nsTrans *transform.NamespaceTransform, transformRef bool) []*OplogRecord {
-	if nsTrans == nil {
+func transformLogs(logs []*OplogRecord, nsTrans *transform.NamespaceTransform,
+	fieldTrans *transform.FieldTransform, transformRef bool) []*OplogRecord {
+	if nsTrans == nil && fieldTrans == nil {
 		return logs
 	}
 	for _, log := range logs {
 		partialLog := log.original.partialLog
-		transPartialLog := transformPartialLog(partialLog, nsTrans, transformRef)
+		transPartialLog := transformPartialLog(partialLog, nsTrans, fieldTrans, transformRef)
 		if transPartialLog != nil {
 			log.original.partialLog = transPartialLog
 		}
@@ -250,16 +281,31 @@ func transformLogs(logs []*OplogRecord, nsTrans *transform.NamespaceTransform, t
 	return logs
 }
 
-func transformPartialLog(partialLog *oplog.PartialLog, nsTrans *transform.NamespaceTransform, transformRef bool) *oplog.PartialLog {
+func transformPartialLog(partialLog *oplog.PartialLog, nsTrans *transform.NamespaceTransform,
+	fieldTrans *transform.FieldTransform, transformRef bool) *oplog.PartialLog {
 	db := strings.SplitN(partialLog.Namespace, ".", 2)[0]
 	if partialLog.Operation != "c" {
+		// the rules are matched by the source namespace
+		if fieldTrans != nil {
+			switch partialLog.Operation {
+			case "i":
+				partialLog.Object = fieldTrans.TransformDoc(partialLog.Namespace, partialLog.Object)
+			case "u":
+				if object := fieldTrans.TransformUpdate(partialLog.Namespace, partialLog.Object); object != nil {
+					partialLog.Object = object
+				} else {
+					// all the changed fields are dropped, replay it as noop
+					partialLog.Operation = "n"
+				}
+			}
+		}
 		// {"op" : "i", "ns" : "my.system.indexes", "o" : { "v" : 2, "key" : { "date" : 1 }, "name" : "date_1", "ns" : "my.tbl", "expireAfterSeconds" : 3600 }
 		if strings.HasSuffix(partialLog.Namespace, "system.indexes") {
 			value := oplog.GetKey(partialLog.Object, "ns")
 			oplog.SetFiled(partialLog.Object, "ns", nsTrans.Transform(value.(string)))
 		}
 		partialLog.Namespace = nsTrans.Transform(partialLog.Namespace)
-		if transformRef {
+		if transformRef && nsTrans != nil {
 			partialLog.Object = transform.TransformDBRefByDocD(partialLog.Object, db, nsTrans)
 		}
 	} else {
@@ -323,7 +369,7 @@ func transformPartialLog(partialLog *oplog.PartialLog, nsTrans *transform.Namesp
 				for i, ele := range ops {
 					m, keys := oplog.ConvertBsonD2M(ele)
 					subLog := oplog.NewPartialLog(m)
-					transSubLog := transformPartialLog(subLog, nsTrans, transformRef)
+					transSubLog := transformPartialLog(subLog, nsTrans, fieldTrans, transformRef)
 					if transSubLog == nil {
 						LOG.Warn("transformPartialLog sublog %v return nil, ignore!", subLog)
 						return nil
@@ -2,7 +2,10 @@ package executor
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	"mongoshake/collector/transform"
 	"mongoshake/oplog"
@@ -221,7 +224,7 @@ func TestTransformLog(t *testing.T) {
 		logs := []*OplogRecord{
 			mockTransLogs("i", "fdb1.tc1", bson.D{bson.DocElem{"a", 1}}),
 		}
-		logs = transformLogs(logs, nsTrans, false)
+		logs = transformLogs(logs, nsTrans, nil, false)
 		assert.Equal(t, mockTransLogs("i", "fdb2.tc1", bson.D{bson.DocElem{"a", 1}}), logs[0], "should be equal")
 	}
 
@@ -247,7 +250,7 @@ func TestTransformLog(t *testing.T) {
 				}},
 			}),
 		}
-		logs = transformLogs(logs, nsTrans, false)
+		logs = transformLogs(logs, nsTrans, nil, false)
 		assert.Equal(t, mockTransLogs("i", "tdb1.fcol1", bson.D{bson.DocElem{"a", 1}}), logs[0], "should be equal")
 		assert.Equal(t, mockTransLogs("i", "fdb2.fcol2", bson.D{
 			bson.DocElem{"a", 1},
@@ -289,7 +292,7 @@ func TestTransformLog(t *testing.T) {
 				}},
 			}),
 		}
-		logs = transformLogs(logs, nsTrans, true)
+		logs = transformLogs(logs, nsTrans, nil, true)
 		assert.Equal(t, mockTransLogs("i", "tdb1.fcol1", bson.D{bson.DocElem{"a", 1}}), logs[0], "should be equal")
 		assert.Equal(t, mockTransLogs("i", "fdb2.fcol2", bson.D{
 			bson.DocElem{"a", 1},
@@ -329,7 +332,7 @@ func TestTransformLog(t *testing.T) {
 					bson.DocElem{"key", bson.D{bson.DocElem{"a", 1}}},
 					bson.DocElem{"ns", "fdb1.fcol1"}}}}),
 		}
-		logs = transformLogs(logs, nsTrans, true)
+		logs = transformLogs(logs, nsTrans, nil, true)
 		assert.Equal(t, mockTransLogs("i", "tdb1.tcol1", bson.D{bson.DocElem{"a", 1}}), logs[0], "should be equal")
 		assert.Equal(t, mockTransLogs("i", "fdb2.fcol2", bson.D{
 			bson.DocElem{"a", 1},
@@ -395,7 +398,7 @@ func TestTransformLog(t *testing.T) {
 			}),
 		}
 
-		logs = transformLogs(logs, nsTrans, true)
+		logs = transformLogs(logs, nsTrans, nil, true)
 		assert.Equal(t, mockTransLogs("c", "admin.$cmd", bson.D{
 			bson.DocElem{
 				Name: "applyOps",
@@ -446,7 +449,7 @@ func TestTransformLog(t *testing.T) {
 				bson.DocElem{"renameCollection", "fdb1.fcol1"},
 				bson.DocElem{"to", "fdb2.fcol2"}}),
 		}
-		logs = transformLogs(logs, nsTrans, true)
+		logs = transformLogs(logs, nsTrans, nil, true)
 		assert.Equal(t,
 			mockTransLogs("c", "tdb1.tcol1", bson.D{
 				bson.DocElem{"renameCollection", "tdb1.tcol1"},
@@ -476,7 +479,7 @@ func TestTransformLog(t *testing.T) {
 			}),
 		}
 
-		logs = transformLogs(logs, nsTrans, true)
+		logs = transformLogs(logs, nsTrans, nil, true)
 		assert.Equal(t, mockTransLogs("c", "admin.$cmd", bson.D{
 			bson.DocElem{
 				Name: "applyOps",
@@ -494,4 +497,199 @@ func TestTransformLog(t *testing.T) {
 			},
 		}), logs[0], "should be equal")
 	}
+
+	{
+		fmt.Printf("TestTransformLog case %d.\n", nr)
+		nr++
+		nsTrans := transform.NewNamespaceTransform([]string{"fdb1:tdb1"})
+		fieldTrans := transform.NewFieldTransform([]string{"fdb1.fcol1:drop:ssn", "fdb1:rename:name:fullName"}, "")
+
+		logs := []*OplogRecord{
+			mockTransLogs("i", "fdb1.fcol1", bson.D{{"_id", 1}, {"name", "a"}, {"ssn", "123"}}),
+			mockTransLogs("u", "fdb1.fcol1", bson.D{{"$set", bson.D{{"ssn", "456"}}}}),
+			mockTransLogs("u", "fdb1.fcol2", bson.D{{"$set", bson.D{{"ssn", "456"}, {"name", "b"}}}}),
+		}
+		logs = transformLogs(logs, nsTrans, fieldTrans, false)
+		assert.Equal(t, mockTransLogs("i", "tdb1.fcol1", bson.D{{"_id", 1}, {"fullName", "a"}}), logs[0],
+			"should be equal")
+		assert.Equal(t, "n", logs[1].original.partialLog.Operation, "should be equal")
+		assert.Equal(t, mockTransLogs("u", "tdb1.fcol2", bson.D{{"$set", bson.D{{"ssn", "456"}, {"fullName", "b"}}}}),
+			logs[2], "should be equal")
+	}
+}
+
+func TestBuildTransactionCommand(t *testing.T) {
+	// test buildTransactionCommand
+
+	var nr int
+	{
+		fmt.Printf("TestBuildTransactionCommand case %d.\n", nr)
+		nr++
+
+		object := bson.D{bson.DocElem{"_id", 1}, bson.DocElem{"a", 1}}
+		group := &OplogsGroup{ns: "db.c", op: "i", oplogRecords: []*OplogRecord{
+			mockTransLogs("i", "db.c", object),
+		}}
+		cmd := buildTransactionCommand("c", group)
+		assert.Equal(t, bson.D{{"insert", "c"}, {"documents", []bson.D{object}}}, cmd, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestBuildTransactionCommand case %d.\n", nr)
+		nr++
+
+		group := &OplogsGroup{ns: "db.c", op: "d", oplogRecords: []*OplogRecord{
+			mockTransLogs("d", "db.c", bson.D{bson.DocElem{"_id", 1}}),
+			mockTransLogs("d", "db.c", bson.D{bson.DocElem{"_id", 2}}),
+		}}
+		cmd := buildTransactionCommand("c", group)
+		assert.Equal(t, bson.D{{"delete", "c"}, {"deletes", []bson.M{
+			{"q": bson.D{bson.DocElem{"_id", 1}}, "limit": 1},
+			{"q": bson.D{bson.DocElem{"_id", 2}}, "limit": 1},
+		}}}, cmd, "should be equal")
+	}
+
+	// the duplicated insert is resolved in transaction
+	{
+		fmt.Printf("TestBuildTransactionCommand case %d.\n", nr)
+		nr++
+
+		object := bson.D{bson.DocElem{"_id", 1}, bson.DocElem{"a", 1}}
+		group := &OplogsGroup{ns: "db.c", op: "i", oplogRecords: []*OplogRecord{
+			mockTransLogs("i", "db.c", object),
+		}}
+		cmd, err := buildResolvedInsertCommand("c", group, &ConflictPolicy{Name: ConflictSourceWins})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, bson.D{{"update", "c"}, {"updates", []bson.M{
+			{"q": bson.M{"_id": 1}, "u": object, "upsert": true},
+		}}}, cmd, "should be equal")
+
+		cmd, err = buildResolvedInsertCommand("c", group, &ConflictPolicy{Name: ConflictTargetWins})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, bson.D{{"update", "c"}, {"updates", []bson.M{
+			{"q": bson.M{"_id": 1}, "u": bson.M{"$setOnInsert": object}, "upsert": true},
+		}}}, cmd, "should be equal")
+
+		_, err = buildResolvedInsertCommand("c", group, &ConflictPolicy{Name: ConflictDeadLetter})
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestBuildTransactionCommand case %d.\n", nr)
+		nr++
+
+		resolver, err := NewConflictResolver(ConflictTargetWins, []string{"db1:source_wins"}, nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, resolver.CheckInTransaction(), "should be equal")
+		resolver, err = NewConflictResolver(ConflictTargetWins, []string{"db1.c1:last_writer_wins:ts"}, nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.NotEqual(t, nil, resolver.CheckInTransaction(), "should be not equal")
+	}
+}
+
+func TestConflictResolver(t *testing.T) {
+	// test NewConflictResolver and compareValues
+
+	var nr int
+	{
+		fmt.Printf("TestConflictResolver case %d.\n", nr)
+		nr++
+
+		resolver, err := NewConflictResolver(ConflictTargetWins,
+			[]string{"db1.c1:last_writer_wins:updated_at", "db1:source_wins", "db2:dead_letter"}, nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, &ConflictPolicy{Name: ConflictLastWriterWins, Field: "updated_at"},
+			resolver.Lookup("db1.c1"), "should be equal")
+		assert.Equal(t, ConflictSourceWins, resolver.Lookup("db1.c2").Name, "should be equal")
+		assert.Equal(t, ConflictDeadLetter, resolver.Lookup("db2.c1").Name, "should be equal")
+		assert.Equal(t, ConflictTargetWins, resolver.Lookup("db3.c1").Name, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestConflictResolver case %d.\n", nr)
+		nr++
+
+		_, err := NewConflictResolver("unknown", nil, nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = NewConflictResolver(ConflictLastWriterWins, nil, nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = NewConflictResolver(ConflictSourceWins, []string{"db1.c1"}, nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestConflictResolver case %d.\n", nr)
+		nr++
+
+		cmp, ok := compareValues(time.Unix(100, 0), time.Unix(200, 0))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, -1, cmp, "should be equal")
+		cmp, ok = compareValues(int64(1<<62+1), int64(1<<62))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, 1, cmp, "should be equal")
+		cmp, ok = compareValues(2, 2.0)
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, 0, cmp, "should be equal")
+		_, ok = compareValues("2", 2)
+		assert.Equal(t, false, ok, "should be equal")
+	}
+}
+
+func TestFileDeadLetterQueue(t *testing.T) {
+	// test FileDeadLetterQueue and DeadLetter.PartialLog
+
+	var nr int
+	{
+		fmt.Printf("TestFileDeadLetterQueue case %d.\n", nr)
+		nr++
+
+		dir, err := ioutil.TempDir("", "dead_letter")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.RemoveAll(dir)
+
+		queue, err := NewFileDeadLetterQueue(dir)
+		assert.Equal(t, nil, err, "should be equal")
+		letters, err := queue.List(0)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 0, len(letters), "should be equal")
+
+		log := &oplog.PartialLog{
+			Timestamp: bson.MongoTimestamp(100),
+			Operation: "u",
+			Namespace: "db1.c1",
+			Object:    bson.D{{"$set", bson.D{{"b", 2}, {"a", 1}}}},
+			Query:     bson.M{"_id": 1},
+		}
+		first := NewDeadLetter(1, log, "error1", nil)
+		second := NewDeadLetter(2, log, "error2", bson.D{{"_id", 1}})
+		assert.Equal(t, nil, queue.Put(first), "should be equal")
+		assert.Equal(t, nil, queue.Put(second), "should be equal")
+
+		letters, err = queue.List(0)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 2, len(letters), "should be equal")
+		assert.Equal(t, first.Id, letters[0].Id, "should be equal")
+		assert.Equal(t, "error1", letters[0].Error, "should be equal")
+		assert.Equal(t, bson.D{{"_id", 1}}, letters[1].Target, "should be equal")
+		letters, err = queue.List(1)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 1, len(letters), "should be equal")
+
+		// the order of nested fields is kept
+		decoded, err := letters[0].PartialLog()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, log.Timestamp, decoded.Timestamp, "should be equal")
+		assert.Equal(t, log.Namespace, decoded.Namespace, "should be equal")
+		assert.Equal(t, log.Object, decoded.Object, "should be equal")
+		assert.Equal(t, log.Query, decoded.Query, "should be equal")
+
+		assert.Equal(t, nil, queue.Remove(first.Id), "should be equal")
+		assert.Equal(t, nil, queue.Remove(first.Id), "should be equal")
+		letter, err := queue.Get(first.Id)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, (*DeadLetter)(nil), letter, "should be equal")
+		letter, err = queue.Get(second.Id)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, second.Id, letter.Id, "should be equal")
+	}
 }
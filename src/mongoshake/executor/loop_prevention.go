@@ -0,0 +1,44 @@
+package executor
+
+import (
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// retryable writes are supported since 3.6
+	RetryableWriteVersion = "3.6.0"
+)
+
+// executeMarked writes the insert, update and delete by retryable writes of
+// the session marked by utils.LoopMarker, so their oplogs are dropped by the
+// collector of reverse direction. The commands can't be marked, they are
+// written as usual
+func (exec *Executor) executeMarked(dbWriter BasicWriter, dc []string, group *OplogsGroup,
+	metadata bson.M) error {
+	switch group.op {
+	case "i", "u", "d":
+	default:
+		return exec.write(dbWriter, dc, group, metadata)
+	}
+	if exec.txn == nil {
+		txn, err := newTransaction(exec.session)
+		if err != nil {
+			return err
+		}
+		exec.txn = txn
+	}
+	// the session is changed after reconnecting
+	exec.txn.session = exec.session
+
+	err := exec.txn.retryable(dc[0], buildTransactionCommand(dc[1], group))
+	if err == nil || !mgo.IsDup(err) {
+		return err
+	}
+	// the write resolving the conflict isn't marked, so it's synced back to
+	// the source once, and stops there since the write in source is marked
+	LOG.Warn("Replay-%d oplog collection ns [%s] duplicated in marked write, write without marker. %v",
+		exec.batchExecutor.ReplayerId, group.ns, err)
+	return exec.write(dbWriter, dc, group, metadata)
+}
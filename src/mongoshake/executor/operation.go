@@ -26,6 +26,9 @@ func (exec *Executor) ensureConnection() bool {
 			return false
 		} else {
 			exec.session = conn.Session
+			if exec.batchExecutor.Safe != nil {
+				exec.session.SetSafe(exec.batchExecutor.Safe)
+			}
 			if exec.bulkInsert, err = utils.GetAndCompareVersion(exec.session, ThresholdVersion); err != nil {
 				LOG.Info("compare version with return[%v], bulkInsert disable", err)
 			}
@@ -56,7 +59,7 @@ func (exec *Executor) execute(group *OplogsGroup) error {
 		// just use the first log. they has the same metadata
 		metadata := buildMetadata(group.oplogRecords[0].original.partialLog)
 		hasIndex := strings.Contains(group.ns, "system.indexes")
-		dbWriter := NewDbWriter(exec.session, metadata, exec.bulkInsert && !hasIndex)
+		dbWriter := NewDbWriter(exec.session, metadata, exec.bulkInsert && !hasIndex, exec.batchExecutor.conflict)
 		var err error
 
 		LOG.Debug("Replay-%d oplog collection ns [%s] with command [%s] batch count %d, metadata %v",
@@ -69,21 +72,12 @@ func (exec *Executor) execute(group *OplogsGroup) error {
 		// for indexes
 		// "0" -> database, "1" -> collection
 		dc := strings.SplitN(group.ns, ".", 2)
-		switch group.op {
-		case "i":
-			err = dbWriter.doInsert(dc[0], dc[1], metadata, group.oplogRecords,
-				conf.Options.ReplayerExecutorInsertOnDupUpdate)
-		case "u":
-			err = dbWriter.doUpdate(dc[0], dc[1], metadata, group.oplogRecords,
-				conf.Options.ReplayerExecutorUpsert)
-		case "d":
-			err = dbWriter.doDelete(dc[0], dc[1], metadata, group.oplogRecords)
-		case "c":
-			err = dbWriter.doCommand(dc[0], metadata, group.oplogRecords)
-		case "n":
-			// exec.batchExecutor.ReplMetric.AddFilter(count)
-		default:
-			LOG.Warn("Unknown type oplogs found. op '%s'", group.op)
+		if exec.batchExecutor.ExactlyOnce {
+			err = exec.executeExactlyOnce(dbWriter, dc, group, metadata)
+		} else if conf.Options.ReplayerLoopPrevention {
+			err = exec.executeMarked(dbWriter, dc, group, metadata)
+		} else {
+			err = exec.write(dbWriter, dc, group, metadata)
 		}
 
 		// a few known error we can skip !! such as "ShardKeyNotFound" returned
@@ -115,6 +109,26 @@ func (exec *Executor) execute(group *OplogsGroup) error {
 	return nil
 }
 
+// write the group by dbWriter, dc is the database and collection of group
+func (exec *Executor) write(dbWriter BasicWriter, dc []string, group *OplogsGroup, metadata bson.M) error {
+	switch group.op {
+	case "i":
+		return dbWriter.doInsert(dc[0], dc[1], metadata, group.oplogRecords)
+	case "u":
+		return dbWriter.doUpdate(dc[0], dc[1], metadata, group.oplogRecords,
+			conf.Options.ReplayerExecutorUpsert)
+	case "d":
+		return dbWriter.doDelete(dc[0], dc[1], metadata, group.oplogRecords)
+	case "c":
+		return dbWriter.doCommand(dc[0], metadata, group.oplogRecords)
+	case "n":
+		// exec.batchExecutor.ReplMetric.AddFilter(count)
+	default:
+		LOG.Warn("Unknown type oplogs found. op '%s'", group.op)
+	}
+	return nil
+}
+
 func (exec *Executor) errorIgnore(err error) bool {
 	switch e := err.(type) {
 	case *mgo.LastError:
@@ -0,0 +1,328 @@
+package executor
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/oplog"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// the timestamp of the last applied oplog of each replayer is stored in
+	// the target with document {_id: replayer id, ts: timestamp}
+	AppliedCollectionSuffix = "_applied"
+	AppliedTs               = "ts"
+
+	// transactions are supported since 4.0
+	TransactionVersion = "4.0.0"
+
+	errCodeNamespaceExists                    = 48
+	errCodeOperationNotSupportedInTransaction = 263
+)
+
+// AppliedCollection returns the collection of applied timestamps in the
+// database utils.AppDatabase() of target
+func AppliedCollection() string {
+	return conf.Options.ContextStorageCollection + AppliedCollectionSuffix
+}
+
+// LoadAppliedTs returns the applied timestamp of each replayer stored in the
+// target
+func LoadAppliedTs(session *mgo.Session) (map[uint32]bson.MongoTimestamp, error) {
+	var docs []struct {
+		Id uint32              `bson:"_id"`
+		Ts bson.MongoTimestamp `bson:"ts"`
+	}
+	if err := session.DB(utils.AppDatabase()).C(AppliedCollection()).Find(bson.M{}).All(&docs); err != nil {
+		return nil, err
+	}
+	appliedMap := make(map[uint32]bson.MongoTimestamp, len(docs))
+	for _, doc := range docs {
+		appliedMap[doc.Id] = doc.Ts
+	}
+	return appliedMap, nil
+}
+
+// transaction runs the commands of one executor in a multi-document
+// transaction of the logical session lsid
+type transaction struct {
+	session   *mgo.Session
+	lsid      bson.M
+	txnNumber int64
+	started   bool
+}
+
+func newTransaction(session *mgo.Session) (*transaction, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	// uuid version 4
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	if conf.Options.ReplayerLoopPrevention {
+		// the oplogs written in the session are dropped by the peer collector
+		copy(id, utils.LoopMarker)
+	}
+	return &transaction{session: session, lsid: bson.M{"id": bson.Binary{Kind: 0x04, Data: id}}}, nil
+}
+
+func (txn *transaction) begin() {
+	txn.txnNumber++
+	txn.started = false
+}
+
+// run executes the write command in the transaction
+func (txn *transaction) run(database string, cmd bson.D) error {
+	cmd = append(cmd, bson.DocElem{"lsid", txn.lsid}, bson.DocElem{"txnNumber", txn.txnNumber},
+		bson.DocElem{"autocommit", false})
+	if !txn.started {
+		cmd = append(cmd, bson.DocElem{"startTransaction", true})
+		txn.started = true
+	}
+	return txn.command(database, cmd)
+}
+
+// retryable executes the write command as a retryable write of the session
+// out of transaction, so each oplog of it is marked by lsid
+func (txn *transaction) retryable(database string, cmd bson.D) error {
+	txn.txnNumber++
+	return txn.command(database, append(cmd, bson.DocElem{"lsid", txn.lsid},
+		bson.DocElem{"txnNumber", txn.txnNumber}))
+}
+
+// command returns the write errors as *mgo.LastError so mgo.IsDup works
+func (txn *transaction) command(database string, cmd bson.D) error {
+	var result struct {
+		WriteErrors []struct {
+			Code   int    `bson:"code"`
+			ErrMsg string `bson:"errmsg"`
+		} `bson:"writeErrors"`
+	}
+	if err := txn.session.DB(database).Run(cmd, &result); err != nil {
+		return err
+	}
+	if len(result.WriteErrors) != 0 {
+		return &mgo.LastError{Code: result.WriteErrors[0].Code, Err: result.WriteErrors[0].ErrMsg}
+	}
+	return nil
+}
+
+func (txn *transaction) commit() error {
+	return txn.session.DB("admin").Run(bson.D{{"commitTransaction", 1}, {"lsid", txn.lsid},
+		{"txnNumber", txn.txnNumber}, {"autocommit", false},
+		{"writeConcern", bson.M{"w": utils.MajorityWriteConcern}}}, nil)
+}
+
+func (txn *transaction) abort() {
+	if !txn.started {
+		return
+	}
+	if err := txn.session.DB("admin").Run(bson.D{{"abortTransaction", 1}, {"lsid", txn.lsid},
+		{"txnNumber", txn.txnNumber}, {"autocommit", false}}, nil); err != nil {
+		LOG.Warn("abort transaction[%v] failed. %v", txn.txnNumber, err)
+	}
+}
+
+// ensureApplied loads the applied timestamp of the replayer once
+func (exec *Executor) ensureApplied() error {
+	if exec.txn != nil {
+		// the session is changed after reconnecting
+		exec.txn.session = exec.session
+		return nil
+	}
+	appliedMap, err := LoadAppliedTs(exec.session)
+	if err != nil {
+		return fmt.Errorf("load applied timestamp failed. %v", err)
+	}
+	if err := exec.ensureCollection(utils.AppDatabase(), AppliedCollection()); err != nil {
+		return err
+	}
+	txn, err := newTransaction(exec.session)
+	if err != nil {
+		return err
+	}
+	exec.appliedTs = appliedMap[exec.batchExecutor.ReplayerId]
+	exec.txn = txn
+	LOG.Info("Replayer-%d executor-%d applied timestamp %v", exec.batchExecutor.ReplayerId, exec.id,
+		utils.TimestampToLog(exec.appliedTs))
+	return nil
+}
+
+// ensureCollection creates the collection, which can't be created implicitly
+// by the writes in transaction
+func (exec *Executor) ensureCollection(database, collection string) error {
+	ns := database + "." + collection
+	if exec.namespaces[ns] {
+		return nil
+	}
+	err := exec.session.DB(database).C(collection).Create(&mgo.CollectionInfo{})
+	if e, ok := err.(*mgo.QueryError); err != nil && (!ok || e.Code != errCodeNamespaceExists) {
+		return fmt.Errorf("create collection %v failed. %v", ns, err)
+	}
+	exec.namespaces[ns] = true
+	return nil
+}
+
+// executeExactlyOnce skips the oplogs applied before, and writes the group
+// with the applied timestamp in a transaction. The commands can't run in
+// transaction, so they are written before the timestamp
+func (exec *Executor) executeExactlyOnce(dbWriter BasicWriter, dc []string, group *OplogsGroup,
+	metadata bson.M) error {
+	if err := exec.ensureApplied(); err != nil {
+		return err
+	}
+	records := group.oplogRecords
+	for len(records) != 0 && records[0].original.partialLog.Timestamp <= exec.appliedTs {
+		records = records[1:]
+	}
+	if len(records) == 0 {
+		LOG.Debug("Replay-%d skip applied oplogs of ns [%s] with command [%s]",
+			exec.batchExecutor.ReplayerId, group.ns, strings.ToUpper(lookupOpName(group.op)))
+		return nil
+	}
+	group.oplogRecords = records
+	lastTs := records[len(records)-1].original.partialLog.Timestamp
+
+	switch group.op {
+	case "i", "u", "d":
+		err := exec.writeInTransaction(dc[0], dc[1], buildTransactionCommand(dc[1], group), lastTs)
+		if err != nil && mgo.IsDup(err) && group.op == "i" {
+			// resolve the duplicated _id by the policy in a new transaction
+			policy := exec.batchExecutor.conflict.Lookup(group.ns)
+			LOG.Warn("Replay-%d oplog collection ns [%s] duplicated in transaction, write again by policy %v. %v",
+				exec.batchExecutor.ReplayerId, group.ns, policy, err)
+			var cmd bson.D
+			if cmd, err = buildResolvedInsertCommand(dc[1], group, policy); err == nil {
+				err = exec.writeInTransaction(dc[0], dc[1], cmd, lastTs)
+			}
+		}
+		if err == nil {
+			exec.appliedTs = lastTs
+			return nil
+		}
+		if e, ok := err.(*mgo.QueryError); ok && e.Code == errCodeOperationNotSupportedInTransaction {
+			// the collection is dropped, create it again on retry
+			delete(exec.namespaces, group.ns)
+		}
+		if mgo.IsDup(err) {
+			// duplicated unique index can't be resolved in transaction, fail
+			// the group rather than write it twice
+			return fmt.Errorf("duplicated key of ns %v can't be resolved in transaction. %v", group.ns, err)
+		}
+		// the result of commit is unknown, reload the applied timestamp
+		exec.txn = nil
+		return err
+	case "c":
+		if err := exec.write(dbWriter, dc, group, metadata); err != nil {
+			return err
+		}
+	default:
+		return exec.write(dbWriter, dc, group, metadata)
+	}
+	if err := exec.saveApplied(lastTs); err != nil {
+		return err
+	}
+	exec.appliedTs = lastTs
+	return nil
+}
+
+// writeInTransaction runs the write command with the update of applied
+// timestamp in a transaction
+func (exec *Executor) writeInTransaction(database, collection string, cmd bson.D,
+	lastTs bson.MongoTimestamp) error {
+	if err := exec.ensureCollection(database, collection); err != nil {
+		return err
+	}
+	exec.txn.begin()
+	if err := exec.txn.run(database, cmd); err != nil {
+		exec.txn.abort()
+		return err
+	}
+	if err := exec.txn.run(utils.AppDatabase(), bson.D{{"update", AppliedCollection()},
+		{"updates", []bson.M{appliedUpdate(exec.batchExecutor.ReplayerId, lastTs)}}}); err != nil {
+		exec.txn.abort()
+		return err
+	}
+	return exec.txn.commit()
+}
+
+func (exec *Executor) saveApplied(ts bson.MongoTimestamp) error {
+	update := appliedUpdate(exec.batchExecutor.ReplayerId, ts)
+	_, err := exec.session.DB(utils.AppDatabase()).C(AppliedCollection()).Upsert(update["q"], update["u"])
+	return err
+}
+
+func appliedUpdate(replayerId uint32, ts bson.MongoTimestamp) bson.M {
+	return bson.M{
+		"q":      bson.M{"_id": replayerId},
+		"u":      bson.M{"$set": bson.M{AppliedTs: ts}},
+		"upsert": true,
+	}
+}
+
+// buildTransactionCommand converts the group to a write command of
+// transaction or retryable write. The duplicated insert fails the command,
+// which is written again by buildResolvedInsertCommand in transaction, or
+// as usual in retryable write
+func buildTransactionCommand(collection string, group *OplogsGroup) bson.D {
+	switch group.op {
+	case "i":
+		var inserts []bson.D
+		for _, log := range group.oplogRecords {
+			inserts = append(inserts, log.original.partialLog.Object)
+		}
+		return bson.D{{"insert", collection}, {"documents", inserts}}
+	case "u":
+		var updates []bson.M
+		for _, log := range group.oplogRecords {
+			updates = append(updates, bson.M{
+				"q":      log.original.partialLog.Query,
+				"u":      oplog.RemoveFiled(log.original.partialLog.Object, oplog.VersionMark),
+				"upsert": conf.Options.ReplayerExecutorUpsert,
+			})
+		}
+		return bson.D{{"update", collection}, {"updates", updates}}
+	default:
+		var deletes []bson.M
+		for _, log := range group.oplogRecords {
+			// the oplog of delete removes one document by _id, and limit 0 isn't
+			// allowed in retryable write
+			deletes = append(deletes, bson.M{"q": log.original.partialLog.Object, "limit": 1})
+		}
+		return bson.D{{"delete", collection}, {"deletes", deletes}}
+	}
+}
+
+// buildResolvedInsertCommand converts the inserts of group to upserts by _id,
+// so the duplicated _id is resolved by the policy in the same transaction of
+// the applied timestamp. The source replaces the target if it wins,
+// otherwise the document is only inserted if it doesn't exist
+func buildResolvedInsertCommand(collection string, group *OplogsGroup, policy *ConflictPolicy) (bson.D, error) {
+	var updates []bson.M
+	for _, log := range group.oplogRecords {
+		object := log.original.partialLog.Object
+		var update interface{}
+		switch policy.Name {
+		case ConflictSourceWins:
+			update = object
+		case ConflictTargetWins:
+			update = bson.M{"$setOnInsert": object}
+		default:
+			return nil, fmt.Errorf("conflict policy %v isn't supported with replayer.exactly_once", policy)
+		}
+		updates = append(updates, bson.M{
+			"q":      bson.M{"_id": oplog.GetKey(object, "")},
+			"u":      update,
+			"upsert": true,
+		})
+	}
+	return bson.D{{"update", collection}, {"updates", updates}}, nil
+}
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"mongoshake/common"
@@ -31,6 +32,9 @@ var MasterPromotionNotifier chan bool
 var electionObjectId bson.ObjectId
 var master bool
 
+// set to 1 once the master is released, no more election is joined
+var released int32
+
 func init() {
 	MasterPromotionNotifier = make(chan bool, 1)
 }
@@ -96,6 +100,10 @@ func BecomeMaster(uri string, db string) error {
 				if status == STATUS_LOOKASIDE || status == STATUS_MASTER {
 					wait(HeartBeatPeriod)
 				}
+				if atomic.LoadInt32(&released) == 1 {
+					session.Close()
+					return nil
+				}
 
 				switch status {
 				case STATUS_LOOKASIDE:
@@ -163,6 +171,27 @@ func BecomeMaster(uri string, db string) error {
 	return fmt.Errorf("unreachable master election mongo %s", uri)
 }
 
+// ReleaseMaster quits the election and removes the election info if this
+// node is the master, so another node becomes the master without waiting
+// for the heartbeat timeout
+func ReleaseMaster(uri string, db string) error {
+	atomic.StoreInt32(&released, 1)
+	masterChanged(DescendMaster)
+
+	conn, err := makeSession(uri)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Session.DB(db).C(QUORUM_COLLECTION).Remove(bson.M{"_id": electionObjectId,
+		"pid": os.Getpid(), "host": getNetAddr()})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	LOG.Info("Release the master with election id %v", electionObjectId.Hex())
+	return nil
+}
+
 func competeMaster(coll *mgo.Collection) bool {
 	master := promotion()
 	if err := coll.Insert(master); err == nil {
@@ -0,0 +1,117 @@
+package replayer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mongoshake/common"
+
+	"github.com/vinllen/mgo"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	StorageTypeFile = "file"
+	StorageTypeDB   = "database"
+
+	// file name is prefix + shard, e.g. "ack.3"
+	ackFilePrefix = "ack."
+)
+
+// AckCheckpoint persists the acked offset of each shard, which is the
+// TMessage.Shard received by the replayer
+type AckCheckpoint interface {
+	// Load returns the offset of shard, 0 if not exists
+	Load(shard uint32) (int64, error)
+	Save(shard uint32, ack int64) error
+}
+
+// FileCheckpoint stores the offset of each shard in a separate file of
+// folder, so the replayers never write the same file
+type FileCheckpoint struct {
+	folder string
+}
+
+func NewFileCheckpoint(folder string) (*FileCheckpoint, error) {
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &FileCheckpoint{folder: folder}, nil
+}
+
+func (ckpt *FileCheckpoint) path(shard uint32) string {
+	return filepath.Join(ckpt.folder, fmt.Sprintf("%s%d", ackFilePrefix, shard))
+}
+
+func (ckpt *FileCheckpoint) Load(shard uint32) (int64, error) {
+	data, err := ioutil.ReadFile(ckpt.path(shard))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Save writes a temporary file and renames it, so the offset is either the
+// old or the new one after crash
+func (ckpt *FileCheckpoint) Save(shard uint32, ack int64) error {
+	path := ckpt.path(shard)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(strconv.FormatInt(ack, 10)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// MongoCheckpoint stores the offsets in collection with document
+// {_id: shard, ack: offset}
+type MongoCheckpoint struct {
+	conn       *utils.MongoConn
+	db         string
+	collection string
+}
+
+func NewMongoCheckpoint(url, db, collection string) (*MongoCheckpoint, error) {
+	conn, err := utils.NewMongoConn(url, utils.ConnectModePrimary, true)
+	if err != nil {
+		return nil, err
+	}
+	// the offset is read from primary after failover
+	conn.Session.EnsureSafe(&mgo.Safe{WMode: utils.MajorityWriteConcern})
+	return &MongoCheckpoint{conn: conn, db: db, collection: collection}, nil
+}
+
+func (ckpt *MongoCheckpoint) Load(shard uint32) (int64, error) {
+	var doc struct {
+		Ack int64 `bson:"ack"`
+	}
+	err := ckpt.conn.Session.DB(ckpt.db).C(ckpt.collection).FindId(shard).One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return doc.Ack, nil
+}
+
+func (ckpt *MongoCheckpoint) Save(shard uint32, ack int64) error {
+	_, err := ckpt.conn.Session.DB(ckpt.db).C(ckpt.collection).UpsertId(shard, bson.M{"$set": bson.M{"ack": ack}})
+	return err
+}
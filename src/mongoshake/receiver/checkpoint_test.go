@@ -0,0 +1,63 @@
+package replayer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"mongoshake/oplog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinllen/mgo/bson"
+)
+
+func TestFileCheckpoint(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestFileCheckpoint case %d.\n", nr)
+		nr++
+
+		dir, err := ioutil.TempDir("", "receiver")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.RemoveAll(dir)
+
+		ckpt, err := NewFileCheckpoint(dir)
+		assert.Equal(t, nil, err, "should be equal")
+		ack, err := ckpt.Load(1)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(0), ack, "should be equal")
+
+		assert.Equal(t, nil, ckpt.Save(1, 100), "should be equal")
+		assert.Equal(t, nil, ckpt.Save(1, 200), "should be equal")
+		assert.Equal(t, nil, ckpt.Save(2, 150), "should be equal")
+		ack, err = ckpt.Load(1)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(200), ack, "should be equal")
+
+		ack, retransmit := resume(ckpt, 2)
+		assert.Equal(t, int64(150), ack, "should be equal")
+		assert.Equal(t, true, retransmit, "should be equal")
+		ack, retransmit = resume(ckpt, 3)
+		assert.Equal(t, int64(0), ack, "should be equal")
+		assert.Equal(t, false, retransmit, "should be equal")
+	}
+}
+
+func TestSkipApplied(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestSkipApplied case %d.\n", nr)
+		nr++
+
+		oplogs := []*oplog.PartialLog{
+			{Timestamp: bson.MongoTimestamp(10)},
+			{Timestamp: bson.MongoTimestamp(20)},
+			{Timestamp: bson.MongoTimestamp(30)},
+		}
+		assert.Equal(t, oplogs, skipApplied(oplogs, 0), "should be equal")
+		assert.Equal(t, oplogs[1:], skipApplied(oplogs, 10), "should be equal")
+		assert.Equal(t, oplogs[2:], skipApplied(oplogs, 25), "should be equal")
+		assert.Equal(t, 0, len(skipApplied(oplogs, 30)), "should be equal")
+	}
+}
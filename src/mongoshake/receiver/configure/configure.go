@@ -3,12 +3,34 @@ package conf
 type Configuration struct {
 	Tunnel        string `config:"tunnel"`
 	TunnelAddress string `config:"tunnel.address"`
+	TunnelGroup   string `config:"tunnel.kafka.group"`
 	SystemProfile int    `config:"system_profile"`
 	LogDirectory  string `config:"log.dir"`
 	LogLevel      string `config:"log.level"`
 	LogFileName   string `config:"log.file"`
 	LogBuffer     bool   `config:"log.buffer"`
 	ReplayerNum   int    `config:"replayer"`
+
+	// persist the ack of replayers if the storage is given
+	ContextStorage           string `config:"context.storage"`
+	ContextStorageUrl        string `config:"context.storage.url"`
+	ContextStorageDB         string `config:"context.storage.db"`
+	ContextStorageCollection string `config:"context.storage.collection"`
+
+	// write to MongoDB if the url is given
+	ReplayerMongoUrl                  string `config:"replayer.mongo_url"`
+	ReplayerExecutor                  int    `config:"replayer.executor"`
+	ReplayerExecutorUpsert            bool   `config:"replayer.executor.upsert"`
+	ReplayerExecutorInsertOnDupUpdate bool   `config:"replayer.executor.insert_on_dup_update"`
+	ReplayerConflictWriteTo           string `config:"replayer.conflict_write_to"`
+
+	ReplayerConflictPolicy          string   `config:"replayer.conflict_policy"`
+	ReplayerConflictPolicyNamespace []string `config:"replayer.conflict_policy.namespace"`
+
+	TransformNamespace     []string `config:"transform.namespace"`
+	TransformField         []string `config:"transform.field"`
+	TransformFieldHashSalt string   `config:"transform.field.hash_salt"`
+	DBRef                  bool     `config:"dbref"`
 }
 
 var Options Configuration
@@ -9,7 +9,9 @@ import (
 	"errors"
 	"strconv"
 
+	collectorConf "mongoshake/collector/configure"
 	"mongoshake/common"
+	"mongoshake/executor"
 	"mongoshake/receiver/configure"
 	"mongoshake/tunnel"
 	"mongoshake/receiver"
@@ -55,6 +57,7 @@ func main() {
 		crash(fmt.Sprintf("initial log.dir[%v] log.name[%v] failed[%v].", conf.Options.LogDirectory,
 			conf.Options.LogFileName, err), -2)
 	}
+	utils.InitPrometheus()
 	nimo.Profiling(int(conf.Options.SystemProfile))
 	signalProfile, _ := strconv.Atoi(utils.SIGNALPROFILE)
 	signalStack, _ := strconv.Atoi(utils.SIGNALSTACK)
@@ -78,25 +81,110 @@ func sanitizeOptions() error {
 	if len(conf.Options.TunnelAddress) == 0 {
 		return errors.New("tunnel address is illegal")
 	}
+	// the partitions of kafka are merged into the replayers, so the acks of
+	// replayers aren't in order. The offsets committed after apply are used
+	if conf.Options.Tunnel == "kafka" && conf.Options.ContextStorage != "" {
+		return errors.New("context storage isn't supported with kafka tunnel, the committed offsets are used")
+	}
+	switch conf.Options.ContextStorage {
+	case "":
+	case replayer.StorageTypeFile:
+		if conf.Options.ContextStorageUrl == "" {
+			return errors.New("context storage url should be the folder of checkpoint")
+		}
+	case replayer.StorageTypeDB:
+		if conf.Options.ContextStorageUrl == "" {
+			return errors.New("context storage url should be the mongodb of checkpoint")
+		}
+		if conf.Options.ContextStorageDB == "" {
+			conf.Options.ContextStorageDB = "mongoshake"
+		}
+		if conf.Options.ContextStorageCollection == "" {
+			conf.Options.ContextStorageCollection = "receiver_ckpt"
+		}
+	default:
+		return fmt.Errorf("unknown context storage[%v]", conf.Options.ContextStorage)
+	}
+	if conf.Options.ReplayerMongoUrl != "" {
+		if conf.Options.ReplayerExecutor <= 0 {
+			conf.Options.ReplayerExecutor = 1
+		}
+		if conf.Options.ReplayerConflictWriteTo == "" {
+			conf.Options.ReplayerConflictWriteTo = executor.NoDumpConflict
+		}
+		if conf.Options.ReplayerConflictWriteTo != executor.DumpConflictToDB &&
+			conf.Options.ReplayerConflictWriteTo != executor.DumpConflictToSDK &&
+			conf.Options.ReplayerConflictWriteTo != executor.NoDumpConflict {
+			return errors.New("collision write strategy is neither db nor sdk nor none")
+		}
+		if conf.Options.ReplayerConflictPolicy != "" {
+			if _, err := executor.NewConflictResolver(conf.Options.ReplayerConflictPolicy,
+				conf.Options.ReplayerConflictPolicyNamespace, nil); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// configureExecutor passes the replayer options to the executor, which is
+// configured by the options of collector
+func configureExecutor() {
+	collectorConf.Options.ReplayerDurable = true
+	collectorConf.Options.ReplayerExecutor = conf.Options.ReplayerExecutor
+	collectorConf.Options.ReplayerCollisionEnable = conf.Options.ReplayerExecutor != 1
+	collectorConf.Options.ReplayerExecutorUpsert = conf.Options.ReplayerExecutorUpsert
+	collectorConf.Options.ReplayerExecutorInsertOnDupUpdate = conf.Options.ReplayerExecutorInsertOnDupUpdate
+	collectorConf.Options.ReplayerConflictWriteTo = conf.Options.ReplayerConflictWriteTo
+	collectorConf.Options.ReplayerConflictPolicy = conf.Options.ReplayerConflictPolicy
+	collectorConf.Options.ReplayerConflictPolicyNamespace = conf.Options.ReplayerConflictPolicyNamespace
+	collectorConf.Options.TransformNamespace = conf.Options.TransformNamespace
+	collectorConf.Options.TransformField = conf.Options.TransformField
+	collectorConf.Options.TransformFieldHashSalt = conf.Options.TransformFieldHashSalt
+	collectorConf.Options.DBRef = conf.Options.DBRef
+}
+
 // this is the main connector function
 func startup() {
-	factory := tunnel.ReaderFactory{Name: conf.Options.Tunnel}
+	factory := tunnel.ReaderFactory{Name: conf.Options.Tunnel, KafkaGroup: conf.Options.TunnelGroup}
 	reader := factory.Create(conf.Options.TunnelAddress)
 	if reader == nil {
 		return
 	}
 
+	var checkpoint replayer.AckCheckpoint
+	var err error
+	switch conf.Options.ContextStorage {
+	case replayer.StorageTypeFile:
+		checkpoint, err = replayer.NewFileCheckpoint(conf.Options.ContextStorageUrl)
+	case replayer.StorageTypeDB:
+		checkpoint, err = replayer.NewMongoCheckpoint(conf.Options.ContextStorageUrl,
+			conf.Options.ContextStorageDB, conf.Options.ContextStorageCollection)
+	}
+	if err != nil {
+		LOG.Critical("Replayer create checkpoint on %s failed. %v", conf.Options.ContextStorageUrl, err)
+		return
+	}
+
 	/*
 	 * create re-players, the number of re-players number is equal to the
 	 * collector worker number to fulfill load balance. The tunnel that message
 	 * sent to is determined in the collector side: `TMessage.Shard`.
 	 */
 	repList := make([]tunnel.Replayer, conf.Options.ReplayerNum)
-	for i := range repList {
-		repList[i] = replayer.NewExampleReplayer(i)
+	if conf.Options.ReplayerMongoUrl != "" {
+		if _, err := utils.NewMongoConn(conf.Options.ReplayerMongoUrl, utils.ConnectModePrimary, true); err != nil {
+			LOG.Critical("target mongo server[%s] connect failed: %s", conf.Options.ReplayerMongoUrl, err.Error())
+			return
+		}
+		configureExecutor()
+		for i := range repList {
+			repList[i] = replayer.NewMongoReplayer(i, conf.Options.ReplayerMongoUrl, checkpoint)
+		}
+	} else {
+		for i := range repList {
+			repList[i] = replayer.NewExampleReplayer(i, checkpoint)
+		}
 	}
 
 	LOG.Info("receiver is starting...")
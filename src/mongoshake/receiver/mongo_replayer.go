@@ -0,0 +1,120 @@
+package replayer
+
+import (
+	"sync/atomic"
+
+	"mongoshake/common"
+	"mongoshake/executor"
+	"mongoshake/tunnel"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo"
+)
+
+// MongoReplayer applies the oplogs of tunnel messages to the target MongoDB
+// by executor.BatchGroupExecutor. The executor is configured by the options
+// of collector, include collision detection, namespace transform and
+// conflict dumping
+type MongoReplayer struct {
+	Retransmit bool  // need re-transmit
+	Ack        int64 // ack number, the timestamp of last durable oplog
+
+	// pending queue, use to pass message
+	pendingQueue chan *MessageWithCallback
+
+	// persist the ack, nil if it's only in memory
+	checkpoint AckCheckpoint
+
+	// source replset of the messages
+	replset sourceReplset
+
+	batchExecutor *executor.BatchGroupExecutor
+
+	id int // current replayer id
+}
+
+func NewMongoReplayer(id int, mongoUrl string, checkpoint AckCheckpoint) *MongoReplayer {
+	LOG.Info("MongoReplayer-%d start. target %s, pending queue capacity %d", id, mongoUrl, PendingQueueCapacity)
+	mr := &MongoReplayer{
+		pendingQueue: make(chan *MessageWithCallback, PendingQueueCapacity),
+		checkpoint:   checkpoint,
+		id:           id,
+	}
+	mr.Ack, mr.Retransmit = resume(checkpoint, id)
+	registerPrometheus(id, mr.pendingQueue, mr.GetAcked, mr.replset.get)
+	// the oplogs are acked only if they are written to the majority
+	// with journal, so they won't be rolled back in the target
+	mr.batchExecutor = &executor.BatchGroupExecutor{
+		ReplayerId: uint32(id),
+		MongoUrl:   mongoUrl,
+		Safe:       &mgo.Safe{WMode: utils.MajorityWriteConcern, J: true},
+	}
+	mr.batchExecutor.Start()
+	go mr.handler()
+	return mr
+}
+
+func (mr *MongoReplayer) Sync(message *tunnel.TMessage, completion func()) int64 {
+	// tell collector we need re-trans all unacked oplogs first
+	if mr.Retransmit {
+		// reject normal oplogs request
+		if message.Tag&tunnel.MsgRetransmission == 0 {
+			return tunnel.ReplyRetransmission
+		}
+		mr.Retransmit = false
+	}
+
+	if code := decode(message); code != tunnel.ReplyOK {
+		mr.Retransmit = true
+		return code
+	}
+	mr.replset.set(message)
+
+	mr.pendingQueue <- &MessageWithCallback{message: message, completion: completion}
+	return mr.GetAcked()
+}
+
+func (mr *MongoReplayer) GetAcked() int64 {
+	return atomic.LoadInt64(&mr.Ack)
+}
+
+func (mr *MongoReplayer) handler() {
+	for msg := range mr.pendingQueue {
+		if len(msg.message.RawLogs) == 0 {
+			// probe request
+			if callback := msg.completion; callback != nil {
+				callback()
+			}
+			continue
+		}
+
+		oplogs := parseOplogs(msg.message)
+		if mr.checkpoint != nil {
+			oplogs = skipApplied(oplogs, mr.GetAcked())
+		}
+		if len(oplogs) == 0 {
+			// all applied before restart
+			if callback := msg.completion; callback != nil {
+				callback()
+			}
+			continue
+		}
+
+		// Sync returns after all the oplogs are written, the failed
+		// writes are retried inside
+		mr.batchExecutor.Sync(oplogs, nil)
+
+		if callback := msg.completion; callback != nil {
+			callback()
+		}
+
+		// the ack never moves backward, the oplogs retransmitted may be older
+		lastTs := utils.TimestampToInt64(oplogs[len(oplogs)-1].Timestamp)
+		if lastTs <= mr.GetAcked() {
+			continue
+		}
+		atomic.StoreInt64(&mr.Ack, lastTs)
+		saveAck(mr.checkpoint, mr.id, lastTs)
+		LOG.Debug("MongoReplayer-%d handle ack[%v]", mr.id, lastTs)
+	}
+}
@@ -1,6 +1,9 @@
 package replayer
 
 import (
+	"fmt"
+	"sync/atomic"
+
 	"mongoshake/common"
 	"mongoshake/modules"
 	"mongoshake/oplog"
@@ -18,13 +21,15 @@ type ExampleReplayer struct {
 	Retransmit bool  // need re-transmit
 	Ack        int64 // ack number
 
-	// current compressor construct by TMessage
-	// Compress field specific
-	compressor module.Compress
-
 	// pending queue, use to pass message
 	pendingQueue chan *MessageWithCallback
 
+	// persist the ack, nil if it's only in memory
+	checkpoint AckCheckpoint
+
+	// source replset of the messages
+	replset sourceReplset
+
 	id int // current replayer id
 }
 
@@ -33,12 +38,15 @@ type MessageWithCallback struct {
 	completion func()
 }
 
-func NewExampleReplayer(id int) *ExampleReplayer {
+func NewExampleReplayer(id int, checkpoint AckCheckpoint) *ExampleReplayer {
 	LOG.Info("ExampleReplayer start. pending queue capacity %d", PendingQueueCapacity)
 	er := &ExampleReplayer{
 		pendingQueue: make(chan *MessageWithCallback, PendingQueueCapacity),
+		checkpoint:   checkpoint,
 		id:           id,
 	}
+	er.Ack, er.Retransmit = resume(checkpoint, id)
+	registerPrometheus(id, er.pendingQueue, er.GetAcked, er.replset.get)
 	go er.handler()
 	return er
 }
@@ -46,9 +54,8 @@ func NewExampleReplayer(id int) *ExampleReplayer {
 /*
  * Receiver message and do the following steps:
  * 1. if we need re-transmit, this log will be discard
- * 2. validate the checksum
- * 3. decompress
- * 4. put message into channel
+ * 2. validate the checksum and decompress
+ * 3. put message into channel
  * Generally speaking, do not modify this function.
  */
 func (er *ExampleReplayer) Sync(message *tunnel.TMessage, completion func()) int64 {
@@ -62,12 +69,73 @@ func (er *ExampleReplayer) Sync(message *tunnel.TMessage, completion func()) int
 		er.Retransmit = false
 	}
 
+	if code := decode(message); code != tunnel.ReplyOK {
+		er.Retransmit = true
+		return code
+	}
+	er.replset.set(message)
+
+	er.pendingQueue <- &MessageWithCallback{message: message, completion: completion}
+	return er.GetAcked()
+}
+
+func (er *ExampleReplayer) GetAcked() int64 {
+	return er.Ack
+}
+
+/*
+ * Users should modify this function according to different demands.
+ */
+func (er *ExampleReplayer) handler() {
+	for msg := range er.pendingQueue {
+		count := uint64(len(msg.message.RawLogs))
+		if count == 0 {
+			// probe request
+			if callback := msg.completion; callback != nil {
+				callback()
+			}
+			continue
+		}
+
+		// parse batched message
+		oplogs := parseOplogs(msg.message)
+		if er.checkpoint != nil {
+			oplogs = skipApplied(oplogs, er.Ack)
+		}
+		for _, log := range oplogs {
+			LOG.Info(log) // just print for test, users can modify to fulfill different needs
+		}
+
+		if callback := msg.completion; callback != nil {
+			callback() // exec callback
+		}
+		if len(oplogs) == 0 {
+			// all applied before restart
+			continue
+		}
+
+		// get the newest timestamp
+		n := len(oplogs)
+		lastTs := utils.TimestampToInt64(oplogs[n-1].Timestamp)
+		if lastTs > er.Ack {
+			er.Ack = lastTs
+			saveAck(er.checkpoint, er.id, lastTs)
+		}
+
+		LOG.Debug("handle ack[%v]", er.Ack)
+
+		// add logical code below
+	}
+}
+
+// decode validates the checksum and decompresses the oplogs of message.
+// ReplyOK is returned if successful, otherwise the reply code to collector
+func decode(message *tunnel.TMessage) int64 {
 	// validate the checksum value
 	if message.Checksum != 0 {
 		recalculated := message.Crc32()
 		if recalculated != message.Checksum {
 			// we need the peer to retransmission the current message
-			er.Retransmit = true
 			LOG.Critical("Tunnel message checksum bad. recalculated is 0x%x. origin is 0x%x", recalculated, message.Checksum)
 			return tunnel.ReplyChecksumInvalid
 		}
@@ -75,72 +143,117 @@ func (er *ExampleReplayer) Sync(message *tunnel.TMessage, completion func()) int
 
 	// decompress
 	if message.Compress != module.NoCompress {
-		// reuse current compressor handle
-		var err error
-		if er.compressor, err = module.GetCompressorById(message.Compress); err != nil {
-			er.Retransmit = true
+		compressor, err := module.GetCompressorById(message.Compress)
+		if err != nil {
 			LOG.Critical("Tunnel message compressor not support. is %d", message.Compress)
 			return tunnel.ReplyCompressorNotSupported
 		}
 		var decompress [][]byte
 		for _, toDecompress := range message.RawLogs {
-			bits, err := er.compressor.Decompress(toDecompress)
+			bits, err := compressor.Decompress(toDecompress)
 			if err == nil {
 				decompress = append(decompress, bits)
 			}
 		}
 		if len(decompress) != len(message.RawLogs) {
-			er.Retransmit = true
 			LOG.Critical("Decompress result isn't equivalent. len(decompress) %d, len(Logs) %d", len(decompress), len(message.RawLogs))
 			return tunnel.ReplyDecompressInvalid
 		}
 
 		message.RawLogs = decompress
 	}
+	return tunnel.ReplyOK
+}
 
-	er.pendingQueue <- &MessageWithCallback{message: message, completion: completion}
-	return er.GetAcked()
+func parseOplogs(message *tunnel.TMessage) []*oplog.PartialLog {
+	oplogs := make([]*oplog.PartialLog, len(message.RawLogs))
+	for i, raw := range message.RawLogs {
+		oplogs[i] = new(oplog.PartialLog)
+		if err := bson.Unmarshal(raw, oplogs[i]); err != nil {
+			// impossible switch, need panic and exit
+			LOG.Crashf("unmarshal oplog[%v] failed[%v]", raw, err)
+		}
+		oplogs[i].RawSize = len(raw)
+	}
+	return oplogs
 }
 
-func (er *ExampleReplayer) GetAcked() int64 {
-	return er.Ack
+// resume loads the ack of replayer from checkpoint. The collector is asked
+// to retransmit the unacked oplogs if the ack exists, because the oplogs in
+// pending queue are lost after restart
+func resume(checkpoint AckCheckpoint, id int) (int64, bool) {
+	if checkpoint == nil {
+		return 0, false
+	}
+	ack, err := checkpoint.Load(uint32(id))
+	if err != nil {
+		LOG.Crashf("replayer-%d load ack from checkpoint failed[%v]", id, err)
+	}
+	if ack != 0 {
+		LOG.Info("replayer-%d resume from ack[%v]", id, utils.TimestampToLog(ack))
+	}
+	return ack, ack != 0
 }
 
-/*
- * Users should modify this function according to different demands.
- */
-func (er *ExampleReplayer) handler() {
-	for msg := range er.pendingQueue {
-		count := uint64(len(msg.message.RawLogs))
-		if count == 0 {
-			// probe request
-			continue
+// skipApplied removes the oplogs which are applied before. The oplogs of a
+// shard are in timestamp order, so only the head of message is removed. It's
+// only used with the persisted ack of rpc and tcp tunnel, since the kafka
+// partitions consumed by a replayer aren't in order
+func skipApplied(oplogs []*oplog.PartialLog, ack int64) []*oplog.PartialLog {
+	for i, log := range oplogs {
+		if utils.TimestampToInt64(log.Timestamp) > ack {
+			return oplogs[i:]
 		}
+	}
+	return nil
+}
 
-		// parse batched message
-		oplogs := make([]*oplog.PartialLog, len(msg.message.RawLogs))
-		for i, raw := range msg.message.RawLogs {
-			oplogs[i] = new(oplog.PartialLog)
-			if err := bson.Unmarshal(raw, oplogs[i]); err != nil {
-				// impossible switch, need panic and exit
-				LOG.Crashf("unmarshal oplog[%v] failed[%v]", raw, err)
-				return
-			}
-			oplogs[i].RawSize = len(raw)
-			LOG.Info(oplogs[i]) // just print for test, users can modify to fulfill different needs
-		}
+func saveAck(checkpoint AckCheckpoint, id int, ack int64) {
+	if checkpoint == nil {
+		return
+	}
+	// not fatal, the oplogs after the saved ack are applied again if the
+	// receiver restarts
+	if err := checkpoint.Save(uint32(id), ack); err != nil {
+		LOG.Warn("replayer-%d save ack[%v] to checkpoint failed[%v]", id, ack, err)
+	}
+}
 
-		if callback := msg.completion; callback != nil {
-			callback() // exec callback
-		}
+// sourceReplset keeps the replset name of the last message received. A
+// replayer receives from one collector worker, which belongs to one replset,
+// unless the workers are more than the replayers
+type sourceReplset struct {
+	value atomic.Value
+}
 
-		// get the newest timestamp
-		n := len(oplogs)
-		lastTs := utils.TimestampToInt64(oplogs[n-1].Timestamp)
-		er.Ack = lastTs
+func (source *sourceReplset) set(message *tunnel.TMessage) {
+	// the collector of older version doesn't send it
+	if message.Replset != "" {
+		source.value.Store(message.Replset)
+	}
+}
 
-		LOG.Debug("handle ack[%v]", er.Ack)
+// get returns empty if no message with replset is received
+func (source *sourceReplset) get() string {
+	replset, _ := source.value.Load().(string)
+	return replset
+}
 
-		// add logical code below
-	}
+// registerPrometheus exposes the depth of pending queue and the ack of the
+// replayer, which is labeled by the source replset and the id of collector
+// worker the same as collector
+func registerPrometheus(id int, pendingQueue chan *MessageWithCallback, getAcked func() int64,
+	getReplset func() string) {
+	worker := fmt.Sprint(id)
+	utils.RegisterPrometheus(func(writer *utils.PrometheusWriter) {
+		writePrometheus(writer, getReplset(), worker, len(pendingQueue), getAcked())
+	})
+}
+
+func writePrometheus(writer *utils.PrometheusWriter, replset, worker string, depth int, ack int64) {
+	labels := []string{"replset", replset, "worker", worker}
+	writer.Add("mongoshake_worker_queue_depth", utils.PrometheusGauge, "Messages pending in replayer.",
+		float64(depth), labels...)
+	writer.Add("mongoshake_worker_ack_seconds", utils.PrometheusGauge, "Timestamp of the last acked oplog.",
+		float64(utils.ExtractTs32(ack)), labels...)
 }
@@ -0,0 +1,36 @@
+package replayer
+
+import (
+	"fmt"
+	"testing"
+
+	"mongoshake/common"
+	"mongoshake/tunnel"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestWritePrometheus case %d.\n", nr)
+		nr++
+
+		var source sourceReplset
+		assert.Equal(t, "", source.get(), "should be equal")
+		source.set(&tunnel.TMessage{Replset: "rs1"})
+		// the message of older collector
+		source.set(&tunnel.TMessage{})
+		assert.Equal(t, "rs1", source.get(), "should be equal")
+
+		writer := utils.NewPrometheusWriter()
+		writePrometheus(writer, source.get(), "2", 3, 100<<32)
+		assert.Equal(t, "# HELP mongoshake_worker_ack_seconds Timestamp of the last acked oplog.\n"+
+			"# TYPE mongoshake_worker_ack_seconds gauge\n"+
+			"mongoshake_worker_ack_seconds{replset=\"rs1\",worker=\"2\"} 100\n"+
+			"# HELP mongoshake_worker_queue_depth Messages pending in replayer.\n"+
+			"# TYPE mongoshake_worker_queue_depth gauge\n"+
+			"mongoshake_worker_queue_depth{replset=\"rs1\",worker=\"2\"} 3\n", string(writer.Bytes()),
+			"should be equal")
+	}
+}
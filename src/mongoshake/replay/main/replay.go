@@ -0,0 +1,206 @@
+// replay the segments of file tunnel into MongoDB, which can be used to do
+// point-in-time restore together with a full backup
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"mongoshake/collector/configure"
+	"mongoshake/common"
+	"mongoshake/executor"
+	"mongoshake/modules"
+	"mongoshake/oplog"
+	"mongoshake/tunnel"
+
+	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+type Exit struct{ Code int }
+
+func main() {
+	var err error
+	defer handleExit()
+	defer LOG.Close()
+
+	// argument options
+	dir := flag.String("dir", "", "folder of file tunnel segments")
+	url := flag.String("url", "", "target mongodb address")
+	from := flag.String("from", "", "replay the oplogs since this time, in "+utils.GolangSecurityTime+" or unix seconds")
+	to := flag.String("to", "", "replay the oplogs until this time (inclusive), in "+utils.GolangSecurityTime+" or unix seconds")
+	parallel := flag.Int("executor", 1, "number of executors")
+	verbose := flag.Bool("verbose", false, "show logs on console")
+	flag.Parse()
+
+	if *dir == "" || *url == "" {
+		fmt.Println(utils.BRANCH)
+		flag.Usage()
+		panic(Exit{0})
+	}
+
+	var beginTs, endTs int64
+	if beginTs, err = parseTimestamp(*from); err != nil {
+		crash(fmt.Sprintf("parse from[%v] failed. %v", *from, err), -1)
+	}
+	if endTs, err = parseTimestamp(*to); err != nil {
+		crash(fmt.Sprintf("parse to[%v] failed. %v", *to, err), -1)
+	}
+	if endTs != 0 && endTs < beginTs {
+		crash(fmt.Sprintf("from[%v] is after to[%v]", *from, *to), -1)
+	}
+
+	if err := utils.InitialLogger("", "replay.log", "info", false, *verbose); err != nil {
+		crash(fmt.Sprintf("initial log failed[%v].", err), -2)
+	}
+
+	conn, err := utils.NewMongoConn(*url, utils.ConnectModePrimary, true)
+	if err != nil {
+		crash(fmt.Sprintf("target mongo server[%s] connect failed: %s", *url, err.Error()), -3)
+	}
+	conn.Close()
+
+	// the executor is configured by the collector options. the oplogs may
+	// have been applied by the full backup already, so replay them in the
+	// idempotent way
+	conf.Options.ReplayerDurable = true
+	conf.Options.ReplayerExecutor = *parallel
+	conf.Options.ReplayerCollisionEnable = *parallel != 1
+	conf.Options.ReplayerExecutorUpsert = true
+	conf.Options.ReplayerExecutorInsertOnDupUpdate = true
+	conf.Options.ReplayerConflictWriteTo = executor.NoDumpConflict
+
+	batchExecutor := &executor.BatchGroupExecutor{MongoUrl: *url}
+	batchExecutor.Start()
+
+	segments, err := tunnel.ListSegments(*dir)
+	if err != nil {
+		crash(fmt.Sprintf("list segments of %s failed. %v", *dir, err), -4)
+	}
+
+	total := 0
+	for _, segment := range segments {
+		n, err := replaySegment(batchExecutor, segment, beginTs, endTs)
+		if err != nil {
+			crash(fmt.Sprintf("replay segment %s failed. %v", segment, err), -5)
+		}
+		total += n
+	}
+	LOG.Info("replay %d segments in %s complete. total oplogs %d", len(segments), *dir, total)
+	fmt.Printf("replay complete. total oplogs %d\n", total)
+}
+
+// parseTimestamp converts the time into mongodb timestamp. 0 is returned
+// if it's empty
+func parseTimestamp(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		t, err := time.Parse(utils.GolangSecurityTime, value)
+		if err != nil {
+			return 0, err
+		}
+		seconds = t.Unix()
+	}
+	if seconds < 0 {
+		return 0, errors.New("timestamp should be positive")
+	}
+	return seconds << 32, nil
+}
+
+// replaySegment applies the oplogs in [beginTs, endTs] of the segment, and
+// returns the number of oplogs applied
+func replaySegment(batchExecutor *executor.BatchGroupExecutor, path string, beginTs, endTs int64) (int, error) {
+	dataFile, err := tunnel.OpenDataFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer dataFile.Close()
+
+	// the range of protocol 1 or empty segment is zero, which can't be skipped
+	header := dataFile.Header()
+	if header.EndTs != 0 && (header.EndTs < beginTs || endTs != 0 && header.BeginTs > endTs) {
+		LOG.Info("skip segment %s with oplogs in [%v, %v]", path,
+			utils.TimestampToLog(header.BeginTs), utils.TimestampToLog(header.EndTs))
+		return 0, nil
+	}
+
+	total := 0
+	for {
+		message, err := dataFile.ReadMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
+
+		logs, err := parseMessage(message)
+		if err != nil {
+			return total, err
+		}
+
+		selected := make([]*oplog.PartialLog, 0, len(logs))
+		for _, log := range logs {
+			ts := utils.TimestampToInt64(log.Timestamp)
+			if ts >= beginTs && (endTs == 0 || ts <= endTs) {
+				selected = append(selected, log)
+			}
+		}
+		batchExecutor.Sync(selected, nil)
+		total += len(selected)
+	}
+
+	LOG.Info("replay segment %s complete. oplogs %d", path, total)
+	return total, nil
+}
+
+// parseMessage decompresses and unmarshals the oplogs in message
+func parseMessage(message *tunnel.TMessage) ([]*oplog.PartialLog, error) {
+	var compressor module.Compress
+	if message.Compress != module.NoCompress {
+		var err error
+		if compressor, err = module.GetCompressorById(message.Compress); err != nil {
+			return nil, err
+		}
+	}
+
+	logs := make([]*oplog.PartialLog, 0, len(message.RawLogs))
+	for _, raw := range message.RawLogs {
+		if compressor != nil {
+			var err error
+			if raw, err = compressor.Decompress(raw); err != nil {
+				return nil, err
+			}
+		}
+
+		log := new(oplog.PartialLog)
+		if err := bson.Unmarshal(raw, log); err != nil {
+			return nil, fmt.Errorf("unmarshal oplog failed[%v]", err)
+		}
+		log.RawSize = len(raw)
+		logs = append(logs, log)
+	}
+	return logs, nil
+}
+
+func crash(msg string, errCode int) {
+	fmt.Println(msg)
+	panic(Exit{errCode})
+}
+
+func handleExit() {
+	if e := recover(); e != nil {
+		if exit, ok := e.(Exit); ok == true {
+			os.Exit(exit.Code)
+		}
+		panic(e)
+	}
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"mongoshake/collector/transform"
 	"mongoshake/executor"
 
 	"github.com/gugemichael/nimo4go"
@@ -9,24 +10,48 @@ import (
 )
 
 type DirectWriter struct {
-	RemoteAddrs   []string
-	ReplayerId    uint32 // equal to worker-id
-	batchExecutor *executor.BatchGroupExecutor
+	RemoteAddrs    []string
+	ReplayerId     uint32 // equal to worker-id
+	ExactlyOnce    bool   // write the oplogs with the applied timestamp in transaction
+	LoopPrevention bool   // mark the writes by session id
+	ReplMetric     *utils.ReplicationMetric
+	DeadLetter     executor.DeadLetterQueue // nil if the failed oplogs are retried forever
+	batchExecutor  *executor.BatchGroupExecutor
 }
 
 func (writer *DirectWriter) Prepare() bool {
 	nimo.AssertTrue(len(writer.RemoteAddrs) > 0, "RemoteAddrs must > 0")
 
 	first := writer.RemoteAddrs[0]
-	if _, err := utils.NewMongoConn(first, utils.ConnectModeSecondaryPreferred, true); err != nil {
+	conn, err := utils.NewMongoConn(first, utils.ConnectModeSecondaryPreferred, true)
+	if err != nil {
 		LOG.Critical("target mongo server[%s] connect failed: %s", first, err.Error())
 		return false
 	}
+	if writer.ExactlyOnce {
+		if ok, err := utils.GetAndCompareVersion(conn.Session, executor.TransactionVersion); !ok {
+			LOG.Critical("target mongo server[%s] doesn't support transaction for exactly once: %v", first, err)
+			conn.Close()
+			return false
+		}
+	}
+	if writer.LoopPrevention {
+		if ok, err := utils.GetAndCompareVersion(conn.Session, executor.RetryableWriteVersion); !ok {
+			LOG.Critical("target mongo server[%s] doesn't support retryable write for loop prevention: %v",
+				first, err)
+			conn.Close()
+			return false
+		}
+	}
+	conn.Close()
 
 	urlChoose := writer.ReplayerId % uint32(len(writer.RemoteAddrs))
 	writer.batchExecutor = &executor.BatchGroupExecutor{
-		ReplayerId: writer.ReplayerId,
-		MongoUrl:   writer.RemoteAddrs[urlChoose],
+		ReplayerId:  writer.ReplayerId,
+		MongoUrl:    writer.RemoteAddrs[urlChoose],
+		ExactlyOnce: writer.ExactlyOnce,
+		ReplMetric:  writer.ReplMetric,
+		DeadLetter:  writer.DeadLetter,
 	}
 	// writer.batchExecutor.RestAPI()
 	writer.batchExecutor.Start()
@@ -38,6 +63,12 @@ func (writer *DirectWriter) Send(message *WMessage) int64 {
 	return 0
 }
 
+// SetNamespaceTransform replaces the namespace transform of executors, it's
+// called when no oplog is in flight
+func (writer *DirectWriter) SetNamespaceTransform(trans *transform.NamespaceTransform) {
+	writer.batchExecutor.NsTrans = trans
+}
+
 func (writer *DirectWriter) AckRequired() bool {
 	return false
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 
@@ -27,24 +28,109 @@ func (tunnel *FileReader) Link(relativeReplayer []Replayer) error {
 		go tunnel.consume(ch)
 	}
 
-	var file *os.File
-	var err error
-	if file, err = os.Open(tunnel.File); err != nil {
-		LOG.Critical("File tunnel reader open %s failed, %v", tunnel.File, err)
+	// File is either a single data file or the folder of segments
+	info, err := os.Stat(tunnel.File)
+	if err != nil {
+		LOG.Critical("File tunnel reader stat %s failed, %v", tunnel.File, err)
 		return err
 	}
-	tunnel.dataFile = &DataFile{filehandle: file}
+	files := []string{tunnel.File}
+	if info.IsDir() {
+		if files, err = ListSegments(tunnel.File); err != nil {
+			LOG.Critical("File tunnel reader list segments of %s failed, %v", tunnel.File, err)
+			return err
+		}
+	}
 
-	if fileHeader := tunnel.dataFile.ReadHeader(); fileHeader.Magic != FILE_MAGIC_NUMBER || fileHeader.Protocol != FILE_PROTOCOL_NUMBER {
-		LOG.Critical("File is not belong to mongoshake. magic header or protocol header is invalid")
-		return errors.New("file magic number or protocol number is invalid")
+	// check all files before reading
+	for _, file := range files {
+		dataFile, err := OpenDataFile(file)
+		if err != nil {
+			LOG.Critical("File tunnel reader open %s failed, %v", file, err)
+			return err
+		}
+		dataFile.Close()
 	}
 
-	go tunnel.read()
+	go tunnel.read(files)
 
 	return nil
 }
 
+// OpenDataFile opens the data file and checks its header. The reading
+// position is after the header
+func OpenDataFile(path string) (*DataFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dataFile := &DataFile{filehandle: file}
+
+	if !dataFile.ReadHeader().Valid() {
+		file.Close()
+		LOG.Critical("File %s is not belong to mongoshake. magic header or protocol header is invalid", path)
+		return nil, errors.New("file magic number or protocol number is invalid")
+	}
+	return dataFile, nil
+}
+
+// Header returns the header read by OpenDataFile
+func (dataFile *DataFile) Header() *FileHeader {
+	return dataFile.header
+}
+
+func (dataFile *DataFile) Close() error {
+	return dataFile.filehandle.Close()
+}
+
+// ReadMessage reads the next oplog block. io.EOF is returned at the end
+// of file
+func (dataFile *DataFile) ReadMessage() (*TMessage, error) {
+	bufferedReader := dataFile.filehandle
+	bits := make([]byte, 4, 4)
+	message := new(TMessage)
+
+	// for checksum multi read() is acceptable, the underlaying reader is Buffered
+	if n, err := io.ReadFull(bufferedReader, bits); n != len(bits) || err != nil {
+		return nil, io.EOF
+	}
+	message.Checksum = binary.BigEndian.Uint32(bits[:])
+	// for tag
+	io.ReadFull(bufferedReader, bits)
+	message.Tag = binary.BigEndian.Uint32(bits[:])
+	// for shard
+	io.ReadFull(bufferedReader, bits)
+	message.Shard = binary.BigEndian.Uint32(bits[:])
+	// for compress
+	io.ReadFull(bufferedReader, bits)
+	message.Compress = binary.BigEndian.Uint32(bits[:])
+	// for 0xeeeeeeee
+	io.ReadFull(bufferedReader, bits)
+	if !bytes.Equal(bits, []byte{0xee, 0xee, 0xee, 0xee}) {
+		LOG.Critical("File oplog block magic is not 0xeeeeeeee. found 0x%x", bits)
+		return nil, fmt.Errorf("oplog block magic is not 0xeeeeeeee. found 0x%x", bits)
+	}
+	io.ReadFull(bufferedReader, bits)
+	blockRemained := binary.BigEndian.Uint32(bits)
+
+	logs := [][]byte{}
+	for blockRemained > 0 {
+		// oplog entry length
+		io.ReadFull(bufferedReader, bits[:])
+		oplogLength := binary.BigEndian.Uint32(bits[:])
+		log := make([]byte, oplogLength, oplogLength)
+		if _, err := io.ReadFull(bufferedReader, log); err == io.EOF {
+			break
+		}
+
+		logs = append(logs, log)
+		// header + body
+		blockRemained -= (4 + oplogLength)
+	}
+	message.RawLogs = logs
+	return message, nil
+}
+
 func (tunnel *FileReader) consume(pipe <-chan *TMessage) {
 	seqKey := 1
 	for msg := range pipe {
@@ -71,54 +157,28 @@ func (tunnel *FileReader) consume(pipe <-chan *TMessage) {
 	}
 }
 
-func (tunnel *FileReader) read() {
-	defer tunnel.dataFile.filehandle.Close()
-
-	bufferedReader := tunnel.dataFile.filehandle
-	bits := make([]byte, 4, 4)
+func (tunnel *FileReader) read(files []string) {
 	totalLogs := 0
-	for {
-		message := new(TMessage)
-
-		// for checksum multi read() is acceptable, the underlaying reader is Buffered
-		if n, err := io.ReadFull(bufferedReader, bits); n != len(bits) || err != nil {
-			break
-		}
-		message.Checksum = binary.BigEndian.Uint32(bits[:])
-		// for tag
-		io.ReadFull(bufferedReader, bits)
-		message.Tag = binary.BigEndian.Uint32(bits[:])
-		// for shard
-		io.ReadFull(bufferedReader, bits)
-		message.Shard = binary.BigEndian.Uint32(bits[:])
-		// for compress
-		io.ReadFull(bufferedReader, bits)
-		message.Compress = binary.BigEndian.Uint32(bits[:])
-		// for 0xeeeeeeee
-		io.ReadFull(bufferedReader, bits)
-		if !bytes.Equal(bits, []byte{0xee, 0xee, 0xee, 0xee}) {
-			LOG.Critical("File oplog block magic is not 0xeeeeeeee. found 0x%x", bits)
+	for _, file := range files {
+		dataFile, err := OpenDataFile(file)
+		if err != nil {
+			LOG.Critical("File tunnel reader open %s failed, %v", file, err)
 			break
 		}
-		io.ReadFull(bufferedReader, bits)
-		blockRemained := binary.BigEndian.Uint32(bits)
-
-		logs := [][]byte{}
-		for blockRemained > 0 {
-			// oplog entry length
-			io.ReadFull(bufferedReader, bits[:])
-			oplogLength := binary.BigEndian.Uint32(bits[:])
-			log := make([]byte, oplogLength, oplogLength)
-			if _, err := io.ReadFull(bufferedReader, log); err == io.EOF {
-				break
-			}
+		totalLogs += tunnel.readDataFile(dataFile)
+		dataFile.Close()
+	}
+	LOG.Info("File tunnel reader complete. total oplogs %d", totalLogs)
+}
 
-			logs = append(logs, log)
-			// header + body
-			blockRemained -= (4 + oplogLength)
-			totalLogs++
+func (tunnel *FileReader) readDataFile(dataFile *DataFile) int {
+	totalLogs := 0
+	for {
+		message, err := dataFile.ReadMessage()
+		if err != nil {
+			break
 		}
-		message.RawLogs = logs
+		totalLogs += len(message.RawLogs)
 
 		if message.Shard < 0 {
 			LOG.Warn("Oplog hashed value is bad negative")
@@ -133,5 +193,5 @@ func (tunnel *FileReader) read() {
 		tunnel.pipe[message.Shard] <- message
 		LOG.Info("File tunnel reader extract oplogs with shard[%d], compressor[%d], count (%d)", message.Shard, message.Compress, len(message.RawLogs))
 	}
-	LOG.Info("File tunnel reader complete. total oplogs %d", totalLogs)
+	return totalLogs
 }
@@ -3,34 +3,49 @@ package tunnel
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"mongoshake/common"
+
 	LOG "github.com/vinllen/log4go"
 )
 
 const (
-	OPEN_FILE_FLAGS = os.O_CREATE | os.O_RDWR | os.O_TRUNC
+	OPEN_FILE_FLAGS = os.O_CREATE | os.O_RDWR | os.O_EXCL
 )
 
 const (
 	FILE_MAGIC_NUMBER    uint64 = 0xeeeeeeeeee201314
-	FILE_PROTOCOL_NUMBER uint32 = 1
+	FILE_PROTOCOL_NUMBER uint32 = 2
+	FILE_HEADER_SIZE            = 32
 	BLOCK_HEADER_SIZE           = 20
+
+	// segment file name is prefix + sequence, e.g. "segment.00000001"
+	FILE_SEGMENT_PREFIX = "segment."
 )
 
 var globalInitializer = int32(0)
-var oplogMessage chan *TMessage
+var oplogMessage chan *WMessage
 
 type FileWriter struct {
-	// local file folder path
+	// local folder path of segments
 	Local string
+	// roll to the next segment if the current one is bigger than
+	// SegmentSize bytes or older than SegmentInterval
+	SegmentSize     int64
+	SegmentInterval time.Duration
 
-	// data file header
-	fileHeader *FileHeader
-	// data file handle
+	// sequence of the current segment
+	sequence uint64
+	// current data file handle, nil if no segment is opened
 	dataFile *DataFile
 
 	logs uint64
@@ -42,37 +57,55 @@ type FileWriter struct {
  *  |----- Header ------|------ OplogBlock ------|------ OplogBlock --------| ......
  *  |<--- 32bytes ---->|
  *
+ *  The header of protocol 2 records the timestamp range of the oplogs in
+ *  this segment. Both are zero if the segment is empty.
  */
 type FileHeader struct {
 	Magic    uint64
 	Protocol uint32
 	Checksum uint32
-	Reserved [16]byte
+	BeginTs  int64
+	EndTs    int64
 }
 
 type DataFile struct {
 	filehandle *os.File
+	header     *FileHeader
+	size       int64
+	created    time.Time
 }
 
 func (dataFile *DataFile) WriteHeader() {
-	fileHeader := new(FileHeader)
-	fileHeader.Magic = FILE_MAGIC_NUMBER
-	fileHeader.Protocol = FILE_PROTOCOL_NUMBER
+	dataFile.rewriteHeader()
+	dataFile.filehandle.Sync()
+	if dataFile.size < FILE_HEADER_SIZE {
+		dataFile.size = FILE_HEADER_SIZE
+		dataFile.filehandle.Seek(FILE_HEADER_SIZE, 0)
+	}
+}
+
+// rewriteHeader writes the header in place without sync, it's called after
+// each block so the range covers the blocks written if the process crashes
+func (dataFile *DataFile) rewriteHeader() {
+	if dataFile.header == nil {
+		dataFile.header = &FileHeader{Magic: FILE_MAGIC_NUMBER, Protocol: FILE_PROTOCOL_NUMBER}
+	}
+	fileHeader := dataFile.header
 
 	buffer := bytes.Buffer{}
 	binary.Write(&buffer, binary.BigEndian, fileHeader.Magic)
 	binary.Write(&buffer, binary.BigEndian, fileHeader.Protocol)
 	binary.Write(&buffer, binary.BigEndian, fileHeader.Checksum)
-	binary.Write(&buffer, binary.BigEndian, fileHeader.Reserved)
+	binary.Write(&buffer, binary.BigEndian, fileHeader.BeginTs)
+	binary.Write(&buffer, binary.BigEndian, fileHeader.EndTs)
 
-	dataFile.filehandle.Write(buffer.Bytes())
-	dataFile.filehandle.Sync()
-	dataFile.filehandle.Seek(32, 0)
+	// header is rewritten in place while the blocks are appended
+	dataFile.filehandle.WriteAt(buffer.Bytes(), 0)
 }
 
 func (dataFile *DataFile) ReadHeader() *FileHeader {
 	fileHeader := &FileHeader{}
-	header := [32]byte{}
+	header := [FILE_HEADER_SIZE]byte{}
 
 	io.ReadFull(dataFile.filehandle, header[:])
 	buffer := bytes.NewBuffer(header[:])
@@ -80,14 +113,23 @@ func (dataFile *DataFile) ReadHeader() *FileHeader {
 	binary.Read(buffer, binary.BigEndian, &fileHeader.Magic)
 	binary.Read(buffer, binary.BigEndian, &fileHeader.Protocol)
 	binary.Read(buffer, binary.BigEndian, &fileHeader.Checksum)
-	binary.Read(buffer, binary.BigEndian, &fileHeader.Reserved)
+	binary.Read(buffer, binary.BigEndian, &fileHeader.BeginTs)
+	binary.Read(buffer, binary.BigEndian, &fileHeader.EndTs)
 
+	dataFile.header = fileHeader
 	return fileHeader
 }
 
+// Valid checks the magic number and protocol. The timestamp range of
+// protocol 1 is always zero
+func (fileHeader *FileHeader) Valid() bool {
+	return fileHeader.Magic == FILE_MAGIC_NUMBER &&
+		(fileHeader.Protocol == 1 || fileHeader.Protocol == FILE_PROTOCOL_NUMBER)
+}
+
 func (tunnel *FileWriter) Send(message *WMessage) int64 {
 	if message.Tag&MsgProbe == 0 {
-		oplogMessage <- message.TMessage
+		oplogMessage <- message
 	}
 	return 0
 }
@@ -98,6 +140,11 @@ func (tunnel *FileWriter) SyncToDisk() {
 	for {
 		select {
 		case message := <-oplogMessage:
+			if tunnel.dataFile == nil && !tunnel.openSegment() {
+				// the message is dropped, and we will retry with the next one
+				continue
+			}
+
 			// oplogs array
 			for _, log := range message.RawLogs {
 				tunnel.logs++
@@ -116,38 +163,131 @@ func (tunnel *FileWriter) SyncToDisk() {
 			binary.Write(headerBuffer, binary.BigEndian, uint32(buffer.Len()))
 			tunnel.dataFile.filehandle.Write(headerBuffer.Bytes())
 			tunnel.dataFile.filehandle.Write(buffer.Bytes())
+			tunnel.dataFile.size += int64(headerBuffer.Len() + buffer.Len())
 			buffer.Reset()
+
+			tunnel.updateRange(message)
+			if tunnel.segmentFull() {
+				tunnel.closeSegment()
+			} else {
+				tunnel.dataFile.rewriteHeader()
+			}
 		case <-time.After(time.Millisecond * 1000):
 			LOG.Info("File tunnel sync flush. total oplogs %d", tunnel.logs)
-			tunnel.dataFile.filehandle.Sync()
+			if tunnel.dataFile == nil {
+				continue
+			}
+			if tunnel.segmentFull() {
+				tunnel.closeSegment()
+			} else {
+				tunnel.dataFile.WriteHeader()
+			}
 		}
 	}
 }
 
+// updateRange extends the timestamp range in segment header with the
+// oplogs of message. Oplogs from different workers are interleaved, so
+// the range is the min and max of all timestamps
+func (tunnel *FileWriter) updateRange(message *WMessage) {
+	header := tunnel.dataFile.header
+	for _, log := range message.ParsedLogs {
+		ts := utils.TimestampToInt64(log.Timestamp)
+		if header.BeginTs == 0 || ts < header.BeginTs {
+			header.BeginTs = ts
+		}
+		if ts > header.EndTs {
+			header.EndTs = ts
+		}
+	}
+}
+
+func (tunnel *FileWriter) segmentFull() bool {
+	return tunnel.dataFile.size >= tunnel.SegmentSize ||
+		time.Since(tunnel.dataFile.created) >= tunnel.SegmentInterval
+}
+
+func (tunnel *FileWriter) openSegment() bool {
+	tunnel.sequence++
+	path := filepath.Join(tunnel.Local, SegmentFileName(tunnel.sequence))
+	file, ok := _Open(path)
+	if !ok {
+		return false
+	}
+
+	tunnel.dataFile = &DataFile{filehandle: file, created: time.Now()}
+	tunnel.dataFile.WriteHeader()
+	LOG.Info("File tunnel open segment %s", path)
+	return true
+}
+
+func (tunnel *FileWriter) closeSegment() {
+	tunnel.dataFile.WriteHeader()
+	tunnel.dataFile.filehandle.Close()
+	LOG.Info("File tunnel close segment %s with oplogs in [%v, %v]", tunnel.dataFile.filehandle.Name(),
+		utils.TimestampToLog(tunnel.dataFile.header.BeginTs), utils.TimestampToLog(tunnel.dataFile.header.EndTs))
+	tunnel.dataFile = nil
+}
+
 func _Open(path string) (*os.File, bool) {
-	if file, err := os.OpenFile(path, OPEN_FILE_FLAGS, os.ModePerm); err == nil {
-		return file, true
+	file, err := os.OpenFile(path, OPEN_FILE_FLAGS, os.ModePerm)
+	if err != nil {
+		LOG.Critical("File tunnel create data file %s failed. %v", path, err)
+		return nil, false
+	}
+	return file, true
+}
+
+// SegmentFileName returns the name of segment with sequence
+func SegmentFileName(sequence uint64) string {
+	return fmt.Sprintf("%s%08d", FILE_SEGMENT_PREFIX, sequence)
+}
+
+// ListSegments returns the segment files in folder ordered by sequence
+func ListSegments(folder string) ([]string, error) {
+	infos, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir returns the entries sorted by name, and the sequence is
+	// padded with zero
+	segments := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), FILE_SEGMENT_PREFIX) {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimPrefix(info.Name(), FILE_SEGMENT_PREFIX), 10, 64); err != nil {
+			continue
+		}
+		segments = append(segments, filepath.Join(folder, info.Name()))
 	}
-	LOG.Critical("File tunnel create data file failed")
-	return nil, false
+	return segments, nil
 }
 
 func (tunnel *FileWriter) Prepare() bool {
 	if atomic.CompareAndSwapInt32(&globalInitializer, 0, 1) {
-		if file, ok := _Open(tunnel.Local); ok {
-			tunnel.dataFile = &DataFile{filehandle: file}
-		} else {
-			LOG.Critical("File tunnel open failed")
+		if err := os.MkdirAll(tunnel.Local, os.ModePerm); err != nil {
+			LOG.Critical("File tunnel create folder %s failed. %v", tunnel.Local, err)
 			return false
 		}
-
-		if info, err := os.Stat(tunnel.Local); err != nil || info.IsDir() {
+		if info, err := os.Stat(tunnel.Local); err != nil || !info.IsDir() {
 			LOG.Critical("File tunnel check path failed. %v", err)
 			return false
 		}
-		tunnel.dataFile.WriteHeader()
 
-		oplogMessage = make(chan *TMessage, 8192)
+		// continue after the last segment, the previous ones are kept
+		segments, err := ListSegments(tunnel.Local)
+		if err != nil {
+			LOG.Critical("File tunnel list segments failed. %v", err)
+			return false
+		}
+		if len(segments) != 0 {
+			last := filepath.Base(segments[len(segments)-1])
+			tunnel.sequence, _ = strconv.ParseUint(strings.TrimPrefix(last, FILE_SEGMENT_PREFIX), 10, 64)
+		}
+
+		oplogMessage = make(chan *WMessage, 8192)
 
 		go tunnel.SyncToDisk()
 	}
@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSegment(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestFileSegment case %d.\n", nr)
+		nr++
+
+		dir, err := ioutil.TempDir("", "segment")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.RemoveAll(dir)
+
+		// not segments
+		ioutil.WriteFile(filepath.Join(dir, "segment.tmp"), nil, os.ModePerm)
+		ioutil.WriteFile(filepath.Join(dir, "other"), nil, os.ModePerm)
+
+		writer := &FileWriter{Local: dir, sequence: 9}
+		assert.Equal(t, true, writer.openSegment(), "should be equal")
+		writer.dataFile.header.BeginTs = 10
+		writer.dataFile.header.EndTs = 20
+		writer.closeSegment()
+		assert.Equal(t, true, writer.openSegment(), "should be equal")
+		writer.closeSegment()
+
+		segments, err := ListSegments(dir)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []string{filepath.Join(dir, "segment.00000010"), filepath.Join(dir, "segment.00000011")},
+			segments, "should be equal")
+
+		dataFile, err := OpenDataFile(segments[0])
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(10), dataFile.Header().BeginTs, "should be equal")
+		assert.Equal(t, int64(20), dataFile.Header().EndTs, "should be equal")
+		_, err = dataFile.ReadMessage()
+		assert.Equal(t, io.EOF, err, "should be equal")
+		dataFile.Close()
+
+		// existing segment is never truncated
+		writer.sequence = 9
+		assert.Equal(t, false, writer.openSegment(), "should be equal")
+	}
+}
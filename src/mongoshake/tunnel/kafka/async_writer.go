@@ -0,0 +1,177 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	asyncFlushFrequency = 100 * time.Millisecond
+	asyncFlushMessages  = 1000
+)
+
+// AsyncWriter pipelines the records to brokers without waiting for the reply.
+// Each batch of records is tagged with an offset, and the offset is acked
+// only if all records of this batch and the previous batches are committed
+// by brokers
+type AsyncWriter struct {
+	brokers    []string
+	topic      string
+	client     sarama.Client
+	producer   sarama.AsyncProducer
+	partitions partitionCache
+
+	mutex sync.Mutex
+	// batches not acked yet in order of writing
+	pending []*asyncBatch
+	// the largest offset acked
+	acked int64
+	// the first error of records since the last Reset
+	err error
+	// batches written before the last Reset are ignored
+	generation uint64
+
+	config *Config
+}
+
+type asyncBatch struct {
+	generation uint64
+	offset     int64
+	// number of records not committed yet
+	remaining int
+}
+
+func NewAsyncWriter(address string) (*AsyncWriter, error) {
+	c := NewConfig()
+	// keep the order of records in one partition while retrying
+	c.Config.Net.MaxOpenRequests = 1
+	// the records are acked only if all in-sync replicas committed them
+	c.Config.Producer.RequiredAcks = sarama.WaitForAll
+	// batch the records in flight
+	c.Config.Producer.Flush.Frequency = asyncFlushFrequency
+	c.Config.Producer.Flush.Messages = asyncFlushMessages
+
+	topic, brokers, err := parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AsyncWriter{
+		brokers: brokers,
+		topic:   topic,
+		config:  c,
+	}, nil
+}
+
+func (a *AsyncWriter) Start() error {
+	client, err := sarama.NewClient(a.brokers, a.config.Config)
+	if err != nil {
+		return err
+	}
+	producer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	a.client = client
+	a.producer = producer
+
+	go func() {
+		for msg := range producer.Successes() {
+			a.complete(msg.Metadata.(*asyncBatch), nil)
+		}
+	}()
+	go func() {
+		for pe := range producer.Errors() {
+			a.complete(pe.Msg.Metadata.(*asyncBatch), pe.Err)
+		}
+	}()
+	return nil
+}
+
+// Topic returns the topic in address which may be a template
+func (a *AsyncWriter) Topic() string {
+	return a.topic
+}
+
+// PartitionCount returns the number of partitions of the topic. It's cached
+// after the first fetch
+func (a *AsyncWriter) PartitionCount(topic string) (int, error) {
+	return a.partitions.count(a.client, topic)
+}
+
+// AsyncWrite puts the records into the send queue, and blocks only if the
+// queue is full. The offset is acked after all records are committed. begin
+// is the smallest offset of this batch which is used to initialize the acked
+// offset
+func (a *AsyncWriter) AsyncWrite(records []*Record, begin, offset int64) {
+	batch := a.track(len(records), begin, offset)
+	for _, record := range records {
+		a.producer.Input() <- &sarama.ProducerMessage{
+			Topic:     record.Topic,
+			Partition: record.Partition,
+			Key:       sarama.ByteEncoder(messageKey()),
+			Value:     sarama.ByteEncoder(record.Value),
+			Metadata:  batch,
+		}
+	}
+}
+
+func (a *AsyncWriter) track(count int, begin, offset int64) *asyncBatch {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.acked == 0 {
+		// all offsets before the first batch are regarded as acked
+		a.acked = begin - 1
+	}
+	batch := &asyncBatch{generation: a.generation, offset: offset, remaining: count}
+	a.pending = append(a.pending, batch)
+	return batch
+}
+
+func (a *AsyncWriter) complete(batch *asyncBatch, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if batch.generation != a.generation {
+		return
+	}
+	if err != nil {
+		if a.err == nil {
+			a.err = err
+		}
+		return
+	}
+
+	batch.remaining--
+	for len(a.pending) != 0 && a.pending[0].remaining == 0 {
+		a.acked = a.pending[0].offset
+		a.pending = a.pending[1:]
+	}
+}
+
+// Acked returns the largest acked offset, and the error if any record failed
+func (a *AsyncWriter) Acked() (int64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.acked, a.err
+}
+
+// Reset drops all pending batches and the error. The records written before
+// are not acked any more even if they are committed later, so the caller
+// should write them again
+func (a *AsyncWriter) Reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.generation++
+	a.pending = nil
+	a.err = nil
+}
+
+func (a *AsyncWriter) Close() error {
+	if err := a.producer.Close(); err != nil {
+		return err
+	}
+	return a.client.Close()
+}
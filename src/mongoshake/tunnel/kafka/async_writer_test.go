@@ -0,0 +1,63 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncWriterAck(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestAsyncWriterAck case %d.\n", nr)
+		nr++
+
+		a := &AsyncWriter{}
+		b1 := a.track(2, 10, 20)
+		b2 := a.track(1, 21, 30)
+		acked, err := a.Acked()
+		assert.Equal(t, int64(9), acked, "should be equal")
+		assert.Equal(t, nil, err, "should be equal")
+
+		// the later batch is committed first
+		a.complete(b2, nil)
+		acked, _ = a.Acked()
+		assert.Equal(t, int64(9), acked, "should be equal")
+
+		a.complete(b1, nil)
+		acked, _ = a.Acked()
+		assert.Equal(t, int64(9), acked, "should be equal")
+
+		a.complete(b1, nil)
+		acked, _ = a.Acked()
+		assert.Equal(t, int64(30), acked, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAsyncWriterAck case %d.\n", nr)
+		nr++
+
+		a := &AsyncWriter{}
+		b1 := a.track(1, 10, 20)
+		b2 := a.track(1, 21, 30)
+		a.complete(b1, nil)
+		a.complete(b2, errors.New("failed"))
+		acked, err := a.Acked()
+		assert.Equal(t, int64(20), acked, "should be equal")
+		assert.NotEqual(t, nil, err, "should be not equal")
+
+		// the batches before reset are ignored
+		a.Reset()
+		b3 := a.track(1, 21, 30)
+		a.complete(b2, nil)
+		acked, err = a.Acked()
+		assert.Equal(t, int64(20), acked, "should be equal")
+		assert.Equal(t, nil, err, "should be equal")
+
+		a.complete(b3, nil)
+		acked, _ = a.Acked()
+		assert.Equal(t, int64(30), acked, "should be equal")
+	}
+}
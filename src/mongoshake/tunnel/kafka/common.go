@@ -3,6 +3,7 @@ package kafka
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -14,13 +15,25 @@ var (
 	topicSplitter          = "@"
 	brokersSplitter        = ","
 	defaultPartition int32 = 0
+	topicMaxLength         = 249
+)
+
+const (
+	// placeholders in topic template, replaced with the namespace of oplog.
+	// e.g. "mongoshake.{db}.{collection}@broker1,broker2"
+	TopicTemplateDB         = "{db}"
+	TopicTemplateCollection = "{collection}"
 )
 
 type Message struct {
 	Key       []byte
 	Value     []byte
 	Offset    int64
+	Partition int32
 	TimeStamp time.Time
+
+	// mark the message applied, nil if not read from consumer group
+	ack func()
 }
 
 type Config struct {
@@ -57,3 +70,61 @@ func parse(address string) (string, []string, error) {
 	brokers := strings.Split(arr[l-1], brokersSplitter)
 	return topic, brokers, nil
 }
+
+// Brokers returns the brokers of the address (topic@broker1,broker2,...)
+func Brokers(address string) ([]string, error) {
+	_, brokers, err := parse(address)
+	return brokers, err
+}
+
+// IsTopicTemplate returns true if the topic is routed by namespace
+func IsTopicTemplate(topic string) bool {
+	return strings.Contains(topic, TopicTemplateDB) || strings.Contains(topic, TopicTemplateCollection)
+}
+
+// RenderTopic replaces the placeholders of template with the namespace. The
+// characters which are illegal in kafka topic are replaced with '_'
+func RenderTopic(template, namespace string) string {
+	db, collection := namespace, ""
+	if i := strings.Index(namespace, "."); i >= 0 {
+		db, collection = namespace[:i], namespace[i+1:]
+	}
+	topic := strings.Replace(template, TopicTemplateDB, db, -1)
+	topic = strings.Replace(topic, TopicTemplateCollection, collection, -1)
+
+	legal := []rune(topic)
+	for i, c := range legal {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '.' || c == '_' || c == '-') {
+			legal[i] = '_'
+		}
+	}
+	if len(legal) > topicMaxLength {
+		legal = legal[:topicMaxLength]
+	}
+	return string(legal)
+}
+
+// partitionCache caches the number of partitions of each topic
+type partitionCache struct {
+	mutex      sync.Mutex
+	partitions map[string]int
+}
+
+func (c *partitionCache) count(client sarama.Client, topic string) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if count, ok := c.partitions[topic]; ok {
+		return count, nil
+	}
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+	if c.partitions == nil {
+		c.partitions = make(map[string]int)
+	}
+	c.partitions[topic] = len(partitions)
+	return len(partitions), nil
+}
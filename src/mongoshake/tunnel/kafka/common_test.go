@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTopic(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestRenderTopic case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, false, IsTopicTemplate("mongoshake"), "should be equal")
+		assert.Equal(t, true, IsTopicTemplate("mongoshake.{db}"), "should be equal")
+		assert.Equal(t, "mongoshake.a.b", RenderTopic("mongoshake.{db}.{collection}", "a.b"), "should be equal")
+		assert.Equal(t, "a-b.c", RenderTopic("{db}-{collection}", "a.b.c"), "should be equal")
+		assert.Equal(t, "a", RenderTopic("{db}{collection}", "a"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRenderTopic case %d.\n", nr)
+		nr++
+
+		// illegal characters
+		assert.Equal(t, "t.a._cmd", RenderTopic("t.{db}.{collection}", "a.$cmd"), "should be equal")
+		assert.Equal(t, "t.a.b_c", RenderTopic("t.{db}.{collection}", "a.b c"), "should be equal")
+		assert.Equal(t, topicMaxLength, len(RenderTopic("{collection}", "a."+strings.Repeat("x", 300))),
+			"should be equal")
+	}
+}
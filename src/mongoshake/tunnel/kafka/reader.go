@@ -1,47 +1,62 @@
 package kafka
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/Shopify/sarama"
+	LOG "github.com/vinllen/log4go"
+)
+
+const (
+	DefaultGroup = "mongoshake"
 )
 
 type Reader struct {
-	brokers   []string
-	topic     string
-	partition int32
+	brokers []string
+	topic   string
+	group   string
 
-	partitionConsumer sarama.PartitionConsumer
-	messageChannel    chan *Message
+	consumerGroup  sarama.ConsumerGroup
+	messageChannel chan *Message
 }
 
-func NewReader(address string) (*Reader, error) {
-	// c := NewConfig()
-
+// NewReader joins the consumer group and reads all the partitions of topic
+// assigned to this member. The offset of message is committed after Ack
+func NewReader(address, group string) (*Reader, error) {
 	topic, brokers, err := parse(address)
 	if err != nil {
 		return nil, err
 	}
-
-	consumer, err := sarama.NewConsumer(brokers, nil)
-	if err != nil {
-		return nil, err
+	if group == "" {
+		group = DefaultGroup
 	}
 
-	// pay attention: we fetch data from oldest offset when starting by default, so a lot data will be
-	// replay when receiver restarts.
-	partitionConsumer, err := consumer.ConsumePartition(topic, defaultPartition, sarama.OffsetOldest)
+	config := NewConfig().Config
+	// consumer group is supported since 0.10.2
+	config.Version = sarama.V0_10_2_0
+	// pay attention: we fetch data from oldest offset if the group has no
+	// committed offset, so a lot data will be replayed when receiver starts
+	// at the first time.
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Return.Errors = true
+
+	consumerGroup, err := sarama.NewConsumerGroup(brokers, group, config)
 	if err != nil {
 		return nil, err
 	}
 
 	r := &Reader{
-		brokers:           brokers,
-		topic:             topic,
-		partition:         defaultPartition,
-		partitionConsumer: partitionConsumer,
-		messageChannel:    make(chan *Message),
+		brokers:        brokers,
+		topic:          topic,
+		group:          group,
+		consumerGroup:  consumerGroup,
+		messageChannel: make(chan *Message),
 	}
 
-	go r.send()
+	go r.consume()
+	go r.logErrors()
 	return r, nil
 }
 
@@ -49,13 +64,104 @@ func (r *Reader) Read() chan *Message {
 	return r.messageChannel
 }
 
-func (r *Reader) send() {
-	for msg := range r.partitionConsumer.Messages() {
-		r.messageChannel <- &Message{
+// Ack marks the message applied. The offset is committed once all the
+// messages before it in the same partition are acked
+func (r *Reader) Ack(message *Message) {
+	if message.ack != nil {
+		message.ack()
+	}
+}
+
+func (r *Reader) consume() {
+	for {
+		// Consume blocks during the session, and returns when the members
+		// of group rebalance
+		if err := r.consumerGroup.Consume(context.Background(), []string{r.topic}, r); err != nil {
+			LOG.Warn("kafka reader consume topic[%v] of group[%v] failed[%v]", r.topic, r.group, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (r *Reader) logErrors() {
+	for err := range r.consumerGroup.Errors() {
+		LOG.Warn("kafka reader of group[%v] meets error[%v]", r.group, err)
+	}
+}
+
+// Setup is called at the beginning of a session, before ConsumeClaim
+func (r *Reader) Setup(session sarama.ConsumerGroupSession) error {
+	LOG.Info("kafka reader of group[%v] claims partitions %v", r.group, session.Claims())
+	return nil
+}
+
+// Cleanup is called at the end of a session. The messages acked later are
+// not committed, and they will be delivered again to the next owner
+func (r *Reader) Cleanup(session sarama.ConsumerGroupSession) error {
+	LOG.Info("kafka reader of group[%v] releases partitions %v", r.group, session.Claims())
+	return nil
+}
+
+func (r *Reader) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := newOffsetTracker(session)
+	for msg := range claim.Messages() {
+		tracker.add(msg)
+		message := &Message{
 			Key:       msg.Key,
 			Value:     msg.Value,
 			Offset:    msg.Offset,
+			Partition: msg.Partition,
 			TimeStamp: msg.Timestamp,
+			ack: func(msg *sarama.ConsumerMessage) func() {
+				return func() {
+					tracker.done(msg)
+				}
+			}(msg),
 		}
+
+		select {
+		case r.messageChannel <- message:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// offsetTracker marks the offset of a partition in order. The messages of a
+// partition may be dispatched to different replayers and applied out of
+// order, so an offset is marked only if all the ones before it are done
+type offsetTracker struct {
+	session sarama.ConsumerGroupSession
+
+	mutex   sync.Mutex
+	pending []*sarama.ConsumerMessage
+	acked   map[int64]bool
+}
+
+func newOffsetTracker(session sarama.ConsumerGroupSession) *offsetTracker {
+	return &offsetTracker{session: session, acked: make(map[int64]bool)}
+}
+
+func (t *offsetTracker) add(msg *sarama.ConsumerMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending = append(t.pending, msg)
+}
+
+func (t *offsetTracker) done(msg *sarama.ConsumerMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.acked[msg.Offset] = true
+	var last *sarama.ConsumerMessage
+	for len(t.pending) > 0 && t.acked[t.pending[0].Offset] {
+		last = t.pending[0]
+		delete(t.acked, last.Offset)
+		t.pending = t.pending[1:]
+	}
+	if last != nil {
+		// committed by the session periodically
+		t.session.MarkMessage(last, "")
 	}
 }
@@ -0,0 +1,46 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSession struct {
+	sarama.ConsumerGroupSession
+	marked []int64
+}
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func TestOffsetTracker(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestOffsetTracker case %d.\n", nr)
+		nr++
+
+		session := new(mockSession)
+		tracker := newOffsetTracker(session)
+		msgs := make([]*sarama.ConsumerMessage, 4)
+		for i := range msgs {
+			msgs[i] = &sarama.ConsumerMessage{Offset: int64(i + 10)}
+			tracker.add(msgs[i])
+		}
+
+		// applied out of order by different replayers
+		tracker.done(msgs[1])
+		assert.Equal(t, 0, len(session.marked), "should be equal")
+		tracker.done(msgs[0])
+		assert.Equal(t, []int64{11}, session.marked, "should be equal")
+		tracker.done(msgs[3])
+		assert.Equal(t, []int64{11}, session.marked, "should be equal")
+		tracker.done(msgs[2])
+		assert.Equal(t, []int64{11, 13}, session.marked, "should be equal")
+		assert.Equal(t, 0, len(tracker.pending), "should be equal")
+		assert.Equal(t, 0, len(tracker.acked), "should be equal")
+	}
+}
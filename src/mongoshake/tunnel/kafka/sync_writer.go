@@ -11,11 +11,21 @@ type SyncWriter struct {
 	brokers   []string
 	topic     string
 	partition int32
+	client    sarama.Client
 	producer  sarama.SyncProducer
 
+	partitions partitionCache
+
 	config *Config
 }
 
+// Record is a message sent to the given topic and partition
+type Record struct {
+	Topic     string
+	Partition int32
+	Value     []byte
+}
+
 func NewSyncWriter(address string) (*SyncWriter, error) {
 	c := NewConfig()
 
@@ -35,32 +45,69 @@ func NewSyncWriter(address string) (*SyncWriter, error) {
 }
 
 func (s *SyncWriter) Start() error {
-	producer, err := sarama.NewSyncProducer(s.brokers, s.config.Config)
+	client, err := sarama.NewClient(s.brokers, s.config.Config)
 	if err != nil {
 		return err
 	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	s.client = client
 	s.producer = producer
 	return nil
 }
 
+// Topic returns the topic in address which may be a template
+func (s *SyncWriter) Topic() string {
+	return s.topic
+}
+
+// PartitionCount returns the number of partitions of the topic. It's cached
+// after the first fetch
+func (s *SyncWriter) PartitionCount(topic string) (int, error) {
+	return s.partitions.count(s.client, topic)
+}
+
 func (s *SyncWriter) SimpleWrite(input []byte) error {
 	return s.send(input)
 }
 
-func (s *SyncWriter) send(input []byte) error {
-	// use timestamp as key
-	key := strconv.FormatInt(time.Now().UnixNano(), 16)
+// BatchWrite sends all records in one request. The order of records in the
+// same partition is kept
+func (s *SyncWriter) BatchWrite(records []*Record) error {
+	msgs := make([]*sarama.ProducerMessage, 0, len(records))
+	for _, record := range records {
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic:     record.Topic,
+			Partition: record.Partition,
+			Key:       sarama.ByteEncoder(messageKey()),
+			Value:     sarama.ByteEncoder(record.Value),
+		})
+	}
+	return s.producer.SendMessages(msgs)
+}
 
+func (s *SyncWriter) send(input []byte) error {
 	msg := &sarama.ProducerMessage{
 		Topic:     s.topic,
 		Partition: s.partition,
-		Key:       sarama.ByteEncoder(key),
+		Key:       sarama.ByteEncoder(messageKey()),
 		Value:     sarama.ByteEncoder(input),
 	}
 	_, _, err := s.producer.SendMessage(msg)
 	return err
 }
 
+// use timestamp as key
+func messageKey() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 16)
+}
+
 func (s *SyncWriter) Close() error {
-	return s.producer.Close()
+	if err := s.producer.Close(); err != nil {
+		return err
+	}
+	return s.client.Close()
 }
@@ -10,13 +10,16 @@ import (
 )
 
 type KafkaReader struct {
-	address  string
+	address string
+	// consumer group, the partitions of topic are balanced among the
+	// receivers in the same group
+	group    string
 	reader   *kafka.Reader
 	replayer []Replayer
 }
 
 func (tunnel *KafkaReader) Link(replayer []Replayer) error {
-	reader, err := kafka.NewReader(tunnel.address)
+	reader, err := kafka.NewReader(tunnel.address, tunnel.group)
 	if err != nil {
 		LOG.Critical("KafkaReader link[%v] create reader error[%v]", tunnel.address, err)
 		return err
@@ -60,7 +63,8 @@ func (tunnel *KafkaReader) replay() {
 			logCount--
 		}
 
-		newLogs := &TMessage{Checksum: checksum, Tag: tag, Shard: hashShard, Compress: compress, RawLogs: oplogs}
+		newLogs := &TMessage{Checksum: checksum, Tag: tag, Shard: hashShard, Compress: compress, RawLogs: oplogs,
+			Replset: readReplset(byteBuffer, binary.BigEndian)}
 
 		// re-sharding
 		if newLogs.Shard >= uint32(len(tunnel.replayer)) {
@@ -75,11 +79,8 @@ func (tunnel *KafkaReader) replay() {
 		replay := tunnel.replayer[newLogs.Shard]
 		if replay.Sync(newLogs, func(context *kafka.Message) func() {
 			return func() {
-				// user can add the ack mechanism so that send ack
-				// to kafka to move kafka offset forward. We don't offer this
-				// code in current open source version.
-
-				// tunnel.reader.Ack(context)
+				// the offset is committed after the message is applied
+				tunnel.reader.Ack(context)
 			}
 		}(message)) < 0 {
 			// bad information in message. need to retry
@@ -3,38 +3,270 @@ package tunnel
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
+	"mongoshake/common"
+	"mongoshake/oplog"
 	"mongoshake/tunnel/kafka"
 
 	LOG "github.com/vinllen/log4go"
+	"github.com/vinllen/mgo/bson"
+)
+
+const (
+	// all oplogs are written into partition 0
+	KafkaPartitionByNone = "none"
+)
+
+const (
+	// the whole TMessage in private binary layout, only decoded by KafkaReader
+	MessageRaw = "raw"
+	// one kafka message per oplog which is the raw bson of oplog
+	MessageBson = "bson"
+	// one kafka message per oplog which is the canonical extended json of
+	// ts, op, ns, o and o2
+	MessageJson = "json"
 )
 
 type KafkaWriter struct {
 	RemoteAddr string
-	writer     *kafka.SyncWriter
+	// none, id or collection
+	PartitionBy string
+	// raw, bson or json
+	MessageType string
+	// pipeline the messages and ack the oplogs committed by brokers
+	Async       bool
+	writer      *kafka.SyncWriter
+	asyncWriter *kafka.AsyncWriter
+	// topic and partitions of writer or asyncWriter
+	meta kafkaMeta
+
+	// route oplogs by namespace if the topic is a template
+	topicTemplate bool
+	// nil if all oplogs are written into partition 0
+	hasher oplog.Hasher
+}
+
+type kafkaMeta interface {
+	Topic() string
+	PartitionCount(topic string) (int, error)
+}
+
+// kafkaRoute is the destination of an oplog
+type kafkaRoute struct {
+	topic     string
+	partition int32
 }
 
 func (tunnel *KafkaWriter) Prepare() bool {
-	writer, err := kafka.NewSyncWriter(tunnel.RemoteAddr)
-	if err != nil {
-		LOG.Critical("KafkaWriter prepare[%v] create writer error[%v]", tunnel.RemoteAddr, err)
-		return false
+	if tunnel.Async {
+		writer, err := kafka.NewAsyncWriter(tunnel.RemoteAddr)
+		if err != nil {
+			LOG.Critical("KafkaWriter prepare[%v] create async writer error[%v]", tunnel.RemoteAddr, err)
+			return false
+		}
+		if err := writer.Start(); err != nil {
+			LOG.Critical("KafkaWriter prepare[%v] start async writer error[%v]", tunnel.RemoteAddr, err)
+			return false
+		}
+		tunnel.asyncWriter = writer
+		tunnel.meta = writer
+	} else {
+		writer, err := kafka.NewSyncWriter(tunnel.RemoteAddr)
+		if err != nil {
+			LOG.Critical("KafkaWriter prepare[%v] create writer error[%v]", tunnel.RemoteAddr, err)
+			return false
+		}
+		if err := writer.Start(); err != nil {
+			LOG.Critical("KafkaWriter prepare[%v] start writer error[%v]", tunnel.RemoteAddr, err)
+			return false
+		}
+		tunnel.writer = writer
+		tunnel.meta = writer
 	}
-	if err := writer.Start(); err != nil {
-		LOG.Critical("KafkaWriter prepare[%v] start writer error[%v]", tunnel.RemoteAddr, err)
-		return false
+	tunnel.topicTemplate = kafka.IsTopicTemplate(tunnel.meta.Topic())
+
+	switch tunnel.PartitionBy {
+	case oplog.ShardByID:
+		tunnel.hasher = &oplog.PrimaryKeyHasher{}
+	case oplog.ShardByNamespace:
+		tunnel.hasher = &oplog.TableHasher{}
 	}
-	tunnel.writer = writer
 	return true
 }
 
 func (tunnel *KafkaWriter) Send(message *WMessage) int64 {
+	if tunnel.Async {
+		return tunnel.asyncSend(message)
+	}
+
 	if len(message.RawLogs) == 0 || message.Tag&MsgProbe != 0 {
 		return 0
 	}
 
 	message.Tag |= MsgPersistent
 
+	records, err := tunnel.records(message)
+	if err == nil {
+		err = tunnel.writer.BatchWrite(records)
+	}
+	if err != nil {
+		LOG.Error("KafkaWriter send[%v] error[%v]", tunnel.RemoteAddr, err)
+		return ReplyError
+	}
+
+	// KafkaWriter.AckRequired() is false in sync mode, return 0 directly
+	return 0
+}
+
+// asyncSend returns the offset of oplogs committed by brokers. All unacked
+// oplogs are required to be retransmitted if any message failed
+func (tunnel *KafkaWriter) asyncSend(message *WMessage) int64 {
+	acked, err := tunnel.asyncWriter.Acked()
+	if len(message.RawLogs) == 0 || message.Tag&MsgProbe != 0 {
+		// the error is kept until the next normal message which can
+		// trigger the retransmission
+		if err != nil {
+			return ReplyError
+		}
+		return acked
+	}
+	if err != nil {
+		LOG.Error("KafkaWriter send[%v] error[%v], retransmit oplogs after ack[%v]",
+			tunnel.RemoteAddr, err, utils.TimestampToLog(acked))
+		tunnel.asyncWriter.Reset()
+		return ReplyRetransmission
+	}
+
+	message.Tag |= MsgPersistent
+
+	records, err := tunnel.records(message)
+	if err != nil {
+		LOG.Error("KafkaWriter send[%v] error[%v]", tunnel.RemoteAddr, err)
+		return ReplyError
+	}
+	first := message.ParsedLogs[0].Timestamp
+	last := message.ParsedLogs[len(message.ParsedLogs)-1].Timestamp
+	tunnel.asyncWriter.AsyncWrite(records, utils.TimestampToInt64(first), utils.TimestampToInt64(last))
+
+	acked, _ = tunnel.asyncWriter.Acked()
+	return acked
+}
+
+// records builds the kafka messages of the tunnel message
+func (tunnel *KafkaWriter) records(message *WMessage) ([]*kafka.Record, error) {
+	switch {
+	case tunnel.MessageType == MessageBson || tunnel.MessageType == MessageJson:
+		return tunnel.splitRecords(message)
+	case tunnel.topicTemplate || tunnel.hasher != nil:
+		return tunnel.routeRecords(message)
+	default:
+		return []*kafka.Record{{
+			Topic: tunnel.meta.Topic(),
+			Value: encodeKafkaMessage(message.TMessage),
+		}}, nil
+	}
+}
+
+// routeRecords splits the message by topic and partition of each oplog. The
+// oplogs with the same destination are kept in order in one kafka message
+func (tunnel *KafkaWriter) routeRecords(message *WMessage) ([]*kafka.Record, error) {
+	routes := make([]kafkaRoute, 0)
+	routeLogs := make(map[kafkaRoute][][]byte)
+	for i, log := range message.ParsedLogs {
+		route, err := tunnel.routeOf(log)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := routeLogs[route]; !ok {
+			routes = append(routes, route)
+		}
+		routeLogs[route] = append(routeLogs[route], message.RawLogs[i])
+	}
+
+	records := make([]*kafka.Record, 0, len(routes))
+	for _, route := range routes {
+		split := &TMessage{
+			Tag:      message.Tag,
+			Shard:    message.Shard,
+			Compress: message.Compress,
+			RawLogs:  routeLogs[route],
+			Replset:  message.Replset,
+		}
+		// checksum is calculated again if it's enabled
+		if message.Checksum != 0 {
+			split.Checksum = split.Crc32()
+		}
+		records = append(records, &kafka.Record{
+			Topic:     route.topic,
+			Partition: route.partition,
+			Value:     encodeKafkaMessage(split),
+		})
+	}
+	return records, nil
+}
+
+// splitRecords writes each oplog as a kafka message in bson or json
+func (tunnel *KafkaWriter) splitRecords(message *WMessage) ([]*kafka.Record, error) {
+	records := make([]*kafka.Record, 0, len(message.ParsedLogs))
+	for i, log := range message.ParsedLogs {
+		route, err := tunnel.routeOf(log)
+		if err != nil {
+			return nil, err
+		}
+
+		value := message.RawLogs[i]
+		if tunnel.MessageType == MessageJson {
+			if value, err = encodeJsonOplog(log); err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, &kafka.Record{
+			Topic:     route.topic,
+			Partition: route.partition,
+			Value:     value,
+		})
+	}
+	return records, nil
+}
+
+func (tunnel *KafkaWriter) routeOf(log *oplog.PartialLog) (kafkaRoute, error) {
+	route := kafkaRoute{topic: tunnel.meta.Topic()}
+	if tunnel.topicTemplate {
+		route.topic = kafka.RenderTopic(route.topic, log.Namespace)
+	}
+	if tunnel.hasher != nil {
+		count, err := tunnel.meta.PartitionCount(route.topic)
+		if err != nil {
+			return route, err
+		}
+		if count > 0 {
+			route.partition = int32(tunnel.hasher.DistributeOplogByMod(log, count))
+		}
+	}
+	return route, nil
+}
+
+func encodeJsonOplog(log *oplog.PartialLog) ([]byte, error) {
+	var o2 interface{}
+	if len(log.Query) != 0 {
+		o2 = log.Query
+	}
+	value, err := utils.MarshalExtJSON(bson.D{
+		{"ts", log.Timestamp},
+		{"op", log.Operation},
+		{"ns", log.Namespace},
+		{"o", log.Object},
+		{"o2", o2},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode oplog[%v] to json failed. %v", log, err)
+	}
+	return value, nil
+}
+
+func encodeKafkaMessage(message *TMessage) []byte {
 	byteBuffer := bytes.NewBuffer([]byte{})
 	// checksum
 	binary.Write(byteBuffer, binary.BigEndian, uint32(message.Checksum))
@@ -52,20 +284,12 @@ func (tunnel *KafkaWriter) Send(message *WMessage) int64 {
 		binary.Write(byteBuffer, binary.BigEndian, uint32(len(log)))
 		binary.Write(byteBuffer, binary.BigEndian, log)
 	}
-
-	err := tunnel.writer.SimpleWrite(byteBuffer.Bytes())
-
-	if err != nil {
-		LOG.Error("KafkaWriter send[%v] error[%v]", tunnel.RemoteAddr, err)
-		return ReplyError
-	}
-
-	// KafkaWriter.AckRequired() is always false, return 0 directly
-	return 0
+	writeReplset(byteBuffer, binary.BigEndian, message)
+	return byteBuffer.Bytes()
 }
 
 func (tunnel *KafkaWriter) AckRequired() bool {
-	return false
+	return tunnel.Async
 }
 
 func (tunnel *KafkaWriter) ParsedLogsRequired() bool {
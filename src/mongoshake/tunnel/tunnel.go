@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"time"
 
+	"mongoshake/common"
+	"mongoshake/executor"
 	"mongoshake/oplog"
 
 	"github.com/gugemichael/nimo4go"
@@ -46,6 +49,10 @@ type TMessage struct {
 	Shard    uint32
 	Compress uint32
 	RawLogs  [][]byte
+	// name of the source replset, empty if unknown. it's encoded after the
+	// oplogs by rpc, tcp and kafka tunnel, so the receiver of older version
+	// ignores it. file tunnel doesn't persist it
+	Replset string
 }
 
 func (msg *TMessage) Crc32() uint32 {
@@ -67,6 +74,7 @@ func (msg *TMessage) ToBytes(order binary.ByteOrder) []byte {
 		binary.Write(&buffer, order, uint32(len(log)))
 		buffer.Write(log)
 	}
+	writeReplset(&buffer, order, msg)
 	return buffer.Bytes()
 }
 
@@ -95,11 +103,32 @@ func (msg *TMessage) FromBytes(buf []byte, order binary.ByteOrder) {
 		msg.RawLogs = append(msg.RawLogs, bytes)
 		n--
 	}
+	msg.Replset = readReplset(bytes.NewBuffer(buf[start:]), order)
+}
+
+// writeReplset appends the replset name after the oplogs. It's omitted in
+// probe, which is expected to be empty after the header
+func writeReplset(buffer *bytes.Buffer, order binary.ByteOrder, msg *TMessage) {
+	if msg.Replset == "" || msg.Tag&MsgProbe != 0 {
+		return
+	}
+	binary.Write(buffer, order, uint32(len(msg.Replset)))
+	buffer.WriteString(msg.Replset)
+}
+
+// readReplset reads the replset name after the oplogs, empty if the message
+// is sent by the collector of older version
+func readReplset(buffer *bytes.Buffer, order binary.ByteOrder) string {
+	var length uint32
+	if err := binary.Read(buffer, order, &length); err != nil || int(length) > buffer.Len() {
+		return ""
+	}
+	return string(buffer.Next(int(length)))
 }
 
 func (msg *TMessage) String() string {
-	return fmt.Sprintf("[cksum:%d, tag:%d, shard:%d, compress:%d, logs_len:%d]",
-		msg.Checksum, msg.Tag, msg.Shard, msg.Compress, len(msg.RawLogs))
+	return fmt.Sprintf("[cksum:%d, tag:%d, shard:%d, compress:%d, logs_len:%d, replset:%s]",
+		msg.Checksum, msg.Tag, msg.Shard, msg.Compress, len(msg.RawLogs), msg.Replset)
 }
 
 func (msg *TMessage) ApproximateSize() uint64 {
@@ -145,6 +174,21 @@ type Writer interface {
 
 type WriterFactory struct {
 	Name string
+	// partition and message format of kafka writer
+	KafkaPartitionBy string
+	KafkaMessage     string
+	KafkaAsync       bool
+	// segment of file writer
+	FileSegmentSize     int64 // bytes
+	FileSegmentInterval time.Duration
+	// write the oplogs with the applied timestamp in transaction by direct writer
+	ExactlyOnce bool
+	// mark the writes of direct writer by session id
+	LoopPrevention bool
+	// metric of the syncer, counts the conflicts of direct writer
+	ReplMetric *utils.ReplicationMetric
+	// the queue of failed oplogs of direct writer, nil if retried forever
+	DeadLetter executor.DeadLetterQueue
 }
 
 // create specific Tunnel with tunnel name and pass connection
@@ -152,7 +196,8 @@ type WriterFactory struct {
 func (factory *WriterFactory) Create(address []string, workerId uint32) Writer {
 	switch factory.Name {
 	case "kafka":
-		return &KafkaWriter{RemoteAddr: address[0]}
+		return &KafkaWriter{RemoteAddr: address[0], PartitionBy: factory.KafkaPartitionBy,
+			MessageType: factory.KafkaMessage, Async: factory.KafkaAsync}
 	case "tcp":
 		return &TCPWriter{RemoteAddr: address[0]}
 	case "rpc":
@@ -160,9 +205,12 @@ func (factory *WriterFactory) Create(address []string, workerId uint32) Writer {
 	case "mock":
 		return &MockWriter{}
 	case "file":
-		return &FileWriter{Local: address[0]}
+		return &FileWriter{Local: address[0], SegmentSize: factory.FileSegmentSize,
+			SegmentInterval: factory.FileSegmentInterval}
 	case "direct":
-		return &DirectWriter{RemoteAddrs: address, ReplayerId: workerId}
+		return &DirectWriter{RemoteAddrs: address, ReplayerId: workerId,
+			ExactlyOnce: factory.ExactlyOnce, LoopPrevention: factory.LoopPrevention,
+			ReplMetric: factory.ReplMetric, DeadLetter: factory.DeadLetter}
 	default:
 		LOG.Critical("Specific tunnel not found [%s]", factory.Name)
 		return nil
@@ -174,7 +222,7 @@ func (factory *WriterFactory) Create(address []string, workerId uint32) Writer {
 func (factory *ReaderFactory) Create(address string) Reader {
 	switch factory.Name {
 	case "kafka":
-		return &KafkaReader{address: address}
+		return &KafkaReader{address: address, group: factory.KafkaGroup}
 	case "tcp":
 		return &TCPReader{listenAddress: address}
 	case "rpc":
@@ -213,4 +261,6 @@ type Replayer interface {
 
 type ReaderFactory struct {
 	Name string
+	// consumer group of kafka reader
+	KafkaGroup string
 }
@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageBytes(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestMessageBytes case %d.\n", nr)
+		nr++
+
+		message := &TMessage{Tag: MsgNormal, Shard: 1, RawLogs: [][]byte{[]byte("a"), []byte("bc")}, Replset: "rs1"}
+		decoded := new(TMessage)
+		decoded.FromBytes(message.ToBytes(binary.BigEndian), binary.BigEndian)
+		assert.Equal(t, message, decoded, "should be equal")
+	}
+	{
+		fmt.Printf("TestMessageBytes case %d.\n", nr)
+		nr++
+
+		// the message of older collector has nothing after the oplogs
+		message := &TMessage{Tag: MsgNormal, Shard: 1, RawLogs: [][]byte{[]byte("a")}}
+		decoded := new(TMessage)
+		decoded.FromBytes(message.ToBytes(binary.BigEndian), binary.BigEndian)
+		assert.Equal(t, message, decoded, "should be equal")
+	}
+	{
+		fmt.Printf("TestMessageBytes case %d.\n", nr)
+		nr++
+
+		// probe is empty after the header
+		message := &TMessage{Tag: MsgProbe, Replset: "rs1"}
+		assert.Equal(t, 20, len(message.ToBytes(binary.BigEndian)), "should be equal")
+	}
+}